@@ -0,0 +1,348 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client provides a client for submitting entries to, and verifying entries in, a Betty log.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
+	f_log "github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/serverless-log/api"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// Client talks to a Betty log over HTTP.
+type Client struct {
+	baseURL  string
+	verifier note.Verifier
+	hc       *http.Client
+	// hashLeaf, if set, returns the Merkle leaf hash of an entry in place of the log's hasher.
+	hashLeaf func([]byte) []byte
+	// want, if set, holds the params which the log is expected to have been created with.
+	want *log.Params
+
+	mu sync.Mutex
+	// params holds the log's params, once they've been learned from the log.
+	params *log.Params
+}
+
+// Option configures optional behaviour of the client.
+type Option func(*Client)
+
+// WithLeafHasher causes leaves to be hashed with h when verifying inclusion, for logs configured with a
+// custom log.Params.LeafHasher.
+func WithLeafHasher(h func([]byte) []byte) Option {
+	return func(c *Client) {
+		c.hashLeaf = h
+	}
+}
+
+// WithParams causes the client to expect the log to use the tile height and hash of p, failing any verification
+// if the log describes itself otherwise. Without it, they're learned from the log's /log-info.
+func WithParams(p log.Params) Option {
+	return func(c *Client) {
+		c.want = &p
+	}
+}
+
+// New creates a new Client for the log served at baseURL, whose checkpoints are verified with v.
+// The log's origin is expected to be the verifier's name.
+// If hc is nil, http.DefaultClient is used.
+func New(baseURL string, v note.Verifier, hc *http.Client, opts ...Option) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	c := &Client{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		verifier: v,
+		hc:       hc,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Add submits the leaf to the log, and returns the index it was assigned once it has been integrated.
+func (c *Client) Add(ctx context.Context, leaf []byte) (uint64, error) {
+	b, err := c.do(ctx, http.MethodPost, "/add", bytes.NewReader(leaf))
+	if err != nil {
+		return 0, err
+	}
+	idx, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid index in response: %v", err)
+	}
+	return idx, nil
+}
+
+// AddBatch submits the leaves to the log in a single request, and returns the indices they were assigned, in the
+// same order, once they have been integrated.
+func (c *Client) AddBatch(ctx context.Context, leaves [][]byte) ([]uint64, error) {
+	var body bytes.Buffer
+	for _, l := range leaves {
+		body.WriteString(base64.StdEncoding.EncodeToString(l))
+		body.WriteString("\n")
+	}
+	b, err := c.do(ctx, http.MethodPost, "/add-batch", &body)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Fields(string(b))
+	if len(lines) != len(leaves) {
+		return nil, fmt.Errorf("got %d indices in response, want %d", len(lines), len(leaves))
+	}
+	idx := make([]uint64, 0, len(lines))
+	for _, l := range lines {
+		i, err := strconv.ParseUint(l, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index in response: %v", err)
+		}
+		idx = append(idx, i)
+	}
+	return idx, nil
+}
+
+// Entries returns the leaves at indices starting from start, up to count of them.
+// Fewer leaves may be returned than were requested, if the log limits the number served by a single request.
+func (c *Client) Entries(ctx context.Context, start, count uint64) ([][]byte, error) {
+	b, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/entries?start=%d&count=%d", start, count), nil)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Fields(string(b))
+	if len(lines) == 0 || uint64(len(lines)) > count {
+		return nil, fmt.Errorf("got %d entries in response, requested %d", len(lines), count)
+	}
+	es := make([][]byte, 0, len(lines))
+	for i, l := range lines {
+		e, err := base64.StdEncoding.DecodeString(l)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %d in response: %v", start+uint64(i), err)
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
+
+// LogInfo returns the metadata which the log serves at /log-info, describing the params it was created with.
+func (c *Client) LogInfo(ctx context.Context) (log.Metadata, error) {
+	b, err := c.do(ctx, http.MethodGet, "/log-info", nil)
+	if err != nil {
+		return log.Metadata{}, err
+	}
+	return log.ParseMetadata(b)
+}
+
+// logParams returns the params of the log, which determine how its tiles are laid out and hashed.
+// They're learned from the log's /log-info the first time they're needed, and checked against those given by
+// WithParams. Logs which don't serve their metadata are assumed to use the params given by WithParams, or the
+// tlog-tiles defaults of SHA-256 and a tile height of 8.
+func (c *Client) logParams(ctx context.Context) (log.Params, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.params != nil {
+		return *c.params, nil
+	}
+	p := log.Params{}
+	if c.want != nil {
+		p = *c.want
+	}
+	m, err := c.LogInfo(ctx)
+	var he *httpError
+	switch {
+	case errors.As(err, &he) && he.status == http.StatusNotFound:
+		// Nothing to check the configured params against.
+	case err != nil:
+		return log.Params{}, fmt.Errorf("failed to fetch log info: %v", err)
+	default:
+		h, err := log.ParseHash(m.Hash)
+		if err != nil {
+			return log.Params{}, fmt.Errorf("log uses %v", err)
+		}
+		if c.want != nil {
+			want := c.want.Metadata()
+			if m.TileHeight != want.TileHeight {
+				return log.Params{}, fmt.Errorf("log uses tile height %d, but %d is configured", m.TileHeight, want.TileHeight)
+			}
+			if m.Hash != want.Hash {
+				return log.Params{}, fmt.Errorf("log uses hash %s, but %s is configured", m.Hash, want.Hash)
+			}
+		}
+		if m.Origin != "" && m.Origin != c.verifier.Name() {
+			return log.Params{}, fmt.Errorf("log has origin %q, but the verifier is for %q", m.Origin, c.verifier.Name())
+		}
+		p.TileHeight, p.Hash = m.TileHeight, h
+	}
+	c.params = &p
+	return p, nil
+}
+
+// Checkpoint returns the log's latest checkpoint, once its signature has been verified.
+func (c *Client) Checkpoint(ctx context.Context) (*f_log.Checkpoint, error) {
+	b, err := c.do(ctx, http.MethodGet, "/checkpoint", nil)
+	if err != nil {
+		return nil, err
+	}
+	cp, _, _, err := f_log.ParseCheckpoint(b, c.verifier.Name(), c.verifier)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint: %v", err)
+	}
+	return cp, nil
+}
+
+// VerifyInclusion checks that the leaf is included in the log at the given index, under the log's latest
+// checkpoint.
+// The proof is built from tiles fetched from the log, each of which is checked against the checkpoint.
+func (c *Client) VerifyInclusion(ctx context.Context, leaf []byte, index uint64) error {
+	cp, err := c.Checkpoint(ctx)
+	if err != nil {
+		return err
+	}
+	return c.VerifyInclusionIn(ctx, cp, leaf, index)
+}
+
+// VerifyInclusionIn checks that the leaf is included in the log at the given index, under the checkpoint cp,
+// which must have been verified, e.g. by fetching it with Checkpoint.
+// The proof is built from tiles fetched from the log, which are checked against the checkpoint's root hash.
+func (c *Client) VerifyInclusionIn(ctx context.Context, cp *f_log.Checkpoint, leaf []byte, index uint64) error {
+	if index >= cp.Size {
+		return fmt.Errorf("index %d is not included in checkpoint of size %d", index, cp.Size)
+	}
+	params, err := c.logParams(ctx)
+	if err != nil {
+		return err
+	}
+	h := params.Hasher()
+	pb, err := reader.NewProofBuilder(ctx, params, cp.Size, h.HashChildren, &tileReader{c: c, params: params})
+	if err != nil {
+		return fmt.Errorf("failed to read tree: %v", err)
+	}
+	if !bytes.Equal(pb.Root(), cp.Hash) {
+		return fmt.Errorf("tiles have root hash %x, but checkpoint has %x", pb.Root(), cp.Hash)
+	}
+	p, err := pb.InclusionProof(ctx, index)
+	if err != nil {
+		return fmt.Errorf("failed to build inclusion proof: %v", err)
+	}
+	lh := h.HashLeaf(leaf)
+	if c.hashLeaf != nil {
+		lh = c.hashLeaf(leaf)
+	}
+	if err := proof.VerifyInclusion(h, index, cp.Size, lh, p, cp.Hash); err != nil {
+		return fmt.Errorf("failed to verify inclusion proof: %v", err)
+	}
+	return nil
+}
+
+// do makes a request to the log, returning the response body if it was successful.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	// Adding a new leaf responds with 201 Created.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		// Errors are described by a JSON object, but fall back to the raw body in case the response came from
+		// something other than the log, e.g. a proxy.
+		var e struct {
+			Error string `json:"error"`
+		}
+		msg := string(bytes.TrimSpace(b))
+		if err := json.Unmarshal(b, &e); err == nil && e.Error != "" {
+			msg = e.Error
+		}
+		return nil, &httpError{status: resp.StatusCode, msg: fmt.Sprintf("%s %s: %s: %s", method, path, resp.Status, msg)}
+	}
+	return b, nil
+}
+
+// httpError is returned by do when the log responds with an error status.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+// tileReader fetches tiles from the log's tlog-tiles endpoint.
+// The tiles are verified against the checkpoint by the proofs built from them, so they're not cached.
+type tileReader struct {
+	c      *Client
+	params log.Params
+}
+
+// GetTile fetches the tile at the given level and index, as it was in the tree of size logSize, and fills in the
+// nodes above its lowest level.
+func (r *tileReader) GetTile(ctx context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	tw := r.params.TileWidth()
+	width := r.params.PartialTileSize(level, index, logSize)
+	if width == 0 {
+		width = tw
+	}
+	th := r.params.Metadata().TileHeight
+	// tlog includes the tile height in the path, which https://c2sp.org/tlog-tiles doesn't.
+	t := tlog.Tile{H: th, L: int(level), N: int64(index), W: int(width)}
+	b, err := r.c.do(ctx, http.MethodGet, "/tile/"+strings.TrimPrefix(t.Path(), fmt.Sprintf("tile/%d/", th)), nil)
+	if err != nil {
+		return nil, err
+	}
+	h := r.params.Hasher()
+	if hs := h.Size(); len(b) != int(width)*hs {
+		return nil, fmt.Errorf("got %d bytes for tile of %d hashes of %d bytes", len(b), width, hs)
+	}
+	tile := &api.Tile{NumLeaves: uint(width), Nodes: make([][]byte, api.TileNodeKey(0, width-1)+1)}
+	row := make([][]byte, width)
+	for i := range row {
+		row[i] = b[i*h.Size() : (i+1)*h.Size()]
+	}
+	// Each level holds the nodes whose subtrees are complete within the tile.
+	for l := uint(0); len(row) > 0; l++ {
+		for i, n := range row {
+			tile.Nodes[api.TileNodeKey(l, uint64(i))] = n
+		}
+		next := make([][]byte, len(row)/2)
+		for i := range next {
+			next[i] = h.HashChildren(row[2*i], row[2*i+1])
+		}
+		row = next
+	}
+	return tile, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// requestIDHeader is the header in which request IDs are accepted from callers, and echoed in responses.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen is the longest request ID which will be accepted from a caller.
+const maxRequestIDLen = 64
+
+// requestIDKey is the context key under which a request's ID is stored.
+type requestIDKey struct{}
+
+// requestID returns the ID assigned to the request with the given context, or "" if there isn't one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// accessLogEntry is the structure of the line logged for each request.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	LatencyMs  float64   `json:"latency_ms"`
+}
+
+// accessLogger assigns an ID to each request, and optionally logs a JSON line describing each request once
+// it's been handled.
+type accessLogger struct {
+	mu sync.Mutex
+	// enc writes the log lines, or is nil if requests aren't being logged.
+	enc *json.Encoder
+}
+
+// newAccessLogger creates an accessLogger which logs requests to w, or only assigns request IDs if w is nil.
+func newAccessLogger(w io.Writer) *accessLogger {
+	l := &accessLogger{}
+	if w != nil {
+		l.enc = json.NewEncoder(w)
+	}
+	return l
+}
+
+// Wrap returns a handler which assigns the request an ID before calling h, echoing the ID in the response's
+// X-Request-Id header. A well-formed ID provided by the caller in that header is used in preference to a new one.
+func (l *accessLogger) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		if l.enc == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, r)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if err := l.enc.Encode(accessLogEntry{
+			Time:       start.UTC(),
+			RequestID:  id,
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     rw.status,
+			Bytes:      rw.bytes,
+			LatencyMs:  float64(time.Since(start).Microseconds()) / 1000,
+		}); err != nil {
+			klog.Errorf("Failed to write access log: %v", err)
+		}
+	})
+}
+
+// validRequestID returns true if id is non-empty, not too long, and contains only characters which are safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a new random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// responseRecorder records the status code and number of bytes written in a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
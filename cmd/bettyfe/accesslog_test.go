@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	_, h := newMemoryTestServer(t)
+	addLeaves(t, h, "one")
+	var buf bytes.Buffer
+	h = newAccessLogger(&buf).Wrap(h)
+	newID := regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+	for _, test := range []struct {
+		name, method, target, body string
+		// id is the X-Request-Id sent with the request, if any.
+		id         string
+		wantStatus int
+		// wantID is the ID expected to be logged and echoed, or "" if a new one should be assigned.
+		wantID string
+	}{
+		{name: "new ID", method: http.MethodGet, target: "/size", wantStatus: http.StatusOK},
+		{name: "caller's ID", method: http.MethodPost, target: "/add", body: "two", id: "abc-123_x.y", wantStatus: http.StatusCreated, wantID: "abc-123_x.y"},
+		{name: "invalid ID", method: http.MethodGet, target: "/size", id: "bad id\n", wantStatus: http.StatusOK},
+		{name: "ID too long", method: http.MethodGet, target: "/size", id: strings.Repeat("a", maxRequestIDLen+1), wantStatus: http.StatusOK},
+		{name: "error", method: http.MethodGet, target: "/proof/inclusion?index=x", wantStatus: http.StatusBadRequest},
+		{name: "not found", method: http.MethodGet, target: "/nothing/here", wantStatus: http.StatusNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			buf.Reset()
+			var header http.Header
+			if test.id != "" {
+				header = http.Header{requestIDHeader: {test.id}}
+			}
+			before := time.Now().UTC()
+			w := do(h, test.method, test.target, test.body, header)
+			if w.Code != test.wantStatus {
+				t.Fatalf("%s %s: got %d %q, want %d", test.method, test.target, w.Code, w.Body, test.wantStatus)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("Got %d access log lines %q, want 1", len(lines), buf.String())
+			}
+			var e accessLogEntry
+			if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+				t.Fatalf("Failed to parse access log line %q: %v", lines[0], err)
+			}
+			id := w.Header().Get(requestIDHeader)
+			if test.wantID != "" && id != test.wantID {
+				t.Errorf("Got %s %q, want %q", requestIDHeader, id, test.wantID)
+			}
+			if test.wantID == "" && !newID.MatchString(id) {
+				t.Errorf("Got %s %q, want a new ID", requestIDHeader, id)
+			}
+			if e.RequestID != id {
+				t.Errorf("request_id: got %q, want %q", e.RequestID, id)
+			}
+			if e.Method != test.method {
+				t.Errorf("method: got %q, want %q", e.Method, test.method)
+			}
+			if want, _, _ := strings.Cut(test.target, "?"); e.Path != want {
+				t.Errorf("path: got %q, want %q", e.Path, want)
+			}
+			if e.Status != test.wantStatus {
+				t.Errorf("status: got %d, want %d", e.Status, test.wantStatus)
+			}
+			if e.Bytes != int64(w.Body.Len()) {
+				t.Errorf("bytes: got %d, want %d", e.Bytes, w.Body.Len())
+			}
+			if e.LatencyMs < 0 || e.LatencyMs > float64(time.Since(before).Milliseconds()+1) {
+				t.Errorf("latency_ms: got %v, want between 0 and the time taken", e.LatencyMs)
+			}
+			if e.Time.Before(before.Truncate(time.Millisecond)) || e.Time.After(time.Now()) {
+				t.Errorf("time: got %v, want the time of the request", e.Time)
+			}
+			if e.RemoteAddr == "" {
+				t.Error("remote_addr is empty")
+			}
+		})
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	_, h := newMemoryTestServer(t)
+	h = newAccessLogger(nil).Wrap(h)
+	w := do(h, http.MethodGet, "/size", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /size: got %d %q, want 200", w.Code, w.Body)
+	}
+	// Request IDs are still assigned without the access log.
+	if id := w.Header().Get(requestIDHeader); !validRequestID(id) {
+		t.Errorf("Got %s %q, want a valid request ID", requestIDHeader, id)
+	}
+}
+
+func TestAccessLogRequestIDInSpans(t *testing.T) {
+	sr := spanRecorder()
+	_, h := newMemoryTestServer(t)
+	h = newAccessLogger(nil).Wrap(h)
+	start := len(sr.Ended())
+	do(h, http.MethodPost, "/add", "leaf", http.Header{requestIDHeader: {"traced-request"}})
+	var found bool
+	for _, s := range sr.Ended()[start:] {
+		if s.Name() != "bettyfe.handleAdd" {
+			continue
+		}
+		found = true
+		var got string
+		for _, a := range s.Attributes() {
+			if a.Key == "betty.request_id" {
+				got = a.Value.AsString()
+			}
+		}
+		if got != "traced-request" {
+			t.Errorf("Span %s has betty.request_id %q, want %q", s.Name(), got, "traced-request")
+		}
+	}
+	if !found {
+		t.Error("No bettyfe.handleAdd span was recorded")
+	}
+}
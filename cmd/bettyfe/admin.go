@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"k8s.io/klog/v2"
+)
+
+// flusher is implemented by storage which can sequence and integrate pending entries on demand.
+type flusher interface {
+	// Flush sequences and integrates any pending entries, returning once a checkpoint covering them is published.
+	Flush(ctx context.Context) error
+}
+
+// handleAdminFlush sequences and integrates any pending entries immediately, rather than waiting for their batch
+// to be flushed, and serves the size and root hash of the resulting tree as JSON.
+func (s *server) handleAdminFlush(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.storage.(flusher)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "Flushing is not supported by this log")
+		return
+	}
+	if err := f.Flush(r.Context()); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to flush: %v", err)
+		return
+	}
+	size, root, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(treeSize{Size: size, Root: root}); err != nil {
+		klog.Errorf("Failed to write size: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newAdminTestServer creates a server for the log with the given storage, with its admin handlers served to
+// requests presenting the token "admin".
+func newAdminTestServer(t *testing.T, newServer func(*testing.T) (*server, http.Handler)) http.Handler {
+	t.Helper()
+	tokens := filepath.Join(t.TempDir(), "admin_tokens")
+	writeTokens(t, tokens, "admin\n")
+	setFlag(t, adminTokensFile, tokens)
+	srv, _ := newServer(t)
+	// Stop reloading the tokens once the test completes.
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	mux := http.NewServeMux()
+	srv.registerHandlers(mux, func(h http.HandlerFunc) http.HandlerFunc { return h }, newAdminWrapper(ctx), nil)
+	return mux
+}
+
+var adminAuth = http.Header{"Authorization": {"Bearer admin"}}
+
+func TestAdminFlush(t *testing.T) {
+	// Pending entries would otherwise wait for a full batch or an hour.
+	setFlag(t, batchSize, 100)
+	setFlag(t, batchMaxAge, time.Hour)
+	h := newAdminTestServer(t, newPOSIXTestServer)
+
+	added := make(chan string, 1)
+	go func() {
+		w := do(h, http.MethodPost, "/add", "leaf", nil)
+		added <- w.Body.String()
+	}()
+	// The entry may not have reached the pending batch by the time of the first flush.
+	var size treeSize
+	for start := time.Now(); size.Size == 0; time.Sleep(10 * time.Millisecond) {
+		w := do(h, http.MethodPost, "/admin/flush", "", adminAuth)
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST /admin/flush: got %d %q, want 200", w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &size); err != nil {
+			t.Fatalf("Failed to parse flush response %q: %v", w.Body, err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Flush never integrated the pending entry")
+		}
+	}
+	if size.Size != 1 {
+		t.Errorf("Flush returned tree size %d, want 1", size.Size)
+	}
+	select {
+	case idx := <-added:
+		if idx != "0\n" {
+			t.Errorf("POST /add: got %q, want index 0", idx)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("POST /add didn't return once its entry was flushed")
+	}
+	cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+	if cp.Size != 1 || string(cp.Hash) != string(size.Root) {
+		t.Errorf("Got checkpoint (%d, %x), want the flushed tree (1, %x)", cp.Size, cp.Hash, size.Root)
+	}
+
+	// Flushing with nothing pending leaves the tree as it was.
+	w := do(h, http.MethodPost, "/admin/flush", "", adminAuth)
+	if err := json.Unmarshal(w.Body.Bytes(), &size); err != nil || size.Size != 1 {
+		t.Errorf("POST /admin/flush with nothing pending: got %q, want size 1", w.Body)
+	}
+}
+
+func TestAdminFlushErrors(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		newServer func(*testing.T) (*server, http.Handler)
+		header    http.Header
+		want      int
+	}{
+		{name: "no token", newServer: newPOSIXTestServer, want: http.StatusUnauthorized},
+		{name: "wrong token", newServer: newPOSIXTestServer, header: http.Header{"Authorization": {"Bearer submitter"}}, want: http.StatusUnauthorized},
+		{name: "unsupported storage", newServer: newMemoryTestServer, header: adminAuth, want: http.StatusNotImplemented},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := newAdminTestServer(t, test.newServer)
+			if w := do(h, http.MethodPost, "/admin/flush", "", test.header); w.Code != test.want {
+				t.Errorf("POST /admin/flush: got %d %q, want %d", w.Code, w.Body, test.want)
+			}
+		})
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	// Without --admin_tokens_file, the admin endpoints aren't served at all.
+	_, h := newPOSIXTestServer(t)
+	if w := do(h, http.MethodPost, "/admin/flush", "", adminAuth); w.Code != http.StatusNotFound {
+		t.Errorf("POST /admin/flush: got %d, want 404", w.Code)
+	}
+}
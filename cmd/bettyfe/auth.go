@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// tokenAuth restricts requests to those presenting one of a set of bearer tokens.
+type tokenAuth struct {
+	path string
+
+	mu sync.RWMutex
+	// tokens holds the SHA-256 hashes of the valid tokens, so that lookups don't leak timing information
+	// about the tokens themselves.
+	tokens map[[sha256.Size]byte]bool
+}
+
+// newTokenAuth creates a tokenAuth which accepts the tokens listed in the file at path, one per line.
+// Blank lines, and lines starting with #, are ignored.
+func newTokenAuth(path string) (*tokenAuth, error) {
+	a := &tokenAuth{path: path}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load (re)reads the tokens from the file.
+func (a *tokenAuth) load() error {
+	raw, err := os.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("failed to read token file: %v", err)
+	}
+	tokens := make(map[[sha256.Size]byte]bool)
+	sc := bufio.NewScanner(bytes.NewReader(raw))
+	for sc.Scan() {
+		t := strings.TrimSpace(sc.Text())
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		tokens[sha256.Sum256([]byte(t))] = true
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to parse token file: %v", err)
+	}
+	a.mu.Lock()
+	a.tokens = tokens
+	a.mu.Unlock()
+	klog.Infof("Loaded %d tokens from %q", len(tokens), a.path)
+	return nil
+}
+
+// reloadOnSIGHUP reloads the tokens each time the process receives SIGHUP, until ctx is done.
+// If the file can't be read, the previously loaded tokens remain in use.
+func (a *tokenAuth) reloadOnSIGHUP(ctx context.Context) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			if err := a.load(); err != nil {
+				klog.Errorf("Failed to reload tokens: %v", err)
+			}
+		}
+	}
+}
+
+// Wrap returns a handler which calls h for requests bearing a valid token, and responds with
+// 401 Unauthorized to the rest.
+func (a *tokenAuth) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.valid(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "Missing or invalid bearer token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// valid returns true if the request has an Authorization header with one of the tokens.
+func (a *tokenAuth) valid(r *http.Request) bool {
+	t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || t == "" {
+		return false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.tokens[sha256.Sum256([]byte(t))]
+}
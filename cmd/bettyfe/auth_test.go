@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTokens writes the contents of a token file to path.
+func writeTokens(t *testing.T, path, tokens string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(tokens), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	writeTokens(t, path, "# Submitters\nalpha\n\n  beta  \n")
+	a, err := newTokenAuth(path)
+	if err != nil {
+		t.Fatalf("newTokenAuth: %v", err)
+	}
+	h := a.Wrap(func(w http.ResponseWriter, r *http.Request) {})
+
+	check := func(t *testing.T, auth []string, wantCode int) {
+		t.Helper()
+		w := do(h, http.MethodPost, "/add", "leaf", http.Header{"Authorization": auth})
+		if w.Code != wantCode {
+			t.Fatalf("Got %d %q, want %d", w.Code, w.Body, wantCode)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); wantCode == http.StatusUnauthorized && got != "Bearer" {
+			t.Errorf("Got WWW-Authenticate %q, want Bearer", got)
+		}
+	}
+	for _, test := range []struct {
+		name     string
+		auth     []string
+		wantCode int
+	}{
+		{name: "valid", auth: []string{"Bearer alpha"}, wantCode: http.StatusOK},
+		{name: "trimmed", auth: []string{"Bearer beta"}, wantCode: http.StatusOK},
+		{name: "missing", wantCode: http.StatusUnauthorized},
+		{name: "invalid", auth: []string{"Bearer gamma"}, wantCode: http.StatusUnauthorized},
+		{name: "empty", auth: []string{"Bearer "}, wantCode: http.StatusUnauthorized},
+		{name: "comment", auth: []string{"Bearer # Submitters"}, wantCode: http.StatusUnauthorized},
+		{name: "wrong scheme", auth: []string{"Basic alpha"}, wantCode: http.StatusUnauthorized},
+		{name: "without scheme", auth: []string{"alpha"}, wantCode: http.StatusUnauthorized},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			check(t, test.auth, test.wantCode)
+		})
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		writeTokens(t, path, "gamma\n")
+		if err := a.load(); err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		check(t, []string{"Bearer alpha"}, http.StatusUnauthorized)
+		check(t, []string{"Bearer gamma"}, http.StatusOK)
+
+		// The tokens already loaded remain in use if the file can't be read.
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+		if err := a.load(); err == nil {
+			t.Fatal("load succeeded without a token file")
+		}
+		check(t, []string{"Bearer gamma"}, http.StatusOK)
+	})
+}
+
+func TestTokenAuthReadsArePublic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	writeTokens(t, path, "alpha\n")
+	a, err := newTokenAuth(path)
+	if err != nil {
+		t.Fatalf("newTokenAuth: %v", err)
+	}
+	srv, _ := newMemoryTestServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /add", a.Wrap(srv.handleAdd))
+	mux.HandleFunc("POST /add-batch", a.Wrap(srv.handleAddBatch))
+	mux.HandleFunc("GET /checkpoint", srv.handleCheckpoint)
+	mux.HandleFunc("GET /entries", srv.handleEntries)
+
+	if w := do(mux, http.MethodPost, "/add", "leaf", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST /add without token: got %d %q, want 401", w.Code, w.Body)
+	}
+	if w := do(mux, http.MethodPost, "/add-batch", "bGVhZg==\n", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("POST /add-batch without token: got %d %q, want 401", w.Code, w.Body)
+	}
+	if w := do(mux, http.MethodPost, "/add", "leaf", http.Header{"Authorization": {"Bearer alpha"}}); w.Code != http.StatusCreated {
+		t.Errorf("POST /add with token: got %d %q, want 201", w.Code, w.Body)
+	}
+	for _, target := range []string{"/checkpoint", "/entries?start=0&count=1"} {
+		if w := do(mux, http.MethodGet, target, "", nil); w.Code != http.StatusOK {
+			t.Errorf("GET %s without token: got %d %q, want 200", target, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	checkpointCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "betty_checkpoint_cache_hits_total",
+		Help: "Total number of checkpoint reads served from memory.",
+	})
+	checkpointCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "betty_checkpoint_cache_misses_total",
+		Help: "Total number of checkpoint reads which had to read the checkpoint from storage.",
+	})
+)
+
+// checkpointCache holds the latest checkpoint in memory, so that it needn't be read from storage for every request.
+//
+// Checkpoints written through the cache replace the cached one immediately. A checkpoint read from storage,
+// which may have been written by another process, is only cached for ttl, unless no other process can write
+// one, in which case it's cached until replaced.
+type checkpointCache struct {
+	readCheckpoint  func() ([]byte, error)
+	writeCheckpoint func([]byte) error
+	ttl             time.Duration
+	// sole is true if this process is the only one which writes checkpoints.
+	sole bool
+
+	mu      sync.RWMutex
+	raw     []byte
+	fetched time.Time
+	// gen is incremented by each write, so that a concurrent read doesn't replace the checkpoint written with
+	// an older one.
+	gen uint64
+}
+
+// Read returns the latest checkpoint.
+func (c *checkpointCache) Read() ([]byte, error) {
+	c.mu.RLock()
+	raw, fetched, gen := c.raw, c.fetched, c.gen
+	c.mu.RUnlock()
+	if raw != nil && (c.sole || time.Since(fetched) < c.ttl) {
+		checkpointCacheHits.Inc()
+		return raw, nil
+	}
+	checkpointCacheMisses.Inc()
+	raw, err := c.readCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen == gen {
+		c.raw, c.fetched = raw, time.Now()
+	}
+	return raw, nil
+}
+
+// Write writes the checkpoint to storage, and caches it if it's written successfully.
+func (c *checkpointCache) Write(cp []byte) error {
+	err := c.writeCheckpoint(cp)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if err != nil {
+		// It's unknown whether the checkpoint was written, so the next read must find out.
+		c.raw = nil
+		return err
+	}
+	c.raw, c.fetched = cp, time.Now()
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue returns the current value of the counter.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// cacheStorage is the storage behind a checkpointCache, which counts the reads which reach it.
+type cacheStorage struct {
+	cp       []byte
+	reads    int
+	writeErr error
+}
+
+func (s *cacheStorage) read() ([]byte, error) {
+	s.reads++
+	if s.cp == nil {
+		return nil, errors.New("no checkpoint")
+	}
+	return s.cp, nil
+}
+
+func (s *cacheStorage) write(cp []byte) error {
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	s.cp = cp
+	return nil
+}
+
+func TestCheckpointCache(t *testing.T) {
+	type op struct {
+		// write writes the checkpoint through the cache, failing if fail is set, and external replaces it in
+		// storage as another process would. Otherwise the checkpoint is read, and want is the result.
+		write, external string
+		fail            bool
+		want            string
+		// wantReads is the total number of reads from storage so far.
+		wantReads int
+	}
+	for _, test := range []struct {
+		name string
+		sole bool
+		ttl  time.Duration
+		ops  []op
+	}{
+		{
+			name: "sole writer",
+			sole: true,
+			ops: []op{
+				{write: "a"},
+				{want: "a", wantReads: 0},
+				{want: "a", wantReads: 0},
+				{write: "b"},
+				{want: "b", wantReads: 0},
+			},
+		}, {
+			name: "sole writer reads storage once",
+			sole: true,
+			ops: []op{
+				{external: "a"},
+				{want: "a", wantReads: 1},
+				{external: "b"},
+				{want: "a", wantReads: 1},
+				{write: "c"},
+				{want: "c", wantReads: 1},
+			},
+		}, {
+			name: "cached until ttl",
+			ttl:  time.Hour,
+			ops: []op{
+				{external: "a"},
+				{want: "a", wantReads: 1},
+				{want: "a", wantReads: 1},
+				{external: "b"},
+				{want: "a", wantReads: 1},
+				{write: "c"},
+				{want: "c", wantReads: 1},
+			},
+		}, {
+			name: "no ttl",
+			ttl:  0,
+			ops: []op{
+				{write: "a"},
+				{want: "a", wantReads: 1},
+				{external: "b"},
+				{want: "b", wantReads: 2},
+			},
+		}, {
+			name: "failed write",
+			sole: true,
+			ops: []op{
+				{write: "a"},
+				{want: "a", wantReads: 0},
+				{write: "b", fail: true},
+				// It's unknown whether the failed write reached storage, so it's read from there.
+				{want: "a", wantReads: 1},
+				{want: "a", wantReads: 1},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			st := &cacheStorage{}
+			c := &checkpointCache{readCheckpoint: st.read, writeCheckpoint: st.write, ttl: test.ttl, sole: test.sole}
+			for i, o := range test.ops {
+				switch {
+				case o.external != "":
+					st.cp = []byte(o.external)
+				case o.write != "":
+					st.writeErr = nil
+					if o.fail {
+						st.writeErr = errors.New("write failed")
+					}
+					if err := c.Write([]byte(o.write)); (err != nil) != o.fail {
+						t.Fatalf("Op %d: Write(%q) = %v, want error: %t", i, o.write, err, o.fail)
+					}
+				default:
+					hits, reads := counterValue(t, checkpointCacheHits), st.reads
+					got, err := c.Read()
+					if err != nil {
+						t.Fatalf("Op %d: Read: %v", i, err)
+					}
+					if string(got) != o.want {
+						t.Errorf("Op %d: Read = %q, want %q", i, got, o.want)
+					}
+					if st.reads != o.wantReads {
+						t.Errorf("Op %d: %d reads reached storage, want %d", i, st.reads, o.wantReads)
+					}
+					// Reads which don't reach storage are counted as hits.
+					hit := st.reads == reads
+					if got := counterValue(t, checkpointCacheHits) - hits; (got == 1) != hit {
+						t.Errorf("Op %d: hits increased by %v, want hit: %t", i, got, hit)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AlCutter/betty/client"
+	"github.com/AlCutter/betty/log"
+	"github.com/transparency-dev/merkle/rfc6962"
+)
+
+// newClientTestServer serves the log created with params from a new POSIX test server, returning a client for it.
+func newClientTestServer(t *testing.T, params log.Params, opts ...client.Option) *client.Client {
+	t.Helper()
+	setFlag(t, path, t.TempDir())
+	_, h := newTestServer(t, params)
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return client.New(ts.URL, testVerifier(t), ts.Client(), opts...)
+}
+
+// addAll adds each of the leaves to the log via c, failing the test if they aren't assigned consecutive indices.
+func addAll(t *testing.T, c *client.Client, leaves [][]byte) {
+	t.Helper()
+	for i, l := range leaves {
+		idx, err := c.Add(context.Background(), l)
+		if err != nil {
+			t.Fatalf("Add(%q): %v", l, err)
+		}
+		if idx != uint64(i) {
+			t.Fatalf("Add(%q): got index %d, want %d", l, idx, i)
+		}
+	}
+}
+
+func TestClientVerifyInclusion(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		params log.Params
+		leaves int
+	}{
+		{name: "single bundle", params: log.Params{EntryBundleSize: 256}, leaves: 3},
+		{name: "several bundles", params: log.Params{EntryBundleSize: 4}, leaves: 10},
+		{name: "partial tiles", params: log.Params{EntryBundleSize: 4, TileHeight: 2}, leaves: 23},
+		{name: "full tiles", params: log.Params{EntryBundleSize: 4, TileHeight: 2}, leaves: 64},
+		{name: "SHA-384", params: log.Params{EntryBundleSize: 4, TileHeight: 3, Hash: crypto.SHA384}, leaves: 30},
+		{name: "SHA-512", params: log.Params{EntryBundleSize: 4, Hash: crypto.SHA512}, leaves: 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := newClientTestServer(t, test.params)
+			var leaves [][]byte
+			for i := range test.leaves {
+				leaves = append(leaves, []byte(fmt.Sprintf("leaf %d", i)))
+			}
+			addAll(t, c, leaves)
+			cp, err := c.Checkpoint(ctx)
+			if err != nil {
+				t.Fatalf("Checkpoint: %v", err)
+			}
+			if cp.Size != uint64(test.leaves) {
+				t.Fatalf("Got checkpoint of size %d, want %d", cp.Size, test.leaves)
+			}
+			for i, l := range leaves {
+				if err := c.VerifyInclusion(ctx, l, uint64(i)); err != nil {
+					t.Errorf("VerifyInclusion(%q, %d): %v", l, i, err)
+				}
+			}
+			if err := c.VerifyInclusion(ctx, []byte("not a leaf"), 0); err == nil {
+				t.Error("VerifyInclusion succeeded for a leaf which isn't in the log")
+			}
+			if err := c.VerifyInclusion(ctx, leaves[0], uint64(test.leaves)); err == nil {
+				t.Error("VerifyInclusion succeeded for an index beyond the checkpoint")
+			}
+		})
+	}
+}
+
+func TestClientParamsMismatch(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		want    log.Params
+		wantErr bool
+	}{
+		{name: "matching", want: log.Params{TileHeight: 2, Hash: crypto.SHA384}},
+		{name: "tile height", want: log.Params{TileHeight: 8, Hash: crypto.SHA384}, wantErr: true},
+		{name: "default tile height", want: log.Params{Hash: crypto.SHA384}, wantErr: true},
+		{name: "hash", want: log.Params{TileHeight: 2, Hash: crypto.SHA256}, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := newClientTestServer(t, log.Params{EntryBundleSize: 4, TileHeight: 2, Hash: crypto.SHA384}, client.WithParams(test.want))
+			if _, err := c.Add(ctx, []byte("leaf")); err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			if err := c.VerifyInclusion(ctx, []byte("leaf"), 0); (err != nil) != test.wantErr {
+				t.Errorf("VerifyInclusion: got %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientCustomLeafHasher(t *testing.T) {
+	// Hash leaves as CT does, prefixing them with the MerkleTreeLeaf version and leaf type, as well as RFC6962's
+	// leaf hash prefix.
+	ctLeafHash := func(e []byte) []byte {
+		h := sha256.Sum256(append([]byte{0x00, 0x00, 0x00}, e...))
+		return h[:]
+	}
+	for _, test := range []struct {
+		name    string
+		opts    []client.Option
+		wantErr bool
+	}{
+		{name: "same hasher", opts: []client.Option{client.WithLeafHasher(ctLeafHash)}},
+		{name: "default hasher", wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := newClientTestServer(t, log.Params{EntryBundleSize: 4, TileHeight: 2, LeafHasher: ctLeafHash}, test.opts...)
+			var leaves [][]byte
+			for i := range 11 {
+				leaves = append(leaves, []byte(fmt.Sprintf("leaf %d", i)))
+			}
+			addAll(t, c, leaves)
+			cp, err := c.Checkpoint(ctx)
+			if err != nil {
+				t.Fatalf("Checkpoint: %v", err)
+			}
+			// The checkpoint commits to the leaves as hashed by the custom hasher.
+			var hashes [][]byte
+			for _, l := range leaves {
+				hashes = append(hashes, ctLeafHash(l))
+			}
+			if want := rootOf(hashes); !bytes.Equal(cp.Hash, want) {
+				t.Fatalf("Got checkpoint root %x, want %x", cp.Hash, want)
+			}
+			for i, l := range leaves {
+				if err := c.VerifyInclusion(ctx, l, uint64(i)); (err != nil) != test.wantErr {
+					t.Errorf("VerifyInclusion(%q, %d): got %v, want error %t", l, i, err, test.wantErr)
+				}
+			}
+		})
+	}
+}
+
+// rootOf returns the RFC6962 root of the tree with the given leaf hashes.
+func rootOf(hashes [][]byte) []byte {
+	if len(hashes) == 1 {
+		return hashes[0]
+	}
+	k := 1
+	for k*2 < len(hashes) {
+		k *= 2
+	}
+	return rfc6962.DefaultHasher.HashChildren(rootOf(hashes[:k]), rootOf(hashes[k:]))
+}
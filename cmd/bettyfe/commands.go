@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
+	"k8s.io/klog/v2"
+)
+
+// command is a bettyfe subcommand, selected by the first argument which isn't a flag.
+type command struct {
+	help string
+	run  func(ctx context.Context)
+}
+
+// commands maps the name of each subcommand to its implementation.
+var commands = map[string]command{
+	"serve":  {help: "Serve the log over HTTP, initialising it first if necessary. This is the default", run: runServe},
+	"init":   {help: "Create an empty log, with a checkpoint for the empty tree signed by --log_signer, and exit", run: runInit},
+	"verify": {help: "Recompute the root hash of the log's checkpoint from its tiles, and check the hashes and inclusion proofs of up to --verify_on_start_leaves randomly chosen leaves", run: runVerify},
+}
+
+// parseCommandLine parses the command line, which may name a subcommand either before or after the flags,
+// returning the subcommand to run.
+func parseCommandLine() command {
+	flag.Usage = usage
+	// Parsing stops at the first argument which isn't a flag, so any flags following the subcommand are parsed
+	// once it's been removed.
+	flag.Parse()
+	name := "serve"
+	if flag.NArg() > 0 {
+		name = flag.Arg(0)
+		if err := flag.CommandLine.Parse(flag.Args()[1:]); err != nil {
+			klog.Exit(err)
+		}
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %q\n", name)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if flag.NArg() > 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "Unexpected arguments %q\n", flag.Args())
+		flag.Usage()
+		os.Exit(2)
+	}
+	return cmd
+}
+
+// usage describes the subcommands and flags.
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(w, "  %s\n    \t%s\n", n, commands[n].help)
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// maintenanceParams returns the params of the single log operated on by the init and verify commands.
+func maintenanceParams(cmd string) log.Params {
+	if *logsConfig != "" {
+		klog.Exitf("%s doesn't support --logs_config, run it for each log in turn", cmd)
+	}
+	return log.Params{EntryBundleSize: *batchSize, BundleMaxBytes: *bundleMaxBytes, TileHeight: *tileHeight, Hash: hashFromFlag()}
+}
+
+// runInit creates an empty log at the configured location, doing nothing if the log already exists.
+func runInit(ctx context.Context) {
+	if *readOnly {
+		klog.Exit("init can't be run with --read_only")
+	}
+	params := maintenanceParams("init")
+	loc, err := storageLocation(*path)
+	if err != nil {
+		klog.Exitf("Invalid --storage: %v", err)
+	}
+	if loc.Scheme == "memory" {
+		klog.Exit("init requires persistent storage")
+	}
+	sKeys, vKeys := keysFromFlag()
+	// Creating the storage initialises the log if necessary.
+	s, ct, _ := newStorage(ctx, loc, params, sKeys, vKeys)
+	size, root, err := ct()
+	if cErr := s.Close(ctx); cErr != nil {
+		klog.Exitf("Failed to close storage: %v", cErr)
+	}
+	if err != nil {
+		klog.Exitf("Failed to read checkpoint: %v", err)
+	}
+	fmt.Printf("Log %q at %s has size %d and root hash %x\n", sKeys[0].Name(), loc, size, root)
+}
+
+// runVerify checks that the tiles and entry bundles of the log at the configured location are consistent with
+// its checkpoint, without writing to the log.
+func runVerify(ctx context.Context) {
+	params := maintenanceParams("verify")
+	loc, err := storageLocation(*path)
+	if err != nil {
+		klog.Exitf("Invalid --storage: %v", err)
+	}
+	if loc.Scheme == "memory" || loc.Scheme == "kv" {
+		klog.Exit("verify is not supported with in-memory or KV storage")
+	}
+	// Open the log read-only, so that nothing is written to it and no writer lease is needed.
+	*readOnly = true
+	sKeys, vKeys := keysFromFlag()
+	s, ct, _ := newStorage(ctx, loc, params, sKeys, vKeys)
+	defer func() {
+		if err := s.Close(ctx); err != nil {
+			klog.Errorf("Failed to close storage: %v", err)
+		}
+	}()
+	size, root, err := ct()
+	if err != nil {
+		klog.Exitf("Failed to read checkpoint: %v", err)
+	}
+	if err := reader.VerifyTree(ctx, params, size, root, s, s, *verifyLeaves); err != nil {
+		klog.Exitf("Log at %s failed verification: %v", loc, err)
+	}
+	fmt.Printf("Verified log at %s with size %d and root hash %x\n", loc, size, root)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlCutter/betty/log"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		args        []string
+		wantCommand string
+		wantLeaves  uint64
+	}{
+		{name: "default", args: nil, wantCommand: "serve", wantLeaves: 1000},
+		{name: "serve", args: []string{"serve"}, wantCommand: "serve", wantLeaves: 1000},
+		{name: "flags before command", args: []string{"--verify_on_start_leaves=5", "verify"}, wantCommand: "verify", wantLeaves: 5},
+		{name: "flags after command", args: []string{"init", "--verify_on_start_leaves=7"}, wantCommand: "init", wantLeaves: 7},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, verifyLeaves, 1000)
+			setFlag(t, &os.Args, append([]string{"bettyfe"}, test.args...))
+			if got, want := parseCommandLine().help, commands[test.wantCommand].help; got != want {
+				t.Errorf("parseCommandLine() returned command %q, want %q", got, want)
+			}
+			if *verifyLeaves != test.wantLeaves {
+				t.Errorf("--verify_on_start_leaves = %d, want %d", *verifyLeaves, test.wantLeaves)
+			}
+			if flag.NArg() != 0 {
+				t.Errorf("Left arguments %q", flag.Args())
+			}
+		})
+	}
+}
+
+func TestInitThenVerify(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// leaves are added to the log between init and verify.
+		leaves int
+	}{
+		{name: "fresh log", leaves: 0},
+		{name: "with leaves", leaves: 10},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := filepath.Join(t.TempDir(), "log")
+			setFlag(t, path, dir)
+			// verify opens the log read-only by setting the flag, which mustn't leak into other tests.
+			setFlag(t, readOnly, false)
+
+			runInit(ctx)
+			raw, err := os.ReadFile(filepath.Join(dir, "checkpoint"))
+			if err != nil {
+				t.Fatalf("init didn't write a checkpoint: %v", err)
+			}
+			// The checkpoint commits to the empty tree, and is signed by the log's key.
+			cp := parseCheckpoint(t, raw)
+			if want := testParams().Hasher().EmptyRoot(); cp.Size != 0 || !bytes.Equal(cp.Hash, want) {
+				t.Errorf("init wrote checkpoint (%d, %x), want (0, %x)", cp.Size, cp.Hash, want)
+			}
+			m, err := os.ReadFile(filepath.Join(dir, log.MetadataPath))
+			if err != nil {
+				t.Fatalf("init didn't write the log's metadata: %v", err)
+			}
+			if err := testParams().CheckMetadata(m); err != nil {
+				t.Errorf("init wrote invalid metadata: %v", err)
+			}
+			// Running init again leaves the log as it was.
+			runInit(ctx)
+			if again, err := os.ReadFile(filepath.Join(dir, "checkpoint")); err != nil || !bytes.Equal(again, raw) {
+				t.Errorf("Second init changed the checkpoint to %q (%v), want %q", again, err, raw)
+			}
+
+			if test.leaves > 0 {
+				srv, _, err := openTestLog(t, dir)
+				if err != nil {
+					t.Fatalf("openTestLog: %v", err)
+				}
+				for i := range test.leaves {
+					if _, err := srv.storage.Sequence(ctx, []byte(fmt.Sprintf("leaf %d", i))); err != nil {
+						t.Fatalf("Sequence: %v", err)
+					}
+				}
+				if err := srv.storage.Close(ctx); err != nil {
+					t.Fatalf("Close: %v", err)
+				}
+			}
+			// verify exits if the log fails verification.
+			runVerify(ctx)
+		})
+	}
+}
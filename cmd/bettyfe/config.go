@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// applyConfigFile sets flags from the JSON object in the file f, whose keys are flag names, e.g.
+//
+//	{"listen": ":443", "batch_size": 256, "durable": true, "witness": ["<vkey>,<URL>", "<vkey>,<URL>"]}
+//
+// Flags set on the command line take precedence over the file, which in turn takes precedence over the flags'
+// defaults. Values are parsed by the flags themselves, so are validated exactly as they would be on the command
+// line; lists may be given for flags which can be repeated. Unknown keys are rejected.
+func applyConfigFile(fs *flag.FlagSet, f string) error {
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var cfg map[string]any
+	if err := d.Decode(&cfg); err != nil {
+		return fmt.Errorf("failed to parse %q: %v", f, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+	for name, v := range cfg {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("%q: unknown flag %q", f, name)
+		}
+		if set[name] {
+			continue
+		}
+		vs, ok := v.([]any)
+		if !ok {
+			vs = []any{v}
+		}
+		for _, v := range vs {
+			s, err := configValue(v)
+			if err != nil {
+				return fmt.Errorf("%q: invalid value for %q: %v", f, name, err)
+			}
+			if err := fs.Set(name, s); err != nil {
+				return fmt.Errorf("%q: invalid value for %q: %v", f, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValue returns the flag value corresponding to a scalar JSON value.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// listFlag is a flag which may be repeated, accumulating its values.
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, "|") }
+func (l *listFlag) Set(v string) error { *l = append(*l, v); return nil }
+
+// testConfig is the set of flags which applyConfigFile is tested against.
+type testConfig struct {
+	fs        *flag.FlagSet
+	listen    *string
+	batchSize *int
+	durable   *bool
+	witnesses listFlag
+}
+
+// newTestConfig returns the flags parsed from args.
+func newTestConfig(t *testing.T, args ...string) *testConfig {
+	t.Helper()
+	c := &testConfig{fs: flag.NewFlagSet("test", flag.ContinueOnError)}
+	c.fs.SetOutput(io.Discard)
+	c.fs.String("config", "", "")
+	c.listen = c.fs.String("listen", ":8080", "")
+	c.batchSize = c.fs.Int("batch_size", 1, "")
+	c.durable = c.fs.Bool("durable", false, "")
+	c.fs.Var(&c.witnesses, "witness", "")
+	if err := c.fs.Parse(args); err != nil {
+		t.Fatalf("Parse(%q): %v", args, err)
+	}
+	return c
+}
+
+// writeConfigFile writes the contents of a --config file, returning its path.
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(f, []byte(contents), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return f
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		file string
+		args []string
+		// The flag values expected once the file has been applied.
+		wantListen    string
+		wantBatchSize int
+		wantDurable   bool
+		wantWitnesses string
+	}{
+		{
+			name:          "defaults",
+			file:          `{}`,
+			wantListen:    ":8080",
+			wantBatchSize: 1,
+		}, {
+			name:          "file over default",
+			file:          `{"listen": ":443", "batch_size": 256, "durable": true, "witness": ["a,http://a", "b,http://b"]}`,
+			wantListen:    ":443",
+			wantBatchSize: 256,
+			wantDurable:   true,
+			wantWitnesses: "a,http://a|b,http://b",
+		}, {
+			name:          "flag over file",
+			file:          `{"listen": ":443", "batch_size": 256, "durable": true, "witness": "a,http://a"}`,
+			args:          []string{"--batch_size=16", "--durable=false", "--witness=c,http://c"},
+			wantListen:    ":443",
+			wantBatchSize: 16,
+			wantWitnesses: "c,http://c",
+		}, {
+			name:          "flag equal to default over file",
+			file:          `{"batch_size": 256}`,
+			args:          []string{"--batch_size=1"},
+			wantListen:    ":8080",
+			wantBatchSize: 1,
+		}, {
+			name:          "string values",
+			file:          `{"batch_size": "64", "durable": "true"}`,
+			wantListen:    ":8080",
+			wantBatchSize: 64,
+			wantDurable:   true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestConfig(t, test.args...)
+			if err := applyConfigFile(c.fs, writeConfigFile(t, test.file)); err != nil {
+				t.Fatalf("applyConfigFile: %v", err)
+			}
+			if *c.listen != test.wantListen {
+				t.Errorf("listen: got %q, want %q", *c.listen, test.wantListen)
+			}
+			if *c.batchSize != test.wantBatchSize {
+				t.Errorf("batch_size: got %d, want %d", *c.batchSize, test.wantBatchSize)
+			}
+			if *c.durable != test.wantDurable {
+				t.Errorf("durable: got %t, want %t", *c.durable, test.wantDurable)
+			}
+			if got := c.witnesses.String(); got != test.wantWitnesses {
+				t.Errorf("witness: got %q, want %q", got, test.wantWitnesses)
+			}
+		})
+	}
+}
+
+func TestApplyConfigFileErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		file string
+	}{
+		{name: "not JSON", file: `listen: ":443"`},
+		{name: "not an object", file: `[":443"]`},
+		{name: "unknown flag", file: `{"listne": ":443"}`},
+		{name: "config", file: `{"config": "other.json"}`},
+		{name: "invalid int", file: `{"batch_size": "lots"}`},
+		{name: "fractional int", file: `{"batch_size": 1.5}`},
+		{name: "invalid bool", file: `{"durable": "maybe"}`},
+		{name: "object value", file: `{"listen": {"port": 443}}`},
+		{name: "null value", file: `{"listen": null}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestConfig(t)
+			if err := applyConfigFile(c.fs, writeConfigFile(t, test.file)); err == nil {
+				t.Errorf("applyConfigFile(%s) succeeded, want error", test.file)
+			}
+		})
+	}
+
+	c := newTestConfig(t)
+	if err := applyConfigFile(c.fs, filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("applyConfigFile of a missing file succeeded, want error")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// corsPolicy allows browsers to read the responses of the read endpoints from pages served by other origins,
+// e.g. browser-based monitors which fetch the checkpoint and tiles.
+// The add and admin endpoints aren't covered by the policy, so browsers on other origins can't read their responses.
+type corsPolicy struct {
+	// any is true if every origin is allowed.
+	any     bool
+	origins map[string]bool
+}
+
+// newCORSPolicy creates a corsPolicy allowing the origins in the comma separated list, which may be "*" to allow
+// any origin, or returns nil if the list is empty.
+func newCORSPolicy(list string) (*corsPolicy, error) {
+	if list == "" {
+		return nil, nil
+	}
+	p := &corsPolicy{origins: make(map[string]bool)}
+	for _, o := range strings.Split(list, ",") {
+		o = strings.TrimSpace(o)
+		switch {
+		case o == "*":
+			p.any = true
+		case strings.HasPrefix(o, "http://") || strings.HasPrefix(o, "https://"):
+			p.origins[strings.TrimSuffix(o, "/")] = true
+		default:
+			return nil, fmt.Errorf("invalid origin %q, must be \"*\" or of the form https://host[:port]", o)
+		}
+	}
+	return p, nil
+}
+
+// setHeaders sets the CORS response headers for a request from the given origin, returning false if the origin
+// isn't allowed.
+func (p *corsPolicy) setHeaders(h http.Header, origin string) bool {
+	if p.any {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return true
+	}
+	// The response depends on the origin, so caches must not serve it to other origins.
+	h.Add("Vary", "Origin")
+	if !p.origins[origin] {
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	return true
+}
+
+// Wrap returns a handler which adds the CORS headers to the response to a request from an allowed origin before
+// calling h. If p is nil, h is returned unchanged.
+func (p *corsPolicy) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	if p == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if p.setHeaders(w.Header(), origin) {
+				w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+			}
+		}
+		h(w, r)
+	}
+}
+
+// handlePreflight responds to CORS preflight requests, which only permit GET and HEAD requests, so that the add
+// and admin endpoints remain unavailable to browsers on other origins.
+func (p *corsPolicy) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && p.setHeaders(w.Header(), origin) {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+		if rh := r.Header.Get("Access-Control-Request-Headers"); rh != "" {
+			w.Header().Set("Access-Control-Allow-Headers", rh)
+		}
+		w.Header().Set("Access-Control-Max-Age", "86400")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewCORSPolicy(t *testing.T) {
+	for _, test := range []struct {
+		list        string
+		wantNil     bool
+		wantAny     bool
+		wantOrigins []string
+		wantErr     bool
+	}{
+		{list: "", wantNil: true},
+		{list: "*", wantAny: true},
+		{list: "https://a.example.com", wantOrigins: []string{"https://a.example.com"}},
+		{list: "https://a.example.com/, http://localhost:8080", wantOrigins: []string{"https://a.example.com", "http://localhost:8080"}},
+		{list: "a.example.com", wantErr: true},
+		{list: "https://a.example.com,", wantErr: true},
+		{list: "ftp://a.example.com", wantErr: true},
+	} {
+		t.Run(test.list, func(t *testing.T) {
+			p, err := newCORSPolicy(test.list)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newCORSPolicy(%q) = %v, want error: %t", test.list, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (p == nil) != test.wantNil {
+				t.Fatalf("newCORSPolicy(%q) = %v, want nil: %t", test.list, p, test.wantNil)
+			}
+			if p == nil {
+				return
+			}
+			if p.any != test.wantAny {
+				t.Errorf("newCORSPolicy(%q) allows any origin: %t, want %t", test.list, p.any, test.wantAny)
+			}
+			if len(p.origins) != len(test.wantOrigins) {
+				t.Errorf("newCORSPolicy(%q) allows %v, want %q", test.list, p.origins, test.wantOrigins)
+			}
+			for _, o := range test.wantOrigins {
+				if !p.origins[o] {
+					t.Errorf("newCORSPolicy(%q) doesn't allow %q", test.list, o)
+				}
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	srv, h := newMemoryTestServer(t)
+	addLeaves(t, h, "one")
+	const allowed = "https://monitor.example.com"
+	for _, test := range []struct {
+		name    string
+		origins string
+		method  string
+		target  string
+		header  http.Header
+		// wantOrigin is the expected Access-Control-Allow-Origin header, and wantMethods the expected
+		// Access-Control-Allow-Methods header.
+		wantOrigin  string
+		wantMethods string
+		wantVary    bool
+	}{
+		{name: "allowed origin", origins: allowed, method: http.MethodGet, target: "/checkpoint", header: http.Header{"Origin": {allowed}}, wantOrigin: allowed, wantVary: true},
+		{name: "one of several", origins: "https://other.example.com, " + allowed, method: http.MethodGet, target: "/checkpoint", header: http.Header{"Origin": {allowed}}, wantOrigin: allowed, wantVary: true},
+		{name: "tile", origins: allowed, method: http.MethodGet, target: "/tile/0/000.p/1", header: http.Header{"Origin": {allowed}}, wantOrigin: allowed, wantVary: true},
+		{name: "disallowed origin", origins: allowed, method: http.MethodGet, target: "/checkpoint", header: http.Header{"Origin": {"https://evil.example.com"}}, wantVary: true},
+		{name: "no origin", origins: allowed, method: http.MethodGet, target: "/checkpoint"},
+		{name: "any origin", origins: "*", method: http.MethodGet, target: "/checkpoint", header: http.Header{"Origin": {"https://evil.example.com"}}, wantOrigin: "*"},
+		{name: "not configured", method: http.MethodGet, target: "/checkpoint", header: http.Header{"Origin": {allowed}}},
+		{name: "add", origins: allowed, method: http.MethodPost, target: "/add", header: http.Header{"Origin": {allowed}}},
+		{name: "add any origin", origins: "*", method: http.MethodPost, target: "/add", header: http.Header{"Origin": {allowed}}},
+		{name: "preflight", origins: allowed, method: http.MethodOptions, target: "/checkpoint", header: http.Header{"Origin": {allowed}, "Access-Control-Request-Method": {"GET"}}, wantOrigin: allowed, wantMethods: "GET, HEAD", wantVary: true},
+		{name: "preflight for add", origins: allowed, method: http.MethodOptions, target: "/add", header: http.Header{"Origin": {allowed}, "Access-Control-Request-Method": {"POST"}}, wantOrigin: allowed, wantMethods: "GET, HEAD", wantVary: true},
+		{name: "preflight from disallowed origin", origins: allowed, method: http.MethodOptions, target: "/checkpoint", header: http.Header{"Origin": {"https://evil.example.com"}, "Access-Control-Request-Method": {"GET"}}, wantVary: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cors, err := newCORSPolicy(test.origins)
+			if err != nil {
+				t.Fatalf("newCORSPolicy: %v", err)
+			}
+			mux := http.NewServeMux()
+			srv.registerHandlers(mux, func(h http.HandlerFunc) http.HandlerFunc { return h }, nil, cors)
+			body := ""
+			if test.method == http.MethodPost {
+				body = "two"
+			}
+			w := do(mux, test.method, test.target, body, test.header)
+			if w.Code >= 300 {
+				t.Fatalf("%s %s: got %d %q", test.method, test.target, w.Code, w.Body)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.wantOrigin {
+				t.Errorf("Got Access-Control-Allow-Origin %q, want %q", got, test.wantOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != test.wantMethods {
+				t.Errorf("Got Access-Control-Allow-Methods %q, want %q", got, test.wantMethods)
+			}
+			if got := w.Header().Get("Vary") == "Origin"; got != test.wantVary {
+				t.Errorf("Got Vary %q, want Origin: %t", w.Header().Get("Vary"), test.wantVary)
+			}
+			if test.wantOrigin != "" && test.method == http.MethodGet {
+				if got := w.Header().Get("Access-Control-Expose-Headers"); got != requestIDHeader {
+					t.Errorf("Got Access-Control-Expose-Headers %q, want %q", got, requestIDHeader)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/AlCutter/betty/log/reader"
+	"golang.org/x/mod/sumdb/note"
+	"k8s.io/klog/v2"
+)
+
+// This file implements a read-only subset of the RFC6962 (https://www.rfc-editor.org/rfc/rfc6962) API on top of
+// a Betty log, so that existing CT monitors can consume it unchanged:
+//
+//   - get-sth serves the latest integrated tree. Betty checkpoints are signed notes, which CT clients can't
+//     verify, so a fresh RFC6962 TreeHeadSignature is produced for each request by signing the tree with the
+//     log's first note signer. Note signers use Ed25519, so the signature is a DigitallySigned struct with
+//     the "intrinsic" hash algorithm (8) and "ed25519" signature algorithm (7) from RFC8422, verifiable with
+//     the Ed25519 public key in the log's note verifier key. The timestamp is the time the STH was signed.
+//   - get-entries serves entries from the entry bundles, each as a leaf_input holding the raw leaf with empty
+//     extra_data. Betty doesn't interpret leaves, so they're only valid MerkleTreeLeafs if that's what was added.
+//   - get-proof-by-hash looks up the leaf index by its RFC6962 leaf hash, which requires storage which indexes
+//     leaves by hash (i.e. --dedup), and serves an inclusion proof from the tiles.
+
+const (
+	// ctVersionV1 and ctTreeHash are the RFC6962 Version and SignatureType for a TreeHeadSignature.
+	ctVersionV1 = 0
+	ctTreeHash  = 1
+	// ctHashIntrinsic and ctSigEd25519 are the RFC8422 DigitallySigned algorithms for an Ed25519 signature.
+	ctHashIntrinsic = 8
+	ctSigEd25519    = 7
+)
+
+// leafIndexer is implemented by storage which can look up leaves by their leaf hash, as computed by the log's hasher.
+type leafIndexer interface {
+	// LeafIndex returns the index assigned to the leaf with the given hash.
+	// If the leaf is not known, the returned error must satisfy errors.Is(err, os.ErrNotExist).
+	LeafIndex(ctx context.Context, hash []byte) (uint64, error)
+}
+
+// ctSTH is the response to get-sth.
+type ctSTH struct {
+	TreeSize          uint64 `json:"tree_size"`
+	Timestamp         uint64 `json:"timestamp"`
+	SHA256RootHash    []byte `json:"sha256_root_hash"`
+	TreeHeadSignature []byte `json:"tree_head_signature"`
+}
+
+// ctLeafEntry is a single entry in the response to get-entries.
+type ctLeafEntry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+// ctEntries is the response to get-entries.
+type ctEntries struct {
+	Entries []ctLeafEntry `json:"entries"`
+}
+
+// ctProof is the response to get-proof-by-hash.
+type ctProof struct {
+	LeafIndex uint64   `json:"leaf_index"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+// handleCTGetSTH serves an RFC6962 signed tree head for the latest integrated tree.
+func (s *server) handleCTGetSTH(w http.ResponseWriter, r *http.Request) {
+	size, root, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	ts := uint64(time.Now().UnixMilli())
+	sig, err := signTreeHead(s.sthSigner, ts, size, root)
+	if err != nil {
+		klog.Errorf("Failed to sign tree head: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	writeJSON(w, ctSTH{TreeSize: size, Timestamp: ts, SHA256RootHash: root, TreeHeadSignature: sig})
+}
+
+// signTreeHead returns the serialised DigitallySigned RFC6962 TreeHeadSignature for the tree.
+func signTreeHead(signer note.Signer, timestamp, size uint64, root []byte) ([]byte, error) {
+	if len(root) != 32 {
+		return nil, fmt.Errorf("root hash has length %d, expected 32", len(root))
+	}
+	th := []byte{ctVersionV1, ctTreeHash}
+	th = binary.BigEndian.AppendUint64(th, timestamp)
+	th = binary.BigEndian.AppendUint64(th, size)
+	th = append(th, root...)
+	sig, err := signer.Sign(th)
+	if err != nil {
+		return nil, err
+	}
+	ds := []byte{ctHashIntrinsic, ctSigEd25519}
+	ds = binary.BigEndian.AppendUint16(ds, uint16(len(sig)))
+	return append(ds, sig...), nil
+}
+
+// handleCTGetEntries serves the entries in the inclusive range [start, end].
+// As with CT logs, fewer entries than requested may be returned.
+func (s *server) handleCTGetEntries(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseUint(r.URL.Query().Get("start"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid start: %v", err)
+		return
+	}
+	end, err := strconv.ParseUint(r.URL.Query().Get("end"), 10, 64)
+	if err != nil || end < start {
+		writeError(w, http.StatusBadRequest, "Invalid end: must be an integer >= start")
+		return
+	}
+	cpSize, _, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if start >= cpSize {
+		writeError(w, http.StatusBadRequest, "Start %d must be < %d", start, cpSize)
+		return
+	}
+	count := min(s.capEntries(end-start+1), cpSize-start)
+
+	es, err := reader.GetVerifiedEntries(r.Context(), s.params, cpSize, start, count, s.storage, s.storage)
+	if err != nil {
+		klog.Errorf("GetVerifiedEntries(%d, %d): %v", start, count, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	resp := ctEntries{Entries: make([]ctLeafEntry, 0, len(es))}
+	for _, e := range es {
+		resp.Entries = append(resp.Entries, ctLeafEntry{LeafInput: e, ExtraData: []byte{}})
+	}
+	writeJSON(w, resp)
+}
+
+// handleCTGetProofByHash serves an inclusion proof for the leaf with the given RFC6962 leaf hash.
+func (s *server) handleCTGetProofByHash(w http.ResponseWriter, r *http.Request) {
+	li, ok := s.storage.(leafIndexer)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Looking up leaves by hash is not supported by this log")
+		return
+	}
+	hash, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("hash"))
+	if err != nil || len(hash) != 32 {
+		writeError(w, http.StatusBadRequest, "Invalid hash: must be a base64 encoded SHA-256 leaf hash")
+		return
+	}
+	size, err := strconv.ParseUint(r.URL.Query().Get("tree_size"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid tree_size: %v", err)
+		return
+	}
+	cpSize, _, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if size == 0 || size > cpSize {
+		writeError(w, http.StatusBadRequest, "Tree size %d must be between 1 and %d", size, cpSize)
+		return
+	}
+	index, err := li.LeafIndex(r.Context(), hash)
+	if errors.Is(err, os.ErrNotExist) || err == nil && index >= size {
+		writeError(w, http.StatusNotFound, "Leaf not found in tree of size %d", size)
+		return
+	}
+	if err != nil {
+		klog.Errorf("LeafIndex(%x): %v", hash, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+
+	pb, err := reader.NewProofBuilder(r.Context(), s.params, size, s.params.Hasher().HashChildren, s.storage)
+	if err != nil {
+		klog.Errorf("NewProofBuilder(%d): %v", size, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	p, err := pb.InclusionProof(r.Context(), index)
+	if err != nil {
+		klog.Errorf("InclusionProof(%d, %d): %v", index, size, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if p == nil {
+		p = [][]byte{}
+	}
+	writeJSON(w, ctProof{LeafIndex: index, AuditPath: p})
+}
+
+// writeJSON writes v to the response as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+)
+
+// newCTTestServer creates a server for a POSIX log with --dedup and the CT shim enabled, containing n leaves.
+func newCTTestServer(t *testing.T, n int) (*server, http.Handler, []string) {
+	t.Helper()
+	setFlag(t, ctShim, true)
+	setFlag(t, dedup, true)
+	setFlag(t, path, t.TempDir())
+	srv, h := newTestServer(t, testParams())
+	leaves := make([]string, n)
+	for i := range leaves {
+		leaves[i] = fmt.Sprintf("leaf %d", i)
+	}
+	addBatches(t, h, leaves...)
+	return srv, h, leaves
+}
+
+// ctPublicKey returns the Ed25519 public key from the default --log_verifier.
+func ctPublicKey(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+	parts := strings.Split(*verifier, "+")
+	k, err := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+	if err != nil || len(k) != 1+ed25519.PublicKeySize || k[0] != 1 {
+		t.Fatalf("Invalid verifier key %q", *verifier)
+	}
+	return k[1:]
+}
+
+func TestCTGetSTH(t *testing.T) {
+	_, h, leaves := newCTTestServer(t, 10)
+	w := do(h, http.MethodGet, "/ct/v1/get-sth", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /ct/v1/get-sth: got %d %q, want 200", w.Code, w.Body)
+	}
+	var sth ctSTH
+	if err := json.Unmarshal(w.Body.Bytes(), &sth); err != nil {
+		t.Fatalf("Failed to parse STH: %v", err)
+	}
+	if sth.TreeSize != uint64(len(leaves)) {
+		t.Errorf("tree_size: got %d, want %d", sth.TreeSize, len(leaves))
+	}
+	cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+	if !bytes.Equal(sth.SHA256RootHash, cp.Hash) {
+		t.Errorf("sha256_root_hash: got %x, want checkpoint root %x", sth.SHA256RootHash, cp.Hash)
+	}
+
+	ds := sth.TreeHeadSignature
+	if len(ds) < 4 || ds[0] != ctHashIntrinsic || ds[1] != ctSigEd25519 || int(binary.BigEndian.Uint16(ds[2:])) != len(ds)-4 {
+		t.Fatalf("tree_head_signature %x isn't a DigitallySigned Ed25519 signature", ds)
+	}
+	th := []byte{ctVersionV1, ctTreeHash}
+	th = binary.BigEndian.AppendUint64(th, sth.Timestamp)
+	th = binary.BigEndian.AppendUint64(th, sth.TreeSize)
+	th = append(th, sth.SHA256RootHash...)
+	if !ed25519.Verify(ctPublicKey(t), th, ds[4:]) {
+		t.Error("tree_head_signature doesn't verify with the log's verifier key")
+	}
+}
+
+func TestCTGetEntries(t *testing.T) {
+	_, h, leaves := newCTTestServer(t, 10)
+	for _, test := range []struct {
+		query    string
+		wantCode int
+		want     []string
+	}{
+		{query: "start=0&end=0", wantCode: http.StatusOK, want: leaves[:1]},
+		{query: "start=2&end=7", wantCode: http.StatusOK, want: leaves[2:8]},
+		{query: "start=8&end=20", wantCode: http.StatusOK, want: leaves[8:]},
+		{query: "start=10&end=10", wantCode: http.StatusBadRequest},
+		{query: "start=5&end=4", wantCode: http.StatusBadRequest},
+		{query: "start=x&end=4", wantCode: http.StatusBadRequest},
+		{query: "start=0", wantCode: http.StatusBadRequest},
+	} {
+		t.Run(test.query, func(t *testing.T) {
+			w := do(h, http.MethodGet, "/ct/v1/get-entries?"+test.query, "", nil)
+			if w.Code != test.wantCode {
+				t.Fatalf("GET /ct/v1/get-entries: got %d %q, want %d", w.Code, w.Body, test.wantCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp ctEntries
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Failed to parse entries: %v", err)
+			}
+			var got []string
+			for _, e := range resp.Entries {
+				if len(e.ExtraData) != 0 {
+					t.Errorf("extra_data: got %x, want empty", e.ExtraData)
+				}
+				got = append(got, string(e.LeafInput))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("Got entries %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCTGetProofByHash(t *testing.T) {
+	_, h, leaves := newCTTestServer(t, 10)
+	root := func(size int) []byte {
+		var sth ctSTH
+		w := do(h, http.MethodGet, "/ct/v1/get-sth", "", nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &sth); err != nil {
+			t.Fatalf("Failed to parse STH: %v", err)
+		}
+		if sth.TreeSize != uint64(size) {
+			t.Fatalf("Got tree size %d, want %d", sth.TreeSize, size)
+		}
+		return sth.SHA256RootHash
+	}(len(leaves))
+	leafHash := func(l string) string {
+		return url.QueryEscape(base64.StdEncoding.EncodeToString(rfc6962.DefaultHasher.HashLeaf([]byte(l))))
+	}
+	unknown := sha256.Sum256([]byte("unknown"))
+
+	for _, test := range []struct {
+		name     string
+		query    string
+		wantCode int
+		// wantIndex is the index of the leaf proven to be in the tree of size 10.
+		wantIndex uint64
+	}{
+		{name: "first", query: "hash=" + leafHash(leaves[0]) + "&tree_size=10", wantCode: http.StatusOK, wantIndex: 0},
+		{name: "middle", query: "hash=" + leafHash(leaves[6]) + "&tree_size=10", wantCode: http.StatusOK, wantIndex: 6},
+		{name: "last", query: "hash=" + leafHash(leaves[9]) + "&tree_size=10", wantCode: http.StatusOK, wantIndex: 9},
+		{name: "leaf beyond tree size", query: "hash=" + leafHash(leaves[9]) + "&tree_size=9", wantCode: http.StatusNotFound},
+		{name: "unknown leaf", query: "hash=" + url.QueryEscape(base64.StdEncoding.EncodeToString(unknown[:])) + "&tree_size=10", wantCode: http.StatusNotFound},
+		{name: "tree size too big", query: "hash=" + leafHash(leaves[0]) + "&tree_size=11", wantCode: http.StatusBadRequest},
+		{name: "zero tree size", query: "hash=" + leafHash(leaves[0]) + "&tree_size=0", wantCode: http.StatusBadRequest},
+		{name: "short hash", query: "hash=AAAA&tree_size=10", wantCode: http.StatusBadRequest},
+		{name: "missing tree size", query: "hash=" + leafHash(leaves[0]), wantCode: http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := do(h, http.MethodGet, "/ct/v1/get-proof-by-hash?"+test.query, "", nil)
+			if w.Code != test.wantCode {
+				t.Fatalf("GET /ct/v1/get-proof-by-hash: got %d %q, want %d", w.Code, w.Body, test.wantCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var p ctProof
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatalf("Failed to parse proof: %v", err)
+			}
+			if p.LeafIndex != test.wantIndex {
+				t.Errorf("leaf_index: got %d, want %d", p.LeafIndex, test.wantIndex)
+			}
+			lh := rfc6962.DefaultHasher.HashLeaf([]byte(leaves[test.wantIndex]))
+			if err := proof.VerifyInclusion(rfc6962.DefaultHasher, p.LeafIndex, uint64(len(leaves)), lh, p.AuditPath, root); err != nil {
+				t.Errorf("VerifyInclusion: %v", err)
+			}
+		})
+	}
+}
+
+func TestCTGetProofByHashUnsupported(t *testing.T) {
+	setFlag(t, ctShim, true)
+	_, h := newMemoryTestServer(t)
+	addLeaves(t, h, "one")
+	hash := url.QueryEscape(base64.StdEncoding.EncodeToString(rfc6962.DefaultHasher.HashLeaf([]byte("one"))))
+	if w := do(h, http.MethodGet, "/ct/v1/get-proof-by-hash?tree_size=1&hash="+hash, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /ct/v1/get-proof-by-hash without --dedup: got %d %q, want 404", w.Code, w.Body)
+	}
+}
+
+func TestCTShimDisabled(t *testing.T) {
+	_, h := newMemoryTestServer(t)
+	if w := do(h, http.MethodGet, "/ct/v1/get-sth", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /ct/v1/get-sth without --ct_shim: got %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// drainPollInterval is how often handleAdminDrain checks whether the add requests in flight have completed.
+const drainPollInterval = 100 * time.Millisecond
+
+// drainer refuses new add requests once the log starts draining, while those already in flight complete, so that
+// the instance can be removed from service without losing entries.
+type drainer struct {
+	draining atomic.Bool
+	// active is the number of add requests being handled.
+	active atomic.Int64
+}
+
+// Wrap returns a handler which calls h unless the log is draining, in which case it responds with
+// 503 Service Unavailable and a Retry-After header, so that the client retries against another instance.
+func (d *drainer) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The request is counted before the flag is checked, so that a drain which starts concurrently is sure
+		// to wait for it if it isn't refused.
+		d.active.Add(1)
+		defer d.active.Add(-1)
+		if d.draining.Load() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "Log is draining")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleAdminDrain stops the log accepting new entries, and waits for the add requests in flight to complete,
+// flushing their entries rather than waiting for their batches to fill. Once the log is quiesced, it serves the
+// size and root hash of the resulting tree as JSON.
+// Draining can't be undone, the process is expected to be restarted once it has been removed from service.
+func (s *server) handleAdminDrain(w http.ResponseWriter, r *http.Request) {
+	if !s.drain.draining.Swap(true) {
+		klog.Infof("Draining log served at %s/", s.pathPrefix)
+	}
+	f, _ := s.storage.(flusher)
+	for {
+		// Requests being refused by Wrap are also counted, but only briefly.
+		n := s.drain.active.Load()
+		if n == 0 {
+			break
+		}
+		if f != nil {
+			if err := f.Flush(r.Context()); err != nil {
+				klog.Warningf("Flush while draining: %v", err)
+			}
+		}
+		select {
+		case <-r.Context().Done():
+			writeError(w, http.StatusServiceUnavailable, "Timed out waiting for %d add requests to complete", n)
+			return
+		case <-time.After(drainPollInterval):
+		}
+	}
+	size, root, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	klog.Infof("Drained log served at %s/, its size is %d", s.pathPrefix, size)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(treeSize{Size: size, Root: root}); err != nil {
+		klog.Errorf("Failed to write size: %v", err)
+	}
+}
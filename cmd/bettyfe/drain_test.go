@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrainerWrap(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		draining   bool
+		wantCalled bool
+		wantCode   int
+	}{
+		{name: "serving", wantCalled: true, wantCode: http.StatusCreated},
+		{name: "draining", draining: true, wantCode: http.StatusServiceUnavailable},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d := &drainer{}
+			d.draining.Store(test.draining)
+			called := false
+			h := d.Wrap(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				if n := d.active.Load(); n != 1 {
+					t.Errorf("Got %d active requests while handling one", n)
+				}
+				w.WriteHeader(http.StatusCreated)
+			})
+			w := do(h, http.MethodPost, "/add", "leaf", nil)
+			if called != test.wantCalled || w.Code != test.wantCode {
+				t.Errorf("Got handler called: %t, status %d, want %t, %d", called, w.Code, test.wantCalled, test.wantCode)
+			}
+			if got, want := w.Header().Get("Retry-After") != "", test.draining; got != want {
+				t.Errorf("Got Retry-After %q, want set: %t", w.Header().Get("Retry-After"), want)
+			}
+			if n := d.active.Load(); n != 0 {
+				t.Errorf("Got %d active requests once handled, want 0", n)
+			}
+		})
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	// Pending entries would otherwise wait for a full batch or an hour, so are only integrated by the drain.
+	setFlag(t, batchSize, 100)
+	setFlag(t, batchMaxAge, time.Hour)
+	var srv *server
+	h := newAdminTestServer(t, func(t *testing.T) (*server, http.Handler) {
+		s, h := newPOSIXTestServer(t)
+		srv = s
+		return s, h
+	})
+
+	// Adds in flight when the drain starts complete.
+	leaves := []string{"one", "two", "three"}
+	var wg sync.WaitGroup
+	codes := make([]int, len(leaves))
+	for i, l := range leaves {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = do(h, http.MethodPost, "/add", l, nil).Code
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); srv.drain.active.Load() < int64(len(leaves)); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Adds didn't start")
+		}
+	}
+	w := do(h, http.MethodPost, "/admin/drain", "", adminAuth)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /admin/drain: got %d %q, want 200", w.Code, w.Body)
+	}
+	var size treeSize
+	if err := json.Unmarshal(w.Body.Bytes(), &size); err != nil {
+		t.Fatalf("Failed to parse drain response %q: %v", w.Body, err)
+	}
+	if size.Size != uint64(len(leaves)) {
+		t.Errorf("Drained log has size %d, want %d", size.Size, len(leaves))
+	}
+	wg.Wait()
+	for i, c := range codes {
+		if c != http.StatusCreated {
+			t.Errorf("POST /add of %q in flight during drain: got %d, want 201", leaves[i], c)
+		}
+	}
+
+	// New adds are refused, so that clients retry against another instance.
+	for _, test := range []struct {
+		target, body string
+	}{
+		{target: "/add", body: "four"},
+		{target: "/add-batch", body: "Zm91cg==\n"},
+		{target: "/add-stream", body: string(streamBody([]byte("four")))},
+	} {
+		w := do(h, http.MethodPost, test.target, test.body, nil)
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Errorf("POST %s while drained: got %d with Retry-After %q, want 503 with Retry-After", test.target, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+	// The instance reports that it's not ready, so that it's removed from service, but still serves reads.
+	if w := do(h, http.MethodGet, "/readyz", "", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz while drained: got %d, want 503", w.Code)
+	}
+	if cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes()); cp.Size != uint64(len(leaves)) {
+		t.Errorf("Got checkpoint of size %d, want %d", cp.Size, len(leaves))
+	}
+	// Draining again reports the same tree.
+	w = do(h, http.MethodPost, "/admin/drain", "", adminAuth)
+	if err := json.Unmarshal(w.Body.Bytes(), &size); w.Code != http.StatusOK || err != nil || size.Size != uint64(len(leaves)) {
+		t.Errorf("POST /admin/drain again: got %d %q, want size %d", w.Code, w.Body, len(leaves))
+	}
+}
+
+func TestAdminDrainTimeout(t *testing.T) {
+	var srv *server
+	h := newAdminTestServer(t, func(t *testing.T) (*server, http.Handler) {
+		s, h := newPOSIXTestServer(t)
+		srv = s
+		return s, h
+	})
+	bs := &blockingStorage{Storage: srv.storage, release: make(chan struct{})}
+	srv.storage = bs
+	added := make(chan int)
+	go func() { added <- do(h, http.MethodPost, "/add", "stuck", nil).Code }()
+	for deadline := time.Now().Add(5 * time.Second); srv.drain.active.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Add didn't start")
+		}
+	}
+
+	// The drain gives up once its request is done, while the add is still in flight.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*drainPollInterval)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodPost, "/admin/drain", nil).WithContext(ctx)
+	r.Header = adminAuth.Clone()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "Timed out waiting for 1 add requests") {
+		t.Errorf("POST /admin/drain: got %d %q, want 503 timing out", w.Code, w.Body)
+	}
+	close(bs.release)
+	if c := <-added; c != http.StatusCreated {
+		t.Errorf("POST /add: got %d, want 201", c)
+	}
+}
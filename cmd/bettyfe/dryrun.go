@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"k8s.io/klog/v2"
+)
+
+// dryRunHeader is set on the responses to dry-run add requests, so that they can't be mistaken for real ones.
+const dryRunHeader = "Dry-Run"
+
+// isDryRun returns true if the add request asks, with ?dry_run=1, for the leaf to be checked without being added.
+func isDryRun(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("dry_run")
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// writeDryRun responds to a dry-run add request for the leaf, which has already been validated, with the index it
+// would be assigned if it were added now, without sequencing it.
+//
+// The index is a prediction rather than a reservation: entries added concurrently, or still waiting to be flushed,
+// will be sequenced ahead of a subsequent real add of the leaf.
+func (s *server) writeDryRun(ctx context.Context, w http.ResponseWriter, leaf []byte) {
+	idx, dupe, err := s.predictIndex(ctx, leaf)
+	if err != nil {
+		klog.Errorf("predictIndex: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set(dryRunHeader, "true")
+	if dupe {
+		w.Header().Set("X-Leaf-Duplicate", "true")
+	}
+	// Nothing was created, so unlike a real add there's neither 201 Created nor a Location.
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("%d\n", idx)))
+}
+
+// predictIndex returns the index which the leaf would be assigned if it were added now, and whether that's because
+// an identical leaf is already in the log.
+func (s *server) predictIndex(ctx context.Context, leaf []byte) (uint64, bool, error) {
+	// With --dedup, a leaf already in the log would be given its existing index.
+	if li, ok := s.storage.(leafIndexer); ok {
+		idx, err := li.LeafIndex(ctx, s.params.Hasher().HashLeaf(leaf))
+		if err == nil {
+			return idx, true, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return 0, false, err
+		}
+	}
+	size, _, err := s.curTree()
+	if err != nil {
+		return 0, false, err
+	}
+	// Entries may have been sequenced beyond the latest checkpoint.
+	if ss, ok := s.storage.(sequencedSizer); ok {
+		size = max(size, ss.SequencedSize())
+	}
+	return size, false, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// getSize returns the size of the tree served by h.
+func getSize(t *testing.T, h http.Handler) uint64 {
+	t.Helper()
+	w := do(h, http.MethodGet, "/size", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /size: got %d %q, want 200", w.Code, w.Body)
+	}
+	var ts treeSize
+	if err := json.Unmarshal(w.Body.Bytes(), &ts); err != nil {
+		t.Fatalf("Invalid /size response: %v", err)
+	}
+	return ts.Size
+}
+
+func TestDryRun(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		newServer func(*testing.T) (*server, http.Handler)
+		dedup     bool
+		// hash, if set, is the log's tree hash, with which leaves are looked up in the leaf index.
+		hash string
+	}{
+		{name: "memory", newServer: newMemoryTestServer},
+		{name: "POSIX", newServer: newPOSIXTestServer},
+		{name: "POSIX with dedup", newServer: newPOSIXTestServer, dedup: true},
+		{name: "POSIX with dedup and SHA-512", newServer: newPOSIXTestServer, dedup: true, hash: "SHA-512"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, dedup, test.dedup)
+			if test.hash != "" {
+				setFlag(t, treeHash, test.hash)
+			}
+			setFlag(t, leafValidators, "non-empty")
+			_, h := test.newServer(t)
+			addLeaves(t, h, "one", "two")
+			// With --dedup, a leaf already in the log would be given its existing index.
+			existing := "2\n"
+			if test.dedup {
+				existing = "0\n"
+			}
+			for _, dr := range []struct {
+				name, target, body string
+				wantCode           int
+				wantIndex          string
+				wantDupe           bool
+			}{
+				{name: "new leaf", target: "/add?dry_run=1", body: "three", wantCode: http.StatusOK, wantIndex: "2\n"},
+				{name: "repeated", target: "/add?dry_run=true", body: "three", wantCode: http.StatusOK, wantIndex: "2\n"},
+				{name: "existing leaf", target: "/add?dry_run=1", body: "one", wantCode: http.StatusOK, wantIndex: existing, wantDupe: test.dedup},
+				{name: "invalid leaf", target: "/add?dry_run=1", body: "", wantCode: http.StatusBadRequest},
+				{name: "invalid dry_run", target: "/add?dry_run=maybe", body: "three", wantCode: http.StatusBadRequest},
+			} {
+				t.Run(dr.name, func(t *testing.T) {
+					w := do(h, http.MethodPost, dr.target, dr.body, nil)
+					if w.Code != dr.wantCode {
+						t.Fatalf("POST %s: got %d %q, want %d", dr.target, w.Code, w.Body, dr.wantCode)
+					}
+					if dr.wantCode != http.StatusOK {
+						return
+					}
+					if got := w.Body.String(); got != dr.wantIndex {
+						t.Errorf("POST %s: got index %q, want %q", dr.target, got, dr.wantIndex)
+					}
+					if got := w.Header().Get(dryRunHeader); got != "true" {
+						t.Errorf("Got %s header %q, want true", dryRunHeader, got)
+					}
+					if got := w.Header().Get("X-Leaf-Duplicate") == "true"; got != dr.wantDupe {
+						t.Errorf("Got duplicate %t, want %t", got, dr.wantDupe)
+					}
+					if loc := w.Header().Get("Location"); loc != "" {
+						t.Errorf("Got Location %q for a leaf which wasn't added", loc)
+					}
+				})
+			}
+			// None of the dry runs added anything...
+			if got := getSize(t, h); got != 2 {
+				t.Errorf("Got tree of size %d after dry runs, want 2", got)
+			}
+			// ... so the leaf is given the predicted index when it's actually added.
+			w := do(h, http.MethodPost, "/add?dry_run=0", "three", nil)
+			if w.Code != http.StatusCreated || w.Body.String() != "2\n" {
+				t.Errorf("POST /add?dry_run=0: got %d %q, want 201 with index 2", w.Code, w.Body)
+			}
+			if got := getSize(t, h); got != 3 {
+				t.Errorf("Got tree of size %d after adding, want 3", got)
+			}
+		})
+	}
+}
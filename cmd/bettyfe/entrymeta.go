@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"k8s.io/klog/v2"
+)
+
+// entryMetaHeader is the header of an add request carrying the base64 encoded metadata to be stored alongside the
+// entry, e.g. a signed timestamp and the submitter's ID. Unlike the entry, the metadata isn't committed to by the
+// tree, so it doesn't affect the leaf hash.
+const entryMetaHeader = "Entry-Metadata"
+
+// entryMetaStore is implemented by storage which can store metadata alongside entries.
+type entryMetaStore interface {
+	// WriteEntryMeta stores metadata alongside the entry at the given index.
+	WriteEntryMeta(ctx context.Context, index uint64, meta []byte) error
+	// ReadEntryMeta returns the metadata stored alongside the entry at the given index.
+	// If none was stored, the returned error will satisfy errors.Is(err, os.ErrNotExist).
+	ReadEntryMeta(ctx context.Context, index uint64) ([]byte, error)
+}
+
+// entryMetaFromRequest returns the metadata carried by an add request, or nil if it has none.
+func (s *server) entryMetaFromRequest(r *http.Request) ([]byte, error) {
+	h := r.Header.Get(entryMetaHeader)
+	if h == "" {
+		return nil, nil
+	}
+	if s.maxEntryMetaSize == 0 {
+		return nil, errors.New("entry metadata is not accepted by this log")
+	}
+	meta, err := base64.StdEncoding.DecodeString(h)
+	if err != nil {
+		return nil, fmt.Errorf("must be base64 encoded: %v", err)
+	}
+	if len(meta) > s.maxEntryMetaSize {
+		return nil, fmt.Errorf("metadata of %d bytes exceeds max size of %d bytes", len(meta), s.maxEntryMetaSize)
+	}
+	return meta, nil
+}
+
+// handleEntryMeta serves the metadata stored alongside the entry at the requested index.
+func (s *server) handleEntryMeta(w http.ResponseWriter, r *http.Request) {
+	ms, ok := s.storage.(entryMetaStore)
+	if !ok || s.maxEntryMetaSize == 0 {
+		writeError(w, http.StatusNotFound, "Entry metadata is not supported by this log")
+		return
+	}
+	index, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid index: %v", err)
+		return
+	}
+	cpSize, _, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if index >= cpSize {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	meta, err := ms.ReadEntryMeta(r.Context(), index)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "No metadata was stored for entry %d", index)
+			return
+		}
+		klog.Errorf("ReadEntryMeta(%d): %v", index, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(meta)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metaHeader returns the header of an add request carrying meta.
+func metaHeader(meta string) http.Header {
+	return http.Header{entryMetaHeader: {base64.StdEncoding.EncodeToString([]byte(meta))}}
+}
+
+func TestEntryMeta(t *testing.T) {
+	setFlag(t, entryMetaSize, 8)
+	srv, h := newPOSIXTestServer(t)
+	srv.idempotency = newTestIdempotencyStore(t, filepath.Join(t.TempDir(), "keys"), time.Hour)
+	for _, test := range []struct {
+		name, body string
+		header     http.Header
+		wantCode   int
+		wantErr    string
+	}{
+		{name: "with metadata", body: "one", header: metaHeader("ts=1"), wantCode: http.StatusCreated},
+		{name: "without metadata", body: "two", wantCode: http.StatusCreated},
+		{name: "max size", body: "three", header: metaHeader("12345678"), wantCode: http.StatusCreated},
+		{name: "too large", body: "four", header: metaHeader("123456789"), wantCode: http.StatusBadRequest, wantErr: "Invalid Entry-Metadata header: metadata of 9 bytes exceeds max size of 8 bytes"},
+		{name: "not base64", body: "four", header: http.Header{entryMetaHeader: {"!!"}}, wantCode: http.StatusBadRequest, wantErr: "Invalid Entry-Metadata header: must be base64 encoded"},
+		{name: "first with key", body: "four", header: http.Header{entryMetaHeader: {base64.StdEncoding.EncodeToString([]byte("ts=4"))}, "Idempotency-Key": {"k"}}, wantCode: http.StatusCreated},
+		{name: "replayed", body: "four", header: http.Header{entryMetaHeader: {base64.StdEncoding.EncodeToString([]byte("ts=5"))}, "Idempotency-Key": {"k"}}, wantCode: http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := do(h, http.MethodPost, "/add", test.body, test.header)
+			if w.Code != test.wantCode {
+				t.Fatalf("POST /add: got %d %q, want %d", w.Code, w.Body, test.wantCode)
+			}
+			if test.wantErr != "" {
+				if e := parseError(t, w); !strings.HasPrefix(e.Error, test.wantErr) {
+					t.Errorf("POST /add: got error %q, want %q", e.Error, test.wantErr)
+				}
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		name, target string
+		wantCode     int
+		want         string
+	}{
+		{name: "stored", target: "/entry-meta?index=0", wantCode: http.StatusOK, want: "ts=1"},
+		{name: "max size", target: "/entry-meta?index=2", wantCode: http.StatusOK, want: "12345678"},
+		// The metadata sent with a replayed request is ignored.
+		{name: "replayed", target: "/entry-meta?index=3", wantCode: http.StatusOK, want: "ts=4"},
+		{name: "none stored", target: "/entry-meta?index=1", wantCode: http.StatusNotFound},
+		{name: "beyond tree", target: "/entry-meta?index=4", wantCode: http.StatusNotFound},
+		{name: "invalid index", target: "/entry-meta?index=x", wantCode: http.StatusBadRequest},
+		{name: "no index", target: "/entry-meta", wantCode: http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := do(h, http.MethodGet, test.target, "", nil)
+			if w.Code != test.wantCode {
+				t.Fatalf("GET %s: got %d %q, want %d", test.target, w.Code, w.Body, test.wantCode)
+			}
+			if test.wantCode == http.StatusOK && w.Body.String() != test.want {
+				t.Errorf("GET %s: got %q, want %q", test.target, w.Body, test.want)
+			}
+		})
+	}
+
+	// The tree commits only to the entries, so is the same as that of a log without metadata.
+	setFlag(t, entryMetaSize, 0)
+	_, ref := newMemoryTestServer(t)
+	addLeaves(t, ref, "one", "two", "three", "four")
+	got := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+	want := parseCheckpoint(t, do(ref, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+	if got.Size != want.Size || !bytes.Equal(got.Hash, want.Hash) {
+		t.Errorf("Got tree of size %d with root %x, want size %d with root %x", got.Size, got.Hash, want.Size, want.Hash)
+	}
+}
+
+func TestEntryMetaDisabled(t *testing.T) {
+	_, h := newPOSIXTestServer(t)
+	w := do(h, http.MethodPost, "/add", "one", metaHeader("ts=1"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("POST /add with metadata: got %d %q, want 400", w.Code, w.Body)
+	}
+	if e := parseError(t, w); !strings.Contains(e.Error, "not accepted by this log") {
+		t.Errorf("POST /add with metadata: got error %q", e.Error)
+	}
+	if w := do(h, http.MethodGet, "/entry-meta?index=0", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /entry-meta: got %d %q, want 404", w.Code, w.Body)
+	}
+}
+
+func TestEntryMetaUnsupportedStorage(t *testing.T) {
+	setFlag(t, entryMetaSize, 8)
+	sKeys, vKeys, err := parseKeys(*signer, *verifier)
+	if err != nil {
+		t.Fatalf("parseKeys: %v", err)
+	}
+	if _, err := newLogServer(context.Background(), "test", &url.URL{Scheme: "memory"}, testParams(), sKeys, vKeys, nil); err == nil || !strings.Contains(err.Error(), "--entry_metadata_max_size") {
+		t.Errorf("newLogServer with in memory storage = %v, want an error about --entry_metadata_max_size", err)
+	}
+}
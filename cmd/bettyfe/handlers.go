@@ -0,0 +1,881 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
+	"github.com/AlCutter/betty/log/writer"
+	f_log "github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/serverless-log/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/mod/sumdb/note"
+	"k8s.io/klog/v2"
+)
+
+var tracer = otel.Tracer("github.com/AlCutter/betty/cmd/bettyfe")
+
+// immutableCacheControl is the Cache-Control header for resources whose contents never change, such as tiles
+// and entry bundles.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+const (
+	// bodyBufferSize is the initial capacity of the pooled buffers into which add request bodies are read, which
+	// should fit a typical leaf.
+	bodyBufferSize = 4 << 10
+	// maxPooledBodyBufferSize is the capacity beyond which a buffer isn't returned to the pool, so that a few
+	// large leaves can't pin lots of memory.
+	maxPooledBodyBufferSize = 1 << 20
+)
+
+// bodyBufferPool holds the buffers into which add request bodies are read, so that each request needn't grow one
+// from scratch.
+var bodyBufferPool = sync.Pool{
+	New: func() any { return bytes.NewBuffer(make([]byte, 0, bodyBufferSize)) },
+}
+
+// readBody reads all of r via a pooled buffer, returning a copy of exactly the size read, which the caller may
+// retain.
+func readBody(r io.Reader) ([]byte, error) {
+	buf := bodyBufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBodyBufferSize {
+			buf.Reset()
+			bodyBufferPool.Put(buf)
+		}
+	}()
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// server holds the state needed by the HTTP handlers.
+type server struct {
+	// name identifies the log when several are hosted by this process, and is empty otherwise.
+	name string
+	// pathPrefix is the URL path under which the log's endpoints are served, and is empty if they're served
+	// at the root.
+	pathPrefix string
+	storage    Storage
+	// checkpoint holds the log's latest checkpoint, which is served from it rather than read from storage.
+	checkpoint *checkpointCache
+	params     log.Params
+	curTree    writer.CurrentTreeFunc
+	latency    *latency
+
+	// integration tracks whether entries added via this server are being integrated.
+	integration *integrationTracker
+	// maxStaleness is how long entries may wait for integration before handleReadyz reports that the server
+	// is not ready, zero disables this check.
+	maxStaleness time.Duration
+	// drain refuses new add requests once the log is draining.
+	drain *drainer
+
+	// idempotency, if set, remembers the indices assigned to entries added with an Idempotency-Key header.
+	idempotency *idempotencyStore
+
+	// maxEntries is the largest number of entries which will be returned by a single request to handleEntries,
+	// or zero if there's no limit.
+	maxEntries uint64
+	// maxEntrySize is the largest entry, in bytes, which will be accepted for sequencing, zero means no limit.
+	maxEntrySize int64
+	// maxBatchEntries is the largest number of entries which will be accepted by a single request to
+	// handleAddBatch, zero means no limit.
+	maxBatchEntries int
+	// maxEntryMetaSize is the largest metadata, in bytes, which may be stored alongside an entry added with
+	// handleAdd, zero means that entry metadata isn't accepted.
+	maxEntryMetaSize int
+	// leafValidator, if set, checks each entry before it's sequenced.
+	leafValidator leafValidator
+	// streamWindow is the max number of leaves from each /add-stream request which are sequenced concurrently.
+	streamWindow int
+	// bundleDir, if set, is the directory of the log's POSIX storage, from which entry bundles are served directly.
+	bundleDir string
+
+	// sthSigner signs the tree heads served by the RFC6962 get-sth endpoint.
+	sthSigner note.Signer
+	// signers are the log's signers, which sign the promises returned by handleAdd.
+	signers []note.Signer
+}
+
+// handleAdd sequences a single leaf, returning its assigned index.
+func (s *server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	n := time.Now()
+	defer func() { s.latency.Add(time.Since(n)) }()
+	ctx, span := startSpan(r, "bettyfe.handleAdd")
+	defer span.End()
+
+	if s.maxEntrySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxEntrySize)
+	}
+	b, err := readBody(r.Body)
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			writeError(w, http.StatusRequestEntityTooLarge, "Entry exceeds max size of %d bytes", mbe.Limit)
+			return
+		}
+		writeError(w, http.StatusBadRequest, "Failed to read request body: %v", err)
+		return
+	}
+	defer r.Body.Close()
+	if err := s.validateLeaf(b); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid entry: %v", err)
+		return
+	}
+	meta, err := s.entryMetaFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid %s header: %v", entryMetaHeader, err)
+		return
+	}
+	if dry, err := isDryRun(r); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid dry_run: %v", err)
+		return
+	} else if dry {
+		s.writeDryRun(ctx, w, b)
+		return
+	}
+	dupe := false
+	sequence := func() (uint64, error) {
+		done := s.integration.start()
+		idx, err := s.storage.Sequence(ctx, b)
+		done(err)
+		// A duplicate leaf has already been sequenced, so we can just return its index.
+		if errors.Is(err, writer.ErrDupeLeaf) {
+			dupe, err = true, nil
+		}
+		return idx, err
+	}
+	var (
+		idx      uint64
+		replayed bool
+	)
+	if key := r.Header.Get("Idempotency-Key"); key != "" && s.idempotency != nil {
+		idx, replayed, err = s.idempotency.Do(key, sequence)
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+	} else {
+		idx, err = sequence()
+	}
+	if errors.Is(err, writer.ErrEntryTooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "%v", err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to sequence entry: %v", err)
+		return
+	}
+	// Only a newly appended leaf was created by this request, the response to a duplicate leaf or a replayed
+	// request refers to the leaf as it already existed.
+	status := http.StatusCreated
+	if dupe {
+		// Let clients distinguish an identical leaf already in the log from a newly appended one.
+		w.Header().Set("X-Leaf-Duplicate", "true")
+		status = http.StatusOK
+	}
+	if replayed {
+		status = http.StatusOK
+	}
+	// The metadata of a leaf already in the log is left as it was stored when the leaf was appended.
+	if meta != nil && status == http.StatusCreated {
+		if err := s.storage.(entryMetaStore).WriteEntryMeta(ctx, idx, meta); err != nil {
+			klog.Errorf("WriteEntryMeta(%d): %v", idx, err)
+			writeError(w, http.StatusInternalServerError, "Entry was sequenced at index %d, but its metadata couldn't be stored", idx)
+			return
+		}
+	}
+	w.Header().Set("Location", s.entryPath(idx))
+	switch negotiateAddResponse(r.Header.Values("Accept")) {
+	case "application/json":
+		s.writeReceipt(ctx, w, status, idx)
+	case promiseContentType:
+		s.writePromise(w, status, idx, b)
+	default:
+		w.WriteHeader(status)
+		w.Write([]byte(fmt.Sprintf("%d\n", idx)))
+	}
+}
+
+// addResponseTypes are the media types of the responses handleAdd can write, in order of preference when the
+// client accepts several equally: the plain index, a JSON receipt, or a signed promise.
+var addResponseTypes = []string{"text/plain", "application/json", promiseContentType}
+
+// negotiateAddResponse returns the type from addResponseTypes given the highest quality by the Accept headers,
+// which defaults to the plain index if there are none, or none of the types are acceptable.
+func negotiateAddResponse(accept []string) string {
+	best, bestQ := addResponseTypes[0], 0.0
+	for _, t := range addResponseTypes {
+		if q := acceptQuality(accept, t); q > bestQ {
+			best, bestQ = t, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality given to the media type t by the Accept headers, as per RFC 9110: each
+// comma separated media range may carry a q parameter, and the most specific of the ranges matching t applies.
+func acceptQuality(accept []string, t string) float64 {
+	q, specificity := 0.0, -1
+	for _, h := range accept {
+		for _, r := range strings.Split(h, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+			if err != nil {
+				continue
+			}
+			var s int
+			switch {
+			case mt == t:
+				s = 2
+			case strings.HasSuffix(mt, "/*") && strings.HasPrefix(t, strings.TrimSuffix(mt, "*")):
+				s = 1
+			case mt == "*/*":
+				s = 0
+			default:
+				continue
+			}
+			if s <= specificity {
+				continue
+			}
+			rq := 1.0
+			if v, ok := params["q"]; ok {
+				if rq, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			q, specificity = rq, s
+		}
+	}
+	return q
+}
+
+// entryPath returns the path from which the leaf at the given index can be fetched.
+func (s *server) entryPath(idx uint64) string {
+	return fmt.Sprintf("%s/entries?start=%d&count=1", s.pathPrefix, idx)
+}
+
+// handleReadOnly rejects requests to add entries to a read-only replica.
+func handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, "This instance is a read-only replica")
+}
+
+// apiError is the body of every error response, so that clients can handle errors programmatically.
+type apiError struct {
+	// Error describes the error for humans.
+	Error string `json:"error"`
+	// Code identifies the kind of error, and is derived from the response's status, e.g. "bad_request" for
+	// errors caused by the request and "internal_server_error" for failures of the server.
+	Code string `json:"code"`
+}
+
+// writeError responds with the given status, and an apiError whose message is formatted from format and args.
+func writeError(w http.ResponseWriter, status int, format string, args ...any) {
+	code := strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	// Messages such as "Start 9 must be < 3" are more readable without HTML escaping.
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(apiError{Error: fmt.Sprintf(format, args...), Code: code}); err != nil {
+		klog.Errorf("Failed to write error response: %v", err)
+	}
+}
+
+// receipt is returned by handleAdd to clients which accept JSON, and allows them to verify the inclusion
+// of their leaf without making further requests.
+type receipt struct {
+	// Index is the index assigned to the leaf.
+	Index uint64 `json:"index"`
+	// Checkpoint is a signed checkpoint which includes the leaf.
+	Checkpoint string `json:"checkpoint"`
+	// InclusionProof proves the inclusion of the leaf in the tree committed to by Checkpoint.
+	InclusionProof [][]byte `json:"inclusion_proof"`
+}
+
+// writeReceipt writes a receipt for the leaf at the given index, which must already be integrated, with the
+// given status.
+func (s *server) writeReceipt(ctx context.Context, w http.ResponseWriter, status int, idx uint64) {
+	// The proof must be for the same tree as the checkpoint we return, so use the size from the checkpoint
+	// itself rather than from curTree, which may read a newer one.
+	cpRaw, cp, err := s.checkpointIncluding(ctx, idx)
+	if err != nil {
+		klog.Errorf("Failed to read checkpoint including leaf %d: %v", idx, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	pb, err := reader.NewProofBuilder(ctx, s.params, cp.Size, s.params.Hasher().HashChildren, s.storage)
+	if err != nil {
+		klog.Errorf("NewProofBuilder(%d): %v", cp.Size, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	p, err := pb.InclusionProof(ctx, idx)
+	if err != nil {
+		klog.Errorf("InclusionProof(%d, %d): %v", idx, cp.Size, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(receipt{Index: idx, Checkpoint: string(cpRaw), InclusionProof: p}); err != nil {
+		klog.Errorf("Failed to write receipt: %v", err)
+	}
+}
+
+// receiptPollInterval is how often writeReceipt checks for a checkpoint which includes the leaf, when
+// checkpoints are published separately from integration.
+const receiptPollInterval = 50 * time.Millisecond
+
+// checkpointIncluding returns the raw and parsed latest checkpoint, once it includes the leaf at the given index.
+// Integrated leaves are included immediately unless checkpoints are published at intervals, in which case this
+// waits for the next checkpoint to be published.
+func (s *server) checkpointIncluding(ctx context.Context, idx uint64) ([]byte, *f_log.Checkpoint, error) {
+	for {
+		cpRaw, err := s.checkpoint.Read()
+		if err != nil {
+			return nil, nil, err
+		}
+		cp := &f_log.Checkpoint{}
+		if _, err := cp.Unmarshal(bytes.SplitAfterN(cpRaw, []byte("\n\n"), 2)[0]); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse checkpoint: %v", err)
+		}
+		if idx < cp.Size {
+			return cpRaw, cp, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("leaf is not included in checkpoint of size %d: %v", cp.Size, ctx.Err())
+		case <-time.After(receiptPollInterval):
+		}
+	}
+}
+
+// handleAddBatch sequences a newline delimited list of base64 encoded leaves, returning their
+// assigned indices one per line.
+func (s *server) handleAddBatch(w http.ResponseWriter, r *http.Request) {
+	n := time.Now()
+	defer func() { s.latency.Add(time.Since(n)) }()
+	ctx, span := startSpan(r, "bettyfe.handleAddBatch")
+	defer span.End()
+
+	if limit := s.maxBatchBodySize(); limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			writeError(w, http.StatusRequestEntityTooLarge, "Batch exceeds max size of %d bytes", mbe.Limit)
+			return
+		}
+		writeError(w, http.StatusBadRequest, "Failed to read request body: %v", err)
+		return
+	}
+	defer r.Body.Close()
+	if len(b) == 0 {
+		writeError(w, http.StatusBadRequest, "No entries provided")
+		return
+	}
+	// The body is a newline delimited list of base64 encoded leaves, i.e. the same format as entry bundles.
+	lines := bytes.Split(bytes.TrimRight(b, "\n"), []byte("\n"))
+	if s.maxBatchEntries > 0 && len(lines) > s.maxBatchEntries {
+		writeError(w, http.StatusRequestEntityTooLarge, "Batch of %d entries exceeds max of %d entries", len(lines), s.maxBatchEntries)
+		return
+	}
+	entries := make([][]byte, 0, len(lines))
+	for i, line := range lines {
+		e, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid entry on line %d: %v", i+1, err)
+			return
+		}
+		if s.maxEntrySize > 0 && int64(len(e)) > s.maxEntrySize {
+			writeError(w, http.StatusRequestEntityTooLarge, "Entry on line %d exceeds max size of %d bytes", i+1, s.maxEntrySize)
+			return
+		}
+		if err := s.validateLeaf(e); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid entry on line %d: %v", i+1, err)
+			return
+		}
+		entries = append(entries, e)
+	}
+	done := s.integration.start()
+	idx, err := s.storage.SequenceBatch(ctx, entries)
+	done(err)
+	if errors.Is(err, writer.ErrEntryTooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "%v", err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to sequence %d entries: %v", len(entries), err)
+		return
+	}
+	for _, i := range idx {
+		w.Write([]byte(fmt.Sprintf("%d\n", i)))
+	}
+}
+
+// maxBatchBodySize returns the largest request body which handleAddBatch will read, i.e. that of a batch of
+// maxBatchEntries base64 encoded entries of maxEntrySize bytes, or zero if either is unlimited.
+func (s *server) maxBatchBodySize() int64 {
+	if s.maxBatchEntries == 0 || s.maxEntrySize == 0 {
+		return 0
+	}
+	// Each entry is followed by a newline.
+	return int64(s.maxBatchEntries) * int64(base64.StdEncoding.EncodedLen(int(s.maxEntrySize))+1)
+}
+
+// startSpan starts a span for the provided request, continuing any trace propagated by the caller.
+// The span is annotated with the request's ID, if it has one.
+func startSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindServer)}
+	if id := requestID(ctx); id != "" {
+		opts = append(opts, trace.WithAttributes(attribute.String("betty.request_id", id)))
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// handleCheckpoint serves the latest signed checkpoint.
+func (s *server) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	cp, err := s.checkpoint.Read()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		klog.Errorf("ReadCheckpoint: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	// The checkpoint is updated in place as the log grows, so clients must always revalidate.
+	h := sha256.Sum256(cp)
+	etag := `"` + hex.EncodeToString(h[:]) + `"`
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(cp)
+}
+
+// treeSize is the response served by handleSize.
+type treeSize struct {
+	Size uint64 `json:"size"`
+	Root []byte `json:"root"`
+}
+
+// handleSize serves the size and root hash of the latest integrated tree as JSON, for clients which don't
+// need to verify the signed checkpoint.
+func (s *server) handleSize(w http.ResponseWriter, r *http.Request) {
+	size, root, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(treeSize{Size: size, Root: root}); err != nil {
+		klog.Errorf("Failed to write size: %v", err)
+	}
+}
+
+// metadataReader is implemented by storage which persists the log's metadata.
+type metadataReader interface {
+	// ReadMetadata returns the log's persisted metadata, see log.Metadata.
+	// If the log has none, the returned error must satisfy errors.Is(err, os.ErrNotExist).
+	ReadMetadata(ctx context.Context) ([]byte, error)
+}
+
+// handleLogInfo serves the log's metadata as JSON, describing the parameters it was created with, its origin and
+// when it was created, so that clients have a stable description of the log.
+func (s *server) handleLogInfo(w http.ResponseWriter, r *http.Request) {
+	var m log.Metadata
+	if mr, ok := s.storage.(metadataReader); ok {
+		raw, err := mr.ReadMetadata(r.Context())
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				writeError(w, http.StatusNotFound, "No metadata was stored for this log")
+				return
+			}
+			klog.Errorf("ReadMetadata: %v", err)
+			writeError(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+		if m, err = log.ParseMetadata(raw); err != nil {
+			klog.Errorf("ParseMetadata: %v", err)
+			writeError(w, http.StatusInternalServerError, "Internal error")
+			return
+		}
+	} else {
+		// Without persisted metadata, the log is described by its configuration.
+		m = s.params.Metadata()
+		m.Origin = s.signers[0].Name()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		klog.Errorf("Failed to write log info: %v", err)
+	}
+}
+
+// checkpointArchive is implemented by storage which archives historic checkpoints.
+type checkpointArchive interface {
+	// ReadCheckpointAt returns the archived checkpoint for the tree of the given size.
+	ReadCheckpointAt(ctx context.Context, size uint64) ([]byte, error)
+}
+
+// handleCheckpointAt serves the archived checkpoint for the requested tree size.
+func (s *server) handleCheckpointAt(w http.ResponseWriter, r *http.Request) {
+	a, ok := s.storage.(checkpointArchive)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Checkpoint history is not supported by this log")
+		return
+	}
+	size, err := strconv.ParseUint(r.PathValue("size"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid size: %v", err)
+		return
+	}
+	cp, err := a.ReadCheckpointAt(r.Context(), size)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		klog.Errorf("ReadCheckpointAt(%d): %v", size, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	// Unlike the latest checkpoint, the checkpoint for a given size never changes.
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	w.Write(cp)
+}
+
+// handleEntries serves the leaves at indices [start, start+count), with count clamped to the
+// configured maximum and to the size of the current tree.
+// The leaves are returned as a newline delimited list of base64 encoded entries.
+func (s *server) handleEntries(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseUint(r.URL.Query().Get("start"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid start: %v", err)
+		return
+	}
+	count, err := strconv.ParseUint(r.URL.Query().Get("count"), 10, 64)
+	if err != nil || count == 0 {
+		writeError(w, http.StatusBadRequest, "Invalid count: must be a positive integer")
+		return
+	}
+	cpSize, _, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if start >= cpSize {
+		writeError(w, http.StatusBadRequest, "Start %d must be < %d", start, cpSize)
+		return
+	}
+	count = min(s.capEntries(count), cpSize-start)
+
+	es, err := reader.GetVerifiedEntries(r.Context(), s.params, cpSize, start, count, s.storage, s.storage)
+	if err != nil {
+		klog.Errorf("GetVerifiedEntries(%d, %d): %v", start, count, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	for _, e := range es {
+		w.Write([]byte(base64.StdEncoding.EncodeToString(e) + "\n"))
+	}
+}
+
+// capEntries limits count to the max number of entries returned by a single request, if there is one.
+func (s *server) capEntries(count uint64) uint64 {
+	if s.maxEntries == 0 {
+		return count
+	}
+	return min(count, s.maxEntries)
+}
+
+// handleTile serves a tile in the format described by tlog-tiles (https://c2sp.org/tlog-tiles),
+// i.e. the concatenated hashes of the tile's level 0 nodes.
+func (s *server) handleTile(w http.ResponseWriter, r *http.Request) {
+	level, err := strconv.ParseUint(r.PathValue("level"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid level: %v", err)
+		return
+	}
+	index, width, err := parseTileIndex(r.PathValue("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid tile index: %v", err)
+		return
+	}
+	tw := s.params.TileWidth()
+	if width >= tw {
+		writeError(w, http.StatusBadRequest, "Partial tile width %d must be < %d", width, tw)
+		return
+	}
+	if width == 0 {
+		width = tw
+	}
+	cpSize, _, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	// Figure out the size of the tree in which the requested tile had the requested width.
+	logSize := index*tw + width
+	for i := uint64(0); i < level && logSize <= cpSize; i++ {
+		logSize *= tw
+	}
+	if logSize > cpSize {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	t, err := s.storage.GetTile(r.Context(), level, index, logSize)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		klog.Errorf("GetTile(%d, %d, %d): %v", level, index, logSize, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	// Tiles only ever grow, so once an older partial tile has been replaced by a larger one, the requested width is
+	// served from its prefix.
+	if uint64(t.NumLeaves) < width {
+		klog.Errorf("GetTile(%d, %d, %d): got tile with %d leaves, want at least %d", level, index, logSize, t.NumLeaves, width)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	for i := uint64(0); i < width; i++ {
+		w.Write(t.Nodes[api.TileNodeKey(0, i)])
+	}
+}
+
+// handleEntryBundle serves an entry bundle in the format described by tlog-tiles (https://c2sp.org/tlog-tiles),
+// i.e. each of the bundle's entries prefixed by its length as a big-endian uint16.
+// As with tiles, the partial bundle at the end of the tree is served at N.p/W, where W is the number of entries in
+// it, and only the entries committed to by the latest checkpoint are served.
+func (s *server) handleEntryBundle(w http.ResponseWriter, r *http.Request) {
+	index, width, err := parseTileIndex(r.PathValue("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid entry bundle index: %v", err)
+		return
+	}
+	bs := uint64(s.params.EntryBundleSize)
+	if width >= bs {
+		writeError(w, http.StatusBadRequest, "Partial entry bundle width %d must be < %d", width, bs)
+		return
+	}
+	if width == 0 {
+		width = bs
+	}
+	cpSize, _, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	// A partial bundle of an earlier tree is a prefix of the bundle in the current tree, so can still be served.
+	start := index * bs
+	if start+width > cpSize {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	es, err := reader.GetVerifiedEntries(r.Context(), s.params, cpSize, start, width, s.storage, s.storage)
+	if err != nil {
+		klog.Errorf("GetVerifiedEntries(%d, %d): %v", start, width, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	var b []byte
+	for i, e := range es {
+		if len(e) > math.MaxUint16 {
+			writeError(w, http.StatusNotImplemented, "Entry %d is too large to be served in a tlog-tiles entry bundle", start+uint64(i))
+			return
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(e)))
+		b = append(b, e...)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	w.Write(b)
+}
+
+// parseTileIndex parses a tile index, and optional partial tile width, from a tlog-tiles path
+// such as "x001/x234/067" or "067.p/8".
+// A returned width of zero indicates a full tile.
+func parseTileIndex(p string) (uint64, uint64, error) {
+	var width uint64
+	if i := strings.Index(p, ".p/"); i >= 0 {
+		w, err := strconv.ParseUint(p[i+3:], 10, 64)
+		if err != nil || w == 0 {
+			return 0, 0, fmt.Errorf("invalid partial tile width %q", p[i+3:])
+		}
+		p, width = p[:i], w
+	}
+	parts := strings.Split(p, "/")
+	var index uint64
+	for i, part := range parts {
+		if i < len(parts)-1 {
+			if !strings.HasPrefix(part, "x") {
+				return 0, 0, fmt.Errorf("invalid path element %q", part)
+			}
+			part = part[1:]
+		}
+		n, err := strconv.ParseUint(part, 10, 64)
+		if len(part) != 3 || err != nil {
+			return 0, 0, fmt.Errorf("invalid path element %q", part)
+		}
+		index = index*1000 + n
+	}
+	return index, width, nil
+}
+
+// handleInclusionProof serves an inclusion proof for the leaf at the requested index in a tree
+// of the requested size.
+// The proof is returned as a newline delimited list of base64 encoded hashes.
+func (s *server) handleInclusionProof(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid index: %v", err)
+		return
+	}
+	size, err := strconv.ParseUint(r.URL.Query().Get("size"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid size: %v", err)
+		return
+	}
+	cpSize, _, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if index >= size || size > cpSize {
+		writeError(w, http.StatusBadRequest, "Index %d and size %d must satisfy index < size <= %d", index, size, cpSize)
+		return
+	}
+
+	pb, err := reader.NewProofBuilder(r.Context(), s.params, size, s.params.Hasher().HashChildren, s.storage)
+	if err != nil {
+		klog.Errorf("NewProofBuilder(%d): %v", size, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	p, err := pb.InclusionProof(r.Context(), index)
+	if err != nil {
+		klog.Errorf("InclusionProof(%d, %d): %v", index, size, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	writeHashes(w, p)
+}
+
+// handleConsistencyProof serves a consistency proof between the two requested tree sizes.
+// The proof is returned as a newline delimited list of base64 encoded hashes.
+func (s *server) handleConsistencyProof(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid from: %v", err)
+		return
+	}
+	to, err := strconv.ParseUint(r.URL.Query().Get("to"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid to: %v", err)
+		return
+	}
+	cpSize, _, err := s.curTree()
+	if err != nil {
+		klog.Errorf("curTree: %v", err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	if from > to || to > cpSize {
+		writeError(w, http.StatusBadRequest, "From %d and to %d must satisfy from <= to <= %d", from, to, cpSize)
+		return
+	}
+	// Consistency with an empty tree, or with itself, is trivially proven.
+	if from == 0 || from == to {
+		writeHashes(w, nil)
+		return
+	}
+
+	p, err := reader.ConsistencyProof(r.Context(), s.params, from, to, s.params.Hasher().HashChildren, s.storage)
+	if err != nil {
+		klog.Errorf("ConsistencyProof(%d, %d): %v", from, to, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	writeHashes(w, p)
+}
+
+// writeHashes writes the provided hashes to w as a newline delimited list of base64 encoded strings.
+func writeHashes(w http.ResponseWriter, hs [][]byte) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	b := &bytes.Buffer{}
+	for _, h := range hs {
+		b.WriteString(base64.StdEncoding.EncodeToString(h))
+		b.WriteString("\n")
+	}
+	w.Write(b.Bytes())
+}
+
+// newBundleServer returns a handler which serves the entry bundles stored under the POSIX log at root.
+// Only regular files under seq/ are served, and paths containing dotfiles, or traversing out of the
+// directory, are rejected, so that nothing else stored alongside the log is exposed.
+func newBundleServer(root string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, "/")
+		for _, c := range strings.Split(p, "/") {
+			if c == "" || strings.HasPrefix(c, ".") {
+				writeError(w, http.StatusNotFound, "Not found")
+				return
+			}
+		}
+		if !strings.HasPrefix(p, "seq/") {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		f := filepath.Join(root, filepath.FromSlash(p))
+		if fi, err := os.Stat(f); err != nil || !fi.Mode().IsRegular() {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		// Both complete and partial bundles are named according to the entries they hold, so never change.
+		w.Header().Set("Cache-Control", immutableCacheControl)
+		http.ServeFile(w, r, f)
+	}
+}
@@ -0,0 +1,1440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/storage/posix"
+	"github.com/prometheus/client_golang/prometheus"
+	f_log "github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"github.com/transparency-dev/serverless-log/api/layout"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// testLogs numbers the logs created by tests, whose metrics must be distinguished by name.
+var testLogs atomic.Int64
+
+// newTestServer creates a server for a log with params, stored as selected by the flags, initialised and signed
+// with the default --log_signer as main does, with its handlers registered at the root of the returned handler.
+func newTestServer(t testing.TB, params log.Params) (*server, http.Handler) {
+	t.Helper()
+	sKeys, vKeys := keysFromFlag()
+	loc, err := storageLocation(*path)
+	if err != nil {
+		t.Fatalf("storageLocation: %v", err)
+	}
+	lv, err := parseLeafValidators(*leafValidators)
+	if err != nil {
+		t.Fatalf("parseLeafValidators: %v", err)
+	}
+	s, ct, cpCache := newStorage(context.Background(), loc, params, sKeys, vKeys)
+	srv := &server{
+		storage:    s,
+		checkpoint: cpCache,
+		params:     params,
+		curTree:    ct,
+		// newLatency registers its histogram, which can only be done once per process.
+		latency: &latency{hist: prometheus.NewHistogram(prometheus.HistogramOpts{Name: "betty_sequence_latency_seconds"})},
+
+		integration:      newIntegrationTracker(),
+		maxStaleness:     *readyMaxStale,
+		maxEntries:       *maxEntries,
+		maxEntrySize:     *maxEntrySize,
+		maxBatchEntries:  *maxBatchEntries,
+		maxEntryMetaSize: *entryMetaSize,
+		leafValidator:    lv,
+		streamWindow:     *streamWindow,
+		sthSigner:        sKeys[0],
+		signers:          sKeys,
+		drain:            &drainer{},
+	}
+	if loc.Scheme == "file" {
+		srv.bundleDir = localPath(loc)
+	}
+	mux := http.NewServeMux()
+	srv.registerHandlers(mux, func(h http.HandlerFunc) http.HandlerFunc { return h }, nil, nil)
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	return srv, mux
+}
+
+// newMemoryTestServer creates a server for a log in memory.
+func newMemoryTestServer(t *testing.T) (*server, http.Handler) {
+	setFlag(t, inMemory, true)
+	return newTestServer(t, testParams())
+}
+
+// newPOSIXTestServer creates a server for a log in a temporary directory.
+func newPOSIXTestServer(t *testing.T) (*server, http.Handler) {
+	setFlag(t, path, t.TempDir())
+	return newTestServer(t, testParams())
+}
+
+// testParams returns the params given by the flags.
+func testParams() log.Params {
+	return log.Params{EntryBundleSize: *batchSize, BundleMaxBytes: *bundleMaxBytes, TileHeight: *tileHeight, Hash: hashFromFlag()}
+}
+
+// setFlag sets the flag to v for the duration of the test.
+func setFlag[T any](t testing.TB, f *T, v T) {
+	t.Helper()
+	old := *f
+	*f = v
+	t.Cleanup(func() { *f = old })
+}
+
+// do sends a request to h, returning the recorded response.
+func do(h http.Handler, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// addLeaves adds each of the leaves to the log served by h via /add, failing the test if any isn't accepted.
+func addLeaves(t *testing.T, h http.Handler, leaves ...string) {
+	t.Helper()
+	for _, l := range leaves {
+		if w := do(h, http.MethodPost, "/add", l, nil); w.Code != http.StatusCreated {
+			t.Fatalf("POST /add %q: got %d %q, want 201", l, w.Code, w.Body)
+		}
+	}
+}
+
+// addBatches adds the leaves to the log served by h via /add-batch, in batches of up to 1000 leaves, failing the
+// test if any isn't accepted.
+func addBatches(t *testing.T, h http.Handler, leaves ...string) {
+	t.Helper()
+	for len(leaves) > 0 {
+		n := min(len(leaves), 1000)
+		var body strings.Builder
+		for _, l := range leaves[:n] {
+			body.WriteString(base64.StdEncoding.EncodeToString([]byte(l)) + "\n")
+		}
+		if w := do(h, http.MethodPost, "/add-batch", body.String(), nil); w.Code != http.StatusOK {
+			t.Fatalf("POST /add-batch: got %d %q, want 200", w.Code, w.Body)
+		}
+		leaves = leaves[n:]
+	}
+}
+
+// testVerifier returns the verifier of the checkpoints signed with the default --log_signer.
+func testVerifier(t *testing.T) note.Verifier {
+	t.Helper()
+	v, err := note.NewVerifier(*verifier)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	return v
+}
+
+// parseCheckpoint verifies and parses the raw checkpoint signed with the default --log_signer.
+func parseCheckpoint(t *testing.T, raw []byte) *f_log.Checkpoint {
+	t.Helper()
+	v := testVerifier(t)
+	cp, _, _, err := f_log.ParseCheckpoint(raw, v.Name(), v)
+	if err != nil {
+		t.Fatalf("ParseCheckpoint: %v", err)
+	}
+	return cp
+}
+
+// parseProof parses a proof served as a newline delimited list of base64 encoded hashes.
+func parseProof(t *testing.T, body string) [][]byte {
+	t.Helper()
+	var p [][]byte
+	for _, l := range strings.Fields(body) {
+		b, err := base64.StdEncoding.DecodeString(l)
+		if err != nil {
+			t.Fatalf("Invalid proof hash %q: %v", l, err)
+		}
+		p = append(p, b)
+	}
+	return p
+}
+
+func TestCheckpointHandler(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		server func(*testing.T) (*server, http.Handler)
+		leaves int
+	}{
+		{name: "empty POSIX log", server: newPOSIXTestServer},
+		{name: "one leaf", server: newPOSIXTestServer, leaves: 1},
+		{name: "several leaves", server: newPOSIXTestServer, leaves: 5},
+		{name: "empty memory log", server: newMemoryTestServer},
+		{name: "memory", server: newMemoryTestServer, leaves: 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, h := test.server(t)
+			for i := range test.leaves {
+				addLeaves(t, h, fmt.Sprintf("leaf %d", i))
+			}
+			w := do(h, http.MethodGet, "/checkpoint", "", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /checkpoint: got %d %q, want 200", w.Code, w.Body)
+			}
+			if got, want := w.Header().Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+				t.Errorf("Content-Type: got %q, want %q", got, want)
+			}
+			if got := w.Header().Get("Cache-Control"); got != "no-cache" {
+				t.Errorf("Cache-Control: got %q, want no-cache", got)
+			}
+			if cp := parseCheckpoint(t, w.Body.Bytes()); cp.Size != uint64(test.leaves) {
+				t.Errorf("Got checkpoint of size %d, want %d", cp.Size, test.leaves)
+			}
+		})
+	}
+}
+
+func TestCheckpointHandlerUninitialised(t *testing.T) {
+	srv, _ := newPOSIXTestServer(t)
+	// The checkpoint is read from a directory in which no log has been created.
+	dir := t.TempDir()
+	srv.checkpoint = &checkpointCache{readCheckpoint: func() ([]byte, error) { return posix.ReadCheckpoint(dir) }}
+	w := httptest.NewRecorder()
+	srv.handleCheckpoint(w, httptest.NewRequest(http.MethodGet, "/checkpoint", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /checkpoint of an uninitialised log: got %d %q, want 404", w.Code, w.Body)
+	}
+}
+
+func TestInclusionProofHandler(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		server func(*testing.T) (*server, http.Handler)
+		leaves int
+	}{
+		{name: "single leaf", server: newPOSIXTestServer, leaves: 1},
+		{name: "partial tile", server: newPOSIXTestServer, leaves: 7},
+		{name: "several tiles", server: newPOSIXTestServer, leaves: 300},
+		{name: "memory", server: newMemoryTestServer, leaves: 21},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, h := test.server(t)
+			var leaves []string
+			for i := range test.leaves {
+				leaves = append(leaves, fmt.Sprintf("leaf %d", i))
+			}
+			addLeaves(t, h, leaves...)
+			cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+			rnd := rand.New(rand.NewSource(1))
+			for _, idx := range []int{0, test.leaves - 1, rnd.Intn(test.leaves)} {
+				w := do(h, http.MethodGet, fmt.Sprintf("/proof/inclusion?index=%d&size=%d", idx, cp.Size), "", nil)
+				if w.Code != http.StatusOK {
+					t.Fatalf("GET /proof/inclusion: got %d %q, want 200", w.Code, w.Body)
+				}
+				p := parseProof(t, w.Body.String())
+				if err := proof.VerifyInclusion(rfc6962.DefaultHasher, uint64(idx), cp.Size, rfc6962.DefaultHasher.HashLeaf([]byte(leaves[idx])), p, cp.Hash); err != nil {
+					t.Errorf("VerifyInclusion(%d, %d): %v", idx, cp.Size, err)
+				}
+			}
+			// Proofs can't be requested for trees larger than the checkpoint, or for leaves outside the tree.
+			for _, q := range []string{
+				fmt.Sprintf("index=%d&size=%d", 0, cp.Size+1),
+				fmt.Sprintf("index=%d&size=%d", cp.Size, cp.Size),
+				"index=x&size=1",
+			} {
+				if w := do(h, http.MethodGet, "/proof/inclusion?"+q, "", nil); w.Code != http.StatusBadRequest {
+					t.Errorf("GET /proof/inclusion?%s: got %d, want 400", q, w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxEntrySize(t *testing.T) {
+	batch := func(entries ...string) string {
+		var b strings.Builder
+		for _, e := range entries {
+			b.WriteString(base64.StdEncoding.EncodeToString([]byte(e)) + "\n")
+		}
+		return b.String()
+	}
+	for _, test := range []struct {
+		name, target, body string
+		maxSize            int64
+		want               int
+	}{
+		{name: "largest entry", target: "/add", body: strings.Repeat("a", 16), maxSize: 16, want: http.StatusCreated},
+		{name: "oversized entry", target: "/add", body: strings.Repeat("b", 17), maxSize: 16, want: http.StatusRequestEntityTooLarge},
+		{name: "huge entry", target: "/add", body: strings.Repeat("c", 10<<20), maxSize: 16, want: http.StatusRequestEntityTooLarge},
+		{name: "no limit", target: "/add", body: strings.Repeat("d", 10<<10), maxSize: 0, want: http.StatusCreated},
+		{name: "largest entry in batch", target: "/add-batch", body: batch("e", strings.Repeat("f", 16)), maxSize: 16, want: http.StatusOK},
+		{name: "oversized entry in batch", target: "/add-batch", body: batch("g", strings.Repeat("h", 17)), maxSize: 16, want: http.StatusRequestEntityTooLarge},
+		{name: "oversized batch body", target: "/add-batch", body: batch(strings.Repeat("i", 1000)), maxSize: 16, want: http.StatusRequestEntityTooLarge},
+		{name: "too many entries in batch", target: "/add-batch", body: batch("j", "k", "l", "m", "n"), maxSize: 16, want: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, maxEntrySize, test.maxSize)
+			setFlag(t, maxBatchEntries, 4)
+			_, h := newMemoryTestServer(t)
+			if w := do(h, http.MethodPost, test.target, test.body, nil); w.Code != test.want {
+				t.Errorf("POST %s: got %d %q, want %d", test.target, w.Code, w.Body, test.want)
+			}
+		})
+	}
+}
+
+// parseError decodes the body of an error response, failing the test if it isn't exactly an apiError.
+func parseError(t *testing.T, w *httptest.ResponseRecorder) apiError {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Got Content-Type %q, want application/json", ct)
+	}
+	dec := json.NewDecoder(w.Body)
+	dec.DisallowUnknownFields()
+	var e apiError
+	if err := dec.Decode(&e); err != nil {
+		t.Fatalf("Invalid error response: %v", err)
+	}
+	return e
+}
+
+func TestWriteError(t *testing.T) {
+	for _, test := range []struct {
+		status   int
+		format   string
+		args     []any
+		want     apiError
+		wantBody string
+	}{
+		{status: http.StatusBadRequest, format: "Invalid start: %v", args: []any{errors.New("not a number")}, want: apiError{Error: "Invalid start: not a number", Code: "bad_request"}},
+		{status: http.StatusNotFound, format: "Not found", want: apiError{Error: "Not found", Code: "not_found"}},
+		{status: http.StatusRequestEntityTooLarge, format: "Entry exceeds max size of %d bytes", args: []any{16}, want: apiError{Error: "Entry exceeds max size of 16 bytes", Code: "request_entity_too_large"}},
+		{status: http.StatusInternalServerError, format: "Internal error", want: apiError{Error: "Internal error", Code: "internal_server_error"}},
+		{status: http.StatusNotImplemented, format: "Not supported", want: apiError{Error: "Not supported", Code: "not_implemented"}},
+		// Messages aren't HTML escaped.
+		{status: http.StatusBadRequest, format: "Start %d must be < %d", args: []any{9, 3}, want: apiError{Error: "Start 9 must be < 3", Code: "bad_request"}, wantBody: `{"error":"Start 9 must be < 3","code":"bad_request"}` + "\n"},
+	} {
+		t.Run(test.want.Error, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, test.status, test.format, test.args...)
+			if w.Code != test.status {
+				t.Errorf("Got status %d, want %d", w.Code, test.status)
+			}
+			body := w.Body.String()
+			if got := parseError(t, w); got != test.want {
+				t.Errorf("Got error %+v, want %+v", got, test.want)
+			}
+			if test.wantBody != "" && body != test.wantBody {
+				t.Errorf("Got body %q, want %q", body, test.wantBody)
+			}
+		})
+	}
+}
+
+// failingStorage is a Storage whose sequencing fails.
+type failingStorage struct {
+	Storage
+	err error
+}
+
+func (s failingStorage) Sequence(context.Context, []byte) (uint64, error) {
+	return 0, s.err
+}
+
+func (s failingStorage) SequenceBatch(context.Context, [][]byte) ([]uint64, error) {
+	return nil, s.err
+}
+
+func TestErrorResponses(t *testing.T) {
+	setFlag(t, maxEntrySize, 16)
+	srv, h := newMemoryTestServer(t)
+	addLeaves(t, h, "one")
+	for _, test := range []struct {
+		name           string
+		method, target string
+		body           string
+		// sequenceErr, if set, causes sequencing to fail with it.
+		sequenceErr error
+		wantStatus  int
+		wantCode    string
+		wantError   string
+	}{
+		{name: "sequencing failure", method: http.MethodPost, target: "/add", body: "two", sequenceErr: errors.New("disk on fire"), wantStatus: http.StatusInternalServerError, wantCode: "internal_server_error", wantError: "Failed to sequence entry: disk on fire"},
+		{name: "batch sequencing failure", method: http.MethodPost, target: "/add-batch", body: "dHdv\n", sequenceErr: errors.New("disk on fire"), wantStatus: http.StatusInternalServerError, wantCode: "internal_server_error", wantError: "Failed to sequence 1 entries: disk on fire"},
+		{name: "entry too large", method: http.MethodPost, target: "/add", body: strings.Repeat("a", 17), wantStatus: http.StatusRequestEntityTooLarge, wantCode: "request_entity_too_large", wantError: "Entry exceeds max size of 16 bytes"},
+		{name: "empty batch", method: http.MethodPost, target: "/add-batch", wantStatus: http.StatusBadRequest, wantCode: "bad_request", wantError: "No entries provided"},
+		{name: "invalid batch entry", method: http.MethodPost, target: "/add-batch", body: "!!\n", wantStatus: http.StatusBadRequest, wantCode: "bad_request", wantError: "Invalid entry on line 1"},
+		{name: "invalid start", method: http.MethodGet, target: "/entries?start=x", wantStatus: http.StatusBadRequest, wantCode: "bad_request", wantError: "Invalid start"},
+		{name: "start beyond tree", method: http.MethodGet, target: "/entries?start=5&count=1", wantStatus: http.StatusBadRequest, wantCode: "bad_request", wantError: "Start 5 must be < 1"},
+		{name: "missing tile", method: http.MethodGet, target: "/tile/0/001", wantStatus: http.StatusNotFound, wantCode: "not_found", wantError: "Not found"},
+		{name: "invalid tile", method: http.MethodGet, target: "/tile/x/000", wantStatus: http.StatusBadRequest, wantCode: "bad_request", wantError: "Invalid level"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.sequenceErr != nil {
+				s := srv.storage
+				srv.storage = failingStorage{Storage: s, err: test.sequenceErr}
+				defer func() { srv.storage = s }()
+			}
+			w := do(h, test.method, test.target, test.body, nil)
+			if w.Code != test.wantStatus {
+				t.Fatalf("%s %s: got %d %q, want %d", test.method, test.target, w.Code, w.Body, test.wantStatus)
+			}
+			e := parseError(t, w)
+			if e.Code != test.wantCode || !strings.HasPrefix(e.Error, test.wantError) {
+				t.Errorf("%s %s: got error %+v, want code %q and error starting %q", test.method, test.target, e, test.wantCode, test.wantError)
+			}
+		})
+	}
+}
+
+func TestReadOnlyError(t *testing.T) {
+	// A replica serves a log created by a writer.
+	newPOSIXTestServer(t)
+	setFlag(t, readOnly, true)
+	_, h := newTestServer(t, testParams())
+	for _, target := range []string{"/add", "/add-batch", "/add-stream"} {
+		w := do(h, http.MethodPost, target, "one", nil)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("POST %s: got %d %q, want 405", target, w.Code, w.Body)
+		}
+		if got, want := parseError(t, w), (apiError{Error: "This instance is a read-only replica", Code: "method_not_allowed"}); got != want {
+			t.Errorf("POST %s: got error %+v, want %+v", target, got, want)
+		}
+	}
+}
+
+func TestAddDuplicateHeader(t *testing.T) {
+	// add is a leaf to add, with the index, status and X-Leaf-Duplicate header expected in response.
+	type add struct {
+		leaf     string
+		wantIdx  string
+		wantCode int
+		wantDupe string
+	}
+	for _, test := range []struct {
+		name  string
+		dedup bool
+		adds  []add
+	}{
+		{
+			name:  "dedup",
+			dedup: true,
+			adds: []add{
+				{leaf: "one", wantIdx: "0", wantCode: http.StatusCreated},
+				{leaf: "two", wantIdx: "1", wantCode: http.StatusCreated},
+				{leaf: "one", wantIdx: "0", wantCode: http.StatusOK, wantDupe: "true"},
+				{leaf: "three", wantIdx: "2", wantCode: http.StatusCreated},
+				{leaf: "two", wantIdx: "1", wantCode: http.StatusOK, wantDupe: "true"},
+			},
+		}, {
+			name: "no dedup",
+			adds: []add{
+				{leaf: "one", wantIdx: "0", wantCode: http.StatusCreated},
+				{leaf: "one", wantIdx: "1", wantCode: http.StatusCreated},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, dedup, test.dedup)
+			_, h := newPOSIXTestServer(t)
+			for _, a := range test.adds {
+				w := do(h, http.MethodPost, "/add", a.leaf, nil)
+				if w.Code != a.wantCode {
+					t.Fatalf("POST /add %q: got %d %q, want %d", a.leaf, w.Code, w.Body, a.wantCode)
+				}
+				if got := strings.TrimSpace(w.Body.String()); got != a.wantIdx {
+					t.Errorf("POST /add %q: got index %s, want %s", a.leaf, got, a.wantIdx)
+				}
+				if got := w.Header().Get("X-Leaf-Duplicate"); got != a.wantDupe {
+					t.Errorf("POST /add %q: got X-Leaf-Duplicate %q, want %q", a.leaf, got, a.wantDupe)
+				}
+			}
+		})
+	}
+}
+
+func TestAddLocation(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		leaf     string
+		header   http.Header
+		wantCode int
+		wantIdx  uint64
+	}{
+		{name: "new leaf", leaf: "three", wantCode: http.StatusCreated, wantIdx: 2},
+		{name: "receipt", leaf: "three", header: http.Header{"Accept": {"application/json"}}, wantCode: http.StatusCreated, wantIdx: 2},
+		{name: "duplicate leaf", leaf: "two", wantCode: http.StatusOK, wantIdx: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, dedup, true)
+			_, h := newPOSIXTestServer(t)
+			addLeaves(t, h, "one", "two")
+			w := do(h, http.MethodPost, "/add", test.leaf, test.header)
+			if w.Code != test.wantCode {
+				t.Fatalf("POST /add: got %d %q, want %d", w.Code, w.Body, test.wantCode)
+			}
+			loc := w.Header().Get("Location")
+			if want := fmt.Sprintf("/entries?start=%d&count=1", test.wantIdx); loc != want {
+				t.Fatalf("Location: got %q, want %q", loc, want)
+			}
+			// The Location refers to the leaf, as it was added.
+			w = do(h, http.MethodGet, loc, "", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s: got %d %q, want 200", loc, w.Code, w.Body)
+			}
+			if got := parseEntries(t, w.Body.String()); !slices.Equal(got, []string{test.leaf}) {
+				t.Errorf("GET %s: got entries %q, want %q", loc, got, test.leaf)
+			}
+		})
+	}
+}
+
+func TestConsistencyProofHandler(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		adds []int
+	}{
+		{name: "few leaves", adds: []int{3, 4, 10}},
+		{name: "several tiles", adds: []int{1, 255, 2, 300}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, h := newPOSIXTestServer(t)
+			// The checkpoint after each run of adds is kept, so that proofs can be verified against historical roots.
+			var cps []*f_log.Checkpoint
+			var size uint64
+			for _, n := range test.adds {
+				for i := range n {
+					addLeaves(t, h, fmt.Sprintf("leaf %d", size+uint64(i)))
+				}
+				size += uint64(n)
+				cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+				if cp.Size != size {
+					t.Fatalf("Got checkpoint of size %d, want %d", cp.Size, size)
+				}
+				cps = append(cps, cp)
+			}
+			for _, from := range cps {
+				for _, to := range cps {
+					if from.Size > to.Size {
+						continue
+					}
+					w := do(h, http.MethodGet, fmt.Sprintf("/proof/consistency?from=%d&to=%d", from.Size, to.Size), "", nil)
+					if w.Code != http.StatusOK {
+						t.Fatalf("GET /proof/consistency: got %d %q", w.Code, w.Body)
+					}
+					p := parseProof(t, w.Body.String())
+					if err := proof.VerifyConsistency(rfc6962.DefaultHasher, from.Size, to.Size, p, from.Hash, to.Hash); err != nil {
+						t.Errorf("VerifyConsistency(%d, %d): %v", from.Size, to.Size, err)
+					}
+				}
+			}
+			for _, q := range []string{
+				fmt.Sprintf("from=%d&to=%d", 2, 1),
+				fmt.Sprintf("from=%d&to=%d", 1, size+1),
+				"from=1&to=x",
+			} {
+				if w := do(h, http.MethodGet, "/proof/consistency?"+q, "", nil); w.Code != http.StatusBadRequest {
+					t.Errorf("GET /proof/consistency?%s: got %d, want 400", q, w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyLogConsistency(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		server func(*testing.T) (*server, http.Handler)
+		leaves int
+	}{
+		{name: "memory", server: newMemoryTestServer, leaves: 1},
+		{name: "POSIX", server: newPOSIXTestServer, leaves: 1},
+		{name: "POSIX several leaves", server: newPOSIXTestServer, leaves: 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, h := test.server(t)
+			empty := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+			if want := rfc6962.DefaultHasher.EmptyRoot(); empty.Size != 0 || !bytes.Equal(empty.Hash, want) {
+				t.Fatalf("Got empty checkpoint of size %d with root %x, want size 0 with root %x", empty.Size, empty.Hash, want)
+			}
+			for i := range test.leaves {
+				addLeaves(t, h, fmt.Sprintf("leaf %d", i))
+			}
+			cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+			w := do(h, http.MethodGet, fmt.Sprintf("/proof/consistency?from=0&to=%d", cp.Size), "", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET /proof/consistency: got %d %q, want 200", w.Code, w.Body)
+			}
+			p := parseProof(t, w.Body.String())
+			if err := proof.VerifyConsistency(rfc6962.DefaultHasher, 0, cp.Size, p, empty.Hash, cp.Hash); err != nil {
+				t.Errorf("VerifyConsistency(0, %d): %v", cp.Size, err)
+			}
+		})
+	}
+}
+
+func TestBackendsAgree(t *testing.T) {
+	// The same sequence of adds builds the same tree, whichever storage the log uses.
+	var want *f_log.Checkpoint
+	for _, test := range []struct {
+		name   string
+		server func(*testing.T) (*server, http.Handler)
+	}{
+		{name: "memory", server: newMemoryTestServer},
+		{name: "POSIX", server: newPOSIXTestServer},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, h := test.server(t)
+			var leaves []string
+			for i := range 300 {
+				leaves = append(leaves, fmt.Sprintf("leaf %d", i))
+			}
+			addLeaves(t, h, leaves...)
+			cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+			for _, idx := range []int{0, 255, 256, 299} {
+				w := do(h, http.MethodGet, fmt.Sprintf("/proof/inclusion?index=%d&size=%d", idx, cp.Size), "", nil)
+				p := parseProof(t, w.Body.String())
+				if err := proof.VerifyInclusion(rfc6962.DefaultHasher, uint64(idx), cp.Size, rfc6962.DefaultHasher.HashLeaf([]byte(leaves[idx])), p, cp.Hash); err != nil {
+					t.Errorf("VerifyInclusion(%d, %d): %v", idx, cp.Size, err)
+				}
+			}
+			if want == nil {
+				want = cp
+				return
+			}
+			if cp.Size != want.Size || !bytes.Equal(cp.Hash, want.Hash) {
+				t.Errorf("Got tree of size %d with root %x, want size %d with root %x", cp.Size, cp.Hash, want.Size, want.Hash)
+			}
+		})
+	}
+}
+
+// spanRecorder records the spans of every tracer, it's only set up once since tracers delegate to the first global
+// provider to be set.
+var spanRecorder = sync.OnceValue(func() *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	return sr
+})
+
+func TestAddSpans(t *testing.T) {
+	sr := spanRecorder()
+	for _, test := range []struct {
+		name   string
+		server func(*testing.T) (*server, http.Handler)
+		// wantParents maps the name of each span recorded for an add to that of its parent.
+		wantParents map[string]string
+	}{
+		{name: "POSIX", server: newPOSIXTestServer, wantParents: map[string]string{
+			"bettyfe.handleAdd":    "",
+			"posix.Sequence":       "bettyfe.handleAdd",
+			"writer.SequenceBatch": "posix.Sequence",
+			"writer.Integrate":     "writer.SequenceBatch",
+		}},
+		{name: "memory", server: newMemoryTestServer, wantParents: map[string]string{
+			"bettyfe.handleAdd":    "",
+			"memory.Sequence":      "bettyfe.handleAdd",
+			"writer.SequenceBatch": "memory.Sequence",
+			"writer.Integrate":     "writer.SequenceBatch",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, h := test.server(t)
+			start := len(sr.Ended())
+			addLeaves(t, h, "leaf")
+			spans := sr.Ended()[start:]
+			names := map[trace.SpanID]string{}
+			for _, s := range spans {
+				names[s.SpanContext().SpanID()] = s.Name()
+			}
+			got := map[string]string{}
+			for _, s := range spans {
+				if s.SpanContext().TraceID() != spans[0].SpanContext().TraceID() {
+					t.Errorf("Span %s isn't in the same trace as %s", s.Name(), spans[0].Name())
+				}
+				got[s.Name()] = names[s.Parent().SpanID()]
+			}
+			if !maps.Equal(got, test.wantParents) {
+				t.Errorf("Got span parents %v, want %v", got, test.wantParents)
+			}
+		})
+	}
+}
+
+// parseEntries parses entries served as a newline delimited list of base64 encoded entries.
+func parseEntries(t *testing.T, body string) []string {
+	t.Helper()
+	var es []string
+	for _, l := range strings.Fields(body) {
+		e, err := base64.StdEncoding.DecodeString(l)
+		if err != nil {
+			t.Fatalf("Invalid entry %q: %v", l, err)
+		}
+		es = append(es, string(e))
+	}
+	return es
+}
+
+func TestEntriesHandler(t *testing.T) {
+	setFlag(t, batchSize, 4)
+	srv, h := newPOSIXTestServer(t)
+	var leaves []string
+	for i := range 18 {
+		leaves = append(leaves, fmt.Sprintf("leaf %d", i))
+	}
+	addLeaves(t, h, leaves...)
+	for _, test := range []struct {
+		name         string
+		maxEntries   uint64
+		start, count int
+		// want is the range of the leaves which are returned.
+		want     [2]int
+		wantCode int
+	}{
+		{name: "within a bundle", start: 1, count: 2, want: [2]int{1, 3}, wantCode: http.StatusOK},
+		{name: "spanning bundles", start: 3, count: 10, want: [2]int{3, 13}, wantCode: http.StatusOK},
+		{name: "partial bundle", start: 14, count: 3, want: [2]int{14, 17}, wantCode: http.StatusOK},
+		{name: "clamped to tree size", start: 10, count: 100, want: [2]int{10, 18}, wantCode: http.StatusOK},
+		{name: "capped", maxEntries: 5, start: 2, count: 10, want: [2]int{2, 7}, wantCode: http.StatusOK},
+		{name: "not capped", maxEntries: 0, start: 0, count: 100, want: [2]int{0, 18}, wantCode: http.StatusOK},
+		{name: "start beyond tree", start: 18, count: 1, wantCode: http.StatusBadRequest},
+		{name: "zero count", start: 0, count: 0, wantCode: http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv.maxEntries = test.maxEntries
+			w := do(h, http.MethodGet, fmt.Sprintf("/entries?start=%d&count=%d", test.start, test.count), "", nil)
+			if w.Code != test.wantCode {
+				t.Fatalf("GET /entries: got %d %q, want %d", w.Code, w.Body, test.wantCode)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got, want := parseEntries(t, w.Body.String()), leaves[test.want[0]:test.want[1]]; !slices.Equal(got, want) {
+				t.Errorf("GET /entries returned %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestEntriesCorruptBundle(t *testing.T) {
+	setFlag(t, batchSize, 4)
+	dir := t.TempDir()
+	setFlag(t, storageURI, "file://"+dir)
+	_, h := newTestServer(t, testParams())
+	addLeaves(t, h, "zero", "one", "two", "three", "four", "five", "six", "seven")
+	// Replace "five" in the second bundle with a validly encoded entry which isn't the leaf committed to by the tree.
+	bd, bf := layout.SeqPath(dir, 1)
+	f := filepath.Join(bd, bf)
+	b, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	b = bytes.Replace(b, []byte(base64.StdEncoding.EncodeToString([]byte("five"))), []byte(base64.StdEncoding.EncodeToString([]byte("evil"))), 1)
+	if err := os.WriteFile(f, b, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	for _, test := range []struct {
+		start, count int
+		wantCode     int
+	}{
+		{start: 0, count: 4, wantCode: http.StatusOK},
+		{start: 4, count: 1, wantCode: http.StatusOK},
+		{start: 5, count: 1, wantCode: http.StatusInternalServerError},
+		{start: 2, count: 6, wantCode: http.StatusInternalServerError},
+	} {
+		target := fmt.Sprintf("/entries?start=%d&count=%d", test.start, test.count)
+		if w := do(h, http.MethodGet, target, "", nil); w.Code != test.wantCode {
+			t.Errorf("GET %s: got %d %q, want %d", target, w.Code, w.Body, test.wantCode)
+		}
+	}
+}
+
+// handlerTiles is a tlog.TileReader which fetches tiles from a handler's /tile endpoint.
+type handlerTiles struct {
+	h      http.Handler
+	height int
+}
+
+func (ht handlerTiles) Height() int {
+	return ht.height
+}
+
+func (ht handlerTiles) ReadTiles(tiles []tlog.Tile) ([][]byte, error) {
+	r := make([][]byte, len(tiles))
+	for i, tile := range tiles {
+		// The tiles are served without the tile height in their path.
+		p := "/tile/" + strings.TrimPrefix(tile.Path(), fmt.Sprintf("tile/%d/", ht.height))
+		w := do(ht.h, http.MethodGet, p, "", nil)
+		if w.Code != http.StatusOK {
+			return nil, fmt.Errorf("GET %s: got %d %q", p, w.Code, w.Body)
+		}
+		r[i] = w.Body.Bytes()
+	}
+	return r, nil
+}
+
+func (handlerTiles) SaveTiles([]tlog.Tile, [][]byte) {}
+
+func TestTileHandler(t *testing.T) {
+	for _, test := range []struct {
+		height int
+		leaves int
+	}{
+		{height: 8, leaves: 1},
+		{height: 8, leaves: 300},
+		{height: 8, leaves: 70000},
+		{height: 2, leaves: 7},
+		{height: 2, leaves: 100},
+		{height: 3, leaves: 555},
+	} {
+		t.Run(fmt.Sprintf("height %d with %d leaves", test.height, test.leaves), func(t *testing.T) {
+			setFlag(t, batchSize, 256)
+			setFlag(t, tileHeight, test.height)
+			_, h := newPOSIXTestServer(t)
+			var leaves []string
+			for i := range test.leaves {
+				leaves = append(leaves, fmt.Sprintf("leaf %d", i))
+			}
+			addBatches(t, h, leaves...)
+			cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+			tree := tlog.Tree{N: int64(cp.Size), Hash: tlog.Hash(cp.Hash)}
+			// The tiles read are verified against the checkpoint by the TileHashReader.
+			hr := tlog.TileHashReader(tree, handlerTiles{h: h, height: test.height})
+			for _, idx := range []int{0, test.leaves / 3, test.leaves - 1} {
+				p, err := tlog.ProveRecord(tree.N, int64(idx), hr)
+				if err != nil {
+					t.Fatalf("ProveRecord(%d, %d): %v", tree.N, idx, err)
+				}
+				if err := tlog.CheckRecord(p, tree.N, tree.Hash, int64(idx), tlog.RecordHash([]byte(leaves[idx]))); err != nil {
+					t.Errorf("CheckRecord(%d, %d): %v", tree.N, idx, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTileHandlerErrors(t *testing.T) {
+	setFlag(t, batchSize, 4)
+	setFlag(t, tileHeight, 2)
+	_, h := newPOSIXTestServer(t)
+	for i := range 6 {
+		addLeaves(t, h, fmt.Sprintf("leaf %d", i))
+	}
+	for _, test := range []struct {
+		path string
+		want int
+	}{
+		{path: "/tile/0/000", want: http.StatusOK},
+		{path: "/tile/0/001.p/2", want: http.StatusOK},
+		{path: "/tile/0/001.p/1", want: http.StatusOK},
+		{path: "/tile/1/000.p/1", want: http.StatusOK},
+		{path: "/tile/0/001", want: http.StatusNotFound},
+		{path: "/tile/0/001.p/3", want: http.StatusNotFound},
+		{path: "/tile/1/000.p/2", want: http.StatusNotFound},
+		{path: "/tile/0/001.p/4", want: http.StatusBadRequest},
+		{path: "/tile/0/1", want: http.StatusBadRequest},
+		{path: "/tile/x/000", want: http.StatusBadRequest},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			w := do(h, http.MethodGet, test.path, "", nil)
+			if w.Code != test.want {
+				t.Fatalf("GET %s: got %d %q, want %d", test.path, w.Code, w.Body, test.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateAddResponse(t *testing.T) {
+	for _, test := range []struct {
+		accept []string
+		want   string
+	}{
+		{accept: nil, want: "text/plain"},
+		{accept: []string{"*/*"}, want: "text/plain"},
+		{accept: []string{"application/json"}, want: "application/json"},
+		{accept: []string{"application/json, */*;q=0.8"}, want: "application/json"},
+		{accept: []string{"text/plain;q=0.5, application/json;q=0.9"}, want: "application/json"},
+		{accept: []string{"application/json;q=0.1, text/plain"}, want: "text/plain"},
+		{accept: []string{"application/*"}, want: "application/json"},
+		{accept: []string{"application/*;q=0.5", promiseContentType}, want: promiseContentType},
+		{accept: []string{"application/json;q=0, */*"}, want: "text/plain"},
+		{accept: []string{"*/*;q=0.1, application/json;q=0"}, want: "text/plain"},
+		{accept: []string{"image/png"}, want: "text/plain"},
+		{accept: []string{"not a media type, application/json"}, want: "application/json"},
+	} {
+		t.Run(strings.Join(test.accept, "|"), func(t *testing.T) {
+			if got := negotiateAddResponse(test.accept); got != test.want {
+				t.Errorf("negotiateAddResponse(%q) = %q, want %q", test.accept, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAddReceipt(t *testing.T) {
+	_, h := newMemoryTestServer(t)
+	addLeaves(t, h, "one", "two")
+	w := do(h, http.MethodPost, "/add", "three", http.Header{"Accept": {"application/json, */*;q=0.8"}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /add: got %d %q, want 201", w.Code, w.Body)
+	}
+	if got, want := w.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Fatalf("Content-Type: got %q, want %q", got, want)
+	}
+	var rcpt receipt
+	if err := json.Unmarshal(w.Body.Bytes(), &rcpt); err != nil {
+		t.Fatalf("Failed to parse receipt: %v", err)
+	}
+	if rcpt.Index != 2 {
+		t.Errorf("Index: got %d, want 2", rcpt.Index)
+	}
+	cp := parseCheckpoint(t, []byte(rcpt.Checkpoint))
+	if err := proof.VerifyInclusion(rfc6962.DefaultHasher, rcpt.Index, cp.Size, rfc6962.DefaultHasher.HashLeaf([]byte("three")), rcpt.InclusionProof, cp.Hash); err != nil {
+		t.Errorf("VerifyInclusion: %v", err)
+	}
+}
+
+func TestAddEntryTooLarge(t *testing.T) {
+	setFlag(t, batchSize, 4)
+	setFlag(t, bundleMaxBytes, 40)
+	_, h := newPOSIXTestServer(t)
+	for _, test := range []struct {
+		name, target, body string
+		want               int
+	}{
+		{name: "largest entry", target: "/add", body: strings.Repeat("a", 10), want: http.StatusCreated},
+		{name: "too large", target: "/add", body: strings.Repeat("b", 11), want: http.StatusRequestEntityTooLarge},
+		{name: "batch", target: "/add-batch", body: "YQ==\nYmI=\n", want: http.StatusOK},
+		{name: "too large in batch", target: "/add-batch", body: "YQ==\n" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("c", 11))) + "\n", want: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if w := do(h, http.MethodPost, test.target, test.body, nil); w.Code != test.want {
+				t.Errorf("POST %s: got %d %q, want %d", test.target, w.Code, w.Body, test.want)
+			}
+		})
+	}
+}
+
+// parseEntryBundle parses a tlog-tiles entry bundle, in which each entry is preceded by its big-endian uint16
+// length.
+func parseEntryBundle(t *testing.T, b []byte) []string {
+	t.Helper()
+	var es []string
+	for len(b) > 0 {
+		if len(b) < 2 {
+			t.Fatalf("Truncated entry length in bundle")
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+n {
+			t.Fatalf("Truncated entry in bundle")
+		}
+		es = append(es, string(b[2:2+n]))
+		b = b[2+n:]
+	}
+	return es
+}
+
+func TestEntryBundleHandler(t *testing.T) {
+	setFlag(t, batchSize, 4)
+	_, h := newPOSIXTestServer(t)
+	var leaves []string
+	for i := range 12 {
+		leaves = append(leaves, fmt.Sprintf("leaf %d", i))
+	}
+	type fetch struct {
+		path     string
+		wantCode int
+		// want is the range of leaves expected in the bundle.
+		want [2]int
+	}
+	for _, test := range []struct {
+		name string
+		// size is the size the tree is grown to before the bundles are fetched.
+		size    int
+		fetches []fetch
+	}{
+		{name: "partial tail", size: 10, fetches: []fetch{
+			{path: "/tile/entries/000", wantCode: http.StatusOK, want: [2]int{0, 4}},
+			{path: "/tile/entries/001", wantCode: http.StatusOK, want: [2]int{4, 8}},
+			{path: "/tile/entries/002.p/2", wantCode: http.StatusOK, want: [2]int{8, 10}},
+			// A partial bundle of an earlier tree is a prefix of the bundle.
+			{path: "/tile/entries/002.p/1", wantCode: http.StatusOK, want: [2]int{8, 9}},
+			{path: "/tile/entries/001.p/3", wantCode: http.StatusOK, want: [2]int{4, 7}},
+			// Leaves which haven't been committed aren't served.
+			{path: "/tile/entries/002", wantCode: http.StatusNotFound},
+			{path: "/tile/entries/002.p/3", wantCode: http.StatusNotFound},
+			{path: "/tile/entries/003.p/1", wantCode: http.StatusNotFound},
+			{path: "/tile/entries/x001/000", wantCode: http.StatusNotFound},
+			{path: "/tile/entries/000.p/4", wantCode: http.StatusBadRequest},
+			{path: "/tile/entries/000.p/0", wantCode: http.StatusBadRequest},
+			{path: "/tile/entries/2", wantCode: http.StatusBadRequest},
+			{path: "/tile/entries/000/001", wantCode: http.StatusBadRequest},
+		}},
+		{name: "exactly full", size: 12, fetches: []fetch{
+			{path: "/tile/entries/002", wantCode: http.StatusOK, want: [2]int{8, 12}},
+			{path: "/tile/entries/002.p/2", wantCode: http.StatusOK, want: [2]int{8, 10}},
+			{path: "/tile/entries/002.p/3", wantCode: http.StatusOK, want: [2]int{8, 11}},
+			{path: "/tile/entries/003.p/1", wantCode: http.StatusNotFound},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := do(h, http.MethodGet, "/size", "", nil)
+			var ts treeSize
+			if err := json.Unmarshal(w.Body.Bytes(), &ts); err != nil {
+				t.Fatalf("Invalid /size response %q: %v", w.Body, err)
+			}
+			addLeaves(t, h, leaves[ts.Size:test.size]...)
+			for _, f := range test.fetches {
+				w := do(h, http.MethodGet, f.path, "", nil)
+				if w.Code != f.wantCode {
+					t.Errorf("GET %s: got %d %q, want %d", f.path, w.Code, w.Body, f.wantCode)
+					continue
+				}
+				if w.Code != http.StatusOK {
+					continue
+				}
+				if got, want := parseEntryBundle(t, w.Body.Bytes()), leaves[f.want[0]:f.want[1]]; !slices.Equal(got, want) {
+					t.Errorf("GET %s returned %q, want %q", f.path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBundleServer(t *testing.T) {
+	setFlag(t, batchSize, 4)
+	setFlag(t, tileHeight, 2)
+	_, h := newPOSIXTestServer(t)
+	for i := range 6 {
+		addLeaves(t, h, fmt.Sprintf("leaf %d", i))
+	}
+	// Operators may leave their own files alongside the log.
+	for _, f := range []string{".private", "seq/.private", "seq/00/.checkpoint-123"} {
+		if err := os.WriteFile(filepath.Join(*path, filepath.FromSlash(f)), []byte("private"), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	bd, bf := layout.SeqPath("", 0)
+	bundle := "/" + filepath.ToSlash(filepath.Join(bd, bf))
+	for _, test := range []struct {
+		path string
+		want int
+	}{
+		{path: bundle, want: http.StatusOK},
+		{path: "/checkpoint", want: http.StatusOK},
+		{path: "/tile/0/000", want: http.StatusOK},
+		{path: "/checkpoint.lock", want: http.StatusNotFound},
+		{path: "/log.meta", want: http.StatusNotFound},
+		{path: "/.private", want: http.StatusNotFound},
+		{path: "/seq/.private", want: http.StatusNotFound},
+		{path: "/seq/00/.checkpoint-123", want: http.StatusNotFound},
+		{path: "/seq/", want: http.StatusNotFound},
+		{path: "/seq/00", want: http.StatusNotFound},
+		{path: bundle + "/", want: http.StatusNotFound},
+		{path: "/seq/%2e%2e/checkpoint.lock", want: http.StatusNotFound},
+		{path: "/seq/%2e%2e/%2e%2e/etc/passwd", want: http.StatusNotFound},
+		{path: "/seq/00%2f..%2f..%2fcheckpoint.lock", want: http.StatusNotFound},
+		{path: "/", want: http.StatusNotFound},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			w := do(h, http.MethodGet, test.path, "", nil)
+			if w.Code != test.want {
+				t.Fatalf("GET %s: got %d %q, want %d", test.path, w.Code, w.Body, test.want)
+			}
+		})
+	}
+
+	// Unencoded traversal is cleaned up by the mux, which redirects to a path that isn't served.
+	w := do(h, http.MethodGet, "/seq/../checkpoint.lock", "", nil)
+	if loc := w.Header().Get("Location"); w.Code/100 != 3 || loc != "/checkpoint.lock" {
+		t.Fatalf("GET /seq/../checkpoint.lock: got %d redirecting to %q, want redirect to /checkpoint.lock", w.Code, loc)
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	setFlag(t, batchSize, 4)
+	setFlag(t, tileHeight, 2)
+	_, h := newPOSIXTestServer(t)
+	for i := range 6 {
+		addLeaves(t, h, fmt.Sprintf("leaf %d", i))
+	}
+	bd, bf := layout.SeqPath("", 0)
+	for _, test := range []struct {
+		path         string
+		wantCode     int
+		cacheControl string
+		wantETag     bool
+	}{
+		{path: "/checkpoint", wantCode: http.StatusOK, cacheControl: "no-cache", wantETag: true},
+		{path: "/size", wantCode: http.StatusOK, cacheControl: "no-cache"},
+		{path: "/tile/0/000", wantCode: http.StatusOK, cacheControl: immutableCacheControl},
+		{path: "/tile/0/001.p/2", wantCode: http.StatusOK, cacheControl: immutableCacheControl},
+		{path: "/tile/1/000.p/1", wantCode: http.StatusOK, cacheControl: immutableCacheControl},
+		{path: "/" + filepath.ToSlash(filepath.Join(bd, bf)), wantCode: http.StatusOK, cacheControl: immutableCacheControl},
+		// Resources which don't exist yet mustn't be cached.
+		{path: "/tile/0/002", wantCode: http.StatusNotFound},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			w := do(h, http.MethodGet, test.path, "", nil)
+			if w.Code != test.wantCode {
+				t.Fatalf("GET %s: got %d %q, want %d", test.path, w.Code, w.Body, test.wantCode)
+			}
+			if got := w.Header().Get("Cache-Control"); got != test.cacheControl {
+				t.Errorf("Cache-Control: got %q, want %q", got, test.cacheControl)
+			}
+			if got := w.Header().Get("ETag") != ""; got != test.wantETag {
+				t.Errorf("ETag: got %q, want set %t", w.Header().Get("ETag"), test.wantETag)
+			}
+		})
+	}
+
+	t.Run("checkpoint revalidation", func(t *testing.T) {
+		etag := do(h, http.MethodGet, "/checkpoint", "", nil).Header().Get("ETag")
+		w := do(h, http.MethodGet, "/checkpoint", "", http.Header{"If-None-Match": {etag}})
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Fatalf("GET /checkpoint with current ETag: got %d %q, want 304", w.Code, w.Body)
+		}
+		addLeaves(t, h, "leaf 6")
+		w = do(h, http.MethodGet, "/checkpoint", "", http.Header{"If-None-Match": {etag}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /checkpoint with stale ETag: got %d %q, want 200", w.Code, w.Body)
+		}
+		if got := w.Header().Get("ETag"); got == etag {
+			t.Errorf("Got unchanged ETag %s after the checkpoint changed", got)
+		}
+	})
+}
+
+func TestCheckpointHistory(t *testing.T) {
+	setFlag(t, cpHistory, true)
+	_, h := newPOSIXTestServer(t)
+	cps := map[uint64][]byte{}
+	// Each batch is integrated as a whole, so there are no checkpoints for the sizes in between.
+	for i, n := range []int{1, 3, 5} {
+		var leaves []string
+		for j := range n {
+			leaves = append(leaves, fmt.Sprintf("leaf %d.%d", i, j))
+		}
+		addBatches(t, h, leaves...)
+		raw := do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes()
+		cps[parseCheckpoint(t, raw).Size] = raw
+	}
+	for size, want := range cps {
+		w := do(h, http.MethodGet, fmt.Sprintf("/checkpoint/%d", size), "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /checkpoint/%d: got %d %q, want 200", size, w.Code, w.Body)
+		}
+		if !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("GET /checkpoint/%d: got %q, want %q", size, w.Body, want)
+		}
+		if got := w.Header().Get("Cache-Control"); got != immutableCacheControl {
+			t.Errorf("GET /checkpoint/%d: got Cache-Control %q, want %q", size, got, immutableCacheControl)
+		}
+	}
+	for _, test := range []struct {
+		path string
+		want int
+	}{
+		{path: "/checkpoint/2", want: http.StatusNotFound},
+		{path: "/checkpoint/100", want: http.StatusNotFound},
+		{path: "/checkpoint/x", want: http.StatusBadRequest},
+	} {
+		if w := do(h, http.MethodGet, test.path, "", nil); w.Code != test.want {
+			t.Errorf("GET %s: got %d %q, want %d", test.path, w.Code, w.Body, test.want)
+		}
+	}
+}
+
+func TestSizeHandler(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		server func(*testing.T) (*server, http.Handler)
+		adds   []int
+	}{
+		{name: "memory", server: newMemoryTestServer, adds: []int{0, 1, 4}},
+		{name: "POSIX", server: newPOSIXTestServer, adds: []int{0, 2, 1, 300}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, h := test.server(t)
+			var size int
+			for _, n := range test.adds {
+				var leaves []string
+				for i := range n {
+					leaves = append(leaves, fmt.Sprintf("leaf %d", size+i))
+				}
+				addBatches(t, h, leaves...)
+				size += n
+
+				w := do(h, http.MethodGet, "/size", "", nil)
+				if w.Code != http.StatusOK {
+					t.Fatalf("GET /size: got %d %q, want 200", w.Code, w.Body)
+				}
+				if got, want := w.Header().Get("Content-Type"), "application/json"; got != want {
+					t.Errorf("Content-Type: got %q, want %q", got, want)
+				}
+				var got treeSize
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatalf("Failed to parse %q: %v", w.Body, err)
+				}
+				cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+				if got.Size != cp.Size || !bytes.Equal(got.Root, cp.Hash) {
+					t.Errorf("GET /size = {%d, %x}, want the checkpoint's {%d, %x}", got.Size, got.Root, cp.Size, cp.Hash)
+				}
+				if got.Size != uint64(size) {
+					t.Errorf("GET /size: got size %d, want %d", got.Size, size)
+				}
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	setFlag(t, path, t.TempDir())
+	params := log.Params{EntryBundleSize: 4, TileHeight: 2}
+	// The writer holds the writer lease, which the replica mustn't contend for.
+	_, writer := newTestServer(t, params)
+	for i := range 6 {
+		addLeaves(t, writer, fmt.Sprintf("leaf %d", i))
+	}
+	setFlag(t, readOnly, true)
+	// Don't cache the checkpoint written by the writer, so that the replica sees new entries immediately.
+	setFlag(t, cpCacheTTL, 0)
+	_, replica := newTestServer(t, params)
+
+	for _, test := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{method: http.MethodPost, target: "/add", body: "leaf", want: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, target: "/add-batch", body: "bGVhZg==\n", want: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, target: "/checkpoint", want: http.StatusOK},
+		{method: http.MethodGet, target: "/size", want: http.StatusOK},
+		{method: http.MethodGet, target: "/entries?start=0&count=6", want: http.StatusOK},
+		{method: http.MethodGet, target: "/tile/0/000", want: http.StatusOK},
+		{method: http.MethodGet, target: "/tile/0/001.p/2", want: http.StatusOK},
+		{method: http.MethodGet, target: "/proof/inclusion?index=5&size=6", want: http.StatusOK},
+		{method: http.MethodGet, target: "/proof/consistency?from=2&to=6", want: http.StatusOK},
+	} {
+		t.Run(test.method+" "+test.target, func(t *testing.T) {
+			w := do(replica, test.method, test.target, test.body, nil)
+			if w.Code != test.want {
+				t.Fatalf("%s %s: got %d %q, want %d", test.method, test.target, w.Code, w.Body, test.want)
+			}
+			// The replica serves the same log as the writer.
+			if test.method == http.MethodGet {
+				if ww := do(writer, test.method, test.target, "", nil); !bytes.Equal(w.Body.Bytes(), ww.Body.Bytes()) {
+					t.Errorf("GET %s: replica served %q, writer served %q", test.target, w.Body, ww.Body)
+				}
+			}
+		})
+	}
+
+	// The replica follows the entries added by the writer.
+	addLeaves(t, writer, "leaf 6")
+	if cp := parseCheckpoint(t, do(replica, http.MethodGet, "/checkpoint", "", nil).Body.Bytes()); cp.Size != 7 {
+		t.Errorf("Replica serves checkpoint of size %d, want 7", cp.Size)
+	}
+	if got := parseEntries(t, do(replica, http.MethodGet, "/entries?start=6&count=1", "", nil).Body.String()); fmt.Sprint(got) != "[leaf 6]" {
+		t.Errorf("Replica serves entries %q, want [leaf 6]", got)
+	}
+}
+
+// errReader returns err once the bytes of r have been read.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		err = r.err
+	}
+	return n, err
+}
+
+func TestReadBody(t *testing.T) {
+	errBroken := errors.New("broken")
+	for _, test := range []struct {
+		name    string
+		size    int
+		err     error
+		wantErr error
+	}{
+		{name: "empty", size: 0},
+		{name: "small", size: 100},
+		{name: "initial buffer size", size: bodyBufferSize},
+		{name: "grows buffer", size: 3*bodyBufferSize + 1},
+		{name: "too large to pool", size: maxPooledBodyBufferSize + 1},
+		{name: "read error", size: 100, err: errBroken, wantErr: errBroken},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body := make([]byte, test.size)
+			rand.New(rand.NewSource(int64(test.size))).Read(body)
+			var r io.Reader = bytes.NewReader(body)
+			if test.err != nil {
+				r = &errReader{r: r, err: test.err}
+			}
+			got, err := readBody(r)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("readBody = %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(got, body) {
+				t.Fatalf("readBody returned %d bytes which differ from the %d in the body", len(got), len(body))
+			}
+			// The returned bytes mustn't be overwritten when the pooled buffer is reused.
+			want := bytes.Clone(got)
+			if _, err := readBody(bytes.NewReader(bytes.Repeat([]byte{0xff}, test.size+1))); err != nil {
+				t.Fatalf("readBody: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("readBody's result was overwritten by a later read")
+			}
+		})
+	}
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	for _, size := range []int{64, 1 << 10, 16 << 10} {
+		body := bytes.Repeat([]byte{'a'}, size)
+		for _, bm := range []struct {
+			name string
+			read func(io.Reader) ([]byte, error)
+		}{
+			{name: "ReadAll", read: io.ReadAll},
+			{name: "pooled", read: readBody},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", bm.name, size), func(b *testing.B) {
+				b.ReportAllocs()
+				for range b.N {
+					if _, err := bm.read(bytes.NewReader(body)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	setFlag(b, batchMaxAge, time.Millisecond)
+	setFlag(b, inMemory, true)
+	_, h := newTestServer(b, testParams())
+	var n atomic.Int64
+	pad := strings.Repeat("a", 1<<10)
+	b.ReportAllocs()
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			leaf := fmt.Sprintf("%d %s", n.Add(1), pad)
+			if w := do(h, http.MethodPost, "/add", leaf, nil); w.Code != http.StatusCreated {
+				b.Errorf("POST /add: got %d %q, want 201", w.Code, w.Body)
+				return
+			}
+		}
+	})
+}
+
+// getLogInfo returns the metadata served by h at /log-info.
+func getLogInfo(t *testing.T, h http.Handler) log.Metadata {
+	t.Helper()
+	w := do(h, http.MethodGet, "/log-info", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /log-info: got %d %q, want 200", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("GET /log-info: got Content-Type %q, want application/json", ct)
+	}
+	m, err := log.ParseMetadata(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("GET /log-info: %v", err)
+	}
+	return m
+}
+
+func TestLogInfo(t *testing.T) {
+	setFlag(t, batchSize, 16)
+	setFlag(t, tileHeight, 4)
+	setFlag(t, treeHash, "SHA-512")
+	want := log.Metadata{TileHeight: 4, EntryBundleSize: 16, Hash: "SHA-512", Origin: testVerifier(t).Name()}
+	for _, test := range []struct {
+		name string
+		// persisted is set if the log is stored in a directory, to which the metadata is written when it's
+		// created, otherwise it's stored in memory.
+		persisted bool
+	}{
+		{name: "memory"},
+		{name: "POSIX", persisted: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if test.persisted {
+				setFlag(t, storageURI, "file://"+dir)
+			} else {
+				setFlag(t, inMemory, true)
+			}
+			before := time.Now()
+			_, h := newTestServer(t, testParams())
+			after := time.Now()
+			got := getLogInfo(t, h)
+			if !test.persisted {
+				// Logs whose storage doesn't persist metadata are described by their configuration.
+				if got != want {
+					t.Errorf("GET /log-info = %+v, want %+v", got, want)
+				}
+				return
+			}
+			if got.CreatedAt == nil || got.CreatedAt.Before(before) || got.CreatedAt.After(after) {
+				t.Fatalf("GET /log-info: got creation time %v, want between %v and %v", got.CreatedAt, before, after)
+			}
+			created := *got.CreatedAt
+			got.CreatedAt = nil
+			if got != want {
+				t.Errorf("GET /log-info = %+v, want %+v", got, want)
+			}
+			// The metadata served is that written when the log was created...
+			raw, err := os.ReadFile(filepath.Join(dir, log.MetadataPath))
+			if err != nil {
+				t.Fatalf("Metadata wasn't written on init: %v", err)
+			}
+			onDisk, err := log.ParseMetadata(raw)
+			if err != nil {
+				t.Fatalf("ParseMetadata: %v", err)
+			}
+			if onDisk.CreatedAt == nil || !onDisk.CreatedAt.Equal(created) {
+				t.Errorf("%s has creation time %v, but %v was served", log.MetadataPath, onDisk.CreatedAt, created)
+			}
+			// ... which isn't rewritten when the log is reopened.
+			addLeaves(t, h, "one")
+			setFlag(t, readOnly, true)
+			_, h = newTestServer(t, testParams())
+			if got := getLogInfo(t, h); got.CreatedAt == nil || !got.CreatedAt.Equal(created) {
+				t.Errorf("Reopened log has creation time %v, want %v", got.CreatedAt, created)
+			}
+		})
+	}
+}
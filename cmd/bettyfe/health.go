@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// integrationTracker keeps track of whether entries submitted to this process are being integrated.
+type integrationTracker struct {
+	// pending is the number of add requests waiting for their entries to be integrated.
+	pending atomic.Int64
+	// last is the time, in nanoseconds since the Unix epoch, that entries were most recently integrated.
+	last atomic.Int64
+}
+
+func newIntegrationTracker() *integrationTracker {
+	t := &integrationTracker{}
+	t.last.Store(time.Now().UnixNano())
+	return t
+}
+
+// start records that entries are waiting to be integrated, and returns a func which must be called
+// with the outcome once they have been.
+func (t *integrationTracker) start() func(error) {
+	t.pending.Add(1)
+	return func(err error) {
+		if err == nil {
+			t.last.Store(time.Now().UnixNano())
+		}
+		t.pending.Add(-1)
+	}
+}
+
+// stalled returns how long entries have been waiting for integration without any progress, or zero
+// if nothing is waiting.
+// An idle log is never considered stalled, regardless of how long ago it last integrated entries.
+func (t *integrationTracker) stalled() time.Duration {
+	if t.pending.Load() == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, t.last.Load()))
+}
+
+// handleHealthz reports that the process is up.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the process is able to serve the log, i.e. that the log isn't draining, that the
+// current checkpoint is readable, and that submitted entries are not stuck waiting for integration.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.drain.draining.Load() {
+		writeError(w, http.StatusServiceUnavailable, "Log is draining")
+		return
+	}
+	if _, _, err := s.curTree(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Failed to read checkpoint: %v", err)
+		return
+	}
+	if d := s.integration.stalled(); s.maxStaleness > 0 && d > s.maxStaleness {
+		writeError(w, http.StatusServiceUnavailable, "No entries integrated for %v", d.Round(time.Second))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	_, h := newMemoryTestServer(t)
+	if w := do(h, http.MethodGet, "/healthz", "", nil); w.Code != http.StatusOK {
+		t.Errorf("GET /healthz: got %d %q, want 200", w.Code, w.Body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// setup breaks the server, if it should be unready.
+		setup    func(*server)
+		wantCode int
+	}{
+		{name: "healthy", setup: func(*server) {}, wantCode: http.StatusOK},
+		{
+			name: "idle",
+			setup: func(s *server) {
+				s.integration.last.Store(time.Now().Add(-time.Hour).UnixNano())
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "checkpoint unreadable",
+			setup: func(s *server) {
+				s.curTree = func() (uint64, []byte, error) { return 0, nil, errors.New("unreadable") }
+			},
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{
+			name: "stale",
+			setup: func(s *server) {
+				s.integration.start()
+				s.integration.last.Store(time.Now().Add(-time.Hour).UnixNano())
+			},
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{
+			name: "stale but not checked",
+			setup: func(s *server) {
+				s.maxStaleness = 0
+				s.integration.start()
+				s.integration.last.Store(time.Now().Add(-time.Hour).UnixNano())
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "waiting but not yet stale",
+			setup: func(s *server) {
+				s.integration.start()
+			},
+			wantCode: http.StatusOK,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv, h := newMemoryTestServer(t)
+			addLeaves(t, h, "one")
+			srv.maxStaleness = time.Minute
+			test.setup(srv)
+			if w := do(h, http.MethodGet, "/readyz", "", nil); w.Code != test.wantCode {
+				t.Errorf("GET /readyz: got %d %q, want %d", w.Code, w.Body, test.wantCode)
+			}
+		})
+	}
+}
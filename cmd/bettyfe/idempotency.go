@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// idempotencySweepInterval is the minimum time between sweeps of expired keys from memory.
+const idempotencySweepInterval = time.Minute
+
+// idempotencyStore remembers the index assigned to the entry added with each client-supplied idempotency key,
+// so that retried requests return the original index rather than adding the entry again.
+//
+// Keys are persisted to a file so that they survive restarts, and are forgotten once they're older than the TTL.
+type idempotencyStore struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	keys   map[string]*idempotencyEntry
+	lastGC time.Time
+}
+
+type idempotencyEntry struct {
+	// done is closed once the entry has been added, after which index and err are set.
+	done  chan struct{}
+	index uint64
+	err   error
+	added time.Time
+}
+
+// idempotencyRecord is the persisted form of an idempotency key, stored as one JSON object per line.
+type idempotencyRecord struct {
+	Key   string    `json:"key"`
+	Index uint64    `json:"index"`
+	Added time.Time `json:"added"`
+}
+
+// newIdempotencyStore creates an idempotencyStore persisted in the file at path, loading any unexpired
+// keys which it already contains.
+func newIdempotencyStore(path string, ttl time.Duration) (*idempotencyStore, error) {
+	s := &idempotencyStore{
+		ttl:    ttl,
+		keys:   make(map[string]*idempotencyEntry),
+		lastGC: time.Now(),
+	}
+	if err := s.load(path); err != nil {
+		return nil, err
+	}
+	// Rewrite the file with just the unexpired keys, so that it doesn't grow without bound.
+	if err := s.compact(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open idempotency keys file: %v", err)
+	}
+	s.f = f
+	return s, nil
+}
+
+// load reads the unexpired keys from the file at path, if it exists.
+func (s *idempotencyStore) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open idempotency keys file: %v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r idempotencyRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			// The final line may have been partially written if we crashed.
+			klog.Warningf("Ignoring invalid idempotency key record: %v", err)
+			continue
+		}
+		if time.Since(r.Added) > s.ttl {
+			continue
+		}
+		e := &idempotencyEntry{done: make(chan struct{}), index: r.Index, added: r.Added}
+		close(e.done)
+		s.keys[r.Key] = e
+	}
+	return sc.Err()
+}
+
+// compact atomically replaces the file at path with one containing only the currently loaded keys.
+func (s *idempotencyStore) compact(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".idempotency-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for k, e := range s.keys {
+		if err := enc.Encode(idempotencyRecord{Key: k, Index: e.index, Added: e.added}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Do returns the index previously assigned to the entry added with key, or calls add to add the entry if
+// the key hasn't been seen within the TTL.
+// The returned bool is true if the index was previously assigned.
+//
+// Concurrent calls with the same key wait for the first to complete. If add fails, the key is forgotten so
+// that the request may be retried.
+func (s *idempotencyStore) Do(key string, add func() (uint64, error)) (uint64, bool, error) {
+	s.mu.Lock()
+	s.gcLocked()
+	if e, ok := s.keys[key]; ok && time.Since(e.added) <= s.ttl {
+		s.mu.Unlock()
+		<-e.done
+		return e.index, true, e.err
+	}
+	e := &idempotencyEntry{done: make(chan struct{}), added: time.Now()}
+	s.keys[key] = e
+	s.mu.Unlock()
+
+	e.index, e.err = add()
+	if e.err != nil {
+		s.mu.Lock()
+		delete(s.keys, key)
+		s.mu.Unlock()
+	} else if err := s.persist(key, e); err != nil {
+		// The entry has been added, so this isn't a failure of the request; the key is still remembered
+		// until the process restarts.
+		klog.Errorf("Failed to persist idempotency key: %v", err)
+	}
+	close(e.done)
+	return e.index, false, e.err
+}
+
+// persist appends the key to the file, flushing it to stable storage.
+func (s *idempotencyStore) persist(key string, e *idempotencyEntry) error {
+	b, err := json.Marshal(idempotencyRecord{Key: key, Index: e.index, Added: e.added})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// gcLocked forgets expired keys, at most once per idempotencySweepInterval.
+// Must be called with mu held.
+func (s *idempotencyStore) gcLocked() {
+	if time.Since(s.lastGC) < idempotencySweepInterval {
+		return
+	}
+	for k, e := range s.keys {
+		select {
+		case <-e.done:
+			if time.Since(e.added) > s.ttl {
+				delete(s.keys, k)
+			}
+		default:
+			// Still being added.
+		}
+	}
+	s.lastGC = time.Now()
+}
+
+// Close closes the underlying file.
+func (s *idempotencyStore) Close() error {
+	return s.f.Close()
+}
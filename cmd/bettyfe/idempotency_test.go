@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestIdempotencyStore creates an idempotencyStore persisted in path, which is closed when the test completes.
+func newTestIdempotencyStore(t *testing.T, path string, ttl time.Duration) *idempotencyStore {
+	t.Helper()
+	s, err := newIdempotencyStore(path, ttl)
+	if err != nil {
+		t.Fatalf("newIdempotencyStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestAddIdempotencyKey(t *testing.T) {
+	srv, h := newMemoryTestServer(t)
+	srv.idempotency = newTestIdempotencyStore(t, filepath.Join(t.TempDir(), "keys"), time.Hour)
+	for _, test := range []struct {
+		name, key, body string
+		wantCode        int
+		wantIndex       string
+		wantReplayed    bool
+	}{
+		{name: "first", key: "one", body: "a", wantCode: http.StatusCreated, wantIndex: "0"},
+		{name: "retried", key: "one", body: "a", wantCode: http.StatusOK, wantIndex: "0", wantReplayed: true},
+		{name: "retried with different body", key: "one", body: "a, again", wantCode: http.StatusOK, wantIndex: "0", wantReplayed: true},
+		{name: "distinct key", key: "two", body: "b", wantCode: http.StatusCreated, wantIndex: "1"},
+		{name: "without key", body: "c", wantCode: http.StatusCreated, wantIndex: "2"},
+		{name: "distinct key retried", key: "two", body: "b", wantCode: http.StatusOK, wantIndex: "1", wantReplayed: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			hdr := http.Header{}
+			if test.key != "" {
+				hdr.Set("Idempotency-Key", test.key)
+			}
+			w := do(h, http.MethodPost, "/add", test.body, hdr)
+			if w.Code != test.wantCode {
+				t.Fatalf("POST /add: got %d %q, want %d", w.Code, w.Body, test.wantCode)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != test.wantIndex {
+				t.Errorf("Got index %q, want %q", got, test.wantIndex)
+			}
+			if got := w.Header().Get("Idempotent-Replayed") == "true"; got != test.wantReplayed {
+				t.Errorf("Got Idempotent-Replayed %q, want replayed %t", w.Header().Get("Idempotent-Replayed"), test.wantReplayed)
+			}
+		})
+	}
+	if cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes()); cp.Size != 3 {
+		t.Errorf("Got checkpoint of size %d, want 3", cp.Size)
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	s := newTestIdempotencyStore(t, path, time.Hour)
+	var adds atomic.Int64
+	add := func(idx uint64) func() (uint64, error) {
+		return func() (uint64, error) {
+			adds.Add(1)
+			return idx, nil
+		}
+	}
+	check := func(t *testing.T, s *idempotencyStore, key string, idx uint64, wantIdx uint64, wantReplayed bool) {
+		t.Helper()
+		got, replayed, err := s.Do(key, add(idx))
+		if err != nil {
+			t.Fatalf("Do(%q): %v", key, err)
+		}
+		if got != wantIdx || replayed != wantReplayed {
+			t.Errorf("Do(%q) = (%d, %t), want (%d, %t)", key, got, replayed, wantIdx, wantReplayed)
+		}
+	}
+
+	t.Run("repeated", func(t *testing.T) {
+		check(t, s, "one", 1, 1, false)
+		check(t, s, "one", 2, 1, true)
+		check(t, s, "two", 3, 3, false)
+		if got := adds.Load(); got != 2 {
+			t.Errorf("Got %d adds, want 2", got)
+		}
+	})
+
+	t.Run("failed add forgotten", func(t *testing.T) {
+		if _, _, err := s.Do("three", func() (uint64, error) { return 0, errors.New("failed") }); err == nil {
+			t.Fatal("Do succeeded despite add failing")
+		}
+		check(t, s, "three", 4, 4, false)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		adds.Store(0)
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if idx, _, err := s.Do("four", add(5)); err != nil || idx != 5 {
+					t.Errorf("Do(four) = (%d, %v), want 5", idx, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if got := adds.Load(); got != 1 {
+			t.Errorf("Got %d adds, want 1", got)
+		}
+	})
+
+	t.Run("reopened", func(t *testing.T) {
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		s := newTestIdempotencyStore(t, path, time.Hour)
+		check(t, s, "one", 6, 1, true)
+		check(t, s, "four", 6, 5, true)
+		check(t, s, "five", 6, 6, false)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		s := newTestIdempotencyStore(t, path, time.Millisecond)
+		check(t, s, "six", 7, 7, false)
+		time.Sleep(10 * time.Millisecond)
+		check(t, s, "six", 8, 8, false)
+		check(t, s, "one", 8, 8, false)
+	})
+}
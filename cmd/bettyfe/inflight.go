@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	addInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "betty_add_in_flight",
+		Help: "Number of add requests currently being handled.",
+	})
+	addInFlightLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "betty_add_in_flight_limit",
+		Help: "Max number of add requests which may be handled concurrently.",
+	})
+	addRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "betty_add_rejected_total",
+		Help: "Total number of add requests rejected because too many were already in flight.",
+	})
+)
+
+// inFlightLimiter bounds the number of requests which may be handled concurrently.
+type inFlightLimiter struct {
+	sem chan struct{}
+}
+
+// newInFlightLimiter creates an inFlightLimiter which allows up to max concurrent requests.
+func newInFlightLimiter(max int) *inFlightLimiter {
+	addInFlightLimit.Set(float64(max))
+	return &inFlightLimiter{sem: make(chan struct{}, max)}
+}
+
+// Wrap returns a handler which calls h if fewer than the max number of requests are in flight,
+// and otherwise immediately responds with 503 Service Unavailable rather than queuing the request.
+func (l *inFlightLimiter) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			addRejected.Inc()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "Too many requests in flight")
+			return
+		}
+		addInFlight.Inc()
+		defer func() {
+			addInFlight.Dec()
+			<-l.sem
+		}()
+		h(w, r)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestInFlightLimiter(t *testing.T) {
+	for _, limit := range []int{1, 3} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			entered, release := make(chan struct{}), make(chan struct{})
+			h := newInFlightLimiter(limit).Wrap(func(w http.ResponseWriter, r *http.Request) {
+				entered <- struct{}{}
+				<-release
+			})
+
+			// Saturate the limiter with requests which are stuck sequencing.
+			var wg sync.WaitGroup
+			for range limit {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if w := do(h, http.MethodPost, "/add", "leaf", nil); w.Code != http.StatusOK {
+						t.Errorf("POST /add within limit: got %d %q, want 200", w.Code, w.Body)
+					}
+				}()
+				<-entered
+			}
+			before := scrape(t)
+			if got := before["betty_add_in_flight"]; got != float64(limit) {
+				t.Errorf("Got %v requests in flight, want %d", got, limit)
+			}
+			if got := before["betty_add_in_flight_limit"]; got != float64(limit) {
+				t.Errorf("Got in flight limit %v, want %d", got, limit)
+			}
+			for range 3 {
+				w := do(h, http.MethodPost, "/add", "leaf", nil)
+				if w.Code != http.StatusServiceUnavailable {
+					t.Errorf("POST /add beyond limit: got %d %q, want 503", w.Code, w.Body)
+				}
+				if got := w.Header().Get("Retry-After"); got == "" {
+					t.Error("POST /add beyond limit: missing Retry-After")
+				}
+			}
+			if got := scrape(t)["betty_add_rejected_total"] - before["betty_add_rejected_total"]; got != 3 {
+				t.Errorf("Got %v rejected requests, want 3", got)
+			}
+
+			// Requests are accepted again once those in flight complete.
+			close(release)
+			wg.Wait()
+			go func() { <-entered }()
+			if w := do(h, http.MethodPost, "/add", "leaf", nil); w.Code != http.StatusOK {
+				t.Errorf("POST /add after saturation: got %d %q, want 200", w.Code, w.Body)
+			}
+			if got := scrape(t)["betty_add_in_flight"]; got != 0 {
+				t.Errorf("Got %v requests in flight after completion, want 0", got)
+			}
+		})
+	}
+}
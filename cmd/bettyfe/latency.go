@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// latencyBucketGrowth is the ratio between the upper bounds of adjacent buckets in the latency
+	// histogram, and so bounds the relative error of the reported percentiles.
+	latencyBucketGrowth = 1.05
+	// latencyBuckets is the number of buckets in the latency histogram, which with the growth above
+	// covers latencies from 1µs up to a little over 2 hours.
+	latencyBuckets = 512
+)
+
+// latency tracks the time taken to sequence entries, both as a Prometheus histogram and
+// as a simple summary for the periodic log line.
+//
+// Percentiles are calculated from a fixed size log-scaled histogram, so memory use is constant
+// regardless of the number of latencies added.
+type latency struct {
+	sync.Mutex
+	hist    prometheus.Histogram
+	total   time.Duration
+	n       int
+	min     time.Duration
+	max     time.Duration
+	buckets [latencyBuckets]uint64
+}
+
+// newLatency creates a latency tracker, whose histogram metric has the given constant labels.
+func newLatency(labels prometheus.Labels) *latency {
+	return &latency{
+		hist: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:        "betty_sequence_latency_seconds",
+			Help:        "Time taken for an add request to be sequenced and integrated.",
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 14),
+			ConstLabels: labels,
+		}),
+	}
+}
+
+func (l *latency) Add(d time.Duration) {
+	l.hist.Observe(d.Seconds())
+	l.Lock()
+	defer l.Unlock()
+	l.total += d
+	l.n++
+	// min is zero until the first latency is added, which would otherwise never be beaten.
+	if l.n == 1 || d < l.min {
+		l.min = d
+	}
+	if d > l.max {
+		l.max = d
+	}
+	l.buckets[latencyBucket(d)]++
+}
+
+// Snapshot returns a summary of the latencies added since the previous call, and resets them.
+func (l *latency) Snapshot() latencyStats {
+	l.Lock()
+	defer l.Unlock()
+	r := latencyStats{n: l.n, min: l.min, max: l.max}
+	if l.n > 0 {
+		r.mean = l.total / time.Duration(l.n)
+		r.p50 = l.percentile(0.5)
+		r.p90 = l.percentile(0.9)
+		r.p99 = l.percentile(0.99)
+	}
+	l.total, l.n, l.min, l.max = 0, 0, 0, 0
+	l.buckets = [latencyBuckets]uint64{}
+	return r
+}
+
+// percentile returns an estimate of the q-th quantile of the added latencies.
+// Must be called with l locked, and with at least one latency added.
+func (l *latency) percentile(q float64) time.Duration {
+	target := uint64(math.Ceil(q * float64(l.n)))
+	var seen uint64
+	for i, c := range l.buckets {
+		seen += c
+		if seen >= target {
+			// The bucket's upper bound may be larger than anything actually seen.
+			return min(latencyBucketBound(i), l.max)
+		}
+	}
+	return l.max
+}
+
+// latencyBucket returns the index of the histogram bucket which d falls into.
+func latencyBucket(d time.Duration) int {
+	if d <= time.Microsecond {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(float64(d)/float64(time.Microsecond)) / math.Log(latencyBucketGrowth)))
+	return min(i, latencyBuckets-1)
+}
+
+// latencyBucketBound returns the upper bound of the i-th histogram bucket.
+func latencyBucketBound(i int) time.Duration {
+	return time.Duration(float64(time.Microsecond) * math.Pow(latencyBucketGrowth, float64(i)))
+}
+
+// latencyStats summarises the latencies observed over an interval.
+type latencyStats struct {
+	n              int
+	mean, min, max time.Duration
+	p50, p90, p99  time.Duration
+}
+
+func (l latencyStats) String() string {
+	if l.n == 0 {
+		return "--"
+	}
+	return fmt.Sprintf("[Mean: %v P50: %v P90: %v P99: %v Min: %v Max %v]", l.mean, l.p50, l.p90, l.p99, l.min, l.max)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// repeat returns a slice holding n copies of d.
+func repeat(d time.Duration, n int) []time.Duration {
+	r := make([]time.Duration, n)
+	for i := range r {
+		r[i] = d
+	}
+	return r
+}
+
+// newTestLatency returns a latency tracker whose histogram metric isn't registered.
+func newTestLatency() *latency {
+	return &latency{hist: prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_latency_seconds"})}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		name string
+		ds   func() []time.Duration
+	}{
+		{name: "constant", ds: func() []time.Duration {
+			return repeat(3*time.Millisecond, 100)
+		}},
+		{name: "uniform", ds: func() []time.Duration {
+			var r []time.Duration
+			for i := 1; i <= 1000; i++ {
+				r = append(r, time.Duration(i)*time.Millisecond)
+			}
+			rnd.Shuffle(len(r), func(i, j int) { r[i], r[j] = r[j], r[i] })
+			return r
+		}},
+		{name: "bimodal", ds: func() []time.Duration {
+			return append(repeat(time.Millisecond, 95), repeat(time.Second, 5)...)
+		}},
+		{name: "log-normal", ds: func() []time.Duration {
+			var r []time.Duration
+			for range 10000 {
+				r = append(r, time.Duration(math.Exp(rnd.NormFloat64()*2)*float64(time.Millisecond)))
+			}
+			return r
+		}},
+		{name: "single", ds: func() []time.Duration {
+			return []time.Duration{42 * time.Millisecond}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ds := test.ds()
+			l := newTestLatency()
+			for _, d := range ds {
+				l.Add(d)
+			}
+			got := l.Snapshot()
+			slices.Sort(ds)
+			for _, p := range []struct {
+				q   float64
+				got time.Duration
+			}{{0.5, got.p50}, {0.9, got.p90}, {0.99, got.p99}} {
+				// The percentile is reported as the upper bound of the histogram bucket in which it falls.
+				want := ds[int(math.Ceil(p.q*float64(len(ds))))-1]
+				if p.got < want || float64(p.got) > float64(want)*latencyBucketGrowth {
+					t.Errorf("P%v = %v, want within %v of %v", p.q*100, p.got, latencyBucketGrowth, want)
+				}
+			}
+			if got.n != len(ds) || got.max != ds[len(ds)-1] {
+				t.Errorf("Got %d latencies up to %v, want %d up to %v", got.n, got.max, len(ds), ds[len(ds)-1])
+			}
+			// The latencies are reset by each snapshot.
+			if got := l.Snapshot(); got.n != 0 {
+				t.Errorf("Got %d latencies after Snapshot, want 0", got.n)
+			}
+		})
+	}
+}
+
+func TestLatencyMin(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		ds   []time.Duration
+		want time.Duration
+	}{
+		{name: "single", ds: []time.Duration{5 * time.Millisecond}, want: 5 * time.Millisecond},
+		{name: "increasing", ds: []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond}, want: time.Millisecond},
+		{name: "decreasing", ds: []time.Duration{3 * time.Second, 2 * time.Second, time.Second}, want: time.Second},
+		{name: "smallest in the middle", ds: []time.Duration{7 * time.Millisecond, 300 * time.Microsecond, 9 * time.Millisecond}, want: 300 * time.Microsecond},
+		{name: "zero", ds: []time.Duration{time.Millisecond, 0}, want: 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestLatency()
+			// Each snapshot resets the min, so the latencies of one interval don't affect the next.
+			for _, first := range []time.Duration{time.Nanosecond, time.Hour} {
+				l.Add(first)
+				l.Snapshot()
+				for _, d := range test.ds {
+					l.Add(d)
+				}
+				got := l.Snapshot()
+				if got.min != test.want {
+					t.Errorf("After %v: got min %v, want %v", first, got.min, test.want)
+				}
+				if s, want := got.String(), fmt.Sprintf("Min: %v ", test.want); !strings.Contains(s, want) {
+					t.Errorf("After %v: got %q, want it to contain %q", first, s, want)
+				}
+			}
+		})
+	}
+}
@@ -1,167 +1,906 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	pathpkg "path"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+
 	"github.com/AlCutter/betty/log"
-	"github.com/AlCutter/betty/storage/posix"
+	"github.com/AlCutter/betty/log/reader"
+	"github.com/AlCutter/betty/log/witness"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/AlCutter/betty/storage/retry"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	aws_s3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	f_log "github.com/transparency-dev/formats/log"
 	"golang.org/x/mod/sumdb/note"
 	"k8s.io/klog/v2"
 )
 
 var (
+	configFile      = flag.String("config", "", "If set, flags are read from this JSON file, an object keyed by flag name. Flags set on the command line take precedence")
 	leavesPerSecond = flag.Int64("leaves_per_second", 10, "How many leaves to generate per second")
 	leafSize        = flag.Int("leaf_size", 1024, "Leaf size in bytes")
 	numWriters      = flag.Int("num_writers", 100, "Number of parallel writers")
 	path            = flag.String("path", "/tmp/log", "Path to log root diretory")
+	storageURI      = flag.String("storage", "", "If set, the log's storage as a URI, one of file:///path, gs://bucket/prefix, s3://bucket/prefix, azblob://container/prefix, kv:///path or memory:, in place of --path and the backend specific location flags")
 	batchSize       = flag.Int("batch_size", 1, "Size of batch before flushing")
+	durable         = flag.Bool("durable", true, "If true, entries and tiles are fsync'd before being acknowledged, only applies to --path storage")
+	dirModeFlag     = flag.String("dir_mode", "0755", "Octal permissions of the directories created for the log, less the process umask, only applies to --path storage")
+	fileModeFlag    = flag.String("file_mode", "0644", "Octal permissions of the files written for the log, only applies to --path storage")
+	bundleCompress  = flag.String("bundle_compression", "none", "Codec used to compress entry bundles as they're written, one of none, gzip or zstd, only applies to --path storage")
+	dedup           = flag.Bool("dedup", false, "If true, identical leaves are only added to the log once, currently only supported with --path")
+	dedupFilterSize = flag.Int("dedup_filter_size", 0, "If set with --dedup, an in-memory Bloom filter sized for this many leaves lets new leaves skip the leaf index lookup. Requires --writer_lease_ttl")
+	tileHeight      = flag.Int("tile_height", log.DefaultTileHeight, "Number of tree levels stored in each tile, must not change over the life of the log")
+	treeHash        = flag.String("hash", "SHA-256", "Hash function used to build the log's Merkle tree, one of SHA-256, SHA-384, SHA-512 or SHA-512/256, must not change over the life of the log")
 	batchMaxAge     = flag.Duration("batch_max_age", 100*time.Millisecond, "Max age for batch entries before flushing")
+	bundleMaxBytes  = flag.Int("bundle_max_bytes", 0, "If set, batches are also flushed once the total size of their entries reaches this many bytes, and with POSIX storage entries larger than this divided by --batch_size are rejected")
+	batchTarget     = flag.Duration("batch_target_latency", 0, "If set, batches are sized adaptively according to the arrival rate of entries, aiming to flush them within this time, up to --batch_size entries. Only applies to --path storage")
+	seqShards       = flag.Int("sequencer_shards", 1, "If greater than 1, added entries are batched by this many shards, whose batches are sequenced together, to reduce contention at very high write rates. Only applies to --path storage")
+	cpHistory       = flag.Bool("checkpoint_history", false, "If true, each checkpoint is archived so that it can be retrieved from /checkpoint/{size}, only applies to --path storage")
+	cpHistoryKeep   = flag.Int("checkpoint_history_keep", 0, "Max number of archived checkpoints to retain, 0 retains them all")
+	cpCacheTTL      = flag.Duration("checkpoint_cache_ttl", time.Second, "Max time for which a checkpoint read from storage is served from memory, when other processes may write the checkpoint. If this process holds the writer lease, the checkpoint is cached until it writes a new one")
+	cpInterval      = flag.Duration("checkpoint_interval", 0, "If set, a new checkpoint is published at most once per interval, reflecting the latest integrated tree, rather than after every batch. Only applies to --path storage")
+	indexReserve    = flag.Uint64("index_reservation", 0, "If set, the sequence counter is persisted by fsyncing a high-water mark once per block of this many indices, rather than relying on the entry bundles stored by each flush, so that no index is reused after a crash even without --durable. Requires --writer_lease_ttl, only applies to --path storage")
+	integInterval   = flag.Duration("integrate_interval", 0, "If set, sequenced entries are integrated into the tree at most once per interval, rather than after every batch, so that several batches are integrated together. Requires --writer_lease_ttl, only applies to --path storage")
+	tileCacheSize   = flag.Int("tile_cache_size", 1024, "Max number of tiles to cache in memory, 0 disables the cache")
+	writeAttempts   = flag.Int("write_max_attempts", retry.DefaultPolicy.MaxAttempts, "Max number of times each object is written, retrying with exponential backoff if it fails transiently, e.g. because it was throttled. Only applies to --gcs_bucket, --s3_bucket and --azblob_container storage")
+	writeDeadline   = flag.Duration("write_retry_deadline", retry.DefaultPolicy.Deadline, "Max time after its first attempt that a write which failed transiently is retried, zero means no limit. Only applies to --gcs_bucket, --s3_bucket and --azblob_container storage")
+	writeConc       = flag.Int("write_concurrency", 32, "Max number of entry bundle and tile objects written concurrently while integrating a batch, only applies to --gcs_bucket, --s3_bucket and --azblob_container storage")
+	tileCompress    = flag.Bool("tile_compression", false, "If true, tiles are compressed with zstd as they're written")
+	writerLeaseTTL  = flag.Duration("writer_lease_ttl", 30*time.Second, "Time after which the writer lease held by a process which has stopped renewing it is considered stale, 0 disables the lease")
+	takeover        = flag.Bool("takeover", false, "If true, a stale writer lease held by another process is taken over rather than failing at startup")
+	readOnly        = flag.Bool("read_only", false, "If true, only the read endpoints are served, from a log written by another instance, and no writer lease is taken")
+	verifyOnStart   = flag.Bool("verify_on_start", false, "If true, the root hash is recomputed from the stored tiles at startup and checked against the checkpoint, failing if they differ")
+	verifyLeaves    = flag.Uint64("verify_on_start_leaves", 1000, "Max number of randomly chosen leaves whose hashes and inclusion proofs are also checked by --verify_on_start")
+
+	listen          = flag.String("listen", ":2024", "Address:port to listen on")
+	basePath        = flag.String("base_path", "", "If set, every endpoint is served under this URL path prefix, e.g. /logs/foo, which is stripped before requests are dispatched")
+	readHdrTimeout  = flag.Duration("read_header_timeout", 10*time.Second, "Max time to read the headers of each request, 0 means no limit")
+	readTimeout     = flag.Duration("read_timeout", time.Minute, "Max time to read each request, including its body, 0 means no limit. Doesn't apply to /add-stream")
+	writeTimeout    = flag.Duration("write_timeout", time.Minute, "Max time from the end of reading each request's headers to the end of writing its response, 0 means no limit. Doesn't apply to /add-stream")
+	idleTimeout     = flag.Duration("idle_timeout", 2*time.Minute, "Max time to keep an idle keep-alive connection open waiting for the next request, 0 means --read_timeout is used")
+	tlsCert         = flag.String("tls_cert", "", "If set along with --tls_key, the server is served over TLS using this certificate, which is reloaded when it changes")
+	tlsKey          = flag.String("tls_key", "", "Private key for --tls_cert")
+	clientCA        = flag.String("client_ca", "", "If set, add requests must present a client certificate signed by one of the CAs in this file, requires --tls_cert")
+	statsInterval   = flag.Duration("stats_interval", time.Second, "Interval between logging stats")
+	statsJSONFormat = flag.Bool("stats_json", false, "If true, stats are written to stdout as a JSON object per interval, rather than logged as text")
+	logsConfig      = flag.String("logs_config", "", "If set, the logs listed in this JSON file are hosted by this process, each served under /{name}/ with its own path, keys and params, rather than a single log at --path. Only the POSIX storage is supported")
+	pprofAddr       = flag.String("pprof_addr", "", "If set, the net/http/pprof handlers are served under /debug/pprof/ on this address:port, separately from --listen")
+	accessLog       = flag.String("access_log", "", "If set, a JSON line describing each request is appended to this file, or written to stdout if \"-\"")
+	maxEntries      = flag.Uint64("max_entries", 1000, "Max number of entries returned by a single request to /entries, 0 means no limit")
+	entryMetaSize   = flag.Int("entry_metadata_max_size", 0, "If set, /add accepts up to this many bytes of metadata, e.g. a signed timestamp, in a base64 encoded Entry-Metadata header, which is stored alongside the entry without affecting its leaf hash and served by /entry-meta. Only applies to --path storage")
+	leafValidators  = flag.String("leaf_validators", "", "Comma separated list of validators which added entries must pass, otherwise they're rejected with 400 Bad Request: non-empty rejects empty entries, and max-size=N rejects entries larger than N bytes")
+	maxEntrySize    = flag.Int64("max_entry_size", 1<<20, "Max size in bytes of an entry accepted by /add, /add-batch or /add-stream, larger entries are rejected with 413 Request Entity Too Large. 0 means no limit")
+	maxBatchEntries = flag.Int("max_batch_entries", 1000, "Max number of entries accepted by a single request to /add-batch, larger batches are rejected with 413 Request Entity Too Large. Along with --max_entry_size, this bounds the size of /add-batch request bodies. 0 means no limit")
+	streamWindow    = flag.Int("add_stream_window", 1024, "Max number of leaves from each /add-stream request which are sequenced concurrently, beyond which the request body isn't read until the oldest has been sequenced")
+	corsOrigins     = flag.String("cors_allowed_origins", "", "If set, a comma separated list of origins, e.g. https://monitor.example.com, whose browser-based clients may read the responses of the read endpoints, or \"*\" to allow any origin. The add and admin endpoints are never allowed")
+	ctShim          = flag.Bool("ct_shim", false, "If true, the RFC6962 get-sth, get-entries and get-proof-by-hash endpoints are served under /ct/v1/, get-proof-by-hash requires --dedup")
+	otlpEndpoint    = flag.String("otlp_endpoint", "", "If set, traces are exported via OTLP/gRPC to this host:port")
+	otlpInsecure    = flag.Bool("otlp_insecure", false, "If true, traces are exported to --otlp_endpoint without TLS")
+	addRateLimit    = flag.Float64("add_rate_limit", 0, "Max number of add requests per second accepted across all clients, 0 disables this limit")
+	addRateLimitIP  = flag.Float64("add_rate_limit_per_ip", 0, "Max number of add requests per second accepted from each source IP, 0 disables this limit")
+	addRateBurst    = flag.Int("add_rate_burst", 100, "Number of add requests which may exceed the rate limits in a burst")
+	idempotencyFile = flag.String("idempotency_keys_file", "", "If set, the index assigned to each entry added with an Idempotency-Key header is persisted in this file, and requests repeating the key return the same index rather than adding the entry again")
+	idempotencyTTL  = flag.Duration("idempotency_ttl", 24*time.Hour, "How long idempotency keys are remembered for")
+	maxInFlight     = flag.Int("max_in_flight", 0, "Max number of add requests handled concurrently, further requests are rejected with 503 Service Unavailable. 0 means no limit")
+	adminTokensFile = flag.String("admin_tokens_file", "", "If set, the /admin/ endpoints are served to requests presenting one of the bearer tokens listed in this file, one per line. The file is reloaded on SIGHUP")
+	addTokensFile   = flag.String("add_tokens_file", "", "If set, add requests must present one of the bearer tokens listed in this file, one per line. The file is reloaded on SIGHUP")
+	readyMaxStale   = flag.Duration("ready_max_staleness", time.Minute, "Max time that added entries may wait for integration before /readyz reports the server as not ready, 0 disables this check")
+	shutdownTimeout = flag.Duration("shutdown_timeout", 10*time.Second, "Max time to wait for in-flight requests and pending entries on shutdown")
+
+	inMemory = flag.Bool("in_memory", false, "If true, the log is held only in memory and is lost when the process exits")
+
+	gcsBucket = flag.String("gcs_bucket", "", "If set, the log is stored in this GCS bucket rather than at --path")
+	gcsPrefix = flag.String("gcs_prefix", "", "Prefix for the log's objects within --gcs_bucket")
+
+	s3Bucket          = flag.String("s3_bucket", "", "If set, the log is stored in this S3 bucket rather than at --path")
+	s3Prefix          = flag.String("s3_prefix", "", "Prefix for the log's objects within --s3_bucket")
+	s3Region          = flag.String("s3_region", "", "S3 region, defaults to the region from the environment")
+	s3Endpoint        = flag.String("s3_endpoint", "", "If set, overrides the S3 endpoint, e.g. to use MinIO")
+	s3AccessKeyID     = flag.String("s3_access_key_id", "", "S3 access key ID, defaults to credentials from the environment")
+	s3SecretAccessKey = flag.String("s3_secret_access_key", "", "S3 secret access key, used with --s3_access_key_id")
+
+	azblobContainer        = flag.String("azblob_container", "", "If set, the log is stored in this Azure Blob Storage container rather than at --path")
+	azblobPrefix           = flag.String("azblob_prefix", "", "Prefix for the log's blobs within --azblob_container")
+	azblobAccountURL       = flag.String("azblob_account_url", "", "Azure storage account URL, e.g. https://<account>.blob.core.windows.net, authenticated with the default Azure credential (e.g. a managed identity)")
+	azblobConnectionString = flag.String("azblob_connection_string", "", "If set, the Azure storage connection string to use in preference to --azblob_account_url")
+
+	kvPath = flag.String("kv_path", "", "If set, the log is stored in an embedded Pebble database in this directory rather than at --path")
 
-	listen = flag.String("listen", ":2024", "Address:port to listen on")
+	cpWebhook         = flag.String("checkpoint_webhook", "", "If set, each newly published checkpoint is POSTed to this URL as the raw signed note")
+	cpTimestamp       = flag.Bool("checkpoint_timestamp", false, "If true, each checkpoint's body ends with a \"timestamp <ms>\" extension line giving the time at which it was signed, in milliseconds since the Unix epoch")
+	cpExtensions      repeatedFlag
+	cpWebhookAttempts = flag.Int("checkpoint_webhook_attempts", 5, "Max number of attempts at delivering each checkpoint to --checkpoint_webhook, with exponential backoff between them")
 
-	signer   = flag.String("log_signer", "PRIVATE+KEY+Test-Betty+df84580a+Afge8kCzBXU7jb3cV2Q363oNXCufJ6u9mjOY1BGRY9E2", "Log signer")
-	verifier = flag.String("log_verifier", "Test-Betty+df84580a+AQQASqPUZoIHcJAF5mBOryctwFdTV1E0GRY4kEAtTzwB", "log verifier")
+	witnessQuorum  = flag.Int("witness_quorum", 0, "Minimum number of --witness cosignatures required before a checkpoint is published")
+	witnessTimeout = flag.Duration("witness_timeout", 5*time.Second, "Max time to wait for each witness to respond")
+	witnessFlags   repeatedFlag
+
+	signer   = flag.String("log_signer", "PRIVATE+KEY+Test-Betty+df84580a+Afge8kCzBXU7jb3cV2Q363oNXCufJ6u9mjOY1BGRY9E2", "Comma separated list of log signers, the checkpoint is signed by all of them. The first signer's name is used as the log origin")
+	verifier = flag.String("log_verifier", "Test-Betty+df84580a+AQQASqPUZoIHcJAF5mBOryctwFdTV1E0GRY4kEAtTzwB", "Comma separated list of log verifiers, a checkpoint is accepted if it is signed by any of them. The first verifier's name is used as the log origin")
 )
 
+func init() {
+	flag.Var(&witnessFlags, "witness", "A witness to request checkpoint cosignatures from, in the form <verifier key>,<URL>. May be repeated")
+	flag.Var(&cpExtensions, "checkpoint_extension", "An extension line to append to the body of each checkpoint, after the origin, size and root hash. May be repeated")
+}
+
+// repeatedFlag collects the values of a repeated flag.
+type repeatedFlag []string
+
+func (w *repeatedFlag) String() string {
+	return strings.Join(*w, " ")
+}
+
+func (w *repeatedFlag) Set(v string) error {
+	*w = append(*w, v)
+	return nil
+}
+
 // Storage defines the explicit interface that storage implementations must implement for the HTTP handler here.
-// In addition, they'll need to implement the IntegrateStorage methods in log/writer/integrate.go too.
 type Storage interface {
+	// IntegrateStorage provides access to the tiles created during integration.
+	writer.IntegrateStorage
+
 	// Sequence assigns the provided leaf data to an index in the log, returning
 	// that index once it's durably committed.
 	// Implementations are expected to integrate these new entries in a "timely" fashion.
+	// If the leaf is a duplicate of one already in the log, implementations may return its existing
+	// index along with writer.ErrDupeLeaf.
 	Sequence(context.Context, []byte) (uint64, error)
-}
 
-type latency struct {
-	sync.Mutex
-	total time.Duration
-	n     int
-	min   time.Duration
-	max   time.Duration
+	// SequenceBatch assigns a contiguous run of indices to the provided leaves, returning
+	// the assigned indices, in order, once they're durably committed.
+	// Either all of the leaves are sequenced, or none are.
+	SequenceBatch(context.Context, [][]byte) ([]uint64, error)
+
+	// ReadCheckpoint returns the latest signed checkpoint for the log.
+	ReadCheckpoint(context.Context) ([]byte, error)
+
+	// Close sequences and integrates any pending entries, returning once they're durably committed.
+	Close(context.Context) error
 }
 
-func (l *latency) Add(d time.Duration) {
-	l.Lock()
-	defer l.Unlock()
-	l.total += d
-	l.n++
-	if d < l.min {
-		l.min = d
-	}
-	if d > l.max {
-		l.max = d
+// hashFromFlag returns the hash function selected by --hash.
+func hashFromFlag() crypto.Hash {
+	h, err := log.ParseHash(*treeHash)
+	if err != nil {
+		klog.Exitf("Invalid --hash: %v", err)
 	}
+	return h
 }
 
-func (l *latency) String() string {
-	l.Lock()
-	defer l.Unlock()
-	if l.n == 0 {
-		return "--"
+func keysFromFlag() ([]note.Signer, []note.Verifier) {
+	sKeys, vKeys, err := parseKeys(*signer, *verifier)
+	if err != nil {
+		klog.Exit(err)
 	}
-	return fmt.Sprintf("[Mean: %v Min: %v Max %v]", l.total/time.Duration(l.n), l.min, l.max)
+	return sKeys, vKeys
 }
 
-func keysFromFlag() (note.Signer, note.Verifier) {
-	sKey, err := note.NewSigner(*signer)
-	if err != nil {
-		klog.Exitf("Invalid signing key: %v", err)
+// parseKeys parses comma separated lists of note signers and verifiers.
+func parseKeys(signers, verifiers string) ([]note.Signer, []note.Verifier, error) {
+	var sKeys []note.Signer
+	for _, k := range strings.Split(signers, ",") {
+		sKey, err := note.NewSigner(k)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid signing key: %v", err)
+		}
+		sKeys = append(sKeys, sKey)
 	}
-	vKey, err := note.NewVerifier(*verifier)
-	if err != nil {
-		klog.Exitf("Invalid verifier key: %v", err)
+	var vKeys []note.Verifier
+	for _, k := range strings.Split(verifiers, ",") {
+		vKey, err := note.NewVerifier(k)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid verifier key: %v", err)
+		}
+		vKeys = append(vKeys, vKey)
 	}
-	return sKey, vKey
+	return sKeys, vKeys, nil
 }
 
 func main() {
 	klog.InitFlags(nil)
-	flag.Parse()
-	ctx := context.Background()
+	cmd := parseCommandLine()
+	if *configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, *configFile); err != nil {
+			klog.Exitf("Failed to load --config: %v", err)
+		}
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
-	sKey, vKey := keysFromFlag()
-	ct := currentTree(*path, vKey)
-	nt := newTree(*path, sKey)
+	cmd.run(ctx)
+}
 
-	if err := os.MkdirAll(*path, 0o755); err != nil {
-		klog.Exitf("failed to make directory structure: %v", err)
+// runServe serves the logs over HTTP until ctx is done, then shuts down gracefully.
+func runServe(ctx context.Context) {
+	if *streamWindow < 1 {
+		klog.Exit("--add_stream_window must be at least 1")
 	}
-	if _, _, err := ct(); err != nil {
-		klog.Infof("ct: %v", err)
-		if err := nt(0, []byte("Empty")); err != nil {
-			klog.Exitf("Failed to initialise log: %v", err)
+	shutdownTracing := initTracing(ctx)
+
+	tlsConfig := tlsConfigFromFlags()
+	accessLogW := accessLogWriter()
+	wrapAdd := newAddWrapper(ctx)
+	wrapAdmin := newAdminWrapper(ctx)
+	cors, err := newCORSPolicy(*corsOrigins)
+	if err != nil {
+		klog.Exitf("Invalid --cors_allowed_origins: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	var logs []*server
+	if *logsConfig != "" {
+		if logs, err = newHostedLogs(ctx, mux, *logsConfig, wrapAdd, wrapAdmin, cors); err != nil {
+			klog.Exitf("Failed to start logs from --logs_config: %v", err)
 		}
+	} else {
+		sKeys, vKeys := keysFromFlag()
+		var idempotency *idempotencyStore
+		if *idempotencyFile != "" {
+			var err error
+			if idempotency, err = newIdempotencyStore(*idempotencyFile, *idempotencyTTL); err != nil {
+				klog.Exitf("Failed to load idempotency keys: %v", err)
+			}
+			defer idempotency.Close()
+		}
+		params := log.Params{EntryBundleSize: *batchSize, BundleMaxBytes: *bundleMaxBytes, TileHeight: *tileHeight, Hash: hashFromFlag()}
+		loc, err := storageLocation(*path)
+		if err != nil {
+			klog.Exitf("Invalid --storage: %v", err)
+		}
+		srv, err := newLogServer(ctx, "", loc, params, sKeys, vKeys, idempotency)
+		if err != nil {
+			klog.Exit(err)
+		}
+		srv.registerHandlers(mux, wrapAdd, wrapAdmin, cors)
+		logs = append(logs, srv)
 	}
 
-	var s Storage = posix.New(*path, log.Params{EntryBundleSize: *batchSize}, *batchMaxAge, ct, nt)
-	l := &latency{}
+	var ps *http.Server
+	if *pprofAddr != "" {
+		ps = startPprofServer(*pprofAddr)
+	}
 
-	http.HandleFunc("POST /add", func(w http.ResponseWriter, r *http.Request) {
-		n := time.Now()
-		defer func() { l.Add(time.Since(n)) }()
+	for _, srv := range logs {
+		go printStats(ctx, os.Stdout, srv.name, srv.curTree, srv.latency, srv.storage)
+	}
+	hs := newHTTPServer(newAccessLogger(accessLogW).Wrap(withBasePath(mux)), tlsConfig)
+	go func() {
+		var err error
+		if hs.TLSConfig != nil {
+			// The certificate is provided by TLSConfig.GetCertificate.
+			err = hs.ListenAndServeTLS("", "")
+		} else {
+			err = hs.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			klog.Exitf("ListenAndServe: %v", err)
+		}
+	}()
 
-		b, err := io.ReadAll(r.Body)
+	<-ctx.Done()
+	klog.Info("Shutting down")
+	// Use a fresh context here since ctx is already done.
+	sCtx, sCancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer sCancel()
+	// Stop accepting new requests, and wait for those in-flight to complete...
+	if err := hs.Shutdown(sCtx); err != nil {
+		klog.Errorf("Shutdown: %v", err)
+	}
+	if ps != nil {
+		if err := ps.Shutdown(sCtx); err != nil {
+			klog.Errorf("pprof Shutdown: %v", err)
+		}
+	}
+	// ... then ensure that anything still pending is committed.
+	if err := closeLogs(sCtx, logs); err != nil {
+		klog.Exitf("Failed to close storage: %v", err)
+	}
+	if err := shutdownTracing(sCtx); err != nil {
+		klog.Errorf("Failed to shut down tracing: %v", err)
+	}
+}
+
+// newLogServer creates the storage for a log, and the server which handles requests for it.
+// The name distinguishes the log's metrics and stats when several logs are hosted by this process, and is empty
+// otherwise. The log is stored at loc.
+func newLogServer(ctx context.Context, name string, loc *url.URL, params log.Params, sKeys []note.Signer, vKeys []note.Verifier, idempotency *idempotencyStore) (*server, error) {
+	var labels prometheus.Labels
+	if name != "" {
+		labels = prometheus.Labels{"log": name}
+	}
+	params.Name = name
+	if *ctShim && params.Hash != 0 && params.Hash != crypto.SHA256 {
+		return nil, fmt.Errorf("--ct_shim requires the log to use SHA-256, not %s", params.Hash)
+	}
+	lv, err := parseLeafValidators(*leafValidators)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --leaf_validators: %v", err)
+	}
+	if *entryMetaSize > 0 && loc.Scheme != "file" {
+		return nil, fmt.Errorf("--entry_metadata_max_size is only supported by the POSIX storage")
+	}
+	s, ct, cpCache := newStorage(ctx, loc, params, sKeys, vKeys)
+	var bundleDir string
+	if loc.Scheme == "file" {
+		bundleDir = localPath(loc)
+	}
+	if *verifyOnStart {
+		size, root, err := ct()
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return nil, fmt.Errorf("failed to read checkpoint: %v", err)
+		}
+		klog.Infof("Verifying stored tree of size %d", size)
+		if err := reader.VerifyTree(ctx, params, size, root, s, s, *verifyLeaves); err != nil {
+			// Release the writer lease, so that the log can be repaired without waiting for it to expire.
+			if err := s.Close(ctx); err != nil {
+				klog.Errorf("Failed to close storage: %v", err)
+			}
+			return nil, fmt.Errorf("stored tree failed verification: %v", err)
 		}
-		defer r.Body.Close()
-		idx, err := s.Sequence(ctx, b)
+	}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "betty_tree_size",
+		Help:        "Size of the latest integrated tree.",
+		ConstLabels: labels,
+	}, func() float64 {
+		size, _, err := ct()
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf("Failed to sequence entry: %v", err)))
-			return
+			return 0
 		}
-		w.Write([]byte(fmt.Sprintf("%d\n", idx)))
+		return float64(size)
 	})
-	fs := http.FileServer(http.Dir(*path))
-	http.Handle("GET /", fs)
+	if ss, ok := s.(sequencedSizer); ok {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "betty_sequenced_size",
+			Help:        "Size of the smallest tree containing every entry sequenced by this process.",
+			ConstLabels: labels,
+		}, func() float64 {
+			return float64(ss.SequencedSize())
+		})
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "betty_integration_lag_entries",
+			Help:        "Number of entries sequenced by this process which aren't yet in the latest checkpoint. A growing lag means that integration isn't keeping up.",
+			ConstLabels: labels,
+		}, func() float64 {
+			size, _, err := ct()
+			if err != nil {
+				return 0
+			}
+			return float64(integrationLag(ss.SequencedSize(), size))
+		})
+	}
 
-	go printStats(ctx, ct, l)
-	if err := http.ListenAndServe(*listen, http.DefaultServeMux); err != nil {
-		klog.Exitf("ListenAndServe: %v", err)
+	pathPrefix := basePathFromFlag()
+	if name != "" {
+		pathPrefix += "/" + name
 	}
+	return &server{
+		name:       name,
+		pathPrefix: pathPrefix,
+		storage:    s,
+		checkpoint: cpCache,
+		params:     params,
+		curTree:    ct,
+		latency:    newLatency(labels),
+
+		integration:  newIntegrationTracker(),
+		maxStaleness: *readyMaxStale,
+		drain:        &drainer{},
+		idempotency:  idempotency,
+
+		maxEntries:       *maxEntries,
+		maxEntrySize:     *maxEntrySize,
+		maxBatchEntries:  *maxBatchEntries,
+		maxEntryMetaSize: *entryMetaSize,
+		leafValidator:    lv,
+		streamWindow:     *streamWindow,
+		bundleDir:        bundleDir,
+
+		sthSigner: sKeys[0],
+		signers:   sKeys,
+	}, nil
 }
 
-func currentTree(path string, verifier note.Verifier) posix.CurrentTreeFunc {
+// registerHandlers registers the handlers for the log served by srv with mux.
+// The add handlers are wrapped with wrapAdd, the admin handlers are wrapped with wrapAdmin and only registered if
+// it's set, the read handlers are subject to cors if it's set, and the entry bundles are served directly from disk
+// if the log is stored with the POSIX storage.
+func (srv *server) registerHandlers(mux *http.ServeMux, wrapAdd, wrapAdmin func(http.HandlerFunc) http.HandlerFunc, cors *corsPolicy) {
+	// Requests refused while draining shouldn't count against the add limits.
+	add, addBatch, addStream := srv.drain.Wrap(wrapAdd(srv.handleAdd)), srv.drain.Wrap(wrapAdd(srv.handleAddBatch)), srv.drain.Wrap(wrapAdd(srv.handleAddStream))
+	if *readOnly {
+		add, addBatch, addStream = handleReadOnly, handleReadOnly, handleReadOnly
+	}
+	mux.HandleFunc("POST /add", add)
+	mux.HandleFunc("POST /add-batch", addBatch)
+	mux.HandleFunc("POST /add-stream", addStream)
+	mux.HandleFunc("GET /checkpoint", cors.Wrap(srv.handleCheckpoint))
+	mux.HandleFunc("GET /checkpoint/{size}", cors.Wrap(srv.handleCheckpointAt))
+	mux.HandleFunc("GET /size", cors.Wrap(srv.handleSize))
+	mux.HandleFunc("GET /log-info", cors.Wrap(srv.handleLogInfo))
+	mux.HandleFunc("GET /entries", cors.Wrap(srv.handleEntries))
+	mux.HandleFunc("GET /entry-meta", cors.Wrap(srv.handleEntryMeta))
+	mux.HandleFunc("GET /tile/{level}/{index...}", cors.Wrap(srv.handleTile))
+	mux.HandleFunc("GET /tile/entries/{index...}", cors.Wrap(srv.handleEntryBundle))
+	mux.HandleFunc("GET /proof/inclusion", cors.Wrap(srv.handleInclusionProof))
+	mux.HandleFunc("GET /proof/consistency", cors.Wrap(srv.handleConsistencyProof))
+	mux.HandleFunc("GET /readyz", srv.handleReadyz)
+	if wrapAdmin != nil {
+		mux.HandleFunc("POST /admin/flush", wrapAdmin(srv.handleAdminFlush))
+		mux.HandleFunc("POST /admin/drain", wrapAdmin(srv.handleAdminDrain))
+	}
+	if *ctShim {
+		mux.HandleFunc("GET /ct/v1/get-sth", cors.Wrap(srv.handleCTGetSTH))
+		mux.HandleFunc("GET /ct/v1/get-entries", cors.Wrap(srv.handleCTGetEntries))
+		mux.HandleFunc("GET /ct/v1/get-proof-by-hash", cors.Wrap(srv.handleCTGetProofByHash))
+	}
+	if srv.bundleDir != "" {
+		// Serve the entry bundles directly from disk.
+		mux.HandleFunc("GET /seq/", cors.Wrap(newBundleServer(srv.bundleDir)))
+	}
+	if cors != nil {
+		mux.HandleFunc("OPTIONS /", cors.handlePreflight)
+	}
+}
+
+// newAddWrapper returns a func which wraps the add handlers with the limits and authentication configured by flags.
+// The limits are shared by every handler it wraps.
+func newAddWrapper(ctx context.Context) func(http.HandlerFunc) http.HandlerFunc {
+	var wrappers []func(http.HandlerFunc) http.HandlerFunc
+	if *maxInFlight > 0 {
+		// Both kinds of add share the same limit, since they both hold entries in memory until sequenced.
+		l := newInFlightLimiter(*maxInFlight)
+		wrappers = append(wrappers, l.Wrap)
+	}
+	if *addTokensFile != "" {
+		auth, err := newTokenAuth(*addTokensFile)
+		if err != nil {
+			klog.Exitf("Failed to load tokens: %v", err)
+		}
+		go auth.reloadOnSIGHUP(ctx)
+		wrappers = append(wrappers, auth.Wrap)
+	}
+	if *clientCA != "" {
+		wrappers = append(wrappers, requireClientCert)
+	}
+	if *addRateLimit > 0 || *addRateLimitIP > 0 {
+		rl := newRateLimiter(*addRateLimit, *addRateLimitIP, *addRateBurst)
+		wrappers = append(wrappers, rl.Wrap)
+	}
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		for _, w := range wrappers {
+			h = w(h)
+		}
+		return h
+	}
+}
+
+// newAdminWrapper returns a func which wraps the admin handlers to require one of the tokens in --admin_tokens_file,
+// or nil if it's unset, in which case the admin handlers aren't served.
+func newAdminWrapper(ctx context.Context) func(http.HandlerFunc) http.HandlerFunc {
+	if *adminTokensFile == "" {
+		return nil
+	}
+	auth, err := newTokenAuth(*adminTokensFile)
+	if err != nil {
+		klog.Exitf("Failed to load admin tokens: %v", err)
+	}
+	go auth.reloadOnSIGHUP(ctx)
+	return auth.Wrap
+}
+
+// closeLogs closes the storage of each of the logs, returning any errors once they've all been closed.
+func closeLogs(ctx context.Context, logs []*server) error {
+	var errs []error
+	for _, srv := range logs {
+		if err := srv.storage.Close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// accessLogWriter returns the writer to which the access log should be written, or nil if --access_log is unset.
+// The file is left open for the life of the process.
+func accessLogWriter() io.Writer {
+	switch *accessLog {
+	case "":
+		return nil
+	case "-":
+		return os.Stdout
+	}
+	f, err := os.OpenFile(*accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		klog.Exitf("Failed to open access log: %v", err)
+	}
+	return f
+}
+
+// basePathFromFlag returns --base_path in a canonical form, with a leading slash and no trailing slash, or the
+// empty string if the endpoints are served at the root.
+func basePathFromFlag() string {
+	if *basePath == "" {
+		return ""
+	}
+	p := pathpkg.Clean("/" + *basePath)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+// withBasePath returns h mounted under --base_path, which is stripped from request paths before h sees them,
+// or h itself if no base path is set.
+func withBasePath(h http.Handler) http.Handler {
+	bp := basePathFromFlag()
+	if bp == "" {
+		return h
+	}
+	mux := http.NewServeMux()
+	mux.Handle(bp+"/", http.StripPrefix(bp, h))
+	return mux
+}
+
+// newHTTPServer returns a server for h listening on --listen, with the timeouts given by the flags.
+func newHTTPServer(h http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              *listen,
+		Handler:           h,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: *readHdrTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+}
+
+// tlsConfigFromFlags returns the server's TLS config, or nil if the server should not use TLS.
+func tlsConfigFromFlags() *tls.Config {
+	if (*tlsCert == "") != (*tlsKey == "") {
+		klog.Exit("--tls_cert and --tls_key must be set together")
+	}
+	if *clientCA != "" && *tlsCert == "" {
+		klog.Exit("--client_ca requires --tls_cert")
+	}
+	if *tlsCert == "" {
+		return nil
+	}
+	cfg, err := newTLSConfig(*tlsCert, *tlsKey, *clientCA)
+	if err != nil {
+		klog.Exitf("Failed to configure TLS: %v", err)
+	}
+	return cfg
+}
+
+// initTracing configures trace export if --otlp_endpoint is set, otherwise the default no-op
+// tracer is left in place.
+// Returns a func which flushes any pending spans.
+func initTracing(ctx context.Context) func(context.Context) error {
+	if *otlpEndpoint == "" {
+		return func(context.Context) error { return nil }
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(*otlpEndpoint)}
+	if *otlpInsecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exp, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		klog.Exitf("Failed to create OTLP exporter: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("bettyfe"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown
+}
+
+// newS3Client creates an S3 client configured from flags and the environment.
+func newS3Client(ctx context.Context) *aws_s3.Client {
+	var opts []func(*config.LoadOptions) error
+	if *s3Region != "" {
+		opts = append(opts, config.WithRegion(*s3Region))
+	}
+	if *s3AccessKeyID != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(*s3AccessKeyID, *s3SecretAccessKey, "")))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		klog.Exitf("Failed to load AWS config: %v", err)
+	}
+	return aws_s3.NewFromConfig(cfg, func(o *aws_s3.Options) {
+		if *s3Endpoint != "" {
+			// Non-AWS implementations, like MinIO, generally need path style addressing.
+			o.BaseEndpoint = s3Endpoint
+			o.UsePathStyle = true
+		}
+	})
+}
+
+// newAzblobClient creates a client for the named Azure Blob Storage container, configured from flags.
+// A connection string is used if provided, otherwise the default Azure credential chain (environment,
+// workload or managed identity, Azure CLI) is used to authenticate to the account URL.
+func newAzblobClient(name string) *container.Client {
+	if *azblobConnectionString != "" {
+		c, err := container.NewClientFromConnectionString(*azblobConnectionString, name, nil)
+		if err != nil {
+			klog.Exitf("Failed to create Azure Blob Storage client: %v", err)
+		}
+		return c
+	}
+	if *azblobAccountURL == "" {
+		klog.Exit("One of --azblob_connection_string or --azblob_account_url must be set with Azure Blob Storage")
+	}
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		klog.Exitf("Failed to create Azure credential: %v", err)
+	}
+	c, err := container.NewClient(strings.TrimSuffix(*azblobAccountURL, "/")+"/"+name, cred, nil)
+	if err != nil {
+		klog.Exitf("Failed to create Azure Blob Storage client: %v", err)
+	}
+	return c
+}
+
+// initLog writes a checkpoint for an empty tree if the log has not yet been initialised.
+//
+// The log is only initialised if its checkpoint genuinely doesn't exist: any other failure to read it, which may
+// be transient, is returned rather than risking replacing the checkpoint of a log which already has entries.
+func initLog(params log.Params, ct writer.CurrentTreeFunc, nt writer.NewTreeFunc) error {
+	if *readOnly {
+		// Replicas mustn't write to the log, so leave it to the writer to initialise.
+		return nil
+	}
+	_, _, err := ct()
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read checkpoint, so can't tell whether the log needs initialising: %v", err)
+	}
+	klog.Infof("No checkpoint found, initialising empty log")
+	// The root of an empty tree is the hash of the empty string, per RFC6962.
+	if err := nt(0, params.Hasher().EmptyRoot()); err != nil {
+		// Another process may have initialised the log, and even added entries to it, since we looked.
+		if errors.Is(err, writer.ErrCheckpointRollback) {
+			klog.Infof("Log was initialised concurrently by another process")
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// currentTree returns a function which reads the current checkpoint, accepting it if it is signed by any of
+// the verifiers.
+// The checkpoint is only parsed and verified again once it changes.
+func currentTree(readCheckpoint func() ([]byte, error), verifiers []note.Verifier) writer.CurrentTreeFunc {
+	origin := verifiers[0].Name()
+	var (
+		mu   sync.Mutex
+		last []byte
+		cp   *f_log.Checkpoint
+	)
 	return func() (uint64, []byte, error) {
-		b, err := posix.ReadCheckpoint(path)
+		b, err := readCheckpoint()
 		if err != nil {
-			return 0, nil, fmt.Errorf("ReadCheckpoint: %v", err)
+			return 0, nil, fmt.Errorf("ReadCheckpoint: %w", err)
 		}
-		cp, _, _, err := f_log.ParseCheckpoint(b, verifier.Name(), verifier)
+		mu.Lock()
+		defer mu.Unlock()
+		if last != nil && bytes.Equal(b, last) {
+			return cp.Size, cp.Hash, nil
+		}
+		for _, v := range verifiers {
+			c, _, _, err := f_log.ParseCheckpoint(b, origin, v)
+			if err != nil {
+				continue
+			}
+			last, cp = b, c
+			return cp.Size, cp.Hash, nil
+		}
+		return 0, nil, fmt.Errorf("checkpoint is not signed by any of the %d verifiers", len(verifiers))
+	}
+}
+
+// cosignFunc is the signature of a function which adds cosignatures to a signed checkpoint for a tree of the given size.
+type cosignFunc func(signed []byte, size uint64) ([]byte, error)
+
+// deferredTileReader is a reader.TileReader which delegates to a TileReader that's set after construction.
+type deferredTileReader struct {
+	reader.TileReader
+}
+
+// newCosignFunc returns a function which gathers cosignatures from the witnesses configured via flags, or
+// nil if there are none.
+func newCosignFunc(params log.Params, tr reader.TileReader) cosignFunc {
+	if len(witnessFlags) == 0 {
+		return nil
+	}
+	ws := make([]witness.Witness, 0, len(witnessFlags))
+	for _, f := range witnessFlags {
+		vk, u, ok := strings.Cut(f, ",")
+		if !ok {
+			klog.Exitf("Invalid --witness %q, must be <verifier key>,<URL>", f)
+		}
+		v, err := note.NewVerifier(vk)
 		if err != nil {
-			return 0, nil, err
+			klog.Exitf("Invalid witness verifier key %q: %v", vk, err)
 		}
-		return cp.Size, cp.Hash, nil
+		ws = append(ws, witness.Witness{URL: u, Verifier: v})
+	}
+	c, err := witness.New(ws, *witnessQuorum, &http.Client{Timeout: *witnessTimeout})
+	if err != nil {
+		klog.Exitf("Failed to create witness cosigner: %v", err)
+	}
+	proof := func(ctx context.Context, smaller, larger uint64) ([][]byte, error) {
+		return reader.ConsistencyProof(ctx, params, smaller, larger, params.Hasher().HashChildren, tr)
+	}
+	return func(signed []byte, size uint64) ([]byte, error) {
+		// There's nothing for witnesses to verify in an empty tree.
+		if size == 0 {
+			return signed, nil
+		}
+		return c.Cosign(context.Background(), signed, size, proof)
 	}
 }
 
-func newTree(path string, signer note.Signer) posix.NewTreeFunc {
+// newTree returns a function which writes a checkpoint for new trees, signed by all of the signers, and
+// queues it for delivery to the webhook, if there is one.
+func newTree(writeCheckpoint func([]byte) error, signers []note.Signer, cosign cosignFunc, webhook *checkpointWebhook) writer.NewTreeFunc {
 	return func(size uint64, hash []byte) error {
 		cp := &f_log.Checkpoint{
-			Origin: signer.Name(),
+			Origin: signers[0].Name(),
 			Size:   size,
 			Hash:   hash,
 		}
-		n, err := note.Sign(&note.Note{Text: string(cp.Marshal())}, signer)
+		n, err := note.Sign(&note.Note{Text: checkpointBody(cp, checkpointExtensions())}, signers...)
 		if err != nil {
 			return err
 		}
-		return posix.WriteCheckpoint(path, n)
+		if cosign != nil {
+			if n, err = cosign(n, size); err != nil {
+				return fmt.Errorf("failed to cosign checkpoint: %v", err)
+			}
+		}
+		if err := writeCheckpoint(n); err != nil {
+			return err
+		}
+		webhook.Notify(n)
+		return nil
+	}
+}
+
+// checkpointExtensions returns the extension lines to include in a checkpoint signed now.
+func checkpointExtensions() []string {
+	ext := []string(cpExtensions)
+	if *cpTimestamp {
+		ext = append(ext[:len(ext):len(ext)], fmt.Sprintf("timestamp %d", time.Now().UnixMilli()))
 	}
+	return ext
 }
 
-func printStats(ctx context.Context, s posix.CurrentTreeFunc, l *latency) {
-	interval := time.Second
+// checkpointBody returns the text of the note for cp, with the extension lines appended after the origin, size
+// and root hash, as allowed by https://c2sp.org/tlog-checkpoint.
+// Verifiers which don't understand the extensions ignore them, and they're returned as the "rest" of the body
+// by f_log.ParseCheckpoint.
+func checkpointBody(cp *f_log.Checkpoint, extensions []string) string {
+	var b strings.Builder
+	b.Write(cp.Marshal())
+	for _, e := range extensions {
+		b.WriteString(e)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// validateCheckpointExtensions checks that each --checkpoint_extension is a single, non-empty, line.
+func validateCheckpointExtensions() error {
+	for _, e := range cpExtensions {
+		if e == "" || strings.ContainsAny(e, "\n\r") {
+			return fmt.Errorf("invalid --checkpoint_extension %q, must be a single non-empty line", e)
+		}
+	}
+	return nil
+}
+
+// statsJSON is the structure of the stats emitted each interval when --stats_json is set.
+type statsJSON struct {
+	Log      string  `json:"log,omitempty"`
+	Size     uint64  `json:"size"`
+	Delta    uint64  `json:"delta"`
+	Requests int     `json:"requests"`
+	MeanMs   float64 `json:"mean_latency_ms"`
+	P50Ms    float64 `json:"p50_latency_ms"`
+	P90Ms    float64 `json:"p90_latency_ms"`
+	P99Ms    float64 `json:"p99_latency_ms"`
+	MinMs    float64 `json:"min_latency_ms"`
+	MaxMs    float64 `json:"max_latency_ms"`
+	// Flushes counts the batches flushed in the interval by the reason they were flushed, and MaxBatchAgeMs is
+	// the greatest age of the oldest entry in any of them.
+	Flushes       map[writer.FlushReason]int `json:"flushes,omitempty"`
+	MaxBatchAgeMs float64                    `json:"max_batch_age_ms"`
+	Timestamp     string                     `json:"timestamp"`
+}
+
+// flushStatser is implemented by storage which reports on the batches of entries it flushes for sequencing.
+type flushStatser interface {
+	FlushStats() writer.FlushStats
+}
+
+// sequencedSizer is implemented by storage which reports the size of the tree containing every entry it has
+// sequenced, which may be larger than the published checkpoint.
+type sequencedSizer interface {
+	SequencedSize() uint64
+}
+
+// integrationLag returns the number of sequenced entries which aren't in a checkpoint of the given size.
+// The checkpoint may be larger than the sequenced size if it was published by another process, in which case
+// there's no lag.
+func integrationLag(sequenced, cpSize uint64) uint64 {
+	if sequenced <= cpSize {
+		return 0
+	}
+	return sequenced - cpSize
+}
+
+// formatFlushStats summarises fs for the stats log line.
+func formatFlushStats(fs writer.FlushStats) string {
+	if len(fs.Flushes) == 0 {
+		return "--"
+	}
+	var b strings.Builder
+	b.WriteString("[")
+	for _, r := range []writer.FlushReason{writer.FlushSize, writer.FlushBytes, writer.FlushAge, writer.FlushRequested} {
+		if n := fs.Flushes[r]; n > 0 {
+			fmt.Fprintf(&b, "%s: %d ", r, n)
+		}
+	}
+	fmt.Fprintf(&b, "Max age: %v]", fs.MaxAge)
+	return b.String()
+}
+
+// printStats periodically logs the size of the log and the latency of add requests, along with the reasons
+// for which batches were flushed if st reports them.
+// If name is set, it identifies the log in the stats. With --stats_json, the stats are written to out instead.
+func printStats(ctx context.Context, out io.Writer, name string, s writer.CurrentTreeFunc, l *latency, st Storage) {
+	fsr, _ := st.(flushStatser)
+	interval := *statsInterval
+	enc := json.NewEncoder(out)
 	var lastSize uint64
 	for {
 		select {
@@ -173,9 +912,37 @@ func printStats(ctx context.Context, s posix.CurrentTreeFunc, l *latency) {
 				klog.Errorf("Failed to get checkpoint: %v", err)
 				continue
 			}
+			ls := l.Snapshot()
+			var fs writer.FlushStats
+			if fsr != nil {
+				fs = fsr.FlushStats()
+			}
 			if lastSize > 0 {
 				added := size - lastSize
-				klog.Infof("CP size %d (+%d); Latency: %v", size, added, l.String())
+				if !*statsJSONFormat {
+					if name != "" {
+						klog.Infof("Log %s: CP size %d (+%d); Latency: %v; Flushes: %s", name, size, added, ls, formatFlushStats(fs))
+					} else {
+						klog.Infof("CP size %d (+%d); Latency: %v; Flushes: %s", size, added, ls, formatFlushStats(fs))
+					}
+				} else if err := enc.Encode(statsJSON{
+					Log:      name,
+					Size:     size,
+					Delta:    added,
+					Requests: ls.n,
+					MeanMs:   float64(ls.mean) / float64(time.Millisecond),
+					P50Ms:    float64(ls.p50) / float64(time.Millisecond),
+					P90Ms:    float64(ls.p90) / float64(time.Millisecond),
+					P99Ms:    float64(ls.p99) / float64(time.Millisecond),
+					MinMs:    float64(ls.min) / float64(time.Millisecond),
+					MaxMs:    float64(ls.max) / float64(time.Millisecond),
+
+					Flushes:       fs.Flushes,
+					MaxBatchAgeMs: float64(fs.MaxAge) / float64(time.Millisecond),
+					Timestamp:     time.Now().UTC().Format(time.RFC3339Nano),
+				}); err != nil {
+					klog.Errorf("Failed to write stats: %v", err)
+				}
 			}
 			lastSize = size
 		}
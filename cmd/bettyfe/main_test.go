@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log/reader"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	f_log "github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/serverless-log/api"
+	"github.com/transparency-dev/serverless-log/api/layout"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// scrape fetches the metrics served by /metrics, returning the value of each sample by its name and labels as
+// they're written in the text exposition format, e.g. `betty_batch_fill_ratio_bucket{le="0.1"}`.
+func scrape(t *testing.T) map[string]float64 {
+	t.Helper()
+	w := do(promhttp.Handler(), http.MethodGet, "/metrics", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: got %d, want 200", w.Code)
+	}
+	r := map[string]float64{}
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		l := sc.Text()
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(l, ' ')
+		v, err := strconv.ParseFloat(l[i+1:], 64)
+		if err != nil {
+			t.Fatalf("Invalid sample %q: %v", l, err)
+		}
+		r[l[:i]] = v
+	}
+	return r
+}
+
+func TestMetrics(t *testing.T) {
+	srv, h := newPOSIXTestServer(t)
+	before := scrape(t)
+	addLeaves(t, h, "one", "two", "three")
+	after := scrape(t)
+	// The writer's metrics are labelled with the name of the log, which is empty when only one is hosted.
+	if got := after[`betty_entries_sequenced_total{log=""}`] - before[`betty_entries_sequenced_total{log=""}`]; got != 3 {
+		t.Errorf("betty_entries_sequenced_total increased by %v, want 3", got)
+	}
+	// The batches flushed and integrated for the adds are observed.
+	for _, name := range []string{"betty_batch_age_seconds_count", "betty_batch_fill_ratio_count", "betty_integration_duration_seconds_count"} {
+		if k := name + `{log=""}`; after[k] <= before[k] {
+			t.Errorf("%s didn't increase", name)
+		}
+	}
+	var m dto.Metric
+	if err := srv.latency.hist.Write(&m); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 3 {
+		t.Errorf("Got %d sequence latencies, want 3", got)
+	}
+}
+
+func TestIntegrationLag(t *testing.T) {
+	for _, test := range []struct {
+		sequenced, cpSize, want uint64
+	}{
+		{sequenced: 0, cpSize: 0, want: 0},
+		{sequenced: 10, cpSize: 10, want: 0},
+		{sequenced: 10, cpSize: 4, want: 6},
+		{sequenced: 10, cpSize: 0, want: 10},
+		// The checkpoint was published by another process.
+		{sequenced: 4, cpSize: 10, want: 0},
+		{sequenced: 0, cpSize: 10, want: 0},
+	} {
+		if got := integrationLag(test.sequenced, test.cpSize); got != test.want {
+			t.Errorf("integrationLag(%d, %d) = %d, want %d", test.sequenced, test.cpSize, got, test.want)
+		}
+	}
+}
+
+func TestIntegrationLagMetric(t *testing.T) {
+	// Checkpoints covering the sequenced entries are only published when the storage is flushed.
+	setFlag(t, cpInterval, time.Hour)
+	ctx := context.Background()
+	sKeys, vKeys := keysFromFlag()
+	// The gauges are registered by newLogServer, labelled with the log's name, which must be unique to each run.
+	srv, err := newLogServer(ctx, fmt.Sprintf("lag%d", testLogs.Add(1)), &url.URL{Scheme: "file", Path: t.TempDir()}, testParams(), sKeys, vKeys, nil)
+	if err != nil {
+		t.Fatalf("newLogServer: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := srv.storage.Close(ctx); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	})
+	srv.pathPrefix = ""
+	h := http.NewServeMux()
+	srv.registerHandlers(h, func(h http.HandlerFunc) http.HandlerFunc { return h }, nil, nil)
+	label := `{log="` + srv.name + `"}`
+	for _, test := range []struct {
+		name  string
+		add   []string
+		flush bool
+		// want is the expected value of each of the metrics once the leaves are added and the storage flushed.
+		wantSequenced, wantTreeSize, wantLag float64
+	}{
+		{name: "empty"},
+		// Publishing the first checkpoint starts the interval.
+		{name: "first", add: []string{"zero"}, flush: true, wantSequenced: 1, wantTreeSize: 1},
+		{name: "unpublished", add: []string{"one", "two", "three"}, wantSequenced: 4, wantTreeSize: 1, wantLag: 3},
+		{name: "more unpublished", add: []string{"four", "five"}, wantSequenced: 6, wantTreeSize: 1, wantLag: 5},
+		{name: "flushed", flush: true, wantSequenced: 6, wantTreeSize: 6},
+		{name: "after flush", add: []string{"six"}, wantSequenced: 7, wantTreeSize: 6, wantLag: 1},
+		{name: "flushed again", flush: true, wantSequenced: 7, wantTreeSize: 7},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			addLeaves(t, h, test.add...)
+			if test.flush {
+				if err := srv.storage.(flusher).Flush(context.Background()); err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+			}
+			m := scrape(t)
+			for name, want := range map[string]float64{
+				"betty_sequenced_size":          test.wantSequenced,
+				"betty_tree_size":               test.wantTreeSize,
+				"betty_integration_lag_entries": test.wantLag,
+			} {
+				if got := m[name+label]; got != want {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// newKeys returns the encoded signer and verifier keys of a new key pair with the given name.
+func newKeys(t *testing.T, name string) (string, string) {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return skey, vkey
+}
+
+// testKeys returns the keys given by the comma separated signers and verifiers, as passed to --log_signer and
+// --log_verifier.
+func testKeys(t *testing.T, signers, verifiers string) ([]note.Signer, []note.Verifier) {
+	t.Helper()
+	setFlag(t, signer, signers)
+	setFlag(t, verifier, verifiers)
+	return keysFromFlag()
+}
+
+func TestInitLog(t *testing.T) {
+	sKeys, vKeys, err := parseKeys(*signer, *verifier)
+	if err != nil {
+		t.Fatalf("parseKeys: %v", err)
+	}
+	params := testParams()
+	// existing is the checkpoint of a log which already has entries.
+	var existing []byte
+	if err := newTree(func(b []byte) error { existing = b; return nil }, sKeys, nil, nil)(3, []byte("root hash of the tree of size 3")); err != nil {
+		t.Fatalf("newTree: %v", err)
+	}
+	for _, test := range []struct {
+		name     string
+		readOnly bool
+		// readErr is returned when the checkpoint is read, instead of the existing one. writeErr is returned
+		// when a checkpoint is written.
+		readErr  error
+		writeErr error
+		wantInit bool
+		wantErr  bool
+	}{
+		{name: "existing log"},
+		{name: "no checkpoint", readErr: os.ErrNotExist, wantInit: true},
+		{name: "no checkpoint, wrapped", readErr: fmt.Errorf("checkpoint: %w", os.ErrNotExist), wantInit: true},
+		{name: "permission denied", readErr: os.ErrPermission, wantErr: true},
+		{name: "transient error", readErr: errors.New("connection reset"), wantErr: true},
+		{name: "initialised concurrently", readErr: os.ErrNotExist, writeErr: writer.ErrCheckpointRollback},
+		{name: "write fails", readErr: os.ErrNotExist, writeErr: errors.New("disk full"), wantErr: true},
+		{name: "read-only", readOnly: true, readErr: os.ErrNotExist},
+		{name: "read-only with transient error", readOnly: true, readErr: errors.New("connection reset")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, readOnly, test.readOnly)
+			var written []byte
+			read := func() ([]byte, error) {
+				if test.readErr != nil {
+					return nil, test.readErr
+				}
+				return existing, nil
+			}
+			write := func(b []byte) error {
+				if test.writeErr != nil {
+					return test.writeErr
+				}
+				written = b
+				return nil
+			}
+			err := initLog(params, currentTree(read, vKeys), newTree(write, sKeys, nil, nil))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("initLog = %v, want error: %t", err, test.wantErr)
+			}
+			if !test.wantInit {
+				if written != nil {
+					t.Errorf("initLog wrote checkpoint %q, want the log left unchanged", written)
+				}
+				return
+			}
+			cp := parseCheckpoint(t, written)
+			if cp.Size != 0 || !bytes.Equal(cp.Hash, params.Hasher().EmptyRoot()) {
+				t.Errorf("initLog wrote checkpoint of size %d and root %x, want the empty tree", cp.Size, cp.Hash)
+			}
+		})
+	}
+}
+
+func TestMultipleSigners(t *testing.T) {
+	// The old and new keys of a log must share its name, which is the checkpoint's origin.
+	oldS, oldV := newKeys(t, "example.com/log")
+	newS, newV := newKeys(t, "example.com/log")
+	otherS, _ := newKeys(t, "example.com/log")
+	sKeys, vKeys := testKeys(t, oldS+","+newS, oldV+","+newV)
+	if len(sKeys) != 2 || len(vKeys) != 2 {
+		t.Fatalf("keysFromFlag returned %d signers and %d verifiers, want 2 of each", len(sKeys), len(vKeys))
+	}
+	var written []byte
+	write := func(b []byte) error { written = b; return nil }
+	if err := newTree(write, sKeys, nil, nil)(3, []byte("root hash of the tree of size 3")); err != nil {
+		t.Fatalf("newTree: %v", err)
+	}
+	// The checkpoint verifies with each of the keys independently.
+	for i, v := range vKeys {
+		cp, _, _, err := f_log.ParseCheckpoint(written, v.Name(), v)
+		if err != nil {
+			t.Fatalf("ParseCheckpoint with verifier %d: %v", i, err)
+		}
+		if cp.Size != 3 {
+			t.Errorf("Got checkpoint of size %d with verifier %d, want 3", cp.Size, i)
+		}
+	}
+
+	// The log accepts a checkpoint signed by any of its keys, so that it survives the rotation.
+	for _, test := range []struct {
+		name    string
+		signers string
+		wantErr bool
+	}{
+		{name: "both keys", signers: oldS + "," + newS},
+		{name: "old key", signers: oldS},
+		{name: "new key", signers: newS},
+		{name: "unknown key", signers: otherS, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sKeys, _ := testKeys(t, test.signers, oldV)
+			if err := newTree(write, sKeys, nil, nil)(5, []byte("root hash of the tree of size 5")); err != nil {
+				t.Fatalf("newTree: %v", err)
+			}
+			size, _, err := currentTree(func() ([]byte, error) { return written, nil }, vKeys)()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("currentTree: got %v, want error %t", err, test.wantErr)
+			}
+			if err == nil && size != 5 {
+				t.Errorf("currentTree returned size %d, want 5", size)
+			}
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	s, v := newKeys(t, "example.com/log")
+	for _, test := range []struct {
+		name                  string
+		signers, verifiers    string
+		wantSigners, wantVers int
+		wantErr               bool
+	}{
+		{name: "one key", signers: s, verifiers: v, wantSigners: 1, wantVers: 1},
+		{name: "two keys", signers: s + "," + s, verifiers: v + "," + v, wantSigners: 2, wantVers: 2},
+		{name: "invalid signer", signers: s + ",nope", verifiers: v, wantErr: true},
+		{name: "invalid verifier", signers: s, verifiers: "nope", wantErr: true},
+		{name: "verifier as signer", signers: v, verifiers: v, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			sKeys, vKeys, err := parseKeys(test.signers, test.verifiers)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseKeys: got %v, want error %t", err, test.wantErr)
+			}
+			if len(sKeys) != test.wantSigners || len(vKeys) != test.wantVers {
+				t.Errorf("parseKeys returned %d signers and %d verifiers, want %d and %d", len(sKeys), len(vKeys), test.wantSigners, test.wantVers)
+			}
+		})
+	}
+}
+
+func TestPrintStatsJSON(t *testing.T) {
+	setFlag(t, statsInterval, 20*time.Millisecond)
+	setFlag(t, statsJSONFormat, true)
+	srv, h := newPOSIXTestServer(t)
+	addLeaves(t, h, "one", "two")
+	ctx, cancel := context.WithCancel(context.Background())
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		printStats(ctx, w, "", srv.curTree, srv.latency, srv.storage)
+	}()
+	// printStats reads the flags, so must have returned before they're restored.
+	defer func() {
+		cancel()
+		r.Close()
+		<-done
+	}()
+
+	dec := json.NewDecoder(r)
+	var tick statsJSON
+	// Nothing is written for the first interval, so the adds which follow this tick are counted in later ones.
+	if err := dec.Decode(&tick); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	addLeaves(t, h, "three", "four", "five")
+	var delta uint64
+	var requests int
+	for delta < 3 {
+		if err := dec.Decode(&tick); err != nil {
+			t.Fatalf("Failed to decode stats: %v", err)
+		}
+		delta += tick.Delta
+		requests += tick.Requests
+		if _, err := time.Parse(time.RFC3339Nano, tick.Timestamp); err != nil {
+			t.Errorf("Invalid timestamp %q: %v", tick.Timestamp, err)
+		}
+		if tick.Requests > 0 && (tick.MinMs > tick.MaxMs || tick.MeanMs > tick.MaxMs) {
+			t.Errorf("Got inconsistent latencies %+v", tick)
+		}
+	}
+	if delta != 3 || requests != 3 || tick.Size != 5 {
+		t.Errorf("Got %d requests growing the log by %d to size %d, want 3 requests growing it by 3 to size 5", requests, delta, tick.Size)
+	}
+}
+
+// openTestLog opens the POSIX log in dir with the params given by the flags, verifying it if --verify_on_start is
+// set as is done on startup.
+func openTestLog(t *testing.T, dir string) (*server, http.Handler, error) {
+	t.Helper()
+	setFlag(t, path, dir)
+	srv, h := newTestServer(t, testParams())
+	if *verifyOnStart {
+		size, root, err := srv.curTree()
+		if err != nil {
+			t.Fatalf("curTree: %v", err)
+		}
+		if err := reader.VerifyTree(context.Background(), srv.params, size, root, srv.storage, srv.storage, *verifyLeaves); err != nil {
+			if err := srv.storage.Close(context.Background()); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+			return nil, nil, err
+		}
+	}
+	return srv, h, nil
+}
+
+func TestVerifyOnStart(t *testing.T) {
+	// The 10 leaves are stored in the partial level 0 tile of width 10.
+	const n = 10
+	for _, test := range []struct {
+		name    string
+		corrupt func(t *testing.T, tilePath string)
+		wantErr bool
+	}{
+		{
+			name:    "intact",
+			corrupt: func(*testing.T, string) {},
+		}, {
+			name: "changed hash",
+			corrupt: func(t *testing.T, p string) {
+				raw, err := os.ReadFile(p)
+				if err != nil {
+					t.Fatalf("ReadFile: %v", err)
+				}
+				var tile api.Tile
+				if err := tile.UnmarshalText(raw); err != nil {
+					t.Fatalf("UnmarshalText: %v", err)
+				}
+				// Replace rather than modify the hash, whose bytes may be shared with other nodes.
+				h := bytes.Clone(tile.Nodes[0])
+				h[0] ^= 1
+				tile.Nodes[0] = h
+				if raw, err = tile.MarshalText(); err != nil {
+					t.Fatalf("MarshalText: %v", err)
+				}
+				if err := os.WriteFile(p, raw, 0o644); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+			},
+			wantErr: true,
+		}, {
+			name: "half written",
+			corrupt: func(t *testing.T, p string) {
+				if err := os.Truncate(p, 20); err != nil {
+					t.Fatalf("Truncate: %v", err)
+				}
+			},
+			wantErr: true,
+		}, {
+			name: "missing",
+			corrupt: func(t *testing.T, p string) {
+				if err := os.Remove(p); err != nil {
+					t.Fatalf("Remove: %v", err)
+				}
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			srv, h, err := openTestLog(t, dir)
+			if err != nil {
+				t.Fatalf("openTestLog: %v", err)
+			}
+			for i := range n {
+				addLeaves(t, h, fmt.Sprintf("leaf %d", i))
+			}
+			if err := srv.storage.Close(context.Background()); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			test.corrupt(t, filepath.Join(layout.TilePath(dir, 0, 0, n)))
+			setFlag(t, verifyOnStart, true)
+			srv, _, err = openTestLog(t, dir)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("openTestLog with --verify_on_start: got err %v, want err %t", err, test.wantErr)
+			}
+			if err == nil {
+				if err := srv.storage.Close(context.Background()); err != nil {
+					t.Errorf("Close: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestBasePathFromFlag(t *testing.T) {
+	for _, test := range []struct {
+		basePath string
+		want     string
+	}{
+		{basePath: "", want: ""},
+		{basePath: "/", want: ""},
+		{basePath: "logs/foo", want: "/logs/foo"},
+		{basePath: "/logs/foo/", want: "/logs/foo"},
+		{basePath: "//logs//foo", want: "/logs/foo"},
+		{basePath: "/logs/../foo", want: "/foo"},
+	} {
+		t.Run(test.basePath, func(t *testing.T) {
+			setFlag(t, basePath, test.basePath)
+			if got := basePathFromFlag(); got != test.want {
+				t.Errorf("basePathFromFlag() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		basePath string
+		// prefix is the path under which the endpoints are expected to be served.
+		prefix string
+	}{
+		{name: "root", basePath: "", prefix: ""},
+		{name: "prefix", basePath: "/logs/foo", prefix: "/logs/foo"},
+		{name: "uncanonical prefix", basePath: "logs/foo/", prefix: "/logs/foo"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, basePath, test.basePath)
+			srv, mux := newPOSIXTestServer(t)
+			// As for the log served by main.
+			srv.pathPrefix = basePathFromFlag()
+			h := withBasePath(mux)
+
+			w := do(h, http.MethodPost, test.prefix+"/add", "one", nil)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("POST %s/add: got %d %q, want 201", test.prefix, w.Code, w.Body)
+			}
+			// The Location includes the prefix, since it's followed by clients.
+			loc := w.Header().Get("Location")
+			if want := test.prefix + "/entries?start=0&count=1"; loc != want {
+				t.Errorf("Location: got %q, want %q", loc, want)
+			}
+			if w := do(h, http.MethodGet, loc, "", nil); w.Code != http.StatusOK || !slices.Equal(parseEntries(t, w.Body.String()), []string{"one"}) {
+				t.Errorf("GET %s: got %d %q, want the leaf", loc, w.Code, w.Body)
+			}
+
+			w = do(h, http.MethodGet, test.prefix+"/checkpoint", "", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET %s/checkpoint: got %d %q, want 200", test.prefix, w.Code, w.Body)
+			}
+			if cp := parseCheckpoint(t, w.Body.Bytes()); cp.Size != 1 {
+				t.Errorf("Got checkpoint of size %d, want 1", cp.Size)
+			}
+			if w := do(h, http.MethodGet, test.prefix+"/tile/entries/000", "", nil); w.Code != http.StatusOK {
+				t.Errorf("GET %s/tile/entries/000: got %d %q, want 200", test.prefix, w.Code, w.Body)
+			}
+			// Nothing is served outside the prefix.
+			if test.prefix != "" {
+				if w := do(h, http.MethodGet, "/checkpoint", "", nil); w.Code != http.StatusNotFound {
+					t.Errorf("GET /checkpoint: got %d, want 404", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	for _, test := range []struct {
+		name                                string
+		flags                               func(t *testing.T)
+		wantReadHeader, wantRead, wantWrite time.Duration
+		wantIdle                            time.Duration
+	}{
+		{name: "defaults", flags: func(*testing.T) {}, wantReadHeader: 10 * time.Second, wantRead: time.Minute, wantWrite: time.Minute, wantIdle: 2 * time.Minute},
+		{name: "custom", flags: func(t *testing.T) {
+			setFlag(t, readHdrTimeout, time.Second)
+			setFlag(t, readTimeout, 2*time.Second)
+			setFlag(t, writeTimeout, 3*time.Second)
+			setFlag(t, idleTimeout, 4*time.Second)
+		}, wantReadHeader: time.Second, wantRead: 2 * time.Second, wantWrite: 3 * time.Second, wantIdle: 4 * time.Second},
+		{name: "no limits", flags: func(t *testing.T) {
+			setFlag(t, readHdrTimeout, 0)
+			setFlag(t, readTimeout, 0)
+			setFlag(t, writeTimeout, 0)
+			setFlag(t, idleTimeout, 0)
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.flags(t)
+			setFlag(t, listen, "localhost:1234")
+			hs := newHTTPServer(http.NotFoundHandler(), nil)
+			if hs.Addr != "localhost:1234" {
+				t.Errorf("Got address %q, want localhost:1234", hs.Addr)
+			}
+			for _, d := range []struct {
+				name      string
+				got, want time.Duration
+			}{
+				{name: "ReadHeaderTimeout", got: hs.ReadHeaderTimeout, want: test.wantReadHeader},
+				{name: "ReadTimeout", got: hs.ReadTimeout, want: test.wantRead},
+				{name: "WriteTimeout", got: hs.WriteTimeout, want: test.wantWrite},
+				{name: "IdleTimeout", got: hs.IdleTimeout, want: test.wantIdle},
+			} {
+				if d.got != d.want {
+					t.Errorf("Got %s %v, want %v", d.name, d.got, d.want)
+				}
+			}
+		})
+	}
+}
+
+// serveHTTP serves h with the server returned by newHTTPServer on a local port, returning its URL.
+func serveHTTP(t *testing.T, h http.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	hs := newHTTPServer(h, nil)
+	go hs.Serve(ln)
+	t.Cleanup(func() { hs.Close() })
+	return "http://" + ln.Addr().String()
+}
+
+func TestHTTPServerTimeouts(t *testing.T) {
+	setFlag(t, readHdrTimeout, 100*time.Millisecond)
+	setFlag(t, readTimeout, 200*time.Millisecond)
+	setFlag(t, writeTimeout, 200*time.Millisecond)
+	_, h := newMemoryTestServer(t)
+	u := serveHTTP(t, h)
+
+	t.Run("slow headers", func(t *testing.T) {
+		c, err := net.Dial("tcp", strings.TrimPrefix(u, "http://"))
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer c.Close()
+		// The request's headers are never finished, so the connection is closed once the timeout expires.
+		if _, err := io.WriteString(c, "GET /checkpoint HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		if n, err := c.Read(make([]byte, 1024)); err != io.EOF {
+			t.Errorf("Read = (%d, %v), want EOF once the connection is closed", n, err)
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("Connection was closed after %v", d)
+		}
+	})
+
+	// slowBody returns a request body which writes each of the chunks after a delay.
+	slowBody := func(chunks ...[]byte) io.Reader {
+		pr, pw := io.Pipe()
+		go func() {
+			for _, c := range chunks {
+				time.Sleep(150 * time.Millisecond)
+				if _, err := pw.Write(c); err != nil {
+					return
+				}
+			}
+			pw.Close()
+		}()
+		return pr
+	}
+	for _, test := range []struct {
+		name   string
+		target string
+		chunks [][]byte
+		// wantOK is whether the request is expected to succeed despite its body taking longer than the timeout.
+		wantOK bool
+	}{
+		{name: "slow add", target: "/add", chunks: [][]byte{[]byte("sl"), []byte("ow"), []byte(" leaf")}},
+		{name: "slow stream", target: "/add-stream", chunks: [][]byte{streamBody([]byte("one")), streamBody([]byte("two")), streamBody([]byte("three"))}, wantOK: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := http.Post(u+test.target, "application/octet-stream", slowBody(test.chunks...))
+			ok := err == nil && resp.StatusCode < 300
+			if err == nil {
+				defer resp.Body.Close()
+				if b, err := io.ReadAll(resp.Body); err != nil {
+					ok = false
+				} else if test.target == "/add-stream" && len(strings.Fields(string(b))) != 3 {
+					t.Errorf("POST %s returned %q, want 3 indices", test.target, b)
+				}
+			}
+			if ok != test.wantOK {
+				t.Errorf("POST %s succeeded: %t (err: %v), want %t", test.target, ok, err, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestCheckpointExtensions(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		extensions []string
+		timestamp  bool
+	}{
+		{name: "none"},
+		{name: "one", extensions: []string{"witness example.com/w1"}},
+		{name: "several", extensions: []string{"a", "b c", "— unicode —"}},
+		{name: "timestamp", timestamp: true},
+		{name: "extensions and timestamp", extensions: []string{"a"}, timestamp: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, &cpExtensions, repeatedFlag(test.extensions))
+			setFlag(t, cpTimestamp, test.timestamp)
+			if err := validateCheckpointExtensions(); err != nil {
+				t.Fatalf("validateCheckpointExtensions: %v", err)
+			}
+			sKeys, vKeys, err := parseKeys(*signer, *verifier)
+			if err != nil {
+				t.Fatalf("parseKeys: %v", err)
+			}
+			var raw []byte
+			nt := newTree(func(cp []byte) error {
+				raw = cp
+				return nil
+			}, sKeys, nil, nil)
+			hash := sha256.Sum256([]byte("root"))
+			before := time.Now().UnixMilli()
+			if err := nt(42, hash[:]); err != nil {
+				t.Fatalf("newTree: %v", err)
+			}
+			after := time.Now().UnixMilli()
+
+			// The extension lines are covered by the signature, and are returned as the rest of the body when the
+			// checkpoint is verified.
+			v := testVerifier(t)
+			cp, rest, _, err := f_log.ParseCheckpoint(raw, v.Name(), v)
+			if err != nil {
+				t.Fatalf("ParseCheckpoint: %v", err)
+			}
+			if cp.Size != 42 || !bytes.Equal(cp.Hash, hash[:]) {
+				t.Errorf("Got checkpoint (%d, %x), want (42, %x)", cp.Size, cp.Hash, hash)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(rest), "\n"), "\n")
+			if len(rest) == 0 {
+				lines = nil
+			}
+			want := test.extensions
+			if test.timestamp {
+				if len(lines) == 0 {
+					t.Fatalf("Got no extension lines, want a timestamp")
+				}
+				var ts int64
+				if _, err := fmt.Sscanf(lines[len(lines)-1], "timestamp %d", &ts); err != nil {
+					t.Fatalf("Last extension line %q isn't a timestamp: %v", lines[len(lines)-1], err)
+				}
+				if ts < before || ts > after {
+					t.Errorf("Got timestamp %d, want between %d and %d", ts, before, after)
+				}
+				lines = lines[:len(lines)-1]
+			}
+			if !slices.Equal(lines, want) {
+				t.Errorf("Got extension lines %q, want %q", lines, want)
+			}
+			// The log reads back its own checkpoints, extensions and all.
+			size, root, err := currentTree(func() ([]byte, error) { return raw, nil }, vKeys)()
+			if err != nil || size != 42 || !bytes.Equal(root, hash[:]) {
+				t.Errorf("currentTree = (%d, %x, %v), want (42, %x, nil)", size, root, err, hash)
+			}
+			// Tampering with an extension line invalidates the signature.
+			if len(rest) > 0 {
+				tampered := bytes.Replace(raw, rest, append([]byte("x"), rest...), 1)
+				if _, _, _, err := f_log.ParseCheckpoint(tampered, v.Name(), v); err == nil {
+					t.Error("ParseCheckpoint succeeded with a tampered extension line")
+				}
+			}
+		})
+	}
+}
+
+func TestValidateCheckpointExtensions(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		extensions []string
+		wantErr    bool
+	}{
+		{name: "none"},
+		{name: "valid", extensions: []string{"a", "b c"}},
+		{name: "empty", extensions: []string{"a", ""}, wantErr: true},
+		{name: "newline", extensions: []string{"a\nb"}, wantErr: true},
+		{name: "carriage return", extensions: []string{"a\r"}, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, &cpExtensions, repeatedFlag(test.extensions))
+			if err := validateCheckpointExtensions(); (err != nil) != test.wantErr {
+				t.Errorf("validateCheckpointExtensions() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/AlCutter/betty/log"
+	"k8s.io/klog/v2"
+)
+
+// logConfig describes one of the logs hosted by this process when --logs_config is set.
+type logConfig struct {
+	// Name is the URL path prefix under which the log is served, e.g. /{name}/add.
+	Name string `json:"name"`
+	// Path is the root directory of the log's POSIX storage.
+	Path string `json:"path"`
+	// Signer and Verifier are comma separated lists of keys, in the same form as --log_signer and --log_verifier.
+	Signer   string `json:"log_signer"`
+	Verifier string `json:"log_verifier"`
+	// BatchSize, BundleMaxBytes, TileHeight and Hash default to the values of the corresponding flags if unset.
+	BatchSize      int    `json:"batch_size,omitempty"`
+	BundleMaxBytes int    `json:"bundle_max_bytes,omitempty"`
+	TileHeight     int    `json:"tile_height,omitempty"`
+	Hash           string `json:"hash,omitempty"`
+}
+
+// params returns the log's params, taking defaults from flags.
+func (c logConfig) params() log.Params {
+	p := log.Params{EntryBundleSize: *batchSize, BundleMaxBytes: *bundleMaxBytes, TileHeight: *tileHeight, Hash: hashFromFlag()}
+	if c.BatchSize > 0 {
+		p.EntryBundleSize = c.BatchSize
+	}
+	if c.BundleMaxBytes > 0 {
+		p.BundleMaxBytes = c.BundleMaxBytes
+	}
+	if c.TileHeight > 0 {
+		p.TileHeight = c.TileHeight
+	}
+	if c.Hash != "" {
+		// The name has already been checked by loadLogsConfig.
+		p.Hash, _ = log.ParseHash(c.Hash)
+	}
+	return p
+}
+
+// loadLogsConfig reads the JSON list of logs to host from the file f.
+func loadLogsConfig(f string) ([]logConfig, error) {
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []logConfig
+	if err := json.Unmarshal(b, &cfgs); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", f, err)
+	}
+	if len(cfgs) == 0 {
+		return nil, fmt.Errorf("no logs configured in %q", f)
+	}
+	names, paths := make(map[string]bool), make(map[string]bool)
+	for _, c := range cfgs {
+		if !validLogName(c.Name) {
+			return nil, fmt.Errorf("invalid log name %q", c.Name)
+		}
+		if c.Path == "" {
+			return nil, fmt.Errorf("log %q has no path", c.Name)
+		}
+		if c.Hash != "" {
+			if _, err := log.ParseHash(c.Hash); err != nil {
+				return nil, fmt.Errorf("log %q: %v", c.Name, err)
+			}
+		}
+		if names[c.Name] || paths[c.Path] {
+			return nil, fmt.Errorf("log %q has the same name or path as another", c.Name)
+		}
+		names[c.Name], paths[c.Path] = true, true
+	}
+	return cfgs, nil
+}
+
+// validLogName returns true if name can be used as a single URL path segment, and doesn't collide with the
+// endpoints served for the process as a whole.
+func validLogName(name string) bool {
+	if name == "" || name == "metrics" || name == "healthz" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// newHostedLogs creates each of the logs configured in the file f, registering the handlers for each with mux
+// under the log's name. The add and admin handlers of every log are wrapped with wrapAdd and wrapAdmin, and its
+// read handlers are subject to cors.
+//
+// Each log has its own POSIX storage, keys and params, while the remaining flags apply to all of them.
+func newHostedLogs(ctx context.Context, mux *http.ServeMux, f string, wrapAdd, wrapAdmin func(http.HandlerFunc) http.HandlerFunc, cors *corsPolicy) ([]*server, error) {
+	if *storageURI != "" || *inMemory || *gcsBucket != "" || *s3Bucket != "" || *azblobContainer != "" || *kvPath != "" {
+		return nil, fmt.Errorf("only the POSIX storage is supported")
+	}
+	if *idempotencyFile != "" {
+		return nil, fmt.Errorf("--idempotency_keys_file is not supported")
+	}
+	cfgs, err := loadLogsConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	var logs []*server
+	for _, c := range cfgs {
+		srv, err := newHostedLog(ctx, c)
+		if err != nil {
+			// Release the writer leases of the logs which were started, so that they can be restarted promptly.
+			if err := closeLogs(ctx, logs); err != nil {
+				klog.Errorf("Failed to close storage: %v", err)
+			}
+			return nil, fmt.Errorf("log %q: %v", c.Name, err)
+		}
+		logs = append(logs, srv)
+		logMux := http.NewServeMux()
+		srv.registerHandlers(logMux, wrapAdd, wrapAdmin, cors)
+		mux.Handle("/"+c.Name+"/", http.StripPrefix("/"+c.Name, logMux))
+		klog.Infof("Serving log %q from %s under /%s/", c.Name, c.Path, c.Name)
+	}
+	return logs, nil
+}
+
+// newHostedLog creates the server for a single configured log.
+func newHostedLog(ctx context.Context, c logConfig) (*server, error) {
+	sKeys, vKeys, err := parseKeys(c.Signer, c.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	return newLogServer(ctx, c.Name, &url.URL{Scheme: "file", Path: c.Path}, c.params(), sKeys, vKeys, nil)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	f_log "github.com/transparency-dev/formats/log"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// writeLogsConfig writes the configs as a --logs_config file, returning its path.
+func writeLogsConfig(t *testing.T, cfgs []logConfig) string {
+	t.Helper()
+	b, err := json.Marshal(cfgs)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	f := filepath.Join(t.TempDir(), "logs.json")
+	if err := os.WriteFile(f, b, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return f
+}
+
+func TestHostedLogs(t *testing.T) {
+	ctx := context.Background()
+	// The names of the logs distinguish their metrics, so must be unique to each run of the test.
+	n := testLogs.Add(1)
+	type hostedLog struct {
+		cfg      logConfig
+		verifier note.Verifier
+		leaves   []string
+	}
+	var logs []*hostedLog
+	for _, name := range []string{fmt.Sprintf("alpha%d", n), fmt.Sprintf("beta%d", n)} {
+		s, v := newKeys(t, "example.com/"+name)
+		nv, err := note.NewVerifier(v)
+		if err != nil {
+			t.Fatalf("NewVerifier: %v", err)
+		}
+		logs = append(logs, &hostedLog{
+			cfg:      logConfig{Name: name, Path: t.TempDir(), Signer: s, Verifier: v},
+			verifier: nv,
+		})
+	}
+	// The logs have different shapes.
+	logs[1].cfg.BatchSize, logs[1].cfg.TileHeight = 4, 2
+	var cfgs []logConfig
+	for _, l := range logs {
+		cfgs = append(cfgs, l.cfg)
+	}
+
+	mux := http.NewServeMux()
+	srvs, err := newHostedLogs(ctx, mux, writeLogsConfig(t, cfgs), func(h http.HandlerFunc) http.HandlerFunc { return h }, nil, nil)
+	if err != nil {
+		t.Fatalf("newHostedLogs: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := closeLogs(ctx, srvs); err != nil {
+			t.Errorf("closeLogs: %v", err)
+		}
+	})
+
+	// Interleave adds to the logs, so that each would see the other's leaves if they weren't isolated.
+	for i := range 5 {
+		for j, l := range logs[:1+i%2] {
+			leaf := fmt.Sprintf("log %d leaf %d", j, len(l.leaves))
+			if w := do(mux, http.MethodPost, "/"+l.cfg.Name+"/add", leaf, nil); w.Code != http.StatusCreated {
+				t.Fatalf("POST /%s/add: got %d %q, want 201", l.cfg.Name, w.Code, w.Body)
+			}
+			l.leaves = append(l.leaves, leaf)
+		}
+	}
+
+	for i, l := range logs {
+		other := logs[1-i]
+		t.Run(l.cfg.Name, func(t *testing.T) {
+			var size treeSize
+			if err := json.Unmarshal(do(mux, http.MethodGet, "/"+l.cfg.Name+"/size", "", nil).Body.Bytes(), &size); err != nil {
+				t.Fatalf("Failed to parse size: %v", err)
+			}
+			if size.Size != uint64(len(l.leaves)) {
+				t.Errorf("Got size %d, want %d", size.Size, len(l.leaves))
+			}
+
+			raw := do(mux, http.MethodGet, "/"+l.cfg.Name+"/checkpoint", "", nil).Body.Bytes()
+			cp, _, _, err := f_log.ParseCheckpoint(raw, l.verifier.Name(), l.verifier)
+			if err != nil {
+				t.Fatalf("ParseCheckpoint: %v", err)
+			}
+			if cp.Size != uint64(len(l.leaves)) {
+				t.Errorf("Got checkpoint of size %d, want %d", cp.Size, len(l.leaves))
+			}
+			// Each log's checkpoints are signed only by its own key.
+			if _, _, _, err := f_log.ParseCheckpoint(raw, other.verifier.Name(), other.verifier); err == nil {
+				t.Errorf("Checkpoint verified with the key of log %q", other.cfg.Name)
+			}
+
+			// Each log's writer metrics are labelled with its name.
+			if got := scrape(t)[fmt.Sprintf("betty_entries_sequenced_total{log=%q}", l.cfg.Name)]; got != float64(len(l.leaves)) {
+				t.Errorf("Got %v entries sequenced, want %d", got, len(l.leaves))
+			}
+
+			w := do(mux, http.MethodGet, fmt.Sprintf("/%s/entries?start=0&count=%d", l.cfg.Name, len(l.leaves)), "", nil)
+			if got := parseEntries(t, w.Body.String()); strings.Join(got, ",") != strings.Join(l.leaves, ",") {
+				t.Errorf("Got entries %q, want %q", got, l.leaves)
+			}
+		})
+	}
+
+	if w := do(mux, http.MethodGet, "/unknown/size", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /unknown/size: got %d, want 404", w.Code)
+	}
+}
+
+func TestLoadLogsConfig(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		cfgs    []logConfig
+		wantErr bool
+	}{
+		{name: "valid", cfgs: []logConfig{{Name: "a", Path: "/a"}, {Name: "b-2_c", Path: "/b", Hash: "SHA-256"}}},
+		{name: "none", wantErr: true},
+		{name: "no name", cfgs: []logConfig{{Path: "/a"}}, wantErr: true},
+		{name: "name with slash", cfgs: []logConfig{{Name: "a/b", Path: "/a"}}, wantErr: true},
+		{name: "reserved name", cfgs: []logConfig{{Name: "metrics", Path: "/a"}}, wantErr: true},
+		{name: "no path", cfgs: []logConfig{{Name: "a"}}, wantErr: true},
+		{name: "invalid hash", cfgs: []logConfig{{Name: "a", Path: "/a", Hash: "MD5"}}, wantErr: true},
+		{name: "duplicate name", cfgs: []logConfig{{Name: "a", Path: "/a"}, {Name: "a", Path: "/b"}}, wantErr: true},
+		{name: "duplicate path", cfgs: []logConfig{{Name: "a", Path: "/a"}, {Name: "b", Path: "/a"}}, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadLogsConfig(writeLogsConfig(t, test.cfgs))
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("loadLogsConfig: got err %v, want err %t", err, test.wantErr)
+			}
+		})
+	}
+}
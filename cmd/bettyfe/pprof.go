@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/pprof"
+
+	"k8s.io/klog/v2"
+)
+
+// startPprofServer serves the net/http/pprof handlers on addr, on a mux of their own so that they're never
+// reachable via the public listener.
+// The returned server should be shut down along with the public one.
+func startPprofServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	ps := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		klog.Infof("Serving pprof on %s", addr)
+		if err := ps.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			klog.Exitf("pprof ListenAndServe: %v", err)
+		}
+	}()
+	return ps
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address on which nothing is currently listening.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestPprofServer(t *testing.T) {
+	addr := freeAddr(t)
+	ps := startPprofServer(addr)
+	t.Cleanup(func() {
+		if err := ps.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+
+	get := func(path string) (int, string, error) {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b), err
+	}
+	// The server is started in the background, so wait for it to be listening.
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, _, err := get("/debug/pprof/"); err == nil {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatalf("pprof server isn't serving: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		path string
+		// want is a substring of the expected response.
+		want string
+	}{
+		{path: "/debug/pprof/", want: "heap"},
+		{path: "/debug/pprof/heap?debug=1", want: "heap profile"},
+		{path: "/debug/pprof/goroutine?debug=1", want: "goroutine profile"},
+		{path: "/debug/pprof/cmdline", want: "bettyfe"},
+		{path: "/debug/pprof/symbol", want: "num_symbols"},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			code, body, err := get(test.path)
+			if err != nil {
+				t.Fatalf("GET %s: %v", test.path, err)
+			}
+			if code != http.StatusOK || !strings.Contains(body, test.want) {
+				t.Errorf("GET %s: got %d %.100q, want 200 containing %q", test.path, code, body, test.want)
+			}
+		})
+	}
+}
+
+func TestPprofNotPublic(t *testing.T) {
+	_, h := newMemoryTestServer(t)
+	if w := do(h, http.MethodGet, "/debug/pprof/", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET /debug/pprof/ on the public mux: got %d, want 404", w.Code)
+	}
+}
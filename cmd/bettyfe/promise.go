@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/mod/sumdb/note"
+	"k8s.io/klog/v2"
+)
+
+// promiseContentType is the media type of the signed promises returned by handleAdd to clients which accept it.
+const promiseContentType = "application/x-betty-promise"
+
+// promiseHeader is the first line of a promise's note text, distinguishing it from a checkpoint signed by the
+// same keys.
+const promiseHeader = "betty-promise/v1"
+
+// writePromise writes a note, signed by the log's signers, promising that the leaf with the given data has been
+// assigned the given index and will be included in checkpoints of larger trees.
+//
+// Unlike a receipt, the promise doesn't wait for a checkpoint which includes the leaf to be published, so it's
+// available as soon as the leaf is sequenced. The leaf can later be checked against a checkpoint with an inclusion
+// proof for the promised index and leaf hash.
+//
+// The note text is:
+//
+//	betty-promise/v1
+//	<origin>
+//	<index>
+//	<base64 leaf hash>
+//	<time the promise was made, in milliseconds since the Unix epoch>
+func (s *server) writePromise(w http.ResponseWriter, status int, idx uint64, leaf []byte) {
+	text := fmt.Sprintf("%s\n%s\n%d\n%s\n%d\n",
+		promiseHeader,
+		s.signers[0].Name(),
+		idx,
+		base64.StdEncoding.EncodeToString(s.params.Hasher().HashLeaf(leaf)),
+		time.Now().UnixMilli())
+	p, err := note.Sign(&note.Note{Text: text}, s.signers...)
+	if err != nil {
+		klog.Errorf("Failed to sign promise for leaf %d: %v", idx, err)
+		writeError(w, http.StatusInternalServerError, "Internal error")
+		return
+	}
+	w.Header().Set("Content-Type", promiseContentType)
+	w.WriteHeader(status)
+	w.Write(p)
+}
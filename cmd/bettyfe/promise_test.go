@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// parsedPromise holds the fields of a promise's note text.
+type parsedPromise struct {
+	origin   string
+	index    uint64
+	leafHash []byte
+	time     time.Time
+}
+
+// openPromise verifies the promise with the default --log_verifier and parses its note text.
+func openPromise(t *testing.T, raw []byte) parsedPromise {
+	t.Helper()
+	n, err := note.Open(raw, note.VerifierList(testVerifier(t)))
+	if err != nil {
+		t.Fatalf("Failed to verify promise %q: %v", raw, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(n.Text, "\n"), "\n")
+	if len(lines) != 5 || lines[0] != promiseHeader {
+		t.Fatalf("Promise text %q isn't a %s promise", n.Text, promiseHeader)
+	}
+	var p parsedPromise
+	p.origin = lines[1]
+	if p.index, err = strconv.ParseUint(lines[2], 10, 64); err != nil {
+		t.Fatalf("Invalid promised index %q: %v", lines[2], err)
+	}
+	if p.leafHash, err = base64.StdEncoding.DecodeString(lines[3]); err != nil {
+		t.Fatalf("Invalid promised leaf hash %q: %v", lines[3], err)
+	}
+	ms, err := strconv.ParseInt(lines[4], 10, 64)
+	if err != nil {
+		t.Fatalf("Invalid promise time %q: %v", lines[4], err)
+	}
+	p.time = time.UnixMilli(ms)
+	return p
+}
+
+func TestPromise(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		server func(*testing.T) (*server, http.Handler)
+	}{
+		{name: "memory", server: newMemoryTestServer},
+		{name: "POSIX", server: newPOSIXTestServer},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, h := test.server(t)
+			addLeaves(t, h, "one", "two")
+			before := time.Now().Truncate(time.Millisecond)
+			w := do(h, http.MethodPost, "/add", "three", http.Header{"Accept": {promiseContentType}})
+			if w.Code != http.StatusCreated {
+				t.Fatalf("POST /add: got %d %q, want 201", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != promiseContentType {
+				t.Fatalf("Content-Type: got %q, want %q", got, promiseContentType)
+			}
+			p := openPromise(t, w.Body.Bytes())
+			if want := testVerifier(t).Name(); p.origin != want {
+				t.Errorf("Promised origin %q, want %q", p.origin, want)
+			}
+			if p.index != 2 {
+				t.Errorf("Promised index %d, want 2", p.index)
+			}
+			lh := rfc6962.DefaultHasher.HashLeaf([]byte("three"))
+			if string(p.leafHash) != string(lh) {
+				t.Errorf("Promised leaf hash %x, want %x", p.leafHash, lh)
+			}
+			if p.time.Before(before) || p.time.After(time.Now()) {
+				t.Errorf("Promise time %v isn't the time of the request", p.time)
+			}
+
+			// The promised leaf is eventually included in a checkpoint at the promised index.
+			var cpSize uint64
+			var cpHash []byte
+			for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+				cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes())
+				if cp.Size > p.index {
+					cpSize, cpHash = cp.Size, cp.Hash
+					break
+				}
+				if time.Since(start) > 5*time.Second {
+					t.Fatalf("Checkpoint of size %d doesn't include promised index %d", cp.Size, p.index)
+				}
+			}
+			pw := do(h, http.MethodGet, fmt.Sprintf("/proof/inclusion?index=%d&size=%d", p.index, cpSize), "", nil)
+			if pw.Code != http.StatusOK {
+				t.Fatalf("GET /proof/inclusion: got %d %q, want 200", pw.Code, pw.Body)
+			}
+			if err := proof.VerifyInclusion(rfc6962.DefaultHasher, p.index, cpSize, p.leafHash, parseProof(t, pw.Body.String()), cpHash); err != nil {
+				t.Errorf("Promised leaf isn't included at the promised index: %v", err)
+			}
+		})
+	}
+}
+
+func TestPromiseTampered(t *testing.T) {
+	_, h := newMemoryTestServer(t)
+	w := do(h, http.MethodPost, "/add", "leaf", http.Header{"Accept": {promiseContentType}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /add: got %d %q, want 201", w.Code, w.Body)
+	}
+	// Promise a different index.
+	raw := strings.Replace(w.Body.String(), "\n0\n", "\n1\n", 1)
+	if raw == w.Body.String() {
+		t.Fatalf("Promise %q doesn't contain index 0", raw)
+	}
+	if _, err := note.Open([]byte(raw), note.VerifierList(testVerifier(t))); err == nil {
+		t.Error("Tampered promise verified")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ipLimiterIdle is how long a per-IP limiter may go unused before it's discarded.
+const ipLimiterIdle = 10 * time.Minute
+
+// rateLimiter applies token bucket rate limits to requests, both globally and per source IP.
+type rateLimiter struct {
+	global *rate.Limiter
+
+	// perIP and burst configure the limiters created for each source IP, perIP of zero disables them.
+	perIP rate.Limit
+	burst int
+
+	mu    sync.Mutex
+	ips   map[string]*ipLimiter
+	swept time.Time
+}
+
+type ipLimiter struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+// newRateLimiter creates a rateLimiter which allows global requests per second overall, and perIP requests per second
+// from each source IP, with bursts of up to burst requests.
+// A limit of zero disables the corresponding check.
+func newRateLimiter(global, perIP float64, burst int) *rateLimiter {
+	l := &rateLimiter{
+		perIP: rate.Limit(perIP),
+		burst: burst,
+		ips:   make(map[string]*ipLimiter),
+		swept: time.Now(),
+	}
+	if global > 0 {
+		l.global = rate.NewLimiter(rate.Limit(global), burst)
+	}
+	return l
+}
+
+// Wrap returns a handler which calls h for requests which are within the limits, and responds with
+// 429 Too Many Requests to the rest.
+func (l *rateLimiter) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d, ok := l.allow(r); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// allow returns true if the request is within the limits, otherwise it returns false along with how long the
+// caller should wait before retrying.
+func (l *rateLimiter) allow(r *http.Request) (time.Duration, bool) {
+	now := time.Now()
+	var rs []*rate.Reservation
+	if l.global != nil {
+		rs = append(rs, l.global.ReserveN(now, 1))
+	}
+	if l.perIP > 0 {
+		rs = append(rs, l.ipLimiter(r, now).ReserveN(now, 1))
+	}
+	var wait time.Duration
+	for _, res := range rs {
+		if !res.OK() {
+			// The burst is too small to ever allow the request, this shouldn't happen for a burst of at least 1.
+			wait = max(wait, time.Second)
+			continue
+		}
+		wait = max(wait, res.DelayFrom(now))
+	}
+	if wait == 0 {
+		return 0, true
+	}
+	// Give back the tokens, since we're not going to make the request wait for them.
+	for _, res := range rs {
+		res.CancelAt(now)
+	}
+	return wait, false
+}
+
+// ipLimiter returns the limiter for the request's source IP, creating it if necessary.
+func (l *rateLimiter) ipLimiter(r *http.Request, now time.Time) *rate.Limiter {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > ipLimiterIdle {
+		for k, v := range l.ips {
+			if now.Sub(v.lastUsed) > ipLimiterIdle {
+				delete(l.ips, k)
+			}
+		}
+		l.swept = now
+	}
+	il, ok := l.ips[ip]
+	if !ok {
+		il = &ipLimiter{Limiter: rate.NewLimiter(l.perIP, l.burst)}
+		l.ips[ip] = il
+	}
+	il.lastUsed = now
+	return il.Limiter
+}
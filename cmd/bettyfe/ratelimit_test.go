@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		global, perIP float64
+		burst         int
+		// ips are the source IPs of the requests, which are sent faster than the limits allow.
+		ips []string
+		// wantOK is the number of requests from each IP which should be allowed.
+		wantOK map[string]int
+	}{
+		{
+			name:   "disabled",
+			ips:    []string{"192.0.2.1", "192.0.2.1", "192.0.2.1", "192.0.2.1"},
+			wantOK: map[string]int{"192.0.2.1": 4},
+		},
+		{
+			name:   "global",
+			global: 1, burst: 2,
+			ips:    []string{"192.0.2.1", "192.0.2.2", "192.0.2.1", "192.0.2.2"},
+			wantOK: map[string]int{"192.0.2.1": 1, "192.0.2.2": 1},
+		},
+		{
+			name:  "per IP",
+			perIP: 1, burst: 2,
+			ips:    []string{"192.0.2.1", "192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.2", "192.0.2.2"},
+			wantOK: map[string]int{"192.0.2.1": 2, "192.0.2.2": 2},
+		},
+		{
+			name:   "global and per IP",
+			global: 1, perIP: 1, burst: 3,
+			ips:    []string{"192.0.2.1", "192.0.2.1", "192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.2"},
+			wantOK: map[string]int{"192.0.2.1": 3},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			l := newRateLimiter(test.global, test.perIP, test.burst)
+			h := l.Wrap(func(w http.ResponseWriter, r *http.Request) {})
+			gotOK := make(map[string]int)
+			for _, ip := range test.ips {
+				r := httptest.NewRequest(http.MethodPost, "/add", nil)
+				r.RemoteAddr = ip + ":1234"
+				w := httptest.NewRecorder()
+				h(w, r)
+				switch w.Code {
+				case http.StatusOK:
+					gotOK[ip]++
+				case http.StatusTooManyRequests:
+					if d, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || d < 1 {
+						t.Errorf("Got Retry-After %q, want a positive number of seconds", w.Header().Get("Retry-After"))
+					}
+				default:
+					t.Fatalf("Got %d %q, want 200 or 429", w.Code, w.Body)
+				}
+			}
+			for _, ip := range test.ips {
+				if gotOK[ip] != test.wantOK[ip] {
+					t.Errorf("Got %d requests from %s allowed, want %d", gotOK[ip], ip, test.wantOK[ip])
+				}
+			}
+		})
+	}
+}
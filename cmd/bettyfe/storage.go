@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	gcs_storage "cloud.google.com/go/storage"
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/AlCutter/betty/storage/azblob"
+	"github.com/AlCutter/betty/storage/gcs"
+	"github.com/AlCutter/betty/storage/kv"
+	"github.com/AlCutter/betty/storage/memory"
+	"github.com/AlCutter/betty/storage/posix"
+	"github.com/AlCutter/betty/storage/retry"
+	"github.com/AlCutter/betty/storage/s3"
+	"github.com/cockroachdb/pebble"
+	"golang.org/x/mod/sumdb/note"
+	"k8s.io/klog/v2"
+)
+
+// storageFactory creates a log's storage at the location given by a --storage URI, returning it along with
+// a function which returns the current tree state.
+type storageFactory func(ctx context.Context, loc *url.URL, sc storageConfig) (Storage, writer.CurrentTreeFunc)
+
+// storageFactories maps the scheme of a --storage URI to the factory for the storage backend it selects.
+var storageFactories = map[string]storageFactory{}
+
+// registerStorage makes the storage backend created by f available via --storage URIs with the given scheme.
+func registerStorage(scheme string, f storageFactory) {
+	if _, ok := storageFactories[scheme]; ok {
+		panic(fmt.Sprintf("storage scheme %q registered twice", scheme))
+	}
+	storageFactories[scheme] = f
+}
+
+func init() {
+	registerStorage("file", newPOSIXStorage)
+	registerStorage("memory", newMemoryStorage)
+	registerStorage("gs", newGCSStorage)
+	registerStorage("s3", newS3Storage)
+	registerStorage("azblob", newAzblobStorage)
+	registerStorage("kv", newKVStorage)
+}
+
+// storageConfig holds what a storage factory needs, besides the storage's location, to create a log's storage.
+type storageConfig struct {
+	params log.Params
+	// cache holds the log's latest checkpoint in memory, and is given the functions which read and write it in
+	// storage by checkpoints.
+	cache *checkpointCache
+	// newTree returns a function which signs checkpoints and publishes them with writeCheckpoint.
+	newTree func(writeCheckpoint func([]byte) error) writer.NewTreeFunc
+	// currentTree returns a function which verifies checkpoints read with readCheckpoint.
+	currentTree func(readCheckpoint func() ([]byte, error)) writer.CurrentTreeFunc
+}
+
+// checkpoints returns the functions which read and write the log's checkpoint via readCheckpoint and
+// writeCheckpoint, through the checkpoint cache, initialising an empty log if necessary.
+func (sc storageConfig) checkpoints(readCheckpoint func() ([]byte, error), writeCheckpoint func([]byte) error) (writer.CurrentTreeFunc, writer.NewTreeFunc) {
+	sc.cache.readCheckpoint, sc.cache.writeCheckpoint = readCheckpoint, writeCheckpoint
+	ct, nt := sc.currentTree(sc.cache.Read), sc.newTree(sc.cache.Write)
+	if err := initLog(sc.params, ct, nt); err != nil {
+		klog.Exitf("Failed to initialise log: %v", err)
+	}
+	return ct, nt
+}
+
+// parseStorageURI parses a --storage URI, checking that its scheme selects a registered storage backend.
+func parseStorageURI(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := storageFactories[u.Scheme]; !ok {
+		var schemes []string
+		for k := range storageFactories {
+			schemes = append(schemes, k)
+		}
+		sort.Strings(schemes)
+		return nil, fmt.Errorf("unknown storage scheme %q, must be one of %s", u.Scheme, strings.Join(schemes, ", "))
+	}
+	return u, nil
+}
+
+// storageLocation returns the location of a log's storage, which is --storage if set.
+// Otherwise the location is given by the backend specific flags, defaulting to POSIX storage under path.
+func storageLocation(path string) (*url.URL, error) {
+	switch {
+	case *storageURI != "":
+		return parseStorageURI(*storageURI)
+	case *inMemory:
+		return &url.URL{Scheme: "memory"}, nil
+	case *gcsBucket != "":
+		return &url.URL{Scheme: "gs", Host: *gcsBucket, Path: "/" + *gcsPrefix}, nil
+	case *s3Bucket != "":
+		return &url.URL{Scheme: "s3", Host: *s3Bucket, Path: "/" + *s3Prefix}, nil
+	case *azblobContainer != "":
+		return &url.URL{Scheme: "azblob", Host: *azblobContainer, Path: "/" + *azblobPrefix}, nil
+	case *kvPath != "":
+		return &url.URL{Scheme: "kv", Path: *kvPath}, nil
+	}
+	return &url.URL{Scheme: "file", Path: path}, nil
+}
+
+// localPath returns the filesystem path given by a file:// or kv:// location, which may also be written
+// as a relative path, e.g. file:log.
+func localPath(loc *url.URL) string {
+	if loc.Opaque != "" {
+		return loc.Opaque
+	}
+	return loc.Path
+}
+
+// bucketAndPrefix returns the bucket, or container, and the object prefix given by an object store location,
+// e.g. gs://bucket/prefix.
+func bucketAndPrefix(loc *url.URL) (string, string) {
+	if loc.Host == "" {
+		klog.Exitf("Storage %q must name a bucket", loc)
+	}
+	return loc.Host, strings.TrimPrefix(loc.Path, "/")
+}
+
+// newStorage creates the storage implementation at the given location, initialising an empty log if necessary.
+// Returns the storage along with a function which returns the current tree state, and the cache through which
+// the log's checkpoint is read.
+func newStorage(ctx context.Context, loc *url.URL, params log.Params, sKeys []note.Signer, vKeys []note.Verifier) (Storage, writer.CurrentTreeFunc, *checkpointCache) {
+	// Check the params before anything is written to the log.
+	if err := params.Validate(); err != nil {
+		klog.Exitf("Invalid log params: %v", err)
+	}
+	// The origin of the log's checkpoints is pinned by its metadata, so that it can't be changed by accident along
+	// with the signing key.
+	params.Origin = sKeys[0].Name()
+	if *dedup && loc.Scheme != "file" {
+		klog.Exit("--dedup is only supported with POSIX storage")
+	}
+	if *readOnly && (loc.Scheme == "memory" || loc.Scheme == "kv") {
+		klog.Exit("--read_only is not supported with in-memory or KV storage")
+	}
+	if *writeConc < 1 {
+		klog.Exit("--write_concurrency must be at least 1")
+	}
+	if err := validateCheckpointExtensions(); err != nil {
+		klog.Exit(err)
+	}
+	// The NewTreeFunc needs to read tiles from the storage it's passed to in order to build consistency
+	// proofs for witnesses, so the storage is plumbed in once it's been created.
+	tiles := &deferredTileReader{}
+	cosign := newCosignFunc(params, tiles)
+	var webhook *checkpointWebhook
+	if *cpWebhook != "" {
+		webhook = newCheckpointWebhook(*cpWebhook, *cpWebhookAttempts)
+	}
+	sc := storageConfig{
+		params: params,
+		cache: &checkpointCache{
+			ttl: *cpCacheTTL,
+			// Nothing else can write the checkpoint while this process holds the writer lease, and the in-memory
+			// and KV storage can only be opened by a single process.
+			sole: loc.Scheme == "memory" || loc.Scheme == "kv" || (*writerLeaseTTL > 0 && !*readOnly),
+		},
+		newTree: func(writeCheckpoint func([]byte) error) writer.NewTreeFunc {
+			return newTree(writeCheckpoint, sKeys, cosign, webhook)
+		},
+		currentTree: func(readCheckpoint func() ([]byte, error)) writer.CurrentTreeFunc {
+			return currentTree(readCheckpoint, vKeys)
+		},
+	}
+	s, ct := storageFactories[loc.Scheme](ctx, loc, sc)
+	tiles.TileReader = s
+	return s, ct, sc.cache
+}
+
+// newMemoryStorage creates an in-memory storage, selected with memory:.
+func newMemoryStorage(_ context.Context, _ *url.URL, sc storageConfig) (Storage, writer.CurrentTreeFunc) {
+	cp := &memory.Checkpoint{}
+	ct, nt := sc.checkpoints(cp.Read, cp.Write)
+	s, err := memory.New(cp, sc.params, *batchMaxAge, ct, nt)
+	if err != nil {
+		klog.Exitf("Failed to create storage: %v", err)
+	}
+	return s, ct
+}
+
+// writeRetryPolicy returns the policy with which the object storage backends retry writes which fail transiently.
+func writeRetryPolicy() retry.Policy {
+	p := retry.DefaultPolicy
+	p.MaxAttempts, p.Deadline = *writeAttempts, *writeDeadline
+	return p
+}
+
+// newGCSStorage creates a GCS storage, selected with gs://bucket/prefix.
+func newGCSStorage(ctx context.Context, loc *url.URL, sc storageConfig) (Storage, writer.CurrentTreeFunc) {
+	bucket, prefix := bucketAndPrefix(loc)
+	c, err := gcs_storage.NewClient(ctx)
+	if err != nil {
+		klog.Exitf("Failed to create GCS client: %v", err)
+	}
+	bkt := c.Bucket(bucket)
+	ct, nt := sc.checkpoints(
+		func() ([]byte, error) { return gcs.ReadCheckpoint(ctx, bkt, prefix) },
+		func(cp []byte) error {
+			return gcs.WriteCheckpoint(ctx, bkt, prefix, cp, gcs.WithWriteRetries(writeRetryPolicy()))
+		})
+	opts := []gcs.Option{gcs.WithWriteRetries(writeRetryPolicy())}
+	if *tileCacheSize > 0 {
+		opts = append(opts, gcs.WithTileCache(*tileCacheSize))
+	}
+	if *tileCompress {
+		opts = append(opts, gcs.WithTileCompression())
+	}
+	opts = append(opts, gcs.WithWriteConcurrency(*writeConc))
+	if *readOnly {
+		opts = append(opts, gcs.WithReadOnly())
+	}
+	if *writerLeaseTTL > 0 {
+		opts = append(opts, gcs.WithWriterLease(*writerLeaseTTL, *takeover))
+	}
+	s, err := gcs.New(ctx, bkt, prefix, sc.params, *batchMaxAge, ct, nt, opts...)
+	if err != nil {
+		klog.Exitf("Failed to create storage: %v", err)
+	}
+	return s, ct
+}
+
+// newS3Storage creates an S3 storage, selected with s3://bucket/prefix.
+func newS3Storage(ctx context.Context, loc *url.URL, sc storageConfig) (Storage, writer.CurrentTreeFunc) {
+	bucket, prefix := bucketAndPrefix(loc)
+	c := newS3Client(ctx)
+	ct, nt := sc.checkpoints(
+		func() ([]byte, error) { return s3.ReadCheckpoint(ctx, c, bucket, prefix) },
+		func(cp []byte) error {
+			return s3.WriteCheckpoint(ctx, c, bucket, prefix, cp, s3.WithWriteRetries(writeRetryPolicy()))
+		})
+	opts := []s3.Option{s3.WithWriteRetries(writeRetryPolicy())}
+	if *tileCacheSize > 0 {
+		opts = append(opts, s3.WithTileCache(*tileCacheSize))
+	}
+	if *tileCompress {
+		opts = append(opts, s3.WithTileCompression())
+	}
+	opts = append(opts, s3.WithWriteConcurrency(*writeConc))
+	if *readOnly {
+		opts = append(opts, s3.WithReadOnly())
+	}
+	if *writerLeaseTTL > 0 {
+		opts = append(opts, s3.WithWriterLease(*writerLeaseTTL, *takeover))
+	}
+	s, err := s3.New(ctx, c, bucket, prefix, sc.params, *batchMaxAge, ct, nt, opts...)
+	if err != nil {
+		klog.Exitf("Failed to create storage: %v", err)
+	}
+	return s, ct
+}
+
+// newAzblobStorage creates an Azure Blob Storage storage, selected with azblob://container/prefix.
+func newAzblobStorage(ctx context.Context, loc *url.URL, sc storageConfig) (Storage, writer.CurrentTreeFunc) {
+	container, prefix := bucketAndPrefix(loc)
+	c := newAzblobClient(container)
+	ct, nt := sc.checkpoints(
+		func() ([]byte, error) { return azblob.ReadCheckpoint(ctx, c, prefix) },
+		func(cp []byte) error {
+			return azblob.WriteCheckpoint(ctx, c, prefix, cp, azblob.WithWriteRetries(writeRetryPolicy()))
+		})
+	opts := []azblob.Option{azblob.WithWriteRetries(writeRetryPolicy())}
+	if *tileCacheSize > 0 {
+		opts = append(opts, azblob.WithTileCache(*tileCacheSize))
+	}
+	if *tileCompress {
+		opts = append(opts, azblob.WithTileCompression())
+	}
+	opts = append(opts, azblob.WithWriteConcurrency(*writeConc))
+	if *readOnly {
+		opts = append(opts, azblob.WithReadOnly())
+	}
+	if *writerLeaseTTL > 0 {
+		opts = append(opts, azblob.WithWriterLease(*writerLeaseTTL, *takeover))
+	}
+	s, err := azblob.New(ctx, c, prefix, sc.params, *batchMaxAge, ct, nt, opts...)
+	if err != nil {
+		klog.Exitf("Failed to create storage: %v", err)
+	}
+	return s, ct
+}
+
+// newKVStorage creates a Pebble KV storage, selected with kv:///path.
+func newKVStorage(_ context.Context, loc *url.URL, sc storageConfig) (Storage, writer.CurrentTreeFunc) {
+	// Pebble holds an exclusive lock on the database directory, so a writer lease is unnecessary.
+	db, err := pebble.Open(localPath(loc), &pebble.Options{})
+	if err != nil {
+		klog.Exitf("Failed to open database: %v", err)
+	}
+	ct, nt := sc.checkpoints(
+		func() ([]byte, error) { return kv.ReadCheckpoint(db) },
+		func(cp []byte) error { return kv.WriteCheckpoint(db, cp) })
+	var opts []kv.Option
+	if *tileCacheSize > 0 {
+		opts = append(opts, kv.WithTileCache(*tileCacheSize))
+	}
+	s, err := kv.New(db, sc.params, *batchMaxAge, ct, nt, opts...)
+	if err != nil {
+		klog.Exitf("Failed to create storage: %v", err)
+	}
+	return s, ct
+}
+
+// parseMode parses an octal file mode, e.g. 0750, which may only contain permission bits.
+func parseMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an octal mode", s)
+	}
+	if m&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("%q has bits other than the permission bits set", s)
+	}
+	return os.FileMode(m), nil
+}
+
+// newPOSIXStorage creates a POSIX storage, selected with file:///path.
+func newPOSIXStorage(_ context.Context, loc *url.URL, sc storageConfig) (Storage, writer.CurrentTreeFunc) {
+	path := localPath(loc)
+	dirMode, err := parseMode(*dirModeFlag)
+	if err != nil {
+		klog.Exitf("Invalid --dir_mode: %v", err)
+	}
+	fileMode, err := parseMode(*fileModeFlag)
+	if err != nil {
+		klog.Exitf("Invalid --file_mode: %v", err)
+	}
+	if err := os.MkdirAll(path, dirMode); err != nil {
+		klog.Exitf("failed to make directory structure: %v", err)
+	}
+	// The modes apply to the checkpoints written here, as well as to everything written by the storage itself.
+	// Checkpoint writes only need the modes, the remaining options configure the log storage itself.
+	modeOpts := []posix.Option{posix.WithDirMode(dirMode), posix.WithFileMode(fileMode)}
+	writeCP := func(cp []byte) error { return posix.WriteCheckpoint(path, cp, modeOpts...) }
+	if *cpHistory {
+		writeCP = func(cp []byte) error {
+			if err := posix.WriteCheckpoint(path, cp, modeOpts...); err != nil {
+				return err
+			}
+			return posix.ArchiveCheckpoint(path, cp, *cpHistoryKeep, modeOpts...)
+		}
+	}
+	ct, nt := sc.checkpoints(func() ([]byte, error) { return posix.ReadCheckpoint(path) }, writeCP)
+	opts := slices.Clone(modeOpts)
+	if *dedup {
+		opts = append(opts, posix.WithDedup())
+		if *dedupFilterSize > 0 {
+			if *writerLeaseTTL == 0 {
+				// Leaves added by other writers wouldn't be in the filter.
+				klog.Exit("--dedup_filter_size requires --writer_lease_ttl")
+			}
+			opts = append(opts, posix.WithDedupFilter(*dedupFilterSize))
+		}
+	}
+	if *durable {
+		opts = append(opts, posix.WithDurable())
+	}
+	c, err := posix.ParseCompression(*bundleCompress)
+	if err != nil {
+		klog.Exitf("Invalid --bundle_compression: %v", err)
+	}
+	opts = append(opts, posix.WithBundleCompression(c))
+	if *tileCacheSize > 0 {
+		opts = append(opts, posix.WithTileCache(*tileCacheSize))
+	}
+	if *tileCompress {
+		opts = append(opts, posix.WithTileCompression())
+	}
+	if *readOnly {
+		opts = append(opts, posix.WithReadOnly())
+	}
+	if *batchTarget > 0 {
+		opts = append(opts, posix.WithAdaptiveBatching(*batchTarget))
+	}
+	if *seqShards > 1 {
+		opts = append(opts, posix.WithSequencerShards(*seqShards))
+	}
+	if *cpInterval > 0 {
+		opts = append(opts, posix.WithCheckpointInterval(*cpInterval))
+	}
+	if *indexReserve > 0 {
+		if *writerLeaseTTL == 0 {
+			// The high-water mark is only read at startup, so other writers' reservations would be missed.
+			klog.Exit("--index_reservation requires --writer_lease_ttl")
+		}
+		opts = append(opts, posix.WithIndexReservation(*indexReserve))
+	}
+	if *integInterval > 0 {
+		if *writerLeaseTTL == 0 {
+			// Entries awaiting integration would be overwritten by those sequenced by other writers.
+			klog.Exit("--integrate_interval requires --writer_lease_ttl")
+		}
+		opts = append(opts, posix.WithIntegrateInterval(*integInterval))
+	}
+	if *writerLeaseTTL > 0 {
+		opts = append(opts, posix.WithWriterLease(*writerLeaseTTL, *takeover))
+	}
+	s, err := posix.New(path, sc.params, *batchMaxAge, ct, nt, opts...)
+	if err != nil {
+		klog.Exitf("Failed to create storage: %v", err)
+	}
+	return s, ct
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+)
+
+func TestParseStorageURI(t *testing.T) {
+	for _, test := range []struct {
+		uri     string
+		want    url.URL
+		wantErr bool
+	}{
+		{uri: "file:///tmp/log", want: url.URL{Scheme: "file", Path: "/tmp/log"}},
+		{uri: "file:log", want: url.URL{Scheme: "file", Opaque: "log"}},
+		{uri: "memory:", want: url.URL{Scheme: "memory"}},
+		{uri: "gs://bucket/prefix", want: url.URL{Scheme: "gs", Host: "bucket", Path: "/prefix"}},
+		{uri: "s3://bucket", want: url.URL{Scheme: "s3", Host: "bucket"}},
+		{uri: "azblob://container/a/b", want: url.URL{Scheme: "azblob", Host: "container", Path: "/a/b"}},
+		{uri: "kv:///var/log.db", want: url.URL{Scheme: "kv", Path: "/var/log.db"}},
+		{uri: "ftp://host/log", wantErr: true},
+		{uri: "/tmp/log", wantErr: true},
+		{uri: "file://%zz", wantErr: true},
+	} {
+		t.Run(test.uri, func(t *testing.T) {
+			got, err := parseStorageURI(test.uri)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseStorageURI(%q) = %v, want error: %t", test.uri, err, test.wantErr)
+			}
+			if err == nil && *got != test.want {
+				t.Errorf("parseStorageURI(%q) = %#v, want %#v", test.uri, *got, test.want)
+			}
+		})
+	}
+}
+
+func TestStorageLocation(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		flags func(t *testing.T)
+		want  string
+	}{
+		{name: "default", flags: func(*testing.T) {}, want: "file:///data/log"},
+		{name: "URI", flags: func(t *testing.T) { setFlag(t, storageURI, "s3://bucket/prefix") }, want: "s3://bucket/prefix"},
+		{name: "URI overrides others", flags: func(t *testing.T) {
+			setFlag(t, storageURI, "memory:")
+			setFlag(t, gcsBucket, "bucket")
+		}, want: "memory:"},
+		{name: "in memory", flags: func(t *testing.T) { setFlag(t, inMemory, true) }, want: "memory:"},
+		{name: "GCS", flags: func(t *testing.T) {
+			setFlag(t, gcsBucket, "bucket")
+			setFlag(t, gcsPrefix, "logs/a")
+		}, want: "gs://bucket/logs/a"},
+		{name: "S3", flags: func(t *testing.T) { setFlag(t, s3Bucket, "bucket") }, want: "s3://bucket/"},
+		{name: "Azure", flags: func(t *testing.T) { setFlag(t, azblobContainer, "container") }, want: "azblob://container/"},
+		{name: "KV", flags: func(t *testing.T) { setFlag(t, kvPath, "/data/kv") }, want: "kv:///data/kv"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.flags(t)
+			got, err := storageLocation("/data/log")
+			if err != nil {
+				t.Fatalf("storageLocation: %v", err)
+			}
+			if got.String() != test.want {
+				t.Errorf("storageLocation() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStorageLocationInvalidURI(t *testing.T) {
+	setFlag(t, storageURI, "ftp://host/log")
+	if _, err := storageLocation("/data/log"); err == nil {
+		t.Error("storageLocation succeeded with an unknown scheme")
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	for _, test := range []struct {
+		uri  string
+		want string
+	}{
+		{uri: "file:///tmp/log", want: "/tmp/log"},
+		{uri: "file:log", want: "log"},
+		{uri: "file:a/b", want: "a/b"},
+		{uri: "kv:///var/log.db", want: "/var/log.db"},
+	} {
+		t.Run(test.uri, func(t *testing.T) {
+			u, err := url.Parse(test.uri)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := localPath(u); got != test.want {
+				t.Errorf("localPath(%q) = %q, want %q", test.uri, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBucketAndPrefix(t *testing.T) {
+	for _, test := range []struct {
+		uri                    string
+		wantBucket, wantPrefix string
+	}{
+		{uri: "gs://bucket", wantBucket: "bucket"},
+		{uri: "gs://bucket/", wantBucket: "bucket"},
+		{uri: "s3://bucket/prefix", wantBucket: "bucket", wantPrefix: "prefix"},
+		{uri: "azblob://container/a/b/", wantBucket: "container", wantPrefix: "a/b/"},
+	} {
+		t.Run(test.uri, func(t *testing.T) {
+			u, err := url.Parse(test.uri)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if b, p := bucketAndPrefix(u); b != test.wantBucket || p != test.wantPrefix {
+				t.Errorf("bucketAndPrefix(%q) = (%q, %q), want (%q, %q)", test.uri, b, p, test.wantBucket, test.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "log")
+	setFlag(t, storageURI, "file://"+dir)
+	_, h := newTestServer(t, testParams())
+	addLeaves(t, h, "one", "two", "three")
+	// The log is created in the directory named by the URI...
+	raw, err := os.ReadFile(filepath.Join(dir, "checkpoint"))
+	if err != nil {
+		t.Fatalf("Checkpoint wasn't written under %s: %v", dir, err)
+	}
+	if cp := parseCheckpoint(t, raw); cp.Size != 3 {
+		t.Errorf("Got checkpoint of size %d, want 3", cp.Size)
+	}
+	// ... and so is found there by other servers opening the same URI, which mustn't contend for the writer lease.
+	setFlag(t, readOnly, true)
+	_, h = newTestServer(t, testParams())
+	w := do(h, http.MethodGet, "/checkpoint", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /checkpoint: got %d %q, want 200", w.Code, w.Body)
+	}
+	if cp := parseCheckpoint(t, w.Body.Bytes()); cp.Size != 3 {
+		t.Errorf("Reopened log has checkpoint of size %d, want 3", cp.Size)
+	}
+}
+
+func TestCheckpointWritesDontReapplyOptions(t *testing.T) {
+	setFlag(t, storageURI, "file://"+filepath.Join(t.TempDir(), "log"))
+	setFlag(t, dedup, true)
+	setFlag(t, dedupFilterSize, 1000)
+	setFlag(t, writerLeaseTTL, time.Minute)
+	_, h := newTestServer(t, testParams())
+	// The filter is allocated once when the storage is opened, not again for each checkpoint written.
+	before := scrape(t)["betty_dedup_filter_bytes"]
+	for _, l := range []string{"one", "two", "three"} {
+		addLeaves(t, h, l)
+	}
+	if after := scrape(t)["betty_dedup_filter_bytes"]; after != before {
+		t.Errorf("Dedup filter bytes went from %v to %v over checkpoint writes", before, after)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, test := range []struct {
+		mode    string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{mode: "0755", want: 0o755},
+		{mode: "755", want: 0o755},
+		{mode: "0600", want: 0o600},
+		{mode: "0", want: 0},
+		{mode: "0777", want: 0o777},
+		{mode: "1777", wantErr: true},
+		{mode: "4755", wantErr: true},
+		{mode: "0789", wantErr: true},
+		{mode: "rwxr-xr-x", wantErr: true},
+		{mode: "", wantErr: true},
+		{mode: "-0755", wantErr: true},
+	} {
+		t.Run(test.mode, func(t *testing.T) {
+			got, err := parseMode(test.mode)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseMode(%q) = %v, want error: %t", test.mode, err, test.wantErr)
+			}
+			if err == nil && got != test.want {
+				t.Errorf("parseMode(%q) = %v, want %v", test.mode, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPOSIXStorageModes(t *testing.T) {
+	setFlag(t, dirModeFlag, "0700")
+	setFlag(t, fileModeFlag, "0600")
+	dir := filepath.Join(t.TempDir(), "log")
+	setFlag(t, storageURI, "file://"+dir)
+	_, h := newTestServer(t, testParams())
+	addLeaves(t, h, "one", "two")
+	// The checkpoint is written by bettyfe, rather than the storage, but is subject to the same mode.
+	for _, p := range []string{"checkpoint", log.MetadataPath} {
+		fi, err := os.Stat(filepath.Join(dir, p))
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if got := fi.Mode().Perm(); got != 0o600 {
+			t.Errorf("%s has mode %v, want 0600", p, got)
+		}
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if got := fi.Mode().Perm(); got != 0o700 {
+		t.Errorf("Log directory has mode %v, want 0700", got)
+	}
+}
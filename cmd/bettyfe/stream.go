@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/AlCutter/betty/log/writer"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog/v2"
+)
+
+// streamResult is the outcome of sequencing a leaf read from an /add-stream request.
+type streamResult struct {
+	idx uint64
+	err error
+}
+
+// handleAddStream sequences a stream of leaves read from the request body, each of which is prefixed by its
+// length as a big-endian uint32, writing back the index assigned to each leaf on its own line as soon as it's
+// been sequenced, in the order the leaves were read.
+//
+// Up to s.streamWindow leaves from the stream are sequenced concurrently; once that many are waiting, no more of
+// the body is read until the oldest has been sequenced, so a slow integrator slows down the producer.
+// If a leaf can't be read or sequenced, a line starting "error: " is written in place of its index and the
+// stream ends.
+func (s *server) handleAddStream(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r, "bettyfe.handleAddStream")
+	defer span.End()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	// Indices are written while the body is still being read, which HTTP/1 servers don't allow by default.
+	if err := rc.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		klog.Warningf("Failed to enable full duplex for /add-stream: %v", err)
+	}
+	// A stream may legitimately last much longer than any other request, so it isn't subject to the server's read
+	// and write timeouts.
+	if err := rc.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		klog.Warningf("Failed to clear read deadline for /add-stream: %v", err)
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		klog.Warningf("Failed to clear write deadline for /add-stream: %v", err)
+	}
+
+	// pending holds the results of the leaves being sequenced, in the order they were read, and its capacity
+	// bounds the number of them.
+	pending := make(chan chan streamResult, s.streamWindow)
+	go func() {
+		defer close(pending)
+		br := bufio.NewReader(r.Body)
+		for {
+			res := make(chan streamResult, 1)
+			e, err := readStreamEntry(br, s.maxEntrySize)
+			if err == io.EOF {
+				return
+			}
+			if err == nil {
+				if verr := s.validateLeaf(e); verr != nil {
+					err = fmt.Errorf("invalid entry: %v", verr)
+				}
+			}
+			if err != nil {
+				res <- streamResult{err: err}
+			} else {
+				go func() {
+					n := time.Now()
+					done := s.integration.start()
+					idx, err := s.storage.Sequence(ctx, e)
+					done(err)
+					// A duplicate leaf has already been sequenced, so we can just return its index.
+					if errors.Is(err, writer.ErrDupeLeaf) {
+						err = nil
+					}
+					s.latency.Add(time.Since(n))
+					res <- streamResult{idx: idx, err: err}
+				}()
+			}
+			select {
+			case pending <- res:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	count := 0
+	for {
+		res, ok := recvOrFlush(pending, rc)
+		if !ok {
+			break
+		}
+		sr, _ := recvOrFlush(res, rc)
+		if sr.err != nil {
+			fmt.Fprintf(w, "error: %v\n", sr.err)
+			break
+		}
+		fmt.Fprintf(w, "%d\n", sr.idx)
+		count++
+	}
+	span.SetAttributes(attribute.Int("betty.stream_entries", count))
+}
+
+// recvOrFlush receives the next value from c, first flushing the response written so far if it would have to
+// wait for it, so that the client isn't kept waiting for indices which are already known.
+func recvOrFlush[T any](c <-chan T, rc *http.ResponseController) (T, bool) {
+	select {
+	case v, ok := <-c:
+		return v, ok
+	default:
+	}
+	if err := rc.Flush(); err != nil {
+		klog.V(1).Infof("Failed to flush /add-stream response: %v", err)
+	}
+	v, ok := <-c
+	return v, ok
+}
+
+// readStreamEntry reads the next length-prefixed leaf from an /add-stream request, returning io.EOF if the
+// stream ended cleanly before it.
+// Leaves larger than maxSize are rejected, unless it's zero.
+func readStreamEntry(r io.Reader, maxSize int64) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("stream ended within a length prefix")
+		}
+		return nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(l[:]))
+	if n == 0 {
+		return nil, errors.New("empty entry")
+	}
+	if maxSize > 0 && n > maxSize {
+		return nil, fmt.Errorf("entry of %d bytes exceeds max size of %d bytes", n, maxSize)
+	}
+	// The buffer grows as the entry is read, rather than trusting the length prefix up front.
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, r, n); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("stream ended within an entry of %d bytes", n)
+		}
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
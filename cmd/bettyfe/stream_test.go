@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// streamBody returns an /add-stream request body containing the leaves.
+func streamBody(leaves ...[]byte) []byte {
+	var b bytes.Buffer
+	for _, l := range leaves {
+		binary.Write(&b, binary.BigEndian, uint32(len(l)))
+		b.Write(l)
+	}
+	return b.Bytes()
+}
+
+// streamLeaves returns n distinct leaves of at least size bytes.
+func streamLeaves(n, size int) [][]byte {
+	ls := make([][]byte, n)
+	for i := range ls {
+		ls[i] = []byte(fmt.Sprintf("leaf %d %s", i, strings.Repeat("x", size)))
+	}
+	return ls
+}
+
+// doStream sends the body to the /add-stream handler of h, returning the lines of the response.
+func doStream(t *testing.T, h http.Handler, body io.Reader) []string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/add-stream", body)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /add-stream: got %d %q, want 200", w.Code, w.Body)
+	}
+	return strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+}
+
+func TestReadStreamEntry(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		stream  []byte
+		maxSize int64
+		want    string
+		wantErr error
+	}{
+		{name: "entry", stream: streamBody([]byte("leaf")), want: "leaf"},
+		{name: "at max size", stream: streamBody([]byte("leaf")), maxSize: 4, want: "leaf"},
+		{name: "end of stream", stream: nil, wantErr: io.EOF},
+		{name: "over max size", stream: streamBody([]byte("leaf")), maxSize: 3},
+		{name: "empty", stream: []byte{0, 0, 0, 0}},
+		{name: "partial length", stream: []byte{0, 0}},
+		{name: "partial entry", stream: []byte{0, 0, 0, 10, 'a', 'b'}},
+		{name: "missing entry", stream: []byte{0, 0, 0, 10}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readStreamEntry(bytes.NewReader(test.stream), test.maxSize)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("readStreamEntry = %q, want error", got)
+				}
+				if test.wantErr != nil && err != test.wantErr {
+					t.Errorf("readStreamEntry = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || string(got) != test.want {
+				t.Errorf("readStreamEntry = (%q, %v), want (%q, nil)", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestAddStream(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		n      int
+		window int
+	}{
+		{name: "one entry", n: 1, window: 16},
+		{name: "many entries", n: 500, window: 16},
+		{name: "serial", n: 20, window: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv, h := newMemoryTestServer(t)
+			srv.streamWindow = test.window
+			ls := streamLeaves(test.n, 8)
+			lines := doStream(t, h, bytes.NewReader(streamBody(ls...)))
+			if len(lines) != test.n {
+				t.Fatalf("Got %d lines, want %d: %q", len(lines), test.n, lines)
+			}
+			// Each line gives the index of the leaf in the same position in the stream.
+			seen := make(map[uint64]bool)
+			for i, l := range lines {
+				idx, err := strconv.ParseUint(l, 10, 64)
+				if err != nil {
+					t.Fatalf("Line %d: %q isn't an index", i, l)
+				}
+				if seen[idx] || idx >= uint64(test.n) {
+					t.Fatalf("Line %d: got index %d more than once or out of range", i, idx)
+				}
+				seen[idx] = true
+				w := do(h, http.MethodGet, fmt.Sprintf("/entries?start=%d&count=1", idx), "", nil)
+				if got := parseEntries(t, w.Body.String()); len(got) != 1 || got[0] != string(ls[i]) {
+					t.Errorf("Entry at index %d is %q, want %q", idx, got, ls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAddStreamErrors(t *testing.T) {
+	ls := streamLeaves(2, 0)
+	for _, test := range []struct {
+		name   string
+		stream []byte
+		// wantIndices is the number of indices returned before the error.
+		wantIndices int
+		wantErr     string
+	}{
+		{name: "partial length", stream: append(streamBody(ls...), 0, 0), wantIndices: 2, wantErr: "within a length prefix"},
+		{name: "partial entry", stream: append(streamBody(ls...), 0, 0, 0, 10, 'a'), wantIndices: 2, wantErr: "within an entry"},
+		{name: "empty entry", stream: append(streamBody(ls[0]), 0, 0, 0, 0), wantIndices: 1, wantErr: "empty entry"},
+		{name: "too large", stream: streamBody(ls[0], bytes.Repeat([]byte("a"), 100), ls[1]), wantIndices: 1, wantErr: "exceeds max size"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv, h := newMemoryTestServer(t)
+			srv.maxEntrySize = 64
+			lines := doStream(t, h, bytes.NewReader(test.stream))
+			if len(lines) != test.wantIndices+1 {
+				t.Fatalf("Got %d lines, want %d indices and an error: %q", len(lines), test.wantIndices, lines)
+			}
+			// The leaves are sequenced concurrently, so may be assigned indices in any order.
+			got := slices.Clone(lines[:test.wantIndices])
+			slices.Sort(got)
+			for i, l := range got {
+				if l != strconv.Itoa(i) {
+					t.Errorf("Got indices %q, want 0 to %d", got, test.wantIndices-1)
+					break
+				}
+			}
+			// The stream ends at the error.
+			if last := lines[len(lines)-1]; !strings.HasPrefix(last, "error: ") || !strings.Contains(last, test.wantErr) {
+				t.Errorf("Got last line %q, want an error containing %q", last, test.wantErr)
+			}
+		})
+	}
+}
+
+// blockingStorage is a Storage whose Sequence calls wait until released.
+type blockingStorage struct {
+	Storage
+	release chan struct{}
+}
+
+func (s *blockingStorage) Sequence(ctx context.Context, e []byte) (uint64, error) {
+	<-s.release
+	return s.Storage.Sequence(ctx, e)
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestAddStreamBackpressure(t *testing.T) {
+	const window, n, size = 2, 50, 8 << 10
+	srv, h := newMemoryTestServer(t)
+	srv.streamWindow = window
+	bs := &blockingStorage{Storage: srv.storage, release: make(chan struct{})}
+	srv.storage = bs
+	body := streamBody(streamLeaves(n, size)...)
+	cr := &countingReader{r: bytes.NewReader(body)}
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/add-stream", cr))
+	}()
+
+	// While nothing can be sequenced, the body is only read as far as the entries in the window, the one whose
+	// result is being waited for, and the one waiting to join the window, plus whatever's buffered.
+	time.Sleep(100 * time.Millisecond)
+	if got, limit := cr.n.Load(), int64((window+2)*(size+20)+4096); got > limit {
+		t.Errorf("Read %d bytes of the body while sequencing was blocked, want at most %d", got, limit)
+	}
+	close(bs.release)
+	<-done
+	if lines := strings.Fields(w.Body.String()); len(lines) != n {
+		t.Errorf("Got %d lines once sequencing was unblocked, want %d", len(lines), n)
+	}
+	if got := cr.n.Load(); got != int64(len(body)) {
+		t.Errorf("Read %d bytes of the body, want all %d", got, len(body))
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key, signed by a parent or self-signed.
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate for name, signed by parent, or self-signed as a CA if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return &testCert{cert: cert, der: der, key: key}
+}
+
+// write writes the PEM encoded certificate and key to <dir>/<name>.crt and <dir>/<name>.key, returning their paths.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// tlsCert returns c in the form used by a tls.Config.
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, dir, "server")
+	cfg, err := newTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("newTLSConfig: %v", err)
+	}
+
+	srv, _ := newMemoryTestServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /add", requireClientCert(srv.handleAdd))
+	mux.HandleFunc("GET /checkpoint", srv.handleCheckpoint)
+	// Serve the log as main does, rather than with httptest.Server which would use its own certificate.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	hs := &http.Server{Handler: mux, TLSConfig: cfg, ErrorLog: stdlog.New(io.Discard, "", 0)}
+	go hs.ServeTLS(l, "", "")
+	defer hs.Close()
+	url := "https://" + l.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	for _, test := range []struct {
+		name string
+		// client is the certificate presented by the client, if any.
+		client       *testCert
+		method, path string
+		wantCode     int
+	}{
+		{name: "submit", client: newTestCert(t, "client", ca), method: http.MethodPost, path: "/add", wantCode: http.StatusCreated},
+		{name: "submit without certificate", method: http.MethodPost, path: "/add", wantCode: http.StatusUnauthorized},
+		// The client doesn't offer a certificate which isn't issued by one of the CAs the server asks for.
+		{name: "submit with untrusted certificate", client: newTestCert(t, "client", newTestCert(t, "Other CA", nil)), method: http.MethodPost, path: "/add", wantCode: http.StatusUnauthorized},
+		{name: "read without certificate", method: http.MethodGet, path: "/checkpoint", wantCode: http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tc := &tls.Config{RootCAs: roots}
+			if test.client != nil {
+				tc.Certificates = []tls.Certificate{test.client.tlsCert()}
+			}
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+			req, err := http.NewRequest(test.method, url+test.path, strings.NewReader("leaf"))
+			if err != nil {
+				t.Fatalf("NewRequest: %v", err)
+			}
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", test.method, test.path, err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != test.wantCode {
+				t.Errorf("%s %s: got %d %q, want %d", test.method, test.path, resp.StatusCode, body, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil)
+	first := newTestCert(t, "first", ca)
+	certFile, keyFile := first.write(t, dir, "server")
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	check := func(t *testing.T, want *testCert) {
+		t.Helper()
+		got, err := cr.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate: %v", err)
+		}
+		if got.Leaf == nil {
+			if got.Leaf, err = x509.ParseCertificate(got.Certificate[0]); err != nil {
+				t.Fatalf("ParseCertificate: %v", err)
+			}
+		}
+		if got, want := got.Leaf.Subject.CommonName, want.cert.Subject.CommonName; got != want {
+			t.Errorf("Got certificate for %q, want %q", got, want)
+		}
+	}
+	check(t, first)
+
+	// Make sure that the new files appear to be modified after the old ones.
+	touch := func(t *testing.T) {
+		t.Helper()
+		later := time.Now().Add(time.Minute)
+		for _, f := range []string{certFile, keyFile} {
+			if err := os.Chtimes(f, later, later); err != nil {
+				t.Fatalf("Chtimes: %v", err)
+			}
+		}
+	}
+	second := newTestCert(t, "second", ca)
+	second.write(t, dir, "server")
+	touch(t)
+	check(t, second)
+
+	// An invalid certificate is ignored in favour of the one already loaded.
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	touch(t)
+	check(t, second)
+
+	if _, err := newCertReloader(filepath.Join(dir, "missing.crt"), keyFile); err == nil {
+		t.Error("newCertReloader succeeded with a missing certificate")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// leafValidator checks that a leaf submitted to the log is acceptable, returning an error describing why it
+// isn't if not. Rejected leaves aren't sequenced, and the error is returned to the client with 400 Bad Request.
+type leafValidator func(leaf []byte) error
+
+// leafValidatorFactory creates a leafValidator from the argument given to it in --leaf_validators, which is
+// empty if there was none.
+type leafValidatorFactory func(arg string) (leafValidator, error)
+
+// leafValidatorFactories maps the names usable in --leaf_validators to the factories of the validators they select.
+var leafValidatorFactories = map[string]leafValidatorFactory{}
+
+// registerLeafValidator makes the validator created by f available via --leaf_validators with the given name.
+func registerLeafValidator(name string, f leafValidatorFactory) {
+	if _, ok := leafValidatorFactories[name]; ok {
+		panic(fmt.Sprintf("leaf validator %q registered twice", name))
+	}
+	leafValidatorFactories[name] = f
+}
+
+func init() {
+	registerLeafValidator("non-empty", newNonEmptyValidator)
+	registerLeafValidator("max-size", newMaxSizeValidator)
+}
+
+// newNonEmptyValidator creates a leafValidator which rejects empty leaves.
+func newNonEmptyValidator(arg string) (leafValidator, error) {
+	if arg != "" {
+		return nil, errors.New("takes no argument")
+	}
+	return func(leaf []byte) error {
+		if len(leaf) == 0 {
+			return errors.New("leaf is empty")
+		}
+		return nil
+	}, nil
+}
+
+// newMaxSizeValidator creates a leafValidator which rejects leaves larger than the number of bytes given by arg.
+func newMaxSizeValidator(arg string) (leafValidator, error) {
+	max, err := strconv.Atoi(arg)
+	if err != nil || max <= 0 {
+		return nil, fmt.Errorf("argument %q must be a positive number of bytes", arg)
+	}
+	return func(leaf []byte) error {
+		if len(leaf) > max {
+			return fmt.Errorf("leaf of %d bytes is larger than %d bytes", len(leaf), max)
+		}
+		return nil
+	}, nil
+}
+
+// parseLeafValidators creates a leafValidator which applies each of the validators in the comma separated list,
+// e.g. "non-empty,max-size=1024", in turn, or returns nil if the list is empty.
+func parseLeafValidators(list string) (leafValidator, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var vs []leafValidator
+	for _, spec := range strings.Split(list, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(spec), "=")
+		f, ok := leafValidatorFactories[name]
+		if !ok {
+			var names []string
+			for n := range leafValidatorFactories {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown leaf validator %q, must be one of %s", name, strings.Join(names, ", "))
+		}
+		v, err := f(arg)
+		if err != nil {
+			return nil, fmt.Errorf("leaf validator %q: %v", name, err)
+		}
+		vs = append(vs, v)
+	}
+	return func(leaf []byte) error {
+		for _, v := range vs {
+			if err := v(leaf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// validateLeaf checks the leaf with the server's leafValidator, if it has one.
+func (s *server) validateLeaf(leaf []byte) error {
+	if s.leafValidator == nil {
+		return nil
+	}
+	return s.leafValidator(leaf)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseLeafValidators(t *testing.T) {
+	for _, test := range []struct {
+		list string
+		// accept and reject are leaves which the validator is expected to accept and reject.
+		accept, reject []string
+		wantNil        bool
+		wantErr        string
+	}{
+		{list: "", wantNil: true},
+		{list: "non-empty", accept: []string{"a", strings.Repeat("a", 1000)}, reject: []string{""}},
+		{list: "max-size=4", accept: []string{"", "abcd"}, reject: []string{"abcde"}},
+		{list: "non-empty, max-size=4", accept: []string{"a", "abcd"}, reject: []string{"", "abcde"}},
+		{list: "max-size=4,max-size=2", accept: []string{"ab"}, reject: []string{"abc"}},
+		{list: "unknown", wantErr: `unknown leaf validator "unknown", must be one of max-size, non-empty`},
+		{list: "non-empty,", wantErr: `unknown leaf validator ""`},
+		{list: "non-empty=1", wantErr: "takes no argument"},
+		{list: "max-size", wantErr: "must be a positive number of bytes"},
+		{list: "max-size=0", wantErr: "must be a positive number of bytes"},
+		{list: "max-size=big", wantErr: "must be a positive number of bytes"},
+	} {
+		t.Run(test.list, func(t *testing.T) {
+			v, err := parseLeafValidators(test.list)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseLeafValidators(%q) = %v, want error containing %q", test.list, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLeafValidators(%q): %v", test.list, err)
+			}
+			if (v == nil) != test.wantNil {
+				t.Fatalf("parseLeafValidators(%q) returned nil: %t, want %t", test.list, v == nil, test.wantNil)
+			}
+			for _, l := range test.accept {
+				if err := v([]byte(l)); err != nil {
+					t.Errorf("Validator rejected %q: %v", l, err)
+				}
+			}
+			for _, l := range test.reject {
+				if err := v([]byte(l)); err == nil {
+					t.Errorf("Validator accepted %q", l)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterLeafValidator(t *testing.T) {
+	registerLeafValidator("test-prefix", func(arg string) (leafValidator, error) {
+		return func(leaf []byte) error {
+			if !bytes.HasPrefix(leaf, []byte(arg)) {
+				return errors.New("leaf doesn't have the required prefix")
+			}
+			return nil
+		}, nil
+	})
+	t.Cleanup(func() { delete(leafValidatorFactories, "test-prefix") })
+
+	v, err := parseLeafValidators("test-prefix=cert:")
+	if err != nil {
+		t.Fatalf("parseLeafValidators: %v", err)
+	}
+	if err := v([]byte("cert:abc")); err != nil {
+		t.Errorf("Validator rejected a leaf with the prefix: %v", err)
+	}
+	if err := v([]byte("abc")); err == nil {
+		t.Error("Validator accepted a leaf without the prefix")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a validator twice didn't panic")
+		}
+	}()
+	registerLeafValidator("test-prefix", newNonEmptyValidator)
+}
+
+func TestAddLeafValidation(t *testing.T) {
+	setFlag(t, leafValidators, "non-empty,max-size=8")
+	_, h := newMemoryTestServer(t)
+	for _, test := range []struct {
+		name, target, body string
+		wantCode           int
+		wantErr            string
+	}{
+		{name: "valid", target: "/add", body: "leaf", wantCode: http.StatusCreated},
+		{name: "empty", target: "/add", body: "", wantCode: http.StatusBadRequest, wantErr: "Invalid entry: leaf is empty"},
+		{name: "too large", target: "/add", body: "123456789", wantCode: http.StatusBadRequest, wantErr: "Invalid entry: leaf of 9 bytes is larger than 8 bytes"},
+		{name: "valid batch", target: "/add-batch", body: "b25l\ndHdv\n", wantCode: http.StatusOK},
+		{name: "empty in batch", target: "/add-batch", body: "b25l\n\ndHdv\n", wantCode: http.StatusBadRequest, wantErr: "Invalid entry on line 2: leaf is empty"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := do(h, http.MethodPost, test.target, test.body, nil)
+			if w.Code != test.wantCode {
+				t.Fatalf("POST %s: got %d %q, want %d", test.target, w.Code, w.Body, test.wantCode)
+			}
+			if test.wantErr != "" {
+				if e := parseError(t, w); e.Error != test.wantErr {
+					t.Errorf("POST %s: got error %q, want %q", test.target, e.Error, test.wantErr)
+				}
+			}
+		})
+	}
+	// Only the valid leaves were sequenced.
+	if cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes()); cp.Size != 3 {
+		t.Errorf("Got checkpoint of size %d, want 3", cp.Size)
+	}
+	// A stream ends at the first invalid leaf.
+	lines := doStream(t, h, bytes.NewReader(streamBody([]byte("three"), []byte("123456789"), []byte("four"))))
+	if len(lines) != 2 || lines[0] != "3" || !strings.Contains(lines[1], "invalid entry: leaf of 9 bytes") {
+		t.Errorf("POST /add-stream: got %q, want an index and an error", lines)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// webhookTimeout is the max time to wait for the webhook to respond to each attempt.
+	webhookTimeout = 10 * time.Second
+	// webhookInitialBackoff is the time to wait before retrying a failed delivery, doubling with each attempt.
+	webhookInitialBackoff = 500 * time.Millisecond
+)
+
+// checkpointWebhook POSTs each newly published checkpoint, as the raw signed note, to a URL.
+//
+// Checkpoints are delivered in the background so that a slow or failing receiver never holds up publishing.
+// If a newer checkpoint is published before an older one has been delivered, the older one is skipped, since
+// the newer checkpoint supersedes it.
+type checkpointWebhook struct {
+	url      string
+	attempts int
+	client   *http.Client
+	// backoff is the time to wait before the first retry of a failed delivery.
+	backoff time.Duration
+	// pending holds the latest checkpoint waiting to be delivered.
+	pending chan []byte
+}
+
+// newCheckpointWebhook creates a webhook which delivers checkpoints to url, making up to attempts attempts at
+// delivering each.
+func newCheckpointWebhook(url string, attempts int) *checkpointWebhook {
+	w := &checkpointWebhook{
+		url:      url,
+		attempts: max(attempts, 1),
+		client:   &http.Client{Timeout: webhookTimeout},
+		backoff:  webhookInitialBackoff,
+		pending:  make(chan []byte, 1),
+	}
+	go w.run()
+	return w
+}
+
+// Notify queues the checkpoint cp for delivery, replacing any checkpoint still waiting to be delivered.
+// It's safe to call on a nil webhook, which does nothing.
+func (w *checkpointWebhook) Notify(cp []byte) {
+	if w == nil {
+		return
+	}
+	for {
+		select {
+		case w.pending <- cp:
+			return
+		default:
+			// Discard the older checkpoint in favour of cp, unless it's just been taken for delivery.
+			select {
+			case <-w.pending:
+			default:
+			}
+		}
+	}
+}
+
+// run delivers queued checkpoints until the process exits.
+func (w *checkpointWebhook) run() {
+	for cp := range w.pending {
+		w.deliver(cp)
+	}
+}
+
+// deliver POSTs cp to the webhook, retrying with exponential backoff until it succeeds, the attempts are
+// exhausted, or a newer checkpoint is queued.
+func (w *checkpointWebhook) deliver(cp []byte) {
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		err := w.post(cp)
+		if err == nil {
+			return
+		}
+		if attempt == w.attempts {
+			klog.Errorf("Giving up delivering checkpoint to webhook after %d attempts: %v", attempt, err)
+			return
+		}
+		klog.Warningf("Failed to deliver checkpoint to webhook (attempt %d): %v", attempt, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if len(w.pending) > 0 {
+			// A newer checkpoint supersedes this one.
+			return
+		}
+	}
+}
+
+// post makes a single attempt at delivering cp.
+func (w *checkpointWebhook) post(cp []byte) error {
+	resp, err := w.client.Post(w.url, "text/plain; charset=utf-8", bytes.NewReader(cp))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
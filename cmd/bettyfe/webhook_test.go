@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a fake webhook which records the checkpoints POSTed to it, responding to each in turn with
+// the next of its statuses, or 200 OK once they've been used.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	received [][]byte
+	// block, if set, is waited for before responding.
+	block chan struct{}
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if wr.block != nil {
+		<-wr.block
+	}
+	body, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.received = append(wr.received, body)
+	status := http.StatusOK
+	if len(wr.statuses) > 0 {
+		status, wr.statuses = wr.statuses[0], wr.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+// waitFor waits until the receiver has received a request for which done returns true.
+func (wr *webhookReceiver) waitFor(t *testing.T, done func(received [][]byte) bool) {
+	t.Helper()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		wr.mu.Lock()
+		ok := done(wr.received)
+		wr.mu.Unlock()
+		if ok {
+			return
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("Timed out waiting for webhook delivery")
+		}
+	}
+}
+
+// newWebhookReceiver serves the receiver, returning its URL.
+func newWebhookReceiver(t *testing.T, wr *webhookReceiver) string {
+	t.Helper()
+	ts := httptest.NewServer(wr)
+	t.Cleanup(func() {
+		if wr.block != nil {
+			close(wr.block)
+		}
+		ts.Close()
+	})
+	return ts.URL
+}
+
+func TestCheckpointWebhook(t *testing.T) {
+	wr := &webhookReceiver{}
+	setFlag(t, cpWebhook, newWebhookReceiver(t, wr))
+	_, h := newMemoryTestServer(t)
+	addLeaves(t, h, "one", "two", "three")
+
+	// The latest checkpoint is delivered as the raw signed note, although earlier ones may have been skipped.
+	cp := do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes()
+	wr.waitFor(t, func(received [][]byte) bool {
+		return len(received) > 0 && bytes.Equal(received[len(received)-1], cp)
+	})
+	if got := parseCheckpoint(t, cp); got.Size != 3 {
+		t.Errorf("Delivered checkpoint of size %d, want 3", got.Size)
+	}
+}
+
+func TestCheckpointWebhookRetries(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		attempts int
+		statuses []int
+		// wantPosts is the number of attempts expected, and wantDelivered whether the last of them succeeds.
+		wantPosts     int
+		wantDelivered bool
+	}{
+		{name: "first attempt", attempts: 3, wantPosts: 1, wantDelivered: true},
+		{name: "after failures", attempts: 3, statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, wantPosts: 3, wantDelivered: true},
+		{name: "gives up", attempts: 2, statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}, wantPosts: 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			wr := &webhookReceiver{statuses: test.statuses}
+			w := newCheckpointWebhook(newWebhookReceiver(t, wr), test.attempts)
+			// Retry promptly, to keep the test fast.
+			w.backoff = 10 * time.Millisecond
+			w.Notify([]byte("checkpoint\n"))
+			wr.waitFor(t, func(received [][]byte) bool { return len(received) == test.wantPosts })
+			// Give any unwanted retry a chance to be made.
+			time.Sleep(2 * w.backoff * time.Duration(test.attempts))
+			wr.mu.Lock()
+			defer wr.mu.Unlock()
+			if len(wr.received) != test.wantPosts {
+				t.Errorf("Got %d attempts, want %d", len(wr.received), test.wantPosts)
+			}
+			for _, b := range wr.received {
+				if string(b) != "checkpoint\n" {
+					t.Errorf("Got body %q, want %q", b, "checkpoint\n")
+				}
+			}
+			// Only the attempts after the failure statuses have been used up succeed.
+			if delivered := len(wr.received) > len(test.statuses); delivered != test.wantDelivered {
+				t.Errorf("Delivered: got %t, want %t", delivered, test.wantDelivered)
+			}
+		})
+	}
+}
+
+func TestCheckpointWebhookDoesNotBlockPublishing(t *testing.T) {
+	// The receiver doesn't respond until the test ends.
+	wr := &webhookReceiver{block: make(chan struct{})}
+	setFlag(t, cpWebhook, newWebhookReceiver(t, wr))
+	_, h := newMemoryTestServer(t)
+	start := time.Now()
+	addLeaves(t, h, "one", "two", "three")
+	if cp := parseCheckpoint(t, do(h, http.MethodGet, "/checkpoint", "", nil).Body.Bytes()); cp.Size != 3 {
+		t.Errorf("Got checkpoint of size %d, want 3", cp.Size)
+	}
+	if d := time.Since(start); d > webhookTimeout/2 {
+		t.Errorf("Adds took %v with an unresponsive webhook", d)
+	}
+}
+
+func TestCheckpointWebhookNil(t *testing.T) {
+	var w *checkpointWebhook
+	// Without a webhook, notifying is a no-op.
+	w.Notify([]byte("checkpoint\n"))
+}
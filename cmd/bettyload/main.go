@@ -0,0 +1,145 @@
+// bettyload is a load generator for Betty logs.
+//
+// It adds randomly generated leaves to a log from a number of concurrent writers, reports the throughput
+// and latency of the add requests, and optionally verifies the inclusion of some of the added leaves.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	mrand "math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AlCutter/betty/client"
+	"golang.org/x/mod/sumdb/note"
+	"k8s.io/klog/v2"
+)
+
+var (
+	url          = flag.String("url", "http://localhost:2024", "Base URL of the log to load")
+	verifier     = flag.String("log_verifier", "Test-Betty+df84580a+AQQASqPUZoIHcJAF5mBOryctwFdTV1E0GRY4kEAtTzwB", "Verifier key for the log's checkpoints, used by --verify_leaves")
+	numRequests  = flag.Int("num_requests", 1000, "Total number of leaves to add")
+	numWriters   = flag.Int("num_writers", 10, "Number of concurrent writers")
+	leafSize     = flag.Int("leaf_size", 1024, "Leaf size in bytes")
+	timeout      = flag.Duration("timeout", 30*time.Second, "Max time to wait for each add request")
+	verifyLeaves = flag.Int("verify_leaves", 0, "Number of randomly chosen added leaves whose inclusion is verified once all the leaves have been added")
+)
+
+// added records a leaf which was successfully added to the log.
+type added struct {
+	leaf  []byte
+	index uint64
+}
+
+func main() {
+	klog.InitFlags(nil)
+	flag.Parse()
+	ctx := context.Background()
+
+	var v note.Verifier
+	if *verifyLeaves > 0 {
+		var err error
+		if v, err = note.NewVerifier(*verifier); err != nil {
+			klog.Exitf("Invalid --log_verifier: %v", err)
+		}
+	}
+	c := client.New(*url, v, &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: *numWriters},
+	})
+
+	r := load(ctx, c, *numRequests, *numWriters, *leafSize)
+	fmt.Println(r)
+	if *verifyLeaves > 0 {
+		if err := verify(ctx, c, r.added, *verifyLeaves); err != nil {
+			klog.Exitf("Verification failed: %v", err)
+		}
+		fmt.Printf("Verified inclusion of %d leaves\n", min(*verifyLeaves, len(r.added)))
+	}
+	if r.errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// result summarises a load run.
+type result struct {
+	elapsed   time.Duration
+	errors    int
+	latencies []time.Duration
+	added     []added
+}
+
+// load adds n random leaves of the given size to the log, using the given number of concurrent writers.
+func load(ctx context.Context, c *client.Client, n, writers, size int) result {
+	var (
+		mu        sync.Mutex
+		r         result
+		next      atomic.Int64
+		wg        sync.WaitGroup
+		firstErr  sync.Once
+		startTime = time.Now()
+	)
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for next.Add(1) <= int64(n) {
+				leaf := make([]byte, size)
+				if _, err := rand.Read(leaf); err != nil {
+					klog.Exitf("Failed to generate leaf: %v", err)
+				}
+				actx, cancel := context.WithTimeout(ctx, *timeout)
+				start := time.Now()
+				idx, err := c.Add(actx, leaf)
+				d := time.Since(start)
+				cancel()
+
+				mu.Lock()
+				if err != nil {
+					r.errors++
+					firstErr.Do(func() { klog.Warningf("Add failed: %v", err) })
+				} else {
+					r.latencies = append(r.latencies, d)
+					r.added = append(r.added, added{leaf: leaf, index: idx})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	r.elapsed = time.Since(startTime)
+	slices.Sort(r.latencies)
+	return r
+}
+
+// percentile returns the q-th quantile of the sorted latencies.
+func (r result) percentile(q float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	return r.latencies[min(int(q*float64(len(r.latencies))), len(r.latencies)-1)]
+}
+
+func (r result) String() string {
+	ok := len(r.latencies)
+	return fmt.Sprintf("Added %d leaves (%d errors) in %v: %.1f leaves/s [P50: %v P90: %v P99: %v Max: %v]",
+		ok, r.errors, r.elapsed.Round(time.Millisecond), float64(ok)/r.elapsed.Seconds(),
+		r.percentile(0.5), r.percentile(0.9), r.percentile(0.99), r.percentile(1))
+}
+
+// verify checks the inclusion of up to n randomly chosen leaves from those added.
+func verify(ctx context.Context, c *client.Client, as []added, n int) error {
+	for _, i := range mrand.Perm(len(as))[:min(n, len(as))] {
+		a := as[i]
+		if err := c.VerifyInclusion(ctx, a.leaf, a.index); err != nil {
+			return fmt.Errorf("leaf at index %d: %v", a.index, err)
+		}
+	}
+	return nil
+}
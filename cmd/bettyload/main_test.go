@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AlCutter/betty/client"
+	f_log "github.com/transparency-dev/formats/log"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// fakeLog is a minimal in-memory log serving the endpoints which bettyload uses, with the default tlog-tiles
+// params of SHA-256 and a tile height of 8.
+type fakeLog struct {
+	signer note.Signer
+
+	mu     sync.Mutex
+	size   int64
+	hashes []tlog.Hash
+	// failEvery, if non-zero, causes every failEvery-th add request to fail.
+	failEvery int
+	requests  int
+	// skew is added to the index returned for each leaf, to simulate a log which misreports where leaves are.
+	skew int64
+}
+
+func (l *fakeLog) ReadHashes(indexes []int64) ([]tlog.Hash, error) {
+	hs := make([]tlog.Hash, len(indexes))
+	for i, idx := range indexes {
+		hs[i] = l.hashes[idx]
+	}
+	return hs, nil
+}
+
+func (l *fakeLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/add":
+		l.requests++
+		if l.failEvery > 0 && l.requests%l.failEvery == 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		leaf, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hs, err := tlog.StoredHashes(l.size, leaf, l)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		l.hashes = append(l.hashes, hs...)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%d\n", l.size+l.skew)
+		l.size++
+	case r.URL.Path == "/checkpoint":
+		root, err := tlog.TreeHash(l.size, l)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cp := f_log.Checkpoint{Origin: l.signer.Name(), Size: uint64(l.size), Hash: root[:]}
+		n, err := note.Sign(&note.Note{Text: string(cp.Marshal())}, l.signer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(n)
+	case strings.HasPrefix(r.URL.Path, "/tile/"):
+		t, err := tlog.ParseTilePath("tile/8/" + strings.TrimPrefix(r.URL.Path, "/tile/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		b, err := tlog.ReadTileData(t, l)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newFakeLog starts a server for l, returning a client for it.
+func newFakeLog(t *testing.T, l *fakeLog) *client.Client {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, "Test-Betty")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	s, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	v, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	l.signer = s
+	ts := httptest.NewServer(l)
+	t.Cleanup(ts.Close)
+	return client.New(ts.URL, v, ts.Client())
+}
+
+func TestLoad(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		n, writers int
+		failEvery  int
+		skew       int64
+		wantErrors int
+		verifyErr  bool
+	}{
+		{name: "one writer", n: 10, writers: 1},
+		{name: "concurrent writers", n: 50, writers: 8},
+		{name: "more writers than leaves", n: 3, writers: 10},
+		{name: "failed adds", failEvery: 4, n: 20, writers: 4, wantErrors: 5},
+		{name: "misreported indices", skew: 1, n: 10, writers: 2, verifyErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := newFakeLog(t, &fakeLog{failEvery: test.failEvery, skew: test.skew})
+			r := load(ctx, c, test.n, test.writers, 16)
+			if r.errors != test.wantErrors {
+				t.Errorf("Got %d errors, want %d", r.errors, test.wantErrors)
+			}
+			if got, want := len(r.added), test.n-test.wantErrors; got != want || len(r.latencies) != want {
+				t.Errorf("Got %d added leaves and %d latencies, want %d", got, len(r.latencies), want)
+			}
+			for i := 1; i < len(r.latencies); i++ {
+				if r.latencies[i] < r.latencies[i-1] {
+					t.Fatalf("Latencies aren't sorted: %v", r.latencies)
+				}
+			}
+			if p50, p100 := r.percentile(0.5), r.percentile(1); p50 > p100 {
+				t.Errorf("P50 latency %v is greater than max %v", p50, p100)
+			}
+			if s := r.String(); !strings.Contains(s, fmt.Sprintf("Added %d leaves (%d errors)", len(r.added), r.errors)) {
+				t.Errorf("Unexpected summary %q", s)
+			}
+			if err := verify(ctx, c, r.added, len(r.added)); (err != nil) != test.verifyErr {
+				t.Errorf("verify = %v, want error: %t", err, test.verifyErr)
+			}
+		})
+	}
+}
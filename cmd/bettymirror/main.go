@@ -0,0 +1,183 @@
+// bettymirror copies the entries of one Betty log into another, e.g. to migrate a log between storage backends.
+//
+// The entries of the source log's latest checkpoint are read in order and added to the destination log, which must
+// be empty when the mirror starts and must not deduplicate entries, so that every entry is assigned the same index
+// as in the source. Once they've all been added, the destination's checkpoint is checked to have the same size and
+// root hash as the source's.
+//
+// The index of the next entry to copy is saved to --offset_file after each batch, so an interrupted mirror resumes
+// where it left off when run again.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlCutter/betty/client"
+	f_log "github.com/transparency-dev/formats/log"
+	"golang.org/x/mod/sumdb/note"
+	"k8s.io/klog/v2"
+)
+
+var (
+	sourceURL      = flag.String("source_url", "", "Base URL of the log to copy entries from")
+	sourceVerifier = flag.String("source_verifier", "Test-Betty+df84580a+AQQASqPUZoIHcJAF5mBOryctwFdTV1E0GRY4kEAtTzwB", "Verifier key for the source log's checkpoints")
+	destURL        = flag.String("dest_url", "", "Base URL of the log to add the entries to, which must be served without --dedup")
+	destVerifier   = flag.String("dest_verifier", "Test-Betty+df84580a+AQQASqPUZoIHcJAF5mBOryctwFdTV1E0GRY4kEAtTzwB", "Verifier key for the destination log's checkpoints")
+	offsetFile     = flag.String("offset_file", "", "File in which the index of the next entry to copy is saved, so that the mirror can be resumed")
+	batchSize      = flag.Uint64("batch_size", 256, "Max number of entries read and added in each request")
+	timeout        = flag.Duration("timeout", time.Minute, "Max time to wait for each request, and for the destination to publish a checkpoint containing every entry once they've been added")
+)
+
+// source is the log from which entries are copied.
+type source interface {
+	Checkpoint(ctx context.Context) (*f_log.Checkpoint, error)
+	Entries(ctx context.Context, start, count uint64) ([][]byte, error)
+}
+
+// destination is the log to which entries are copied.
+type destination interface {
+	Checkpoint(ctx context.Context) (*f_log.Checkpoint, error)
+	AddBatch(ctx context.Context, leaves [][]byte) ([]uint64, error)
+}
+
+func main() {
+	klog.InitFlags(nil)
+	flag.Parse()
+	ctx := context.Background()
+
+	if *sourceURL == "" || *destURL == "" {
+		klog.Exit("--source_url and --dest_url are required")
+	}
+	if *offsetFile == "" {
+		klog.Exit("--offset_file is required")
+	}
+	if *batchSize == 0 {
+		klog.Exit("--batch_size must be positive")
+	}
+	hc := &http.Client{Timeout: *timeout}
+	src := client.New(*sourceURL, verifierFromFlag("source_verifier", *sourceVerifier), hc)
+	dst := client.New(*destURL, verifierFromFlag("dest_verifier", *destVerifier), hc)
+
+	cp, err := src.Checkpoint(ctx)
+	if err != nil {
+		klog.Exitf("Failed to read source checkpoint: %v", err)
+	}
+	next, err := readOffset(*offsetFile)
+	if err != nil {
+		klog.Exitf("Failed to read --offset_file: %v", err)
+	}
+	if next > cp.Size {
+		klog.Exitf("Offset %d is beyond the source's checkpoint of size %d", next, cp.Size)
+	}
+	klog.Infof("Mirroring entries [%d, %d) from %s to %s", next, cp.Size, *sourceURL, *destURL)
+	start := time.Now()
+	if err := mirror(ctx, src, dst, next, cp.Size, *batchSize, func(n uint64) error { return writeOffset(*offsetFile, n) }); err != nil {
+		klog.Exitf("Mirroring failed: %v", err)
+	}
+	if err := verifyMirror(ctx, dst, cp, *timeout); err != nil {
+		klog.Exitf("Verification failed: %v", err)
+	}
+	fmt.Printf("Mirrored %d entries in %v, destination has size %d and root hash %x\n", cp.Size-next, time.Since(start).Round(time.Millisecond), cp.Size, cp.Hash)
+}
+
+// verifierFromFlag parses the verifier key given by the named flag.
+func verifierFromFlag(name, vkey string) note.Verifier {
+	v, err := note.NewVerifier(vkey)
+	if err != nil {
+		klog.Exitf("Invalid --%s: %v", name, err)
+	}
+	return v
+}
+
+// mirror copies the source's entries with indices [next, size) to the destination in batches of up to batchSize,
+// calling save with the index of the next entry to copy once each batch has been added.
+// Each entry must be assigned the same index in the destination as it has in the source.
+func mirror(ctx context.Context, src source, dst destination, next, size, batchSize uint64, save func(uint64) error) error {
+	for next < size {
+		es, err := src.Entries(ctx, next, min(batchSize, size-next))
+		if err != nil {
+			return fmt.Errorf("failed to read entries from %d: %v", next, err)
+		}
+		idx, err := dst.AddBatch(ctx, es)
+		if err != nil {
+			return fmt.Errorf("failed to add entries from %d: %v", next, err)
+		}
+		for i, got := range idx {
+			if want := next + uint64(i); got != want {
+				return fmt.Errorf("destination assigned index %d to entry %d, it must only be written by this mirror and must not deduplicate entries", got, want)
+			}
+		}
+		next += uint64(len(es))
+		if err := save(next); err != nil {
+			return fmt.Errorf("failed to save offset: %v", err)
+		}
+		klog.V(1).Infof("Mirrored %d of %d entries", next, size)
+	}
+	return nil
+}
+
+// verifyMirror waits for the destination to publish a checkpoint at least as large as the source's checkpoint
+// want, and checks that it has the same size and root hash.
+func verifyMirror(ctx context.Context, dst destination, want *f_log.Checkpoint, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		got, err := dst.Checkpoint(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read destination checkpoint: %v", err)
+		}
+		if got.Size >= want.Size {
+			if got.Size != want.Size {
+				return fmt.Errorf("destination has size %d, want %d: it must only be written by this mirror", got.Size, want.Size)
+			}
+			if !bytes.Equal(got.Hash, want.Hash) {
+				return fmt.Errorf("destination has root hash %x at size %d, want %x", got.Hash, got.Size, want.Hash)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("destination checkpoint has size %d, timed out waiting for size %d", got.Size, want.Size)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// readOffset returns the index of the next entry to copy saved in the file f, or zero if it doesn't exist yet.
+func readOffset(f string) (uint64, error) {
+	b, err := os.ReadFile(f)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// writeOffset atomically saves the index of the next entry to copy to the file f.
+func writeOffset(f string, next uint64) error {
+	t, err := os.CreateTemp(filepath.Dir(f), filepath.Base(f)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(t.Name())
+	if _, err := fmt.Fprintf(t, "%d\n", next); err != nil {
+		t.Close()
+		return err
+	}
+	if err := t.Close(); err != nil {
+		return err
+	}
+	return os.Rename(t.Name(), f)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
+	"github.com/AlCutter/betty/storage/memory"
+	"github.com/AlCutter/betty/storage/posix"
+	f_log "github.com/transparency-dev/formats/log"
+)
+
+// testTree records the latest tree published by a log's storage.
+type testTree struct {
+	mu   sync.Mutex
+	size uint64
+	root []byte
+}
+
+func (t *testTree) current() (uint64, []byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.size, t.root, nil
+}
+
+func (t *testTree) newTree(size uint64, root []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.size, t.root = size, root
+	return nil
+}
+
+func (t *testTree) Checkpoint(context.Context) (*f_log.Checkpoint, error) {
+	size, root, _ := t.current()
+	return &f_log.Checkpoint{Origin: "test", Size: size, Hash: root}, nil
+}
+
+// posixSource is a source reading the entries of a log from its POSIX storage.
+type posixSource struct {
+	*testTree
+	params log.Params
+	s      *posix.Storage
+}
+
+// newPOSIXSource creates a log in a temporary directory containing the leaves.
+func newPOSIXSource(t *testing.T, params log.Params, leaves [][]byte) *posixSource {
+	t.Helper()
+	src := &posixSource{testTree: &testTree{}, params: params}
+	s, err := posix.New(t.TempDir(), params, 10*time.Millisecond, src.current, src.newTree)
+	if err != nil {
+		t.Fatalf("posix.New: %v", err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+	src.s = s
+	if len(leaves) > 0 {
+		if _, err := s.SequenceBatch(context.Background(), leaves); err != nil {
+			t.Fatalf("SequenceBatch: %v", err)
+		}
+	}
+	return src
+}
+
+func (s *posixSource) Entries(ctx context.Context, start, count uint64) ([][]byte, error) {
+	size, _, _ := s.current()
+	return reader.GetEntries(ctx, s.params, size, start, count, s.s)
+}
+
+// memoryDest is a destination adding entries to a log in memory.
+type memoryDest struct {
+	*testTree
+	params log.Params
+	s      *memory.Storage
+}
+
+func newMemoryDest(t *testing.T, params log.Params) *memoryDest {
+	t.Helper()
+	dst := &memoryDest{testTree: &testTree{}, params: params}
+	s, err := memory.New(&memory.Checkpoint{}, params, 10*time.Millisecond, dst.current, dst.newTree)
+	if err != nil {
+		t.Fatalf("memory.New: %v", err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+	dst.s = s
+	return dst
+}
+
+func (d *memoryDest) AddBatch(ctx context.Context, leaves [][]byte) ([]uint64, error) {
+	return d.s.SequenceBatch(ctx, leaves)
+}
+
+// testLeaves returns n distinct leaves, starting from the given index.
+func testLeaves(from, n int) [][]byte {
+	r := make([][]byte, n)
+	for i := range r {
+		r[i] = []byte(fmt.Sprintf("leaf %d", from+i))
+	}
+	return r
+}
+
+// checkMirrored checks that dst holds exactly the entries of src.
+func checkMirrored(t *testing.T, src *posixSource, dst *memoryDest) {
+	t.Helper()
+	ctx := context.Background()
+	cp, err := src.Checkpoint(ctx)
+	if err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if err := verifyMirror(ctx, dst, cp, time.Second); err != nil {
+		t.Fatalf("verifyMirror: %v", err)
+	}
+	want, err := src.Entries(ctx, 0, cp.Size)
+	if err != nil {
+		t.Fatalf("Entries: %v", err)
+	}
+	got, err := reader.GetEntries(ctx, dst.params, cp.Size, 0, cp.Size, dst.s)
+	if err != nil {
+		t.Fatalf("GetEntries: %v", err)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("Destination entry %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		n          int
+		batchSize  uint64
+		bundleSize int
+		// wantSaves is the number of times the offset is expected to be saved.
+		wantSaves int
+	}{
+		{name: "one batch", n: 10, batchSize: 256, bundleSize: 4, wantSaves: 1},
+		{name: "batch per bundle", n: 16, batchSize: 4, bundleSize: 4, wantSaves: 4},
+		{name: "batches spanning bundles", n: 23, batchSize: 5, bundleSize: 4, wantSaves: 5},
+		{name: "single entry batches", n: 7, batchSize: 1, bundleSize: 4, wantSaves: 7},
+		{name: "larger bundles", n: 30, batchSize: 7, bundleSize: 8, wantSaves: 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			params := log.Params{EntryBundleSize: test.bundleSize, TileHeight: 2}
+			src := newPOSIXSource(t, params, testLeaves(0, test.n))
+			dst := newMemoryDest(t, params)
+			var saved []uint64
+			save := func(n uint64) error {
+				saved = append(saved, n)
+				return nil
+			}
+			if err := mirror(ctx, src, dst, 0, uint64(test.n), test.batchSize, save); err != nil {
+				t.Fatalf("mirror: %v", err)
+			}
+			if len(saved) != test.wantSaves || saved[len(saved)-1] != uint64(test.n) {
+				t.Errorf("Saved offsets %v, want %d ending with %d", saved, test.wantSaves, test.n)
+			}
+			checkMirrored(t, src, dst)
+		})
+	}
+}
+
+// interruptedSource is a source whose reads fail once it's served reads batches.
+type interruptedSource struct {
+	source
+	reads int
+}
+
+func (s *interruptedSource) Entries(ctx context.Context, start, count uint64) ([][]byte, error) {
+	if s.reads == 0 {
+		return nil, errors.New("interrupted")
+	}
+	s.reads--
+	return s.source.Entries(ctx, start, count)
+}
+
+func TestMirrorResume(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// The first run of the mirror is interrupted once it's read reads batches.
+		reads     int
+		n         int
+		batchSize uint64
+	}{
+		{name: "before first batch", reads: 0, n: 20, batchSize: 3},
+		{name: "after first batch", reads: 1, n: 20, batchSize: 3},
+		{name: "mid way", reads: 3, n: 20, batchSize: 3},
+		{name: "before last batch", reads: 6, n: 20, batchSize: 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			params := log.Params{EntryBundleSize: 4, TileHeight: 2}
+			src := newPOSIXSource(t, params, testLeaves(0, test.n))
+			dst := newMemoryDest(t, params)
+			f := filepath.Join(t.TempDir(), "offset")
+			save := func(n uint64) error { return writeOffset(f, n) }
+
+			if err := mirror(ctx, &interruptedSource{source: src, reads: test.reads}, dst, 0, uint64(test.n), test.batchSize, save); err == nil {
+				t.Fatal("mirror succeeded, want it to be interrupted")
+			}
+			next, err := readOffset(f)
+			if err != nil {
+				t.Fatalf("readOffset: %v", err)
+			}
+			if want := uint64(test.reads) * test.batchSize; next != want {
+				t.Fatalf("Saved offset %d, want %d", next, want)
+			}
+			if err := mirror(ctx, src, dst, next, uint64(test.n), test.batchSize, save); err != nil {
+				t.Fatalf("Resumed mirror: %v", err)
+			}
+			if next, err := readOffset(f); err != nil || next != uint64(test.n) {
+				t.Errorf("readOffset = (%d, %v), want (%d, nil)", next, err, test.n)
+			}
+			checkMirrored(t, src, dst)
+		})
+	}
+}
+
+func TestMirrorNonEmptyDestination(t *testing.T) {
+	ctx := context.Background()
+	params := log.Params{EntryBundleSize: 4, TileHeight: 2}
+	src := newPOSIXSource(t, params, testLeaves(0, 10))
+	dst := newMemoryDest(t, params)
+	if _, err := dst.AddBatch(ctx, [][]byte{[]byte("stray")}); err != nil {
+		t.Fatalf("AddBatch: %v", err)
+	}
+	err := mirror(ctx, src, dst, 0, 10, 4, func(uint64) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "destination assigned index 1 to entry 0") {
+		t.Errorf("mirror = %v, want index mismatch", err)
+	}
+}
+
+// fixedDest is a destination whose checkpoint is fixed.
+type fixedDest struct {
+	destination
+	cp *f_log.Checkpoint
+}
+
+func (d fixedDest) Checkpoint(context.Context) (*f_log.Checkpoint, error) {
+	return d.cp, nil
+}
+
+func TestVerifyMirror(t *testing.T) {
+	want := &f_log.Checkpoint{Origin: "source", Size: 10, Hash: []byte("root of 10")}
+	for _, test := range []struct {
+		name    string
+		got     *f_log.Checkpoint
+		wantErr string
+	}{
+		{name: "match", got: &f_log.Checkpoint{Origin: "dest", Size: 10, Hash: []byte("root of 10")}},
+		{name: "different root", got: &f_log.Checkpoint{Size: 10, Hash: []byte("other root")}, wantErr: "destination has root hash"},
+		{name: "larger", got: &f_log.Checkpoint{Size: 11, Hash: []byte("root of 11")}, wantErr: "destination has size 11, want 10"},
+		{name: "smaller", got: &f_log.Checkpoint{Size: 9, Hash: []byte("root of 9")}, wantErr: "timed out waiting for size 10"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifyMirror(context.Background(), fixedDest{cp: test.got}, want, 100*time.Millisecond)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("verifyMirror: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("verifyMirror = %v, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestOffset(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// contents is written to the offset file, unless it's empty.
+		contents string
+		want     uint64
+		wantErr  bool
+	}{
+		{name: "missing", want: 0},
+		{name: "saved", contents: "42\n", want: 42},
+		{name: "no newline", contents: "7", want: 7},
+		{name: "invalid", contents: "forty two\n", wantErr: true},
+		{name: "negative", contents: "-1\n", wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f := filepath.Join(t.TempDir(), "offset")
+			if test.contents != "" {
+				if err := os.WriteFile(f, []byte(test.contents), 0o644); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+			}
+			got, err := readOffset(f)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("readOffset = %v, want error: %t", err, test.wantErr)
+			}
+			if err == nil && got != test.want {
+				t.Errorf("readOffset = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteOffset(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "offset")
+	for _, n := range []uint64{0, 1, 256, 1 << 40} {
+		if err := writeOffset(f, n); err != nil {
+			t.Fatalf("writeOffset(%d): %v", n, err)
+		}
+		if got, err := readOffset(f); err != nil || got != n {
+			t.Errorf("readOffset = (%d, %v), want (%d, nil)", got, err, n)
+		}
+	}
+	// No temporary files are left behind.
+	es, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(es) != 1 {
+		t.Errorf("Got %d files, want only the offset file", len(es))
+	}
+}
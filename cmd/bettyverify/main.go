@@ -0,0 +1,70 @@
+// bettyverify checks that a leaf is included in a Betty log, for auditors who need to confirm that an entry was
+// logged without trusting the log's operator.
+//
+// The log's latest checkpoint is fetched and its signature verified with --log_verifier, then an inclusion proof
+// for the leaf read from --leaf_file at --index is built from the log's tiles and checked against the checkpoint's
+// root hash. The command exits with a non-zero status if any step fails.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/AlCutter/betty/client"
+	f_log "github.com/transparency-dev/formats/log"
+	"golang.org/x/mod/sumdb/note"
+	"k8s.io/klog/v2"
+)
+
+var (
+	logURL   = flag.String("log_url", "", "Base URL of the log")
+	verifier = flag.String("log_verifier", "Test-Betty+df84580a+AQQASqPUZoIHcJAF5mBOryctwFdTV1E0GRY4kEAtTzwB", "Verifier key for the log's checkpoints")
+	leafFile = flag.String("leaf_file", "", "File containing the leaf whose inclusion should be verified")
+	index    = flag.Int64("index", -1, "Index of the leaf in the log")
+	timeout  = flag.Duration("timeout", time.Minute, "Max time to wait for each request to the log")
+)
+
+func main() {
+	klog.InitFlags(nil)
+	flag.Parse()
+	ctx := context.Background()
+
+	if *logURL == "" || *leafFile == "" {
+		klog.Exit("--log_url and --leaf_file are required")
+	}
+	if *index < 0 {
+		klog.Exit("--index is required")
+	}
+	v, err := note.NewVerifier(*verifier)
+	if err != nil {
+		klog.Exitf("Invalid --log_verifier: %v", err)
+	}
+	leaf, err := os.ReadFile(*leafFile)
+	if err != nil {
+		klog.Exitf("Failed to read --leaf_file: %v", err)
+	}
+	c := client.New(*logURL, v, &http.Client{Timeout: *timeout})
+
+	cp, err := verifyLeaf(ctx, c, leaf, uint64(*index))
+	if err != nil {
+		klog.Exit(err)
+	}
+	fmt.Printf("Leaf at index %d is included in checkpoint of size %d with root hash %x\n", *index, cp.Size, cp.Hash)
+}
+
+// verifyLeaf checks that the leaf is included in the log at index, under the log's latest checkpoint, which is
+// returned if so.
+func verifyLeaf(ctx context.Context, c *client.Client, leaf []byte, index uint64) (*f_log.Checkpoint, error) {
+	cp, err := c.Checkpoint(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch checkpoint: %v", err)
+	}
+	if err := c.VerifyInclusionIn(ctx, cp, leaf, index); err != nil {
+		return nil, fmt.Errorf("failed to verify that the leaf at index %d is included in the checkpoint of size %d: %v", index, cp.Size, err)
+	}
+	return cp, nil
+}
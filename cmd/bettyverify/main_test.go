@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AlCutter/betty/client"
+	f_log "github.com/transparency-dev/formats/log"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// fakeLog serves the checkpoint and tiles of a fixed in-memory log, with the default tlog-tiles params of SHA-256
+// and a tile height of 8.
+type fakeLog struct {
+	signer note.Signer
+	size   int64
+	hashes []tlog.Hash
+}
+
+func (l *fakeLog) ReadHashes(indexes []int64) ([]tlog.Hash, error) {
+	hs := make([]tlog.Hash, len(indexes))
+	for i, idx := range indexes {
+		hs[i] = l.hashes[idx]
+	}
+	return hs, nil
+}
+
+func (l *fakeLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/checkpoint":
+		root, err := tlog.TreeHash(l.size, l)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cp := f_log.Checkpoint{Origin: l.signer.Name(), Size: uint64(l.size), Hash: root[:]}
+		n, err := note.Sign(&note.Note{Text: string(cp.Marshal())}, l.signer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(n)
+	case strings.HasPrefix(r.URL.Path, "/tile/"):
+		t, err := tlog.ParseTilePath("tile/8/" + strings.TrimPrefix(r.URL.Path, "/tile/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		b, err := tlog.ReadTileData(t, l)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newFakeLog starts a server for a log containing n leaves, returning the URL it's served at and the verifier
+// key for its checkpoints.
+func newFakeLog(t *testing.T, n int) (string, string) {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, "Test-Betty")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	s, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	l := &fakeLog{signer: s}
+	for i := range n {
+		hs, err := tlog.StoredHashes(l.size, leaf(i), l)
+		if err != nil {
+			t.Fatalf("StoredHashes: %v", err)
+		}
+		l.hashes = append(l.hashes, hs...)
+		l.size++
+	}
+	ts := httptest.NewServer(l)
+	t.Cleanup(ts.Close)
+	return ts.URL, vkey
+}
+
+func leaf(i int) []byte {
+	return []byte(fmt.Sprintf("leaf %d", i))
+}
+
+func TestVerifyLeaf(t *testing.T) {
+	const size = 300
+	url, vkey := newFakeLog(t, size)
+	_, otherKey, err := note.GenerateKey(rand.Reader, "Test-Betty")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	for _, test := range []struct {
+		name    string
+		vkey    string
+		leaf    []byte
+		index   uint64
+		wantErr string
+	}{
+		{name: "first leaf", vkey: vkey, leaf: leaf(0), index: 0},
+		{name: "in full tile", vkey: vkey, leaf: leaf(100), index: 100},
+		{name: "in partial tile", vkey: vkey, leaf: leaf(size - 1), index: size - 1},
+		{name: "wrong leaf", vkey: vkey, leaf: leaf(1), index: 2, wantErr: "failed to verify inclusion proof"},
+		{name: "beyond checkpoint", vkey: vkey, leaf: leaf(size), index: size, wantErr: "not included in checkpoint of size 300"},
+		{name: "wrong key", vkey: otherKey, leaf: leaf(0), index: 0, wantErr: "failed to fetch checkpoint"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := note.NewVerifier(test.vkey)
+			if err != nil {
+				t.Fatalf("NewVerifier: %v", err)
+			}
+			cp, err := verifyLeaf(context.Background(), client.New(url, v, http.DefaultClient), test.leaf, test.index)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("verifyLeaf = %v, want error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyLeaf: %v", err)
+			}
+			if cp.Size != size {
+				t.Errorf("Got checkpoint of size %d, want %d", cp.Size, size)
+			}
+		})
+	}
+}
@@ -1,6 +1,243 @@
 package log
 
+import (
+	"crypto"
+	_ "crypto/sha256" // SHA-256 is the default hash.
+	_ "crypto/sha512" // SHA-384, SHA-512 and SHA-512/256 may be configured.
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/transparency-dev/merkle"
+	"github.com/transparency-dev/merkle/rfc6962"
+)
+
+const (
+	// DefaultTileHeight is the tile height used by tlog-tiles, and is used when Params.TileHeight is unset.
+	DefaultTileHeight = 8
+	// MaxTileHeight is the largest supported tile height.
+	MaxTileHeight = 8
+
+	// MetadataPath is the location, relative to the log root, of the log's persisted metadata.
+	MetadataPath = "log.meta"
+)
+
+// Params describes the shape of a log's storage.
 type Params struct {
-	TileHeight      int
+	// TileHeight is the number of tree levels stored in each tile, defaults to DefaultTileHeight.
+	TileHeight int
+	// EntryBundleSize is the number of entries stored in each entry bundle, and the max number of
+	// entries sequenced together in a batch. It must be positive.
 	EntryBundleSize int
+	// BundleMaxBytes, if non-zero, is the max total size in bytes of the entries in an entry bundle, and of those
+	// sequenced together in a batch, which is flushed once either this or EntryBundleSize is reached.
+	// Entry bundles are addressed by index, so a bundle always holds EntryBundleSize entries once complete; storage
+	// which enforces the limit on bundles does so by rejecting entries larger than MaxEntryBytes.
+	// It must be at least EntryBundleSize.
+	BundleMaxBytes int
+	// LeafHasher, if set, returns the Merkle leaf hash of an entry, defaults to RFC6962 leaf hashing.
+	// This allows applications to apply domain-specific preprocessing to entries before they're hashed
+	// into the tree; the same hasher must be used by everyone verifying inclusion proofs for the log.
+	LeafHasher func([]byte) []byte
+	// Hash is the hash function used to build the log's Merkle tree as per RFC6962, defaults to SHA-256.
+	// It must not change over the life of the log.
+	Hash crypto.Hash
+	// Origin, if set, is the origin line of the log's checkpoints, which identifies the log. It's recorded in the
+	// metadata of a new log, after which it must not change, even if the log's signing key does.
+	Origin string
+	// Name, if set, labels the metrics exported for the log, distinguishing them from those of other logs hosted by
+	// the same process. It isn't recorded in the log's metadata.
+	Name string
+}
+
+// supportedHashes are the hash functions which may be used to build a log's Merkle tree, by name.
+var supportedHashes = map[string]crypto.Hash{
+	crypto.SHA256.String():     crypto.SHA256,
+	crypto.SHA384.String():     crypto.SHA384,
+	crypto.SHA512.String():     crypto.SHA512,
+	crypto.SHA512_256.String(): crypto.SHA512_256,
+}
+
+// ParseHash returns the hash function with the given name, e.g. "SHA-256", if it's supported.
+func ParseHash(name string) (crypto.Hash, error) {
+	h, ok := supportedHashes[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported hash %q", name)
+	}
+	return h, nil
+}
+
+// Validate checks that the params are usable.
+func (p Params) Validate() error {
+	if p.TileHeight < 0 || p.TileHeight > MaxTileHeight {
+		return fmt.Errorf("TileHeight %d must be between 1 and %d, or 0 for the default", p.TileHeight, MaxTileHeight)
+	}
+	if p.EntryBundleSize <= 0 {
+		return fmt.Errorf("EntryBundleSize %d must be positive", p.EntryBundleSize)
+	}
+	if p.BundleMaxBytes < 0 {
+		return fmt.Errorf("BundleMaxBytes %d must not be negative", p.BundleMaxBytes)
+	}
+	if p.BundleMaxBytes > 0 && p.BundleMaxBytes < p.EntryBundleSize {
+		return fmt.Errorf("BundleMaxBytes %d must be at least EntryBundleSize %d, or 0 for no limit", p.BundleMaxBytes, p.EntryBundleSize)
+	}
+	if p.Hash != 0 {
+		if _, err := ParseHash(p.Hash.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MaxEntryBytes returns the size in bytes of the largest entry which can be added to the log such that a complete
+// entry bundle, of EntryBundleSize entries, fits within BundleMaxBytes, or zero if there's no limit.
+func (p Params) MaxEntryBytes() int {
+	if p.BundleMaxBytes == 0 {
+		return 0
+	}
+	return p.BundleMaxBytes / p.EntryBundleSize
+}
+
+// Hasher returns the hasher used to build the log's Merkle tree.
+// Interior nodes are always hashed as per RFC6962 with Hash, leaves are hashed with LeafHasher if set.
+func (p Params) Hasher() merkle.LogHasher {
+	var h merkle.LogHasher = rfc6962.DefaultHasher
+	if p.hash() != crypto.SHA256 {
+		h = rfc6962.New(p.hash())
+	}
+	if p.LeafHasher == nil {
+		return h
+	}
+	return leafHasher{LogHasher: h, hashLeaf: p.LeafHasher}
+}
+
+// hash returns the configured hash function, or SHA-256 if unset.
+func (p Params) hash() crypto.Hash {
+	if p.Hash == 0 {
+		return crypto.SHA256
+	}
+	return p.Hash
+}
+
+// leafHasher is a merkle.LogHasher which overrides the leaf hashing of another LogHasher.
+type leafHasher struct {
+	merkle.LogHasher
+	hashLeaf func([]byte) []byte
+}
+
+// HashLeaf returns the Merkle tree leaf hash of the provided entry.
+func (h leafHasher) HashLeaf(e []byte) []byte {
+	return h.hashLeaf(e)
+}
+
+// tileHeight returns the configured tile height, or the default if unset.
+func (p Params) tileHeight() uint64 {
+	if p.TileHeight == 0 {
+		return DefaultTileHeight
+	}
+	return uint64(p.TileHeight)
+}
+
+// TileWidth returns the maximum number of "tile leaves" in a tile.
+func (p Params) TileWidth() uint64 {
+	return 1 << p.tileHeight()
+}
+
+// NodeCoordsToTileAddress returns the (TileLevel, TileIndex) in tile-space, and the
+// (NodeLevel, NodeIndex) address within that tile of the specified tree node co-ordinates.
+func (p Params) NodeCoordsToTileAddress(treeLevel, treeIndex uint64) (uint64, uint64, uint, uint64) {
+	h := p.tileHeight()
+	tileRowWidth := uint64(1 << (h - treeLevel%h))
+	tileLevel := treeLevel / h
+	tileIndex := treeIndex / tileRowWidth
+	nodeLevel := uint(treeLevel % h)
+	nodeIndex := uint64(treeIndex % tileRowWidth)
+
+	return tileLevel, tileIndex, nodeLevel, nodeIndex
+}
+
+// PartialTileSize returns the expected number of leaves in a tile at the given location within
+// a tree of the specified logSize, or 0 if the tile is expected to be fully populated.
+func (p Params) PartialTileSize(level, index, logSize uint64) uint64 {
+	sizeAtLevel := logSize >> (level * p.tileHeight())
+	fullTiles := sizeAtLevel / p.TileWidth()
+	if index < fullTiles {
+		return 0
+	}
+	return sizeAtLevel % p.TileWidth()
+}
+
+// Metadata describes the parameters a log was created with, these must not change over the life of the log.
+type Metadata struct {
+	TileHeight int `json:"tile_height"`
+	// EntryBundleSize is absent from the metadata of logs created before it was recorded, in which case it
+	// can't be checked.
+	EntryBundleSize int `json:"entry_bundle_size,omitempty"`
+	// Hash is the name of the hash function used to build the tree, it's absent from the metadata of logs
+	// created before it was recorded, all of which use SHA-256.
+	Hash string `json:"hash,omitempty"`
+	// Origin is the origin line of the log's checkpoints, it's absent from the metadata of logs created before
+	// it was recorded, or without Params.Origin set.
+	Origin string `json:"origin,omitempty"`
+	// CreatedAt is when the metadata was first persisted, i.e. when the log was created, it's absent from the
+	// metadata of logs created before it was recorded.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// Metadata returns the metadata which should be persisted for a log created with these params.
+func (p Params) Metadata() Metadata {
+	return Metadata{
+		TileHeight:      int(p.tileHeight()),
+		EntryBundleSize: p.EntryBundleSize,
+		Hash:            p.hash().String(),
+		Origin:          p.Origin,
+	}
+}
+
+// ParseMetadata parses the raw metadata persisted for a log, filling in the hash of logs created before it
+// was recorded.
+func ParseMetadata(raw []byte) (Metadata, error) {
+	var m Metadata
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return Metadata{}, fmt.Errorf("failed to parse log metadata: %v", err)
+	}
+	if m.Hash == "" {
+		m.Hash = crypto.SHA256.String()
+	}
+	return m, nil
+}
+
+// CheckMetadata verifies that the params are compatible with the raw metadata previously persisted for
+// the log, returning an error if not.
+func (p Params) CheckMetadata(raw []byte) error {
+	m, err := ParseMetadata(raw)
+	if err != nil {
+		return err
+	}
+	want := p.Metadata()
+	if m.TileHeight != want.TileHeight {
+		return fmt.Errorf("log was created with tile height %d, but %d is configured", m.TileHeight, want.TileHeight)
+	}
+	// The entry bundle boundaries of the existing entries would no longer line up with those of new entries.
+	if m.EntryBundleSize != 0 && m.EntryBundleSize != want.EntryBundleSize {
+		return fmt.Errorf("log was created with entry bundle size %d, but %d is configured", m.EntryBundleSize, want.EntryBundleSize)
+	}
+	// Nodes hashed with different functions can't be mixed in the same tree.
+	if m.Hash != want.Hash {
+		return fmt.Errorf("log was created with hash %s, but %s is configured", m.Hash, want.Hash)
+	}
+	// Checkpoints with a different origin would no longer be recognised as coming from the same log.
+	if m.Origin != "" && want.Origin != "" && m.Origin != want.Origin {
+		return fmt.Errorf("log was created with origin %q, but %q is configured", m.Origin, want.Origin)
+	}
+	return nil
+}
+
+// MarshalMetadata returns the serialised metadata which should be persisted for a new log created with these
+// params, which records the current time as its creation time.
+func (p Params) MarshalMetadata() ([]byte, error) {
+	m := p.Metadata()
+	now := time.Now().UTC()
+	m.CreatedAt = &now
+	return json.Marshal(m)
 }
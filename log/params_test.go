@@ -0,0 +1,249 @@
+package log
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/transparency-dev/merkle/rfc6962"
+)
+
+func TestValidateTileHeight(t *testing.T) {
+	for _, test := range []struct {
+		height  int
+		wantErr bool
+	}{
+		{height: 0},
+		{height: 1},
+		{height: 4},
+		{height: MaxTileHeight},
+		{height: MaxTileHeight + 1, wantErr: true},
+		{height: -1, wantErr: true},
+	} {
+		p := Params{EntryBundleSize: 256, TileHeight: test.height}
+		if err := p.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("Validate with tile height %d: got %v, want error %t", test.height, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateBundleMaxBytes(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		params  Params
+		wantErr bool
+	}{
+		{name: "no limit", params: Params{EntryBundleSize: 256}},
+		{name: "one byte per entry", params: Params{EntryBundleSize: 256, BundleMaxBytes: 256}},
+		{name: "large limit", params: Params{EntryBundleSize: 256, BundleMaxBytes: 1 << 20}},
+		{name: "negative", params: Params{EntryBundleSize: 256, BundleMaxBytes: -1}, wantErr: true},
+		{name: "too small for a bundle", params: Params{EntryBundleSize: 256, BundleMaxBytes: 255}, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.params.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("Validate: got %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxEntryBytes(t *testing.T) {
+	for _, test := range []struct {
+		params Params
+		want   int
+	}{
+		{params: Params{EntryBundleSize: 256}, want: 0},
+		{params: Params{EntryBundleSize: 256, BundleMaxBytes: 256}, want: 1},
+		{params: Params{EntryBundleSize: 256, BundleMaxBytes: 1 << 20}, want: 4096},
+		{params: Params{EntryBundleSize: 3, BundleMaxBytes: 100}, want: 33},
+	} {
+		if got := test.params.MaxEntryBytes(); got != test.want {
+			t.Errorf("%+v.MaxEntryBytes() = %d, want %d", test.params, got, test.want)
+		}
+	}
+}
+
+func TestValidateEntryBundleSize(t *testing.T) {
+	for _, test := range []struct {
+		size    int
+		wantErr bool
+	}{
+		{size: 1},
+		{size: 256},
+		{size: 0, wantErr: true},
+		{size: -1, wantErr: true},
+		{size: -256, wantErr: true},
+	} {
+		p := Params{EntryBundleSize: test.size}
+		if err := p.Validate(); (err != nil) != test.wantErr {
+			t.Errorf("Validate with entry bundle size %d: got %v, want error %t", test.size, err, test.wantErr)
+		}
+	}
+}
+
+func TestTileGeometry(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		height int
+		// treeLevel and treeIndex are the coordinates of a node in the tree.
+		treeLevel, treeIndex uint64
+		wantWidth            uint64
+		wantTileLevel        uint64
+		wantTileIndex        uint64
+		wantNodeLevel        uint
+		wantNodeIndex        uint64
+	}{
+		{name: "default leaf", treeLevel: 0, treeIndex: 300, wantWidth: 256, wantTileLevel: 0, wantTileIndex: 1, wantNodeLevel: 0, wantNodeIndex: 44},
+		{name: "default interior", treeLevel: 9, treeIndex: 3, wantWidth: 256, wantTileLevel: 1, wantTileIndex: 0, wantNodeLevel: 1, wantNodeIndex: 3},
+		{name: "height 4 leaf", height: 4, treeLevel: 0, treeIndex: 35, wantWidth: 16, wantTileLevel: 0, wantTileIndex: 2, wantNodeLevel: 0, wantNodeIndex: 3},
+		{name: "height 4 interior", height: 4, treeLevel: 5, treeIndex: 20, wantWidth: 16, wantTileLevel: 1, wantTileIndex: 2, wantNodeLevel: 1, wantNodeIndex: 4},
+		{name: "height 4 second tile level", height: 4, treeLevel: 8, treeIndex: 17, wantWidth: 16, wantTileLevel: 2, wantTileIndex: 1, wantNodeLevel: 0, wantNodeIndex: 1},
+		{name: "height 1", height: 1, treeLevel: 3, treeIndex: 5, wantWidth: 2, wantTileLevel: 3, wantTileIndex: 2, wantNodeLevel: 0, wantNodeIndex: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := Params{EntryBundleSize: 256, TileHeight: test.height}
+			if got := p.TileWidth(); got != test.wantWidth {
+				t.Errorf("TileWidth() = %d, want %d", got, test.wantWidth)
+			}
+			tl, ti, nl, ni := p.NodeCoordsToTileAddress(test.treeLevel, test.treeIndex)
+			if tl != test.wantTileLevel || ti != test.wantTileIndex || nl != test.wantNodeLevel || ni != test.wantNodeIndex {
+				t.Errorf("NodeCoordsToTileAddress(%d, %d) = (%d, %d, %d, %d), want (%d, %d, %d, %d)", test.treeLevel, test.treeIndex,
+					tl, ti, nl, ni, test.wantTileLevel, test.wantTileIndex, test.wantNodeLevel, test.wantNodeIndex)
+			}
+		})
+	}
+}
+
+func TestPartialTileSize(t *testing.T) {
+	for _, test := range []struct {
+		height             int
+		level, index, size uint64
+		want               uint64
+	}{
+		{height: 8, level: 0, index: 0, size: 10, want: 10},
+		{height: 8, level: 0, index: 0, size: 256, want: 0},
+		{height: 8, level: 0, index: 1, size: 300, want: 44},
+		{height: 8, level: 1, index: 0, size: 300, want: 1},
+		{height: 4, level: 0, index: 2, size: 40, want: 8},
+		{height: 4, level: 0, index: 1, size: 40, want: 0},
+		{height: 4, level: 1, index: 0, size: 40, want: 2},
+		{height: 4, level: 1, index: 0, size: 256, want: 0},
+		{height: 4, level: 2, index: 0, size: 256, want: 1},
+	} {
+		p := Params{EntryBundleSize: 256, TileHeight: test.height}
+		if got := p.PartialTileSize(test.level, test.index, test.size); got != test.want {
+			t.Errorf("PartialTileSize(%d, %d, %d) at height %d = %d, want %d", test.level, test.index, test.size, test.height, got, test.want)
+		}
+	}
+}
+
+func TestCheckMetadata(t *testing.T) {
+	raw, err := Params{EntryBundleSize: 4, TileHeight: 4, Origin: "example.com/log"}.MarshalMetadata()
+	if err != nil {
+		t.Fatalf("MarshalMetadata: %v", err)
+	}
+	for _, test := range []struct {
+		name    string
+		params  Params
+		raw     []byte
+		wantErr bool
+	}{
+		{name: "same params", params: Params{EntryBundleSize: 4, TileHeight: 4}, raw: raw},
+		{name: "different height", params: Params{EntryBundleSize: 4, TileHeight: 5}, raw: raw, wantErr: true},
+		{name: "larger entry bundle size", params: Params{EntryBundleSize: 8, TileHeight: 4}, raw: raw, wantErr: true},
+		{name: "smaller entry bundle size", params: Params{EntryBundleSize: 1, TileHeight: 4}, raw: raw, wantErr: true},
+		// Logs created before the entry bundle size was recorded can't be checked.
+		{name: "legacy metadata", params: Params{EntryBundleSize: 8, TileHeight: 4}, raw: []byte(`{"tile_height":4}`)},
+		{name: "different hash", params: Params{EntryBundleSize: 4, TileHeight: 4, Hash: crypto.SHA512}, raw: raw, wantErr: true},
+		{name: "same hash", params: Params{EntryBundleSize: 4, TileHeight: 4, Hash: crypto.SHA256}, raw: raw},
+		// Logs created before the hash was recorded were built with SHA-256.
+		{name: "legacy hash", params: Params{EntryBundleSize: 4, TileHeight: 4, Hash: crypto.SHA384}, raw: []byte(`{"tile_height":4}`), wantErr: true},
+		{name: "same origin", params: Params{EntryBundleSize: 4, TileHeight: 4, Origin: "example.com/log"}, raw: raw},
+		{name: "different origin", params: Params{EntryBundleSize: 4, TileHeight: 4, Origin: "example.com/other"}, raw: raw, wantErr: true},
+		{name: "default height", params: Params{}, raw: []byte(`{"tile_height":8}`)},
+		{name: "corrupt", params: Params{}, raw: []byte("{"), wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.params.CheckMetadata(test.raw); (err != nil) != test.wantErr {
+				t.Errorf("CheckMetadata(%s): got %v, want error %t", test.raw, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHasher(t *testing.T) {
+	custom := func(e []byte) []byte {
+		h := sha256.Sum256(append([]byte("custom"), e...))
+		return h[:]
+	}
+	l, r := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	for _, test := range []struct {
+		name   string
+		params Params
+		// wantLeaf is the expected hash of the leaf "leaf".
+		wantLeaf []byte
+	}{
+		{name: "default", params: Params{EntryBundleSize: 256}, wantLeaf: rfc6962.DefaultHasher.HashLeaf([]byte("leaf"))},
+		{name: "custom leaf hasher", params: Params{EntryBundleSize: 256, LeafHasher: custom}, wantLeaf: custom([]byte("leaf"))},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := test.params.Hasher()
+			if got := h.HashLeaf([]byte("leaf")); !bytes.Equal(got, test.wantLeaf) {
+				t.Errorf("HashLeaf = %x, want %x", got, test.wantLeaf)
+			}
+			// Interior nodes are always hashed as per RFC6962.
+			if got, want := h.HashChildren(l, r), rfc6962.DefaultHasher.HashChildren(l, r); !bytes.Equal(got, want) {
+				t.Errorf("HashChildren = %x, want %x", got, want)
+			}
+			if got, want := h.EmptyRoot(), rfc6962.DefaultHasher.EmptyRoot(); !bytes.Equal(got, want) {
+				t.Errorf("EmptyRoot = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	before := time.Now().UTC()
+	raw, err := Params{EntryBundleSize: 4, TileHeight: 2, Hash: crypto.SHA512, Origin: "example.com/log"}.MarshalMetadata()
+	if err != nil {
+		t.Fatalf("MarshalMetadata: %v", err)
+	}
+	after := time.Now().UTC()
+	for _, test := range []struct {
+		name        string
+		raw         []byte
+		want        Metadata
+		wantCreated bool
+		wantErr     bool
+	}{
+		{name: "new log", raw: raw, want: Metadata{TileHeight: 2, EntryBundleSize: 4, Hash: "SHA-512", Origin: "example.com/log"}, wantCreated: true},
+		// Logs created before the hash was recorded all use SHA-256.
+		{name: "legacy metadata", raw: []byte(`{"tile_height":8,"entry_bundle_size":256}`), want: Metadata{TileHeight: 8, EntryBundleSize: 256, Hash: "SHA-256"}},
+		{name: "invalid", raw: []byte("not json"), wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseMetadata(test.raw)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseMetadata = %v, want error: %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (got.CreatedAt != nil) != test.wantCreated {
+				t.Fatalf("Got creation time %v, want one: %t", got.CreatedAt, test.wantCreated)
+			}
+			if got.CreatedAt != nil {
+				// The creation time is recorded when the metadata is marshalled.
+				if got.CreatedAt.Before(before) || got.CreatedAt.After(after) {
+					t.Errorf("Got creation time %v, want between %v and %v", got.CreatedAt, before, after)
+				}
+				got.CreatedAt = nil
+			}
+			if got != test.want {
+				t.Errorf("ParseMetadata = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reader
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/transparency-dev/merkle/compact"
+)
+
+// ErrCorruptEntry is returned by GetVerifiedEntries when an entry read from an entry bundle doesn't match the
+// leaf hash committed to by the tree, e.g. because the bundle has been corrupted in storage.
+var ErrCorruptEntry = errors.New("entry doesn't match its leaf hash in the tree")
+
+// BundleReader represents the set of functions needed to read entries from a log.
+type BundleReader interface {
+	// GetEntryBundle returns the entry bundle at the given index, containing size entries.
+	GetEntryBundle(ctx context.Context, index, size uint64) ([]byte, error)
+}
+
+// GetEntries returns the leaves at indices [start, start+count) from a tree of the given size,
+// reading them from whichever entry bundles they're stored in.
+func GetEntries(ctx context.Context, params log.Params, treeSize, start, count uint64, br BundleReader) ([][]byte, error) {
+	end := start + count
+	if start >= end || end > treeSize {
+		return nil, fmt.Errorf("range [%d, %d) is not within tree of size %d", start, end, treeSize)
+	}
+	bundleSize := uint64(params.EntryBundleSize)
+	r := make([][]byte, 0, count)
+	for i := start / bundleSize; i*bundleSize < end; i++ {
+		// The last bundle in the tree may be partial.
+		size := bundleSize
+		if (i+1)*bundleSize > treeSize {
+			size = treeSize % bundleSize
+		}
+		b, err := br.GetEntryBundle(ctx, i, size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entry bundle %d: %w", i, err)
+		}
+		lines := bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n"))
+		if got, want := uint64(len(lines)), size; got != want {
+			return nil, fmt.Errorf("entry bundle %d contains %d entries, expected %d", i, got, want)
+		}
+		for j, l := range lines {
+			idx := i*bundleSize + uint64(j)
+			if idx < start || idx >= end {
+				continue
+			}
+			e, err := base64.StdEncoding.DecodeString(string(l))
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry %d in bundle %d: %v", j, i, err)
+			}
+			r = append(r, e)
+		}
+	}
+	return r, nil
+}
+
+// GetVerifiedEntries is like GetEntries, but also checks that the hash of each leaf matches the leaf hash stored
+// in the tree's level 0 tiles, so that a corrupt entry bundle results in an ErrCorruptEntry error rather than the
+// wrong leaves being returned.
+// Only one tile needs to be read for every 2^TileHeight leaves.
+func GetVerifiedEntries(ctx context.Context, params log.Params, treeSize, start, count uint64, br BundleReader, tr TileReader) ([][]byte, error) {
+	es, err := GetEntries(ctx, params, treeSize, start, count, br)
+	if err != nil {
+		return nil, err
+	}
+	h := params.Hasher()
+	nc := newNodeCache(params, tr, treeSize)
+	bundleSize := uint64(params.EntryBundleSize)
+	for j, e := range es {
+		i := start + uint64(j)
+		want, err := nc.GetNode(ctx, compact.NewNodeID(0, i))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get leaf hash %d: %w", i, err)
+		}
+		if !bytes.Equal(h.HashLeaf(e), want) {
+			return nil, fmt.Errorf("%w: entry %d in bundle %d", ErrCorruptEntry, i, i/bundleSize)
+		}
+	}
+	return es, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reader
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/AlCutter/betty/log"
+)
+
+// memBundles is a BundleReader serving the entry bundles of the tree built by newMemTiles, with leaves[i] being
+// "leaf i".
+type memBundles struct {
+	params log.Params
+	leaves [][]byte
+}
+
+func newMemBundles(params log.Params, n int) *memBundles {
+	m := &memBundles{params: params, leaves: make([][]byte, n)}
+	for i := range m.leaves {
+		m.leaves[i] = []byte(fmt.Sprintf("leaf %d", i))
+	}
+	return m
+}
+
+func (m *memBundles) GetEntryBundle(_ context.Context, index, size uint64) ([]byte, error) {
+	start := index * uint64(m.params.EntryBundleSize)
+	b := &bytes.Buffer{}
+	for _, l := range m.leaves[start : start+size] {
+		b.WriteString(base64.StdEncoding.EncodeToString(l))
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// corruptBundles is a BundleReader which replaces the contents of one entry bundle.
+type corruptBundles struct {
+	BundleReader
+	index uint64
+	// corrupt is given the bundle's contents, returning what's read instead.
+	corrupt func([]byte) []byte
+}
+
+func (c corruptBundles) GetEntryBundle(ctx context.Context, index, size uint64) ([]byte, error) {
+	b, err := c.BundleReader.GetEntryBundle(ctx, index, size)
+	if err != nil || index != c.index {
+		return b, err
+	}
+	return c.corrupt(b), nil
+}
+
+func TestGetVerifiedEntries(t *testing.T) {
+	ctx := context.Background()
+	params := log.Params{EntryBundleSize: 4, TileHeight: 2}
+	const size = 10
+	// replaceLine returns a corruption which replaces the i'th line of a bundle.
+	replaceLine := func(i int, l string) func([]byte) []byte {
+		return func(b []byte) []byte {
+			lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			lines[i] = l
+			return []byte(strings.Join(lines, "\n") + "\n")
+		}
+	}
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	for _, test := range []struct {
+		name         string
+		start, count uint64
+		// bundle is the index of the bundle to corrupt with corrupt, if set.
+		bundle  uint64
+		corrupt func([]byte) []byte
+		// wantCorrupt is whether an ErrCorruptEntry is expected, and wantErr the text of the error if any.
+		wantCorrupt bool
+		wantErr     string
+	}{
+		{name: "intact", start: 0, count: size},
+		{name: "intact partial bundle", start: 8, count: 2},
+		{name: "flipped bit", start: 0, count: size, bundle: 1, corrupt: func(b []byte) []byte {
+			b = bytes.Clone(b)
+			b[0] ^= 1
+			return b
+		}, wantCorrupt: true, wantErr: "entry 4 in bundle 1"},
+		{name: "replaced entry", start: 0, count: size, bundle: 0, corrupt: replaceLine(2, encode("evil")), wantCorrupt: true, wantErr: "entry 2 in bundle 0"},
+		{name: "swapped entries", start: 4, count: 4, bundle: 1, corrupt: func(b []byte) []byte {
+			return replaceLine(0, encode("leaf 5"))(replaceLine(1, encode("leaf 4"))(b))
+		}, wantCorrupt: true, wantErr: "entry 4 in bundle 1"},
+		{name: "corrupt partial bundle", start: 9, count: 1, bundle: 2, corrupt: replaceLine(1, encode("leaf 8")), wantCorrupt: true, wantErr: "entry 9 in bundle 2"},
+		{name: "corruption outside range", start: 0, count: 2, bundle: 0, corrupt: replaceLine(3, encode("evil"))},
+		{name: "truncated bundle", start: 0, count: size, bundle: 1, corrupt: func(b []byte) []byte {
+			return b[:bytes.IndexByte(b, '\n')+1]
+		}, wantErr: "entry bundle 1 contains 1 entries, expected 4"},
+		{name: "invalid encoding", start: 0, count: size, bundle: 0, corrupt: replaceLine(0, "!!"), wantErr: "invalid entry 0 in bundle 0"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var br BundleReader = newMemBundles(params, size)
+			if test.corrupt != nil {
+				br = corruptBundles{BundleReader: br, index: test.bundle, corrupt: test.corrupt}
+			}
+			got, err := GetVerifiedEntries(ctx, params, size, test.start, test.count, br, newMemTiles(params, size))
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("GetVerifiedEntries: %v", err)
+				}
+				for i, e := range got {
+					if want := fmt.Sprintf("leaf %d", test.start+uint64(i)); string(e) != want {
+						t.Errorf("Got entry %d = %q, want %q", test.start+uint64(i), e, want)
+					}
+				}
+				if uint64(len(got)) != test.count {
+					t.Errorf("Got %d entries, want %d", len(got), test.count)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("GetVerifiedEntries = %v, want error containing %q", err, test.wantErr)
+			}
+			if errors.Is(err, ErrCorruptEntry) != test.wantCorrupt {
+				t.Errorf("errors.Is(%v, ErrCorruptEntry) = %t, want %t", err, !test.wantCorrupt, test.wantCorrupt)
+			}
+		})
+	}
+}
+
+func TestGetVerifiedEntriesTileReads(t *testing.T) {
+	ctx := context.Background()
+	params := log.Params{EntryBundleSize: 4, TileHeight: 2}
+	const size = 16
+	for _, test := range []struct {
+		start, count uint64
+		wantReads    int
+	}{
+		{start: 0, count: 4, wantReads: 1},
+		{start: 2, count: 4, wantReads: 2},
+		{start: 0, count: size, wantReads: 4},
+	} {
+		t.Run(fmt.Sprintf("%d+%d", test.start, test.count), func(t *testing.T) {
+			tr := newMemTiles(params, size)
+			if _, err := GetVerifiedEntries(ctx, params, size, test.start, test.count, newMemBundles(params, size), tr); err != nil {
+				t.Fatalf("GetVerifiedEntries: %v", err)
+			}
+			if tr.reads != test.wantReads {
+				t.Errorf("Read %d tiles, want %d", tr.reads, test.wantReads)
+			}
+		})
+	}
+}
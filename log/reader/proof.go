@@ -0,0 +1,232 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reader provides support for building proofs from the tiles stored by a log.
+package reader
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/serverless-log/api"
+)
+
+// TileReader represents the set of functions needed to build proofs.
+type TileReader interface {
+	// GetTile returns the tile at the given level & index, for a tree of size logSize.
+	GetTile(ctx context.Context, level, index, logSize uint64) (*api.Tile, error)
+}
+
+// ProofBuilder knows how to build inclusion and consistency proofs from tiles.
+// Since the tiles commit only to immutable nodes, the job of building proofs is slightly
+// more complex as proofs can touch "ephemeral" nodes, so these need to be synthesized.
+//
+// The tiles holding the nodes of the tree's compact range are read up front to compute its root, and then
+// those holding the nodes of each proof. To build a single consistency proof, ConsistencyProof reads fewer.
+type ProofBuilder struct {
+	size      uint64
+	root      []byte
+	nodeCache nodeCache
+	h         compact.HashFn
+}
+
+// NewProofBuilder creates a new ProofBuilder object for a given tree size.
+// The returned ProofBuilder can be re-used for proofs related to a given tree size, but
+// it is not thread-safe and should not be accessed concurrently.
+func NewProofBuilder(ctx context.Context, params log.Params, size uint64, h compact.HashFn, tr TileReader) (*ProofBuilder, error) {
+	pb := &ProofBuilder{
+		size:      size,
+		nodeCache: newNodeCache(params, tr, size),
+		h:         h,
+	}
+	// Can't re-create the root of a zero size tree other than by convention,
+	// so return early here in that case.
+	if size == 0 {
+		return pb, nil
+	}
+
+	hashes, err := pb.nodeCache.rangeNodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch range nodes: %w", err)
+	}
+	r, err := (&compact.RangeFactory{Hash: h}).NewRange(0, size, hashes)
+	if err != nil {
+		return nil, err
+	}
+	// Recreate the root hash, which also calculates (and caches) any ephemeral nodes
+	// present in the tree as these could be required by proofs.
+	pb.root, err = r.GetRootHash(pb.nodeCache.SetEphemeralNode)
+	if err != nil {
+		return nil, err
+	}
+	return pb, nil
+}
+
+// Root returns the root hash of the tree the proofs are being built for.
+func (pb *ProofBuilder) Root() []byte {
+	return pb.root
+}
+
+// InclusionProof constructs an inclusion proof for the leaf at index in the tree.
+func (pb *ProofBuilder) InclusionProof(ctx context.Context, index uint64) ([][]byte, error) {
+	nodes, err := proof.Inclusion(index, pb.size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate inclusion proof node list: %w", err)
+	}
+	return pb.fetchNodes(ctx, nodes)
+}
+
+// ConsistencyProof constructs a consistency proof from a tree of the given smaller size
+// to the tree the proofs are being built for.
+func (pb *ProofBuilder) ConsistencyProof(ctx context.Context, smaller uint64) ([][]byte, error) {
+	nodes, err := proof.Consistency(smaller, pb.size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate consistency proof node list: %w", err)
+	}
+	return pb.fetchNodes(ctx, nodes)
+}
+
+// fetchNodes retrieves the specified proof nodes via pb's nodeCache.
+func (pb *ProofBuilder) fetchNodes(ctx context.Context, nodes proof.Nodes) ([][]byte, error) {
+	return fetchNodes(ctx, &pb.nodeCache, nodes, pb.h)
+}
+
+// ConsistencyProof constructs a consistency proof from the tree of size smaller to that of size larger, returning
+// exactly the same proof as ProofBuilder.ConsistencyProof.
+//
+// Rather than reading the compact range of the larger tree to synthesize its ephemeral nodes, only the tiles holding
+// the nodes of the proof are read: each is the root of a perfect subtree, so is stored in a tile, and the one
+// ephemeral node which a proof may contain is computed from the compact range of such nodes which it covers.
+// This reads O(log n) hashes, from as few tiles as possible.
+func ConsistencyProof(ctx context.Context, params log.Params, smaller, larger uint64, h compact.HashFn, tr TileReader) ([][]byte, error) {
+	nodes, err := proof.Consistency(smaller, larger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate consistency proof node list: %w", err)
+	}
+	nc := newNodeCache(params, tr, larger)
+	return fetchNodes(ctx, &nc, nodes, h)
+}
+
+// fetchNodes retrieves the specified proof nodes via nc, rehashing any of them which make up an ephemeral node.
+func fetchNodes(ctx context.Context, nc *nodeCache, nodes proof.Nodes, h compact.HashFn) ([][]byte, error) {
+	hashes := make([][]byte, 0, len(nodes.IDs))
+	for _, id := range nodes.IDs {
+		n, err := nc.GetNode(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get node (%v): %w", id, err)
+		}
+		hashes = append(hashes, n)
+	}
+	var err error
+	if hashes, err = nodes.Rehash(hashes, h); err != nil {
+		return nil, fmt.Errorf("failed to rehash proof: %w", err)
+	}
+	return hashes, nil
+}
+
+// FetchRangeNodes returns the set of nodes representing the compact range covering
+// a log of size s.
+func FetchRangeNodes(ctx context.Context, params log.Params, s uint64, tr TileReader) ([][]byte, error) {
+	nc := newNodeCache(params, tr, s)
+	return nc.rangeNodes(ctx)
+}
+
+// tileKey is a level/index key for the node cache below.
+type tileKey struct {
+	level uint64
+	index uint64
+}
+
+// nodeCache hides the tiles abstraction away, and improves
+// performance by caching tiles it's seen.
+// Not threadsafe, and intended to be only used throughout the course
+// of a single request.
+type nodeCache struct {
+	params    log.Params
+	logSize   uint64
+	ephemeral map[compact.NodeID][]byte
+	tiles     map[tileKey]*api.Tile
+	tr        TileReader
+}
+
+func newNodeCache(params log.Params, tr TileReader, logSize uint64) nodeCache {
+	return nodeCache{
+		params:    params,
+		logSize:   logSize,
+		ephemeral: make(map[compact.NodeID][]byte),
+		tiles:     make(map[tileKey]*api.Tile),
+		tr:        tr,
+	}
+}
+
+// SetEphemeralNode stores a derived "ephemeral" tree node.
+func (n *nodeCache) SetEphemeralNode(id compact.NodeID, h []byte) {
+	n.ephemeral[id] = h
+}
+
+// rangeNodes returns the set of nodes representing the compact range covering the whole tree.
+func (n *nodeCache) rangeNodes(ctx context.Context) ([][]byte, error) {
+	nIDs := compact.RangeNodes(0, n.logSize, nil)
+	ret := make([][]byte, len(nIDs))
+	for i, id := range nIDs {
+		h, err := n.GetNode(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = h
+	}
+	return ret, nil
+}
+
+// getTile returns the tile at the given level and index, fetching it via the
+// TileReader if it's not already been cached.
+func (n *nodeCache) getTile(ctx context.Context, level, index uint64) (*api.Tile, error) {
+	k := tileKey{level: level, index: index}
+	if t, ok := n.tiles[k]; ok {
+		return t, nil
+	}
+	t, err := n.tr.GetTile(ctx, level, index, n.logSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tile: %w", err)
+	}
+	n.tiles[k] = t
+	return t, nil
+}
+
+// GetNode returns the internal log tree node hash for the specified node ID.
+// A previously set ephemeral node will be returned if id matches, otherwise
+// the tile containing the requested node will be fetched and cached, and the
+// node hash returned.
+func (n *nodeCache) GetNode(ctx context.Context, id compact.NodeID) ([]byte, error) {
+	if e := n.ephemeral[id]; len(e) != 0 {
+		return e, nil
+	}
+	tileLevel, tileIndex, nodeLevel, nodeIndex := n.params.NodeCoordsToTileAddress(uint64(id.Level), uint64(id.Index))
+	t, err := n.getTile(ctx, tileLevel, tileIndex)
+	if err != nil {
+		return nil, err
+	}
+	nodeKey := int(api.TileNodeKey(nodeLevel, nodeIndex))
+	if l := len(t.Nodes); nodeKey >= l {
+		return nil, fmt.Errorf("node %v (tile coords [%d,%d]/[%d,%d], key %d) outside populated tile nodes (%d)", id, tileLevel, tileIndex, nodeLevel, nodeIndex, nodeKey, l)
+	}
+	node := t.Nodes[nodeKey]
+	if node == nil {
+		return nil, fmt.Errorf("node %v (tile coords [%d,%d]/[%d,%d], key %d) unknown", id, tileLevel, tileIndex, nodeLevel, nodeIndex, nodeKey)
+	}
+	return node, nil
+}
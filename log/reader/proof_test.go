@@ -0,0 +1,168 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reader
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"github.com/transparency-dev/serverless-log/api"
+)
+
+// memTiles is a TileReader serving the tiles of a tree held in memory, counting the tiles read.
+type memTiles struct {
+	params log.Params
+	// levels holds the hashes of the perfect subtrees at each level of the tree, starting with the leaf hashes.
+	levels [][][]byte
+	reads  int
+}
+
+// newMemTiles returns a memTiles for the tree of n leaves.
+func newMemTiles(params log.Params, n int) *memTiles {
+	h := params.Hasher()
+	row := make([][]byte, n)
+	for i := range row {
+		row[i] = h.HashLeaf([]byte(fmt.Sprintf("leaf %d", i)))
+	}
+	m := &memTiles{params: params}
+	for len(row) > 0 {
+		m.levels = append(m.levels, row)
+		next := make([][]byte, len(row)/2)
+		for i := range next {
+			next[i] = h.HashChildren(row[2*i], row[2*i+1])
+		}
+		row = next
+	}
+	return m
+}
+
+// GetTile returns the tile at the given level and index, as it was in the tree of size logSize.
+func (m *memTiles) GetTile(_ context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	m.reads++
+	h := m.params.Hasher()
+	tw := m.params.TileWidth()
+	width := m.params.PartialTileSize(level, index, logSize)
+	if width == 0 {
+		width = tw
+	}
+	th := uint64(m.params.Metadata().TileHeight)
+	row := m.levels[level*th][index*tw : index*tw+width]
+	t := &api.Tile{NumLeaves: uint(width), Nodes: make([][]byte, api.TileNodeKey(0, width-1)+1)}
+	for l := uint(0); len(row) > 0; l++ {
+		for i, n := range row {
+			t.Nodes[api.TileNodeKey(l, uint64(i))] = n
+		}
+		next := make([][]byte, len(row)/2)
+		for i := range next {
+			next[i] = h.HashChildren(row[2*i], row[2*i+1])
+		}
+		row = next
+	}
+	return t, nil
+}
+
+func TestConsistencyProof(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name   string
+		params log.Params
+		size   int
+	}{
+		{name: "default tile height", params: log.Params{EntryBundleSize: 256}, size: 1000},
+		{name: "small tiles", params: log.Params{EntryBundleSize: 4, TileHeight: 2}, size: 1000},
+		{name: "odd tile height", params: log.Params{EntryBundleSize: 4, TileHeight: 3}, size: 777},
+		{name: "single level tiles", params: log.Params{EntryBundleSize: 4, TileHeight: 1}, size: 300},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tr := newMemTiles(test.params, test.size)
+			h := test.params.Hasher()
+			rnd := rand.New(rand.NewSource(1))
+			for range 200 {
+				larger := uint64(rnd.Intn(test.size)) + 1
+				smaller := uint64(rnd.Intn(int(larger))) + 1
+				pb, err := NewProofBuilder(ctx, test.params, larger, h.HashChildren, tr)
+				if err != nil {
+					t.Fatalf("NewProofBuilder(%d): %v", larger, err)
+				}
+				want, err := pb.ConsistencyProof(ctx, smaller)
+				if err != nil {
+					t.Fatalf("ProofBuilder.ConsistencyProof(%d, %d): %v", smaller, larger, err)
+				}
+				got, err := ConsistencyProof(ctx, test.params, smaller, larger, h.HashChildren, tr)
+				if err != nil {
+					t.Fatalf("ConsistencyProof(%d, %d): %v", smaller, larger, err)
+				}
+				if !slices.EqualFunc(got, want, slices.Equal) {
+					t.Fatalf("ConsistencyProof(%d, %d) = %x, want %x", smaller, larger, got, want)
+				}
+				spb, err := NewProofBuilder(ctx, test.params, smaller, h.HashChildren, tr)
+				if err != nil {
+					t.Fatalf("NewProofBuilder(%d): %v", smaller, err)
+				}
+				if err := proof.VerifyConsistency(h, smaller, larger, got, spb.Root(), pb.Root()); err != nil {
+					t.Fatalf("VerifyConsistency(%d, %d): %v", smaller, larger, err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkConsistencyProof(b *testing.B) {
+	ctx := context.Background()
+	const size = 1 << 18
+	h := rfc6962.DefaultHasher
+	rnd := rand.New(rand.NewSource(1))
+	pairs := make([][2]uint64, 1000)
+	for i := range pairs {
+		larger := uint64(rnd.Intn(size)) + 1
+		pairs[i] = [2]uint64{uint64(rnd.Intn(int(larger))) + 1, larger}
+	}
+	for _, height := range []int{8, 2} {
+		params := log.Params{EntryBundleSize: 256, TileHeight: height}
+		tr := newMemTiles(params, size)
+		for _, bm := range []struct {
+			name  string
+			proof func(smaller, larger uint64) ([][]byte, error)
+		}{
+			{name: "ProofBuilder", proof: func(smaller, larger uint64) ([][]byte, error) {
+				pb, err := NewProofBuilder(ctx, params, larger, h.HashChildren, tr)
+				if err != nil {
+					return nil, err
+				}
+				return pb.ConsistencyProof(ctx, smaller)
+			}},
+			{name: "ConsistencyProof", proof: func(smaller, larger uint64) ([][]byte, error) {
+				return ConsistencyProof(ctx, params, smaller, larger, h.HashChildren, tr)
+			}},
+		} {
+			b.Run(fmt.Sprintf("height %d/%s", height, bm.name), func(b *testing.B) {
+				tr.reads = 0
+				for i := range b.N {
+					p := pairs[i%len(pairs)]
+					if _, err := bm.proof(p[0], p[1]); err != nil {
+						b.Fatalf("proof(%d, %d): %v", p[0], p[1], err)
+					}
+				}
+				b.ReportMetric(float64(tr.reads)/float64(b.N), "tiles/op")
+			})
+		}
+	}
+}
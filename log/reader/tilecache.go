@@ -0,0 +1,148 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reader
+
+import (
+	"container/list"
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/transparency-dev/serverless-log/api"
+)
+
+var (
+	tileCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "betty_tile_cache_hits_total",
+		Help: "Total number of tile reads served from the tile cache.",
+	})
+	tileCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "betty_tile_cache_misses_total",
+		Help: "Total number of tile reads which missed the tile cache.",
+	})
+)
+
+// GetTileFunc returns the tile at the given level & index, for a tree of size logSize.
+type GetTileFunc func(ctx context.Context, level, index, logSize uint64) (*api.Tile, error)
+
+// TileCache is an LRU cache of tiles, intended to sit in front of a storage implementation's tile reads.
+//
+// Only a single version of each tile is cached, identified by its level, index, and the number of leaves it
+// contains, so reads of the tile for an older tree size will miss the cache.
+//
+// A nil *TileCache is valid, and caches nothing.
+type TileCache struct {
+	params log.Params
+	size   int
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[tileCacheKey]*list.Element
+}
+
+type tileCacheKey struct {
+	level, index uint64
+}
+
+type tileCacheEntry struct {
+	key tileCacheKey
+	// partialSize is the number of leaves in the tile if it's partial, or 0 if it's full.
+	partialSize uint64
+	tile        *api.Tile
+}
+
+// NewTileCache creates a new TileCache which holds up to size tiles.
+func NewTileCache(params log.Params, size int) *TileCache {
+	return &TileCache{
+		params: params,
+		size:   size,
+		lru:    list.New(),
+		items:  make(map[tileCacheKey]*list.Element),
+	}
+}
+
+// GetTile returns the requested tile from the cache if present, otherwise it reads it with get and
+// caches it.
+func (c *TileCache) GetTile(ctx context.Context, level, index, logSize uint64, get GetTileFunc) (*api.Tile, error) {
+	if c == nil {
+		return get(ctx, level, index, logSize)
+	}
+	k := tileCacheKey{level: level, index: index}
+	partialSize := c.params.PartialTileSize(level, index, logSize)
+
+	c.mu.Lock()
+	if e, ok := c.items[k]; ok && e.Value.(*tileCacheEntry).partialSize == partialSize {
+		c.lru.MoveToFront(e)
+		t := e.Value.(*tileCacheEntry).tile
+		c.mu.Unlock()
+		tileCacheHits.Inc()
+		return cloneTile(t), nil
+	}
+	c.mu.Unlock()
+	tileCacheMisses.Inc()
+
+	t, err := get(ctx, level, index, logSize)
+	if err != nil {
+		return nil, err
+	}
+	c.put(k, partialSize, cloneTile(t))
+	return t, nil
+}
+
+// put adds the tile to the cache, replacing any other version of it and evicting the least recently
+// used tile if the cache is full.
+func (c *TileCache) put(k tileCacheKey, partialSize uint64, t *api.Tile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[k]; ok {
+		e.Value = &tileCacheEntry{key: k, partialSize: partialSize, tile: t}
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[k] = c.lru.PushFront(&tileCacheEntry{key: k, partialSize: partialSize, tile: t})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*tileCacheEntry).key)
+	}
+}
+
+// Invalidate removes any cached version of the tile at the given level & index, and should be called
+// whenever the tile is rewritten.
+func (c *TileCache) Invalidate(level, index uint64) {
+	if c == nil {
+		return
+	}
+	k := tileCacheKey{level: level, index: index}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[k]; ok {
+		c.lru.Remove(e)
+		delete(c.items, k)
+	}
+}
+
+// cloneTile returns a copy of t which can be modified without affecting t.
+// Callers, such as the integration code, update tiles in place, so the cache must never hand out
+// the tiles it holds.
+func cloneTile(t *api.Tile) *api.Tile {
+	return &api.Tile{
+		NumLeaves: t.NumLeaves,
+		Nodes:     slices.Clone(t.Nodes),
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reader
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/serverless-log/api"
+)
+
+// cachedTiles is a TileReader which reads tiles from m through c.
+type cachedTiles struct {
+	c *TileCache
+	m *memTiles
+}
+
+func (t cachedTiles) GetTile(ctx context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	return t.c.GetTile(ctx, level, index, logSize, t.m.GetTile)
+}
+
+// counterValue returns the current value of c.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestTileCacheInclusionProof(t *testing.T) {
+	ctx := context.Background()
+	params := log.Params{EntryBundleSize: 4, TileHeight: 2}
+	const size = 1000
+	m := newMemTiles(params, size)
+	tr := cachedTiles{c: NewTileCache(params, 100), m: m}
+	h := params.Hasher()
+
+	prove := func(index uint64) ([][]byte, []byte) {
+		t.Helper()
+		pb, err := NewProofBuilder(ctx, params, size, h.HashChildren, tr)
+		if err != nil {
+			t.Fatalf("NewProofBuilder: %v", err)
+		}
+		p, err := pb.InclusionProof(ctx, index)
+		if err != nil {
+			t.Fatalf("InclusionProof(%d): %v", index, err)
+		}
+		return p, pb.Root()
+	}
+	first, root := prove(123)
+	if err := proof.VerifyInclusion(h, 123, size, m.levels[0][123], first, root); err != nil {
+		t.Fatalf("VerifyInclusion: %v", err)
+	}
+	reads, hits := m.reads, counterValue(t, tileCacheHits)
+	second, _ := prove(123)
+	if !slices.EqualFunc(second, first, slices.Equal) {
+		t.Errorf("Second proof %x differs from first %x", second, first)
+	}
+	if m.reads != reads {
+		t.Errorf("Second proof read %d tiles from storage, want 0", m.reads-reads)
+	}
+	if got := counterValue(t, tileCacheHits) - hits; got == 0 {
+		t.Error("Second proof didn't record any cache hits")
+	}
+}
+
+func TestTileCache(t *testing.T) {
+	ctx := context.Background()
+	params := log.Params{EntryBundleSize: 4, TileHeight: 2}
+	type read struct {
+		level, index, logSize uint64
+		// cached is set if the read should be served from the cache.
+		cached bool
+	}
+	for _, test := range []struct {
+		name  string
+		size  int
+		reads []read
+		// invalidate, if set, is the level and index of a tile to invalidate after the first read.
+		invalidate []uint64
+	}{
+		{
+			name: "hit",
+			size: 2,
+			reads: []read{
+				{level: 0, index: 0, logSize: 100},
+				{level: 0, index: 0, logSize: 100, cached: true},
+				{level: 1, index: 0, logSize: 100},
+				{level: 0, index: 0, logSize: 100, cached: true},
+			},
+		},
+		{
+			name: "evicted",
+			size: 1,
+			reads: []read{
+				{level: 0, index: 0, logSize: 100},
+				{level: 0, index: 1, logSize: 100},
+				{level: 0, index: 0, logSize: 100},
+			},
+		},
+		{
+			name: "least recently used evicted",
+			size: 2,
+			reads: []read{
+				{level: 0, index: 0, logSize: 100},
+				{level: 0, index: 1, logSize: 100},
+				{level: 0, index: 0, logSize: 100, cached: true},
+				{level: 0, index: 2, logSize: 100},
+				{level: 0, index: 0, logSize: 100, cached: true},
+				{level: 0, index: 1, logSize: 100},
+			},
+		},
+		{
+			name: "partial tile grown",
+			size: 2,
+			reads: []read{
+				{level: 0, index: 0, logSize: 2},
+				{level: 0, index: 0, logSize: 3},
+				{level: 0, index: 0, logSize: 3, cached: true},
+				// Only the latest version of a tile is held.
+				{level: 0, index: 0, logSize: 2},
+				// Trees of different sizes may share the same full tile.
+				{level: 0, index: 0, logSize: 100},
+				{level: 0, index: 0, logSize: 200, cached: true},
+			},
+		},
+		{
+			name:       "invalidated",
+			size:       2,
+			reads:      []read{{level: 0, index: 0, logSize: 100}, {level: 0, index: 0, logSize: 100}},
+			invalidate: []uint64{0, 0},
+		},
+		{
+			name:       "other tile invalidated",
+			size:       2,
+			reads:      []read{{level: 0, index: 0, logSize: 100}, {level: 0, index: 0, logSize: 100, cached: true}},
+			invalidate: []uint64{0, 1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMemTiles(params, 1000)
+			c := NewTileCache(params, test.size)
+			for i, r := range test.reads {
+				reads := m.reads
+				tile, err := c.GetTile(ctx, r.level, r.index, r.logSize, m.GetTile)
+				if err != nil {
+					t.Fatalf("GetTile(%d, %d, %d): %v", r.level, r.index, r.logSize, err)
+				}
+				if cached := m.reads == reads; cached != r.cached {
+					t.Errorf("Read %d: got cached %t, want %t", i, cached, r.cached)
+				}
+				want, _ := m.GetTile(ctx, r.level, r.index, r.logSize)
+				if tile.NumLeaves != want.NumLeaves || !slices.EqualFunc(tile.Nodes, want.Nodes, slices.Equal) {
+					t.Fatalf("GetTile(%d, %d, %d) returned the wrong tile", r.level, r.index, r.logSize)
+				}
+				// Callers may update the tiles they're given.
+				tile.Nodes[0] = []byte("updated")
+				if i == 0 && test.invalidate != nil {
+					c.Invalidate(test.invalidate[0], test.invalidate[1])
+				}
+			}
+		})
+	}
+}
+
+func TestNilTileCache(t *testing.T) {
+	params := log.Params{EntryBundleSize: 4}
+	m := newMemTiles(params, 10)
+	var c *TileCache
+	for range 2 {
+		if _, err := c.GetTile(context.Background(), 0, 0, 10, m.GetTile); err != nil {
+			t.Fatalf("GetTile: %v", err)
+		}
+	}
+	c.Invalidate(0, 0)
+	if m.reads != 2 {
+		t.Errorf("Got %d reads from storage, want 2", m.reads)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/proof"
+)
+
+// VerifyTree checks that the tiles and entry bundles stored for a tree of the given size are consistent
+// with its root hash, returning an error describing the first inconsistency found.
+//
+// The root is always recomputed from the tiles. In addition, up to maxLeaves randomly chosen leaves are
+// checked: each leaf's hash must match the one stored in its tile, and its inclusion proof must verify.
+// If maxLeaves is at least the size of the tree, every leaf is checked.
+func VerifyTree(ctx context.Context, params log.Params, size uint64, root []byte, tr TileReader, br BundleReader, maxLeaves uint64) error {
+	h := params.Hasher()
+	if size == 0 {
+		if !bytes.Equal(root, h.EmptyRoot()) {
+			return fmt.Errorf("root hash %x of empty tree should be %x", root, h.EmptyRoot())
+		}
+		return nil
+	}
+	pb, err := NewProofBuilder(ctx, params, size, h.HashChildren, tr)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pb.Root(), root) {
+		return fmt.Errorf("root hash %x computed from tiles differs from checkpoint root hash %x", pb.Root(), root)
+	}
+
+	indices := make([]uint64, 0, min(size, maxLeaves))
+	if maxLeaves >= size {
+		for i := range size {
+			indices = append(indices, i)
+		}
+	} else {
+		for range maxLeaves {
+			indices = append(indices, rand.Uint64N(size))
+		}
+	}
+	for _, i := range indices {
+		es, err := GetEntries(ctx, params, size, i, 1, br)
+		if err != nil {
+			return err
+		}
+		lh := h.HashLeaf(es[0])
+		stored, err := pb.nodeCache.GetNode(ctx, compact.NewNodeID(0, i))
+		if err != nil {
+			return fmt.Errorf("failed to get leaf hash %d: %w", i, err)
+		}
+		if !bytes.Equal(stored, lh) {
+			return fmt.Errorf("leaf hash %x stored for entry %d differs from its computed hash %x", stored, i, lh)
+		}
+		p, err := pb.InclusionProof(ctx, i)
+		if err != nil {
+			return err
+		}
+		if err := proof.VerifyInclusion(h, i, size, lh, p, root); err != nil {
+			return fmt.Errorf("inclusion proof for entry %d does not verify: %v", i, err)
+		}
+	}
+	return nil
+}
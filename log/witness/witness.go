@@ -0,0 +1,198 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package witness provides support for gathering witness cosignatures on log checkpoints
+// using the tlog-witness protocol (https://c2sp.org/tlog-witness).
+package witness
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/sumdb/note"
+	"k8s.io/klog/v2"
+)
+
+// errConflict is returned by a witness when its view of the log's size differs from the one we sent.
+var errConflict = errors.New("witness has a different tree size")
+
+// Witness describes a witness which may cosign the log's checkpoints.
+type Witness struct {
+	// URL is the witness' base URL, checkpoints are submitted to its add-checkpoint endpoint under this URL.
+	URL string
+	// Verifier verifies the witness' cosignatures.
+	Verifier note.Verifier
+}
+
+// ConsistencyProofFunc returns a consistency proof between the two provided tree sizes.
+type ConsistencyProofFunc func(ctx context.Context, smaller, larger uint64) ([][]byte, error)
+
+// Cosigner requests cosignatures from a set of witnesses.
+type Cosigner struct {
+	witnesses []Witness
+	quorum    int
+	client    *http.Client
+
+	mu sync.Mutex
+	// sizes holds the most recent tree size known to be held by each witness, keyed by URL.
+	sizes map[string]uint64
+}
+
+// New creates a new Cosigner for the given witnesses.
+// Calls to Cosign will fail unless at least quorum of the witnesses provide a cosignature.
+func New(witnesses []Witness, quorum int, client *http.Client) (*Cosigner, error) {
+	if quorum < 0 || quorum > len(witnesses) {
+		return nil, fmt.Errorf("quorum %d must be between 0 and the number of witnesses (%d)", quorum, len(witnesses))
+	}
+	return &Cosigner{
+		witnesses: witnesses,
+		quorum:    quorum,
+		client:    client,
+		sizes:     make(map[string]uint64),
+	}, nil
+}
+
+// Cosign submits the signed checkpoint note for a tree of the given size to all of the witnesses,
+// and returns the note with the gathered cosignatures appended.
+//
+// Witnesses which cannot be reached, or which refuse to cosign, are skipped so long as the quorum is met.
+func (c *Cosigner) Cosign(ctx context.Context, signed []byte, size uint64, proof ConsistencyProofFunc) ([]byte, error) {
+	sigs := make([][]byte, len(c.witnesses))
+	var wg sync.WaitGroup
+	for i, w := range c.witnesses {
+		wg.Add(1)
+		go func(i int, w Witness) {
+			defer wg.Done()
+			sig, err := c.cosign(ctx, w, signed, size, proof)
+			if err != nil {
+				klog.Warningf("Failed to get cosignature from witness %q: %v", w.URL, err)
+				return
+			}
+			sigs[i] = sig
+		}(i, w)
+	}
+	wg.Wait()
+
+	r := bytes.NewBuffer(signed)
+	n := 0
+	for _, sig := range sigs {
+		if sig != nil {
+			r.Write(sig)
+			n++
+		}
+	}
+	if n < c.quorum {
+		return nil, fmt.Errorf("only got %d cosignatures, need %d", n, c.quorum)
+	}
+	return r.Bytes(), nil
+}
+
+// cosign requests a cosignature from a single witness, returning the verified cosignature lines.
+func (c *Cosigner) cosign(ctx context.Context, w Witness, signed []byte, size uint64, proof ConsistencyProofFunc) ([]byte, error) {
+	c.mu.Lock()
+	old := c.sizes[w.URL]
+	c.mu.Unlock()
+
+	sig, err := c.submit(ctx, w, signed, old, size, proof)
+	var conflict conflictError
+	if errors.As(err, &conflict) {
+		// The witness has a different view of our log than we expected, so retry with a proof from its size.
+		old = uint64(conflict)
+		sig, err = c.submit(ctx, w, signed, old, size, proof)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.sizes[w.URL] = size
+	c.mu.Unlock()
+	return sig, nil
+}
+
+// conflictError is returned by submit when the witness reports that it holds a different tree size.
+type conflictError uint64
+
+func (e conflictError) Error() string {
+	return fmt.Sprintf("%v: %d", errConflict, uint64(e))
+}
+
+func (e conflictError) Unwrap() error {
+	return errConflict
+}
+
+// submit sends a single add-checkpoint request to the witness.
+func (c *Cosigner) submit(ctx context.Context, w Witness, signed []byte, old, size uint64, proof ConsistencyProofFunc) ([]byte, error) {
+	if old > size {
+		return nil, fmt.Errorf("witness has seen tree size %d which is larger than %d", old, size)
+	}
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "old %d\n", old)
+	if old > 0 && old < size {
+		p, err := proof(ctx, old, size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build consistency proof from %d to %d: %v", old, size, err)
+		}
+		for _, h := range p {
+			fmt.Fprintf(body, "%s\n", base64.StdEncoding.EncodeToString(h))
+		}
+	}
+	body.WriteString("\n")
+	body.Write(signed)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(w.URL, "/")+"/add-checkpoint", body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	rb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		s, err := strconv.ParseUint(strings.TrimSpace(string(rb)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tree size in conflict response: %v", err)
+		}
+		return nil, conflictError(s)
+	default:
+		return nil, fmt.Errorf("witness returned %s: %s", resp.Status, bytes.TrimSpace(rb))
+	}
+
+	// The response contains just the cosignature lines, so check them against the checkpoint before using them.
+	n, err := note.Open(append(append([]byte{}, signed...), rb...), note.VerifierList(w.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cosignature: %v", err)
+	}
+	for _, s := range n.Sigs {
+		if s.Name == w.Verifier.Name() && s.Hash == w.Verifier.KeyHash() {
+			return rb, nil
+		}
+	}
+	return nil, errors.New("response did not include a cosignature from the witness")
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package witness
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	f_log "github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"github.com/transparency-dev/merkle/testonly"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// newKeys returns a new signer and verifier pair with the given name.
+func newKeys(t *testing.T, name string) (note.Signer, note.Verifier) {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	s, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	v, err := note.NewVerifier(vkey)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	return s, v
+}
+
+// fakeWitness implements the add-checkpoint endpoint of a witness, which verifies that the checkpoints it's sent
+// are signed by the log and consistent with the last one it cosigned before cosigning them.
+type fakeWitness struct {
+	log    note.Verifier
+	signer note.Signer
+	// refuse causes the witness to refuse every request.
+	refuse bool
+
+	mu   sync.Mutex
+	size uint64
+	root []byte
+	// olds records the old size sent with each request.
+	olds []uint64
+}
+
+func (w *fakeWitness) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if r.URL.Path != "/add-checkpoint" {
+		http.NotFound(rw, r)
+		return
+	}
+	if w.refuse {
+		http.Error(rw, "not today", http.StatusForbidden)
+		return
+	}
+	br := bufio.NewReader(r.Body)
+	var old uint64
+	var p [][]byte
+	for i := 0; ; i++ {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l = strings.TrimSuffix(l, "\n")
+		if l == "" {
+			break
+		}
+		if i == 0 {
+			if old, err = strconv.ParseUint(strings.TrimPrefix(l, "old "), 10, 64); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			continue
+		}
+		h, err := base64.StdEncoding.DecodeString(l)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p = append(p, h)
+	}
+	w.olds = append(w.olds, old)
+	if old != w.size {
+		rw.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(rw, "%d\n", w.size)
+		return
+	}
+	signed, _ := io.ReadAll(br)
+	cp, _, n, err := f_log.ParseCheckpoint(signed, w.log.Name(), w.log)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+	if w.size > 0 {
+		if err := proof.VerifyConsistency(rfc6962.DefaultHasher, w.size, cp.Size, p, w.root, cp.Hash); err != nil {
+			http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	w.size, w.root = cp.Size, cp.Hash
+	cosigned, err := note.Sign(&note.Note{Text: n.Text}, w.signer)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Only the cosignature lines are returned.
+	rw.Write(cosigned[len(n.Text)+1:])
+}
+
+func TestCosign(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// refuse lists whether each of the witnesses refuses to cosign.
+		refuse []bool
+		quorum int
+		// badKey causes the witnesses to cosign with a key other than the one they're configured with.
+		badKey bool
+		// seen is the tree size which the witnesses have already cosigned, unknown to the Cosigner.
+		seen    uint64
+		wantErr bool
+		// wantOlds is the old size sent with each request received by the first witness.
+		wantOlds []uint64
+	}{
+		{name: "one witness", refuse: []bool{false}, quorum: 1, wantOlds: []uint64{0, 2}},
+		{name: "all witnesses", refuse: []bool{false, false, false}, quorum: 3, wantOlds: []uint64{0, 2}},
+		{name: "quorum met", refuse: []bool{false, true, false}, quorum: 2, wantOlds: []uint64{0, 2}},
+		{name: "quorum not met", refuse: []bool{false, true, true}, quorum: 2, wantErr: true},
+		{name: "no quorum", refuse: []bool{true}, quorum: 0},
+		{name: "bad cosignature", refuse: []bool{false}, quorum: 1, badKey: true, wantErr: true},
+		// The first request conflicts with the size held by the witness, so is retried with a proof from it.
+		{name: "witness ahead of the cosigner", refuse: []bool{false}, quorum: 1, seen: 3, wantOlds: []uint64{0, 3, 5}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			logSigner, logVerifier := newKeys(t, "example.com/log")
+			tree := testonly.New(rfc6962.DefaultHasher)
+			// checkpoint returns the log's signed checkpoint after adding n more entries.
+			checkpoint := func(n int) []byte {
+				for range n {
+					tree.AppendData([]byte(fmt.Sprintf("leaf %d", tree.Size())))
+				}
+				cp := f_log.Checkpoint{Origin: logVerifier.Name(), Size: tree.Size(), Hash: tree.Hash()}
+				signed, err := note.Sign(&note.Note{Text: string(cp.Marshal())}, logSigner)
+				if err != nil {
+					t.Fatalf("Sign: %v", err)
+				}
+				return signed
+			}
+			consistency := func(_ context.Context, smaller, larger uint64) ([][]byte, error) {
+				return tree.ConsistencyProof(smaller, larger)
+			}
+
+			var witnesses []Witness
+			var fakes []*fakeWitness
+			for i, refuse := range test.refuse {
+				s, v := newKeys(t, fmt.Sprintf("witness%d", i))
+				if test.badKey {
+					s, _ = newKeys(t, v.Name())
+				}
+				fw := &fakeWitness{log: logVerifier, signer: s, refuse: refuse}
+				ts := httptest.NewServer(fw)
+				defer ts.Close()
+				witnesses = append(witnesses, Witness{URL: ts.URL, Verifier: v})
+				fakes = append(fakes, fw)
+			}
+			if test.seen > 0 {
+				// The witnesses cosigned a checkpoint by some other means, e.g. before the log was restarted.
+				checkpoint(int(test.seen))
+				for _, fw := range fakes {
+					fw.size, fw.root = tree.Size(), tree.Hash()
+				}
+			}
+			c, err := New(witnesses, test.quorum, http.DefaultClient)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			// The witnesses are sent the first checkpoint, then one which they must check is consistent with it.
+			for _, n := range []int{2, 5} {
+				signed := checkpoint(n)
+				cosigned, err := c.Cosign(ctx, signed, tree.Size(), consistency)
+				if (err != nil) != test.wantErr {
+					t.Fatalf("Cosign: got %v, want error %t", err, test.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if !bytes.HasPrefix(cosigned, signed) {
+					t.Fatalf("Cosigned checkpoint %q doesn't extend %q", cosigned, signed)
+				}
+				// Each of the witnesses which didn't refuse has cosigned the checkpoint.
+				var vs []note.Verifier
+				for i, w := range witnesses {
+					if !test.refuse[i] {
+						vs = append(vs, w.Verifier)
+					}
+				}
+				if _, _, n, err := f_log.ParseCheckpoint(cosigned, logVerifier.Name(), logVerifier, vs...); err != nil {
+					t.Fatalf("ParseCheckpoint: %v", err)
+				} else if got, want := len(n.Sigs), len(vs)+1; got != want {
+					t.Errorf("Got %d verified signatures, want %d", got, want)
+				}
+			}
+			if got := fakes[0].olds; !slices.Equal(got, test.wantOlds) {
+				t.Errorf("First witness was sent old sizes %v, want %v", got, test.wantOlds)
+			}
+		})
+	}
+}
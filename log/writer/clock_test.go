@@ -0,0 +1,100 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		timers  []time.Duration
+		stop    []int
+		advance []time.Duration
+		// want is the timers fired by each advance, in the order they fired.
+		want [][]int
+	}{
+		{name: "not due", timers: []time.Duration{time.Second}, advance: []time.Duration{time.Second - 1}, want: [][]int{nil}},
+		{name: "exactly due", timers: []time.Duration{time.Second}, advance: []time.Duration{time.Second}, want: [][]int{{0}}},
+		{name: "fires once", timers: []time.Duration{time.Second}, advance: []time.Duration{2 * time.Second, time.Second}, want: [][]int{{0}, nil}},
+		{name: "in expiry order", timers: []time.Duration{3 * time.Second, time.Second, 2 * time.Second}, advance: []time.Duration{5 * time.Second}, want: [][]int{{1, 2, 0}}},
+		{name: "in steps", timers: []time.Duration{time.Second, 3 * time.Second}, advance: []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}, want: [][]int{nil, {0}, {1}}},
+		{name: "stopped", timers: []time.Duration{time.Second, time.Second}, stop: []int{0}, advance: []time.Duration{time.Second}, want: [][]int{{1}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			c := NewFakeClock(start)
+			var fired []int
+			timers := make([]Timer, len(test.timers))
+			for i, d := range test.timers {
+				timers[i] = c.AfterFunc(d, func() { fired = append(fired, i) })
+			}
+			for _, i := range test.stop {
+				if !timers[i].Stop() {
+					t.Errorf("Stop() of pending timer %d = false, want true", i)
+				}
+				if timers[i].Stop() {
+					t.Errorf("Stop() of stopped timer %d = true, want false", i)
+				}
+			}
+			var elapsed time.Duration
+			for i, d := range test.advance {
+				fired = nil
+				c.Advance(d)
+				elapsed += d
+				// The timers are called synchronously, so have fired by the time Advance returns.
+				if !slices.Equal(fired, test.want[i]) {
+					t.Errorf("Advance %d fired timers %v, want %v", i, fired, test.want[i])
+				}
+				if got := c.Now(); !got.Equal(start.Add(elapsed)) {
+					t.Errorf("Now() = %v after advancing by %v, want %v", got, elapsed, start.Add(elapsed))
+				}
+			}
+		})
+	}
+}
+
+func TestPoolFlushByAge(t *testing.T) {
+	s := &testSequencer{}
+	c := NewFakeClock(time.Now())
+	p := NewPool(4, time.Second, s.sequence, WithClock(c))
+	wait := addInTurn(t, p, s, [][]byte{[]byte("a"), []byte("b")})
+	// The batch isn't flushed until its oldest entry is maxAge old, however long that takes in real time.
+	c.Advance(time.Second - time.Millisecond)
+	wait2 := addInTurn(t, p, s, [][]byte{[]byte("c")})
+	if got := s.batchSizes(); len(got) != 0 {
+		t.Fatalf("Got batches of %v entries before maxAge, want none", got)
+	}
+	c.Advance(time.Millisecond)
+	wait()
+	wait2()
+	if got, want := s.batchSizes(), []int{3}; !slices.Equal(got, want) {
+		t.Errorf("Got batches of %v entries, want %v", got, want)
+	}
+	// The next batch is timed from its own first entry.
+	wait = addInTurn(t, p, s, [][]byte{[]byte("d")})
+	c.Advance(time.Second)
+	wait()
+	if got, want := s.batchSizes(), []int{3, 1}; !slices.Equal(got, want) {
+		t.Errorf("Got batches of %v entries, want %v", got, want)
+	}
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+}
@@ -19,12 +19,17 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"runtime"
+	"time"
 
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
 	"github.com/transparency-dev/merkle"
 	"github.com/transparency-dev/merkle/compact"
 	"github.com/transparency-dev/serverless-log/api"
-	"github.com/transparency-dev/serverless-log/api/layout"
-	"github.com/transparency-dev/serverless-log/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 	"k8s.io/klog/v2"
 )
 
@@ -47,18 +52,58 @@ var (
 	// ErrSeqAlreadyAssigned is returned by the Assign method of storage implementations
 	// to indicate that the provided sequence number is already in use.
 	ErrSeqAlreadyAssigned = errors.New("sequence number already assigned")
+
+	// ErrEntryTooLarge is returned by the Sequence methods of storage implementations for entries which are
+	// larger than Params.MaxEntryBytes, and so could take an entry bundle beyond Params.BundleMaxBytes.
+	ErrEntryTooLarge = errors.New("entry is too large for the log's entry bundles")
+
+	// ErrReadOnly is returned by the Sequence methods of storage implementations which have been
+	// opened for reading only.
+	ErrReadOnly = errors.New("log is read-only")
+
+	// ErrCheckpointRollback is returned by storage implementations asked to write a checkpoint for a smaller
+	// tree than the current checkpoint, which would make the log appear to shrink.
+	ErrCheckpointRollback = errors.New("checkpoint would roll back the log")
 )
 
+// IntegrateOption configures optional behaviour of Integrate.
+type IntegrateOption func(*integrateOpts)
+
+type integrateOpts struct {
+	storeConcurrency int
+}
+
+// WithStoreConcurrency sets the max number of tiles which are stored concurrently, which otherwise defaults to
+// runtime.GOMAXPROCS(0).
+// Storage implementations for which each tile written is a network round trip benefit from a higher limit.
+func WithStoreConcurrency(n int) IntegrateOption {
+	return func(o *integrateOpts) {
+		o.storeConcurrency = n
+	}
+}
+
 // Integrate adds all sequenced entries greater than fromSize into the tree.
 // Returns an updated Checkpoint, or an error.
-func Integrate(ctx context.Context, fromSize uint64, batch [][]byte, st IntegrateStorage, h merkle.LogHasher) (uint64, []byte, error) {
+func Integrate(ctx context.Context, params log.Params, fromSize uint64, batch [][]byte, st IntegrateStorage, h merkle.LogHasher, opts ...IntegrateOption) (uint64, []byte, error) {
+	o := integrateOpts{storeConcurrency: runtime.GOMAXPROCS(0)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	m := metricsFor(params.Name)
+	start := time.Now()
+	defer func() { m.integrationDuration.Observe(time.Since(start).Seconds()) }()
+	m.integrationBatchEntries.Observe(float64(len(batch)))
+	ctx, span := tracer.Start(ctx, "writer.Integrate", trace.WithAttributes(
+		attribute.Int("betty.batch_size", len(batch)),
+		attribute.Int64("betty.from_size", int64(fromSize)),
+		attribute.Int64("betty.to_size", int64(fromSize)+int64(len(batch)))))
+	defer span.End()
+
 	getTile := func(l, i uint64) (*api.Tile, error) {
 		return st.GetTile(ctx, l, i, fromSize)
 	}
 
-	hashes, err := client.FetchRangeNodes(ctx, fromSize, func(_ context.Context, l, i uint64) (*api.Tile, error) {
-		return getTile(l, i)
-	})
+	hashes, err := reader.FetchRangeNodes(ctx, params, fromSize, st)
 	if err != nil {
 		return 0, nil, fmt.Errorf("failed to fetch compact range nodes: %w", err)
 	}
@@ -77,27 +122,25 @@ func Integrate(ctx context.Context, fromSize uint64, batch [][]byte, st Integrat
 
 	klog.V(1).Infof("Loaded state with roothash %x", r)
 
-	// Create a new compact range which represents the update to the tree
-	newRange := rf.NewEmptyRange(fromSize)
-	tc := tileCache{m: make(map[tileKey]*api.Tile), getTile: getTile}
+	tc := &tileCache{m: make(map[tileKey]*api.Tile), params: params, getTile: getTile}
 	if len(batch) == 0 {
 		klog.V(1).Infof("Nothing to do.")
 		// Nothing to do, nothing done.
 		return fromSize, r, nil
 	}
-	for _, e := range batch {
-		lh := h.HashLeaf(e)
-		// Update range and set nodes
-		if err := newRange.Append(lh, tc.Visit); err != nil {
-			return 0, nil, fmt.Errorf("newRange.Append(): %v", err)
-		}
-
+	// Create a new compact range which represents the update to the tree
+	newRange, err := buildRange(&rf, fromSize, batch, h, tc.Visit)
+	if err != nil {
+		return 0, nil, err
 	}
 
 	// Merge the update range into the old tree
 	if err := baseRange.AppendRange(newRange, tc.Visit); err != nil {
 		return 0, nil, fmt.Errorf("failed to merge new range onto existing log: %w", err)
 	}
+	if tc.err != nil {
+		return 0, nil, fmt.Errorf("failed to fetch tile: %w", tc.err)
+	}
 
 	// Calculate the new root hash - don't pass in the tileCache visitor here since
 	// this will construct any ephemeral nodes and we do not want to store those.
@@ -110,15 +153,88 @@ func Integrate(ctx context.Context, fromSize uint64, batch [][]byte, st Integrat
 	// tiles and updated log state.
 	klog.V(1).Infof("New log state: size 0x%x hash: %x", baseRange.End(), newRoot)
 
+	// The tiles are independent of one another, so can be stored concurrently.
+	eg := errgroup.Group{}
+	eg.SetLimit(o.storeConcurrency)
 	for k, t := range tc.m {
-		if err := st.StoreTile(ctx, k.level, k.index, t); err != nil {
-			return 0, nil, fmt.Errorf("failed to store tile at level %d index %d: %w", k.level, k.index, err)
-		}
+		eg.Go(func() error {
+			if err := st.StoreTile(ctx, k.level, k.index, t); err != nil {
+				return fmt.Errorf("failed to store tile at level %d index %d: %w", k.level, k.index, err)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return 0, nil, err
 	}
 
 	return baseRange.End(), newRoot, nil
 }
 
+// minParallelLeaves is the smallest number of leaves worth handing to each worker when building ranges in
+// parallel, below which the overhead outweighs the benefit.
+const minParallelLeaves = 1024
+
+// buildRange returns a compact range covering the batch of leaves starting at index fromSize, calling visit
+// for each node which the batch fully populates.
+//
+// Large batches are split into contiguous chunks, the ranges for which are built in parallel and then merged
+// in order, so both the resulting range and the set of nodes visited are identical to building it serially.
+func buildRange(rf *compact.RangeFactory, fromSize uint64, batch [][]byte, h merkle.LogHasher, visit compact.VisitFn) (*compact.Range, error) {
+	workers := min(runtime.GOMAXPROCS(0), len(batch)/minParallelLeaves)
+	if workers <= 1 {
+		r := rf.NewEmptyRange(fromSize)
+		for _, e := range batch {
+			if err := r.Append(h.HashLeaf(e), visit); err != nil {
+				return nil, fmt.Errorf("newRange.Append(): %v", err)
+			}
+		}
+		return r, nil
+	}
+
+	type node struct {
+		id   compact.NodeID
+		hash []byte
+	}
+	chunk := (len(batch) + workers - 1) / workers
+	ranges := make([]*compact.Range, workers)
+	// The visitor isn't safe for concurrent use, so each worker collects the nodes it visits.
+	nodes := make([][]node, workers)
+	eg := errgroup.Group{}
+	for w := range workers {
+		begin, end := w*chunk, min((w+1)*chunk, len(batch))
+		eg.Go(func() error {
+			r := rf.NewEmptyRange(fromSize + uint64(begin))
+			v := func(id compact.NodeID, hash []byte) {
+				nodes[w] = append(nodes[w], node{id: id, hash: hash})
+			}
+			for _, e := range batch[begin:end] {
+				if err := r.Append(h.HashLeaf(e), v); err != nil {
+					return fmt.Errorf("newRange.Append(): %v", err)
+				}
+			}
+			ranges[w] = r
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	r := ranges[0]
+	for w, ns := range nodes {
+		for _, n := range ns {
+			visit(n.id, n.hash)
+		}
+		if w > 0 {
+			if err := r.AppendRange(ranges[w], visit); err != nil {
+				return nil, fmt.Errorf("failed to merge ranges: %v", err)
+			}
+		}
+	}
+	return r, nil
+}
+
 // tileKey is a level/index key for the tile cache below.
 type tileKey struct {
 	level uint64
@@ -134,9 +250,12 @@ type tileKey struct {
 //
 // Note that by itself, this cache does not update any on-disk state.
 type tileCache struct {
-	m map[tileKey]*api.Tile
+	m      map[tileKey]*api.Tile
+	params log.Params
 
 	getTile func(level, index uint64) (*api.Tile, error)
+	// err is the first error returned by getTile, after which further visits are ignored.
+	err error
 }
 
 // Visit should be called once for each newly set non-ephemeral node in the
@@ -145,8 +264,14 @@ type tileCache struct {
 // If the tile containing id has not been seen before, this method will fetch
 // it from disk (or create a new empty in-memory tile if it doesn't exist), and
 // update it by setting the node corresponding to id to the value hash.
-func (tc tileCache) Visit(id compact.NodeID, hash []byte) {
-	tileLevel, tileIndex, nodeLevel, nodeIndex := layout.NodeCoordsToTileAddress(uint64(id.Level), uint64(id.Index))
+//
+// Since the visitor can't return an error, a failure to fetch a tile is recorded
+// in tc.err for the caller to check once the visits are complete.
+func (tc *tileCache) Visit(id compact.NodeID, hash []byte) {
+	if tc.err != nil {
+		return
+	}
+	tileLevel, tileIndex, nodeLevel, nodeIndex := tc.params.NodeCoordsToTileAddress(uint64(id.Level), uint64(id.Index))
 	tileKey := tileKey{level: tileLevel, index: tileIndex}
 	tile := tc.m[tileKey]
 	if tile == nil {
@@ -156,13 +281,14 @@ func (tc tileCache) Visit(id compact.NodeID, hash []byte) {
 		var err error
 		tile, err = tc.getTile(tileLevel, tileIndex)
 		if err != nil {
-			if !os.IsNotExist(err) {
-				panic(err)
+			if !errors.Is(err, os.ErrNotExist) {
+				tc.err = err
+				return
 			}
 			// This is a brand new tile.
 			created = true
 			tile = &api.Tile{
-				Nodes: make([][]byte, 0, 256*2),
+				Nodes: make([][]byte, 0, tc.params.TileWidth()*2),
 			}
 		}
 		klog.V(2).Infof("GetTile: %v new: %v", tileKey, created)
@@ -0,0 +1,369 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"github.com/transparency-dev/serverless-log/api"
+)
+
+// memTileStorage is an IntegrateStorage which holds the latest version of each tile in memory.
+type memTileStorage struct {
+	mu    sync.Mutex
+	tiles map[tileKey]*api.Tile
+}
+
+func newMemTileStorage() *memTileStorage {
+	return &memTileStorage{tiles: make(map[tileKey]*api.Tile)}
+}
+
+func (m *memTileStorage) GetTile(_ context.Context, level, index, _ uint64) (*api.Tile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tiles[tileKey{level: level, index: index}]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return &api.Tile{NumLeaves: t.NumLeaves, Nodes: slices.Clone(t.Nodes)}, nil
+}
+
+func (m *memTileStorage) StoreTile(_ context.Context, level, index uint64, t *api.Tile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tiles[tileKey{level: level, index: index}] = &api.Tile{NumLeaves: t.NumLeaves, Nodes: slices.Clone(t.Nodes)}
+	return nil
+}
+
+func (m *memTileStorage) GetEntryBundle(context.Context, uint64, uint64) ([]byte, error) {
+	return nil, os.ErrNotExist
+}
+
+// slowTileStorage is a memTileStorage whose tile writes each take latency, as they would if each were a round trip
+// to an object store, and which records how many were in flight at once.
+type slowTileStorage struct {
+	*memTileStorage
+	latency time.Duration
+
+	mu                  sync.Mutex
+	inFlight, maxFlight int
+}
+
+func (s *slowTileStorage) StoreTile(ctx context.Context, level, index uint64, t *api.Tile) error {
+	s.mu.Lock()
+	s.inFlight++
+	s.maxFlight = max(s.maxFlight, s.inFlight)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+	time.Sleep(s.latency)
+	return s.memTileStorage.StoreTile(ctx, level, index, t)
+}
+
+// failingTileStorage is a memTileStorage whose tile reads or writes fail once enabled.
+type failingTileStorage struct {
+	*memTileStorage
+	getErr, storeErr error
+}
+
+func (f *failingTileStorage) GetTile(ctx context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+	return f.memTileStorage.GetTile(ctx, level, index, logSize)
+}
+
+func (f *failingTileStorage) StoreTile(ctx context.Context, level, index uint64, t *api.Tile) error {
+	if f.storeErr != nil {
+		return f.storeErr
+	}
+	return f.memTileStorage.StoreTile(ctx, level, index, t)
+}
+
+// testLeaves returns n distinct leaves, starting from the given index.
+func testLeaves(from, n int) [][]byte {
+	r := make([][]byte, n)
+	for i := range r {
+		r[i] = []byte(fmt.Sprintf("leaf %d", from+i))
+	}
+	return r
+}
+
+// setGOMAXPROCS sets GOMAXPROCS, which determines the number of workers integrating in parallel, for the
+// duration of the test.
+func setGOMAXPROCS(tb testing.TB, n int) {
+	tb.Helper()
+	old := runtime.GOMAXPROCS(n)
+	tb.Cleanup(func() { runtime.GOMAXPROCS(old) })
+}
+
+// integrateAll integrates the leaves into st in batches of the given sizes, returning the final root.
+func integrateAll(t *testing.T, params log.Params, st IntegrateStorage, batches []int) []byte {
+	t.Helper()
+	var size uint64
+	var root []byte
+	for _, n := range batches {
+		var err error
+		size, root, err = Integrate(context.Background(), params, size, testLeaves(int(size), n), st, params.Hasher())
+		if err != nil {
+			t.Fatalf("Integrate: %v", err)
+		}
+	}
+	return root
+}
+
+func TestIntegrateParallel(t *testing.T) {
+	params := log.Params{EntryBundleSize: 256}
+	for _, test := range []struct {
+		name    string
+		batches []int
+	}{
+		{name: "too small to parallelise", batches: []int{minParallelLeaves}},
+		{name: "one batch", batches: []int{10 * minParallelLeaves}},
+		{name: "uneven chunks", batches: []int{10*minParallelLeaves + 7}},
+		{name: "onto existing tree", batches: []int{3, 5*minParallelLeaves + 1, 1, 4 * minParallelLeaves}},
+		{name: "onto tile boundary", batches: []int{256, 4 * minParallelLeaves}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var total int
+			for _, n := range test.batches {
+				total += n
+			}
+			rf := compact.RangeFactory{Hash: rfc6962.DefaultHasher.HashChildren}
+			ref := rf.NewEmptyRange(0)
+			for _, l := range testLeaves(0, total) {
+				if err := ref.Append(rfc6962.DefaultHasher.HashLeaf(l), nil); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+			want, err := ref.GetRootHash(nil)
+			if err != nil {
+				t.Fatalf("GetRootHash: %v", err)
+			}
+
+			serial, parallel := newMemTileStorage(), newMemTileStorage()
+			setGOMAXPROCS(t, 1)
+			serialRoot := integrateAll(t, params, serial, test.batches)
+			runtime.GOMAXPROCS(8)
+			parallelRoot := integrateAll(t, params, parallel, test.batches)
+
+			if !bytes.Equal(serialRoot, want) {
+				t.Errorf("Serial integration gave root %x, want %x", serialRoot, want)
+			}
+			if !bytes.Equal(parallelRoot, want) {
+				t.Errorf("Parallel integration gave root %x, want %x", parallelRoot, want)
+			}
+			if len(parallel.tiles) != len(serial.tiles) {
+				t.Fatalf("Parallel integration stored %d tiles, serial stored %d", len(parallel.tiles), len(serial.tiles))
+			}
+			for k, st := range serial.tiles {
+				pt := parallel.tiles[k]
+				if pt == nil || pt.NumLeaves != st.NumLeaves || !slices.EqualFunc(pt.Nodes, st.Nodes, bytes.Equal) {
+					t.Errorf("Tile at level %d index %d differs between serial and parallel integration", k.level, k.index)
+				}
+			}
+		})
+	}
+}
+
+func TestIntegrateTileErrors(t *testing.T) {
+	params := log.Params{EntryBundleSize: 256}
+	errTest := errors.New("test error")
+	for _, test := range []struct {
+		name string
+		// from is the size of the tree integrated before the errors are injected.
+		from             uint64
+		getErr, storeErr error
+		wantErr          bool
+	}{
+		{name: "no errors", from: 3},
+		{name: "tile read", from: 3, getErr: errTest, wantErr: true},
+		{name: "tile write", from: 3, storeErr: errTest, wantErr: true},
+		// Tiles which don't exist yet are created.
+		{name: "tile not found", from: 0, getErr: os.ErrNotExist},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			st := &failingTileStorage{memTileStorage: newMemTileStorage()}
+			integrateAll(t, params, st, []int{int(test.from)})
+			st.getErr, st.storeErr = test.getErr, test.storeErr
+			size, root, err := Integrate(context.Background(), params, test.from, testLeaves(int(test.from), 2), st, params.Hasher())
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Integrate = %v, want error: %t", err, test.wantErr)
+			}
+			if err != nil {
+				// The error is returned, rather than a tree which may not match the tiles.
+				if !errors.Is(err, errTest) {
+					t.Errorf("Integrate = %v, want %v", err, errTest)
+				}
+				if size != 0 || root != nil {
+					t.Errorf("Integrate returned tree (%d, %x) along with an error", size, root)
+				}
+				return
+			}
+			if want := test.from + 2; size != want {
+				t.Errorf("Integrate returned size %d, want %d", size, want)
+			}
+		})
+	}
+}
+
+func BenchmarkIntegrate(b *testing.B) {
+	params := log.Params{EntryBundleSize: 256}
+	for _, size := range []int{minParallelLeaves, 16 * minParallelLeaves} {
+		batch := testLeaves(0, size)
+		for _, bm := range []struct {
+			name  string
+			procs int
+		}{
+			{name: "serial", procs: 1},
+			{name: "parallel", procs: runtime.GOMAXPROCS(0)},
+		} {
+			b.Run(fmt.Sprintf("%d leaves/%s", size, bm.name), func(b *testing.B) {
+				setGOMAXPROCS(b, bm.procs)
+				for range b.N {
+					if _, _, err := Integrate(context.Background(), params, 0, batch, newMemTileStorage(), params.Hasher()); err != nil {
+						b.Fatalf("Integrate: %v", err)
+					}
+				}
+				b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "leaves/s")
+			})
+		}
+	}
+}
+
+func TestIntegrateStoreConcurrency(t *testing.T) {
+	params := log.Params{EntryBundleSize: 256}
+	// 16 complete tiles at level 0, and a partial one at level 1.
+	const leaves, tiles = 16 * 256, 17
+	for _, test := range []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{name: "serial", limit: 1, want: 1},
+		{name: "limited", limit: 4, want: 4},
+		{name: "more than tiles", limit: 64, want: tiles},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			st := &slowTileStorage{memTileStorage: newMemTileStorage(), latency: 20 * time.Millisecond}
+			_, root, err := Integrate(context.Background(), params, 0, testLeaves(0, leaves), st, params.Hasher(), WithStoreConcurrency(test.limit))
+			if err != nil {
+				t.Fatalf("Integrate: %v", err)
+			}
+			if got := len(st.tiles); got != tiles {
+				t.Errorf("Stored %d tiles, want %d", got, tiles)
+			}
+			if want := integrateAll(t, params, newMemTileStorage(), []int{leaves}); !bytes.Equal(root, want) {
+				t.Errorf("Got root %x, want %x", root, want)
+			}
+			if st.maxFlight != test.want {
+				t.Errorf("Stored up to %d tiles concurrently, want %d", st.maxFlight, test.want)
+			}
+		})
+	}
+}
+
+func BenchmarkIntegrateStoreLatency(b *testing.B) {
+	params := log.Params{EntryBundleSize: 256}
+	batch := testLeaves(0, 16*256)
+	for _, limit := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("concurrency %d", limit), func(b *testing.B) {
+			for range b.N {
+				st := &slowTileStorage{memTileStorage: newMemTileStorage(), latency: 5 * time.Millisecond}
+				if _, _, err := Integrate(context.Background(), params, 0, batch, st, params.Hasher(), WithStoreConcurrency(limit)); err != nil {
+					b.Fatalf("Integrate: %v", err)
+				}
+			}
+			b.ReportMetric(float64(len(batch)*b.N)/b.Elapsed().Seconds(), "leaves/s")
+		})
+	}
+}
+
+// histogramSnapshot returns the sample count and sum of h, and the cumulative count of samples in each of its
+// buckets by upper bound.
+func histogramSnapshot(t *testing.T, h prometheus.Observer) (uint64, float64, map[float64]uint64) {
+	t.Helper()
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buckets := make(map[float64]uint64)
+	for _, b := range m.GetHistogram().GetBucket() {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum(), buckets
+}
+
+func TestIntegrationBatchEntriesMetric(t *testing.T) {
+	params := log.Params{EntryBundleSize: 256}
+	for _, test := range []struct {
+		name  string
+		sizes []int
+	}{
+		{name: "single entry", sizes: []int{1}},
+		{name: "full batches", sizes: []int{256, 256, 256}},
+		{name: "differing sizes", sizes: []int{1, 3, 17, 256, 100, 2}},
+		{name: "large batch", sizes: []int{10000}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			count, sum, buckets := histogramSnapshot(t, metricsFor("").integrationBatchEntries)
+			st := newMemTileStorage()
+			size := uint64(0)
+			wantSum := 0
+			for _, n := range test.sizes {
+				var err error
+				if size, _, err = Integrate(context.Background(), params, size, testLeaves(int(size), n), st, params.Hasher()); err != nil {
+					t.Fatalf("Integrate: %v", err)
+				}
+				wantSum += n
+			}
+			gotCount, gotSum, gotBuckets := histogramSnapshot(t, metricsFor("").integrationBatchEntries)
+			if d := gotCount - count; d != uint64(len(test.sizes)) {
+				t.Errorf("Got %d samples, want %d", d, len(test.sizes))
+			}
+			if d := gotSum - sum; d != float64(wantSum) {
+				t.Errorf("Got samples summing to %v, want %d", d, wantSum)
+			}
+			for ub, c := range gotBuckets {
+				want := uint64(0)
+				for _, n := range test.sizes {
+					if float64(n) <= ub {
+						want++
+					}
+				}
+				if d := c - buckets[ub]; d != want {
+					t.Errorf("Got %d samples <= %v, want %d", d, ub, want)
+				}
+			}
+		})
+	}
+}
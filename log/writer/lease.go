@@ -0,0 +1,165 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// LeasePath is the location, relative to the log root, of the writer lease.
+const LeasePath = "writer.lease"
+
+var (
+	// ErrLeaseHeld is returned when attempting to acquire a writer lease which is held by another writer.
+	ErrLeaseHeld = errors.New("writer lease is held by another writer")
+
+	// ErrLeaseLost is returned when a writer finds that its lease has been taken over by another writer.
+	ErrLeaseLost = errors.New("writer lease has been lost")
+)
+
+// LeaseStorage represents the set of functions needed to persist a writer lease.
+type LeaseStorage interface {
+	// ReadLease returns the stored lease.
+	// If there is no lease, the returned error must satisfy errors.Is(err, os.ErrNotExist).
+	ReadLease(ctx context.Context) ([]byte, error)
+	// WriteLease stores the lease.
+	WriteLease(ctx context.Context, l []byte) error
+	// DeleteLease removes the stored lease.
+	DeleteLease(ctx context.Context) error
+}
+
+// leaseRecord is the persisted form of a lease.
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Renewed time.Time `json:"renewed"`
+}
+
+// Lease fences a log so that only a single writer may add entries to it.
+//
+// The lease must be renewed more frequently than its TTL, after which it is considered stale and
+// may be taken over by another writer.
+// Callers must ensure that calls to the methods of a Lease are serialised with respect to all other
+// writers, e.g. by holding the storage's checkpoint lock.
+type Lease struct {
+	holder   string
+	ttl      time.Duration
+	takeover bool
+	st       LeaseStorage
+}
+
+// NewLease creates a new Lease, which will be stored in st.
+// If takeover is true, a stale lease held by another writer may be taken over by Acquire.
+func NewLease(st LeaseStorage, ttl time.Duration, takeover bool) *Lease {
+	return &Lease{
+		holder:   newHolderID(),
+		ttl:      ttl,
+		takeover: takeover,
+		st:       st,
+	}
+}
+
+// TTL returns the duration after which an unrenewed lease is considered stale.
+func (l *Lease) TTL() time.Duration {
+	return l.ttl
+}
+
+// Acquire takes the lease, failing if it's held by another writer.
+func (l *Lease) Acquire(ctx context.Context) error {
+	r, err := l.read(ctx)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil && r.Holder != l.holder {
+		age := time.Since(r.Renewed)
+		if age < l.ttl {
+			return fmt.Errorf("%w %q, last renewed %v ago", ErrLeaseHeld, r.Holder, age.Round(time.Second))
+		}
+		if !l.takeover {
+			return fmt.Errorf("%w %q, but it was last renewed %v ago and may be taken over", ErrLeaseHeld, r.Holder, age.Round(time.Second))
+		}
+	}
+	return l.write(ctx)
+}
+
+// Renew extends the lease, failing if it's been taken over by another writer.
+func (l *Lease) Renew(ctx context.Context) error {
+	if err := l.Check(ctx); err != nil {
+		return err
+	}
+	return l.write(ctx)
+}
+
+// Check returns an error unless the lease is still held by this writer.
+func (l *Lease) Check(ctx context.Context) error {
+	r, err := l.read(ctx)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrLeaseLost
+		}
+		return err
+	}
+	if r.Holder != l.holder {
+		return fmt.Errorf("%w to %q", ErrLeaseLost, r.Holder)
+	}
+	return nil
+}
+
+// Release gives up the lease, if it's still held by this writer.
+func (l *Lease) Release(ctx context.Context) error {
+	if err := l.Check(ctx); err != nil {
+		return err
+	}
+	return l.st.DeleteLease(ctx)
+}
+
+func (l *Lease) read(ctx context.Context) (leaseRecord, error) {
+	var r leaseRecord
+	raw, err := l.st.ReadLease(ctx)
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return r, fmt.Errorf("failed to parse lease: %v", err)
+	}
+	return r, nil
+}
+
+func (l *Lease) write(ctx context.Context) error {
+	raw, err := json.Marshal(leaseRecord{Holder: l.holder, Renewed: time.Now()})
+	if err != nil {
+		return err
+	}
+	return l.st.WriteLease(ctx, raw)
+}
+
+// newHolderID returns a string which identifies this writer.
+func newHolderID() string {
+	h, err := os.Hostname()
+	if err != nil {
+		h = "unknown"
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%s/%d/%s", h, os.Getpid(), hex.EncodeToString(b))
+}
@@ -0,0 +1,82 @@
+package writer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("github.com/AlCutter/betty/log/writer")
+
+// Each metric is labelled with the name of the log, see log.Params.Name, so that the logs hosted by a process can
+// be told apart.
+var (
+	entriesSequenced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "betty_entries_sequenced_total",
+		Help: "Total number of entries successfully sequenced.",
+	}, []string{"log"})
+	batchFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "betty_batch_failures_total",
+		Help: "Total number of flushed batches which failed to be sequenced, the callers of which were returned an error.",
+	}, []string{"log"})
+	entriesWithdrawn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "betty_entries_withdrawn_total",
+		Help: "Total number of entries withdrawn because their callers gave up before they were flushed.",
+	}, []string{"log"})
+	batchFlushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "betty_batch_flushes_total",
+		Help: "Total number of batches flushed for sequencing, by the reason they were flushed.",
+	}, []string{"log", "reason"})
+	batchAge = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "betty_batch_age_seconds",
+		Help:    "Age of the oldest entry in a batch when it's flushed for sequencing.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"log"})
+	batchFillRatio = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "betty_batch_fill_ratio",
+		Help:    "Ratio of entries in a flushed batch to the configured batch size.",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+	}, []string{"log"})
+	batchEffectiveSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "betty_batch_effective_size",
+		Help: "Number of entries at which batches are currently flushed, this varies with load when adaptive batching is enabled.",
+	}, []string{"log"})
+	integrationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "betty_integration_duration_seconds",
+		Help:    "Time taken to integrate a batch of entries into the tree.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"log"})
+	integrationBatchEntries = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "betty_integration_batch_entries",
+		Help:    "Number of entries integrated into the tree by each integration pass.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"log"})
+)
+
+// metrics holds the metrics of a single log.
+type metrics struct {
+	entriesSequenced        prometheus.Counter
+	batchFailures           prometheus.Counter
+	entriesWithdrawn        prometheus.Counter
+	batchFlushes            *prometheus.CounterVec
+	batchAge                prometheus.Observer
+	batchFillRatio          prometheus.Observer
+	batchEffectiveSize      prometheus.Gauge
+	integrationDuration     prometheus.Observer
+	integrationBatchEntries prometheus.Observer
+}
+
+// metricsFor returns the metrics of the named log.
+func metricsFor(name string) *metrics {
+	return &metrics{
+		entriesSequenced:        entriesSequenced.WithLabelValues(name),
+		batchFailures:           batchFailures.WithLabelValues(name),
+		entriesWithdrawn:        entriesWithdrawn.WithLabelValues(name),
+		batchFlushes:            batchFlushes.MustCurryWith(prometheus.Labels{"log": name}),
+		batchAge:                batchAge.WithLabelValues(name),
+		batchFillRatio:          batchFillRatio.WithLabelValues(name),
+		batchEffectiveSize:      batchEffectiveSize.WithLabelValues(name),
+		integrationDuration:     integrationDuration.WithLabelValues(name),
+		integrationBatchEntries: integrationBatchEntries.WithLabelValues(name),
+	}
+}
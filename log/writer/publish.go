@@ -0,0 +1,124 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Publisher decouples publishing checkpoints from integration, so that a log can integrate entries
+// continuously while only signing (and witnessing) a new checkpoint at most once per interval.
+//
+// Storage should use the Publisher's CurrentTree and NewTree in place of the funcs it wraps, so that
+// integration continues from the latest integrated tree rather than the latest published one.
+// The latest integrated tree is only held in memory, so storage must be able to recover entries
+// integrated beyond the published checkpoint after a crash.
+type Publisher struct {
+	interval time.Duration
+	curTree  CurrentTreeFunc
+	newTree  NewTreeFunc
+
+	// publishMu serialises calls to newTree.
+	publishMu sync.Mutex
+
+	// mu guards the fields below.
+	mu sync.Mutex
+	// size and root describe the latest integrated tree, root is nil until a tree has been integrated.
+	size uint64
+	root []byte
+	// dirty is set if the latest integrated tree has not yet been published.
+	dirty bool
+	// timer, if set, will publish the latest integrated tree.
+	timer *time.Timer
+	// last is the time of the most recent publish.
+	last time.Time
+}
+
+// NewPublisher creates a new Publisher which publishes integrated trees via newTree at most once per interval.
+// Until a tree has been integrated, the current tree is read via curTree.
+func NewPublisher(curTree CurrentTreeFunc, newTree NewTreeFunc, interval time.Duration) *Publisher {
+	return &Publisher{
+		interval: interval,
+		curTree:  curTree,
+		newTree:  newTree,
+	}
+}
+
+// CurrentTree returns the size and root hash of the latest integrated tree, which may not yet have been published.
+func (p *Publisher) CurrentTree() (uint64, []byte, error) {
+	p.mu.Lock()
+	size, root := p.size, p.root
+	p.mu.Unlock()
+	if root == nil {
+		return p.curTree()
+	}
+	return size, root, nil
+}
+
+// NewTree records a newly integrated tree, scheduling it to be published once interval has passed since
+// the previous publish.
+func (p *Publisher) NewTree(size uint64, root []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.size, p.root, p.dirty = size, root, true
+	p.scheduleLocked()
+	return nil
+}
+
+// scheduleLocked arranges for the latest integrated tree to be published, unless that's already scheduled.
+// Must be called with mu held.
+func (p *Publisher) scheduleLocked() {
+	if p.timer != nil {
+		return
+	}
+	p.timer = time.AfterFunc(time.Until(p.last.Add(p.interval)), func() {
+		if err := p.Publish(); err != nil {
+			klog.Errorf("Failed to publish checkpoint: %v", err)
+		}
+	})
+}
+
+// Publish immediately publishes the latest integrated tree, if it hasn't been already.
+// If publishing fails, it will be retried after the interval.
+func (p *Publisher) Publish() error {
+	p.publishMu.Lock()
+	defer p.publishMu.Unlock()
+
+	p.mu.Lock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if !p.dirty {
+		p.mu.Unlock()
+		return nil
+	}
+	size, root := p.size, p.root
+	p.dirty = false
+	p.last = time.Now()
+	p.mu.Unlock()
+
+	if err := p.newTree(size, root); err != nil {
+		p.mu.Lock()
+		p.dirty = true
+		p.scheduleLocked()
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPublished records the trees published by a Publisher, and when.
+type testPublished struct {
+	mu    sync.Mutex
+	sizes []uint64
+	times []time.Time
+	// err, if set, is returned by newTree rather than publishing the tree.
+	err error
+}
+
+func (tp *testPublished) newTree(size uint64, _ []byte) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.err != nil {
+		return tp.err
+	}
+	tp.sizes = append(tp.sizes, size)
+	tp.times = append(tp.times, time.Now())
+	return nil
+}
+
+func (tp *testPublished) published() ([]uint64, []time.Time) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return append([]uint64(nil), tp.sizes...), append([]time.Time(nil), tp.times...)
+}
+
+// testRoot returns a distinct root hash for the tree of the given size.
+func testRoot(size uint64) []byte {
+	return []byte(fmt.Sprintf("root %d", size))
+}
+
+func TestPublisher(t *testing.T) {
+	storedTree := func() (uint64, []byte, error) { return 3, testRoot(3), nil }
+	for _, test := range []struct {
+		name string
+		// integrated are the sizes of the trees integrated before Publish is called.
+		integrated []uint64
+		// wantCur is the size of the current tree before Publish is called.
+		wantCur       uint64
+		wantPublished []uint64
+	}{
+		{name: "nothing integrated", wantCur: 3},
+		{name: "one tree", integrated: []uint64{5}, wantCur: 5, wantPublished: []uint64{5}},
+		{name: "only latest is published", integrated: []uint64{5, 8, 13}, wantCur: 13, wantPublished: []uint64{13}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tp := &testPublished{}
+			// The interval is long enough that only the explicit calls to Publish publish anything.
+			p := NewPublisher(storedTree, tp.newTree, time.Hour)
+			// Otherwise, the first tree would be published immediately as there's been no previous publish.
+			p.last = time.Now()
+			for _, size := range test.integrated {
+				if err := p.NewTree(size, testRoot(size)); err != nil {
+					t.Fatalf("NewTree(%d): %v", size, err)
+				}
+			}
+			size, root, err := p.CurrentTree()
+			if err != nil {
+				t.Fatalf("CurrentTree: %v", err)
+			}
+			if size != test.wantCur || string(root) != string(testRoot(test.wantCur)) {
+				t.Errorf("CurrentTree: got (%d, %q), want (%d, %q)", size, root, test.wantCur, testRoot(test.wantCur))
+			}
+			if got, _ := tp.published(); len(got) != 0 {
+				t.Errorf("Published %v before Publish was called", got)
+			}
+			// Publishing is idempotent until a new tree is integrated.
+			for range 2 {
+				if err := p.Publish(); err != nil {
+					t.Fatalf("Publish: %v", err)
+				}
+			}
+			if got, _ := tp.published(); fmt.Sprint(got) != fmt.Sprint(test.wantPublished) {
+				t.Errorf("Got published sizes %v, want %v", got, test.wantPublished)
+			}
+		})
+	}
+}
+
+func TestPublisherRetriesFailedPublish(t *testing.T) {
+	tp := &testPublished{err: errors.New("witness unavailable")}
+	p := NewPublisher(func() (uint64, []byte, error) { return 0, nil, nil }, tp.newTree, time.Hour)
+	p.last = time.Now()
+	if err := p.NewTree(4, testRoot(4)); err != nil {
+		t.Fatalf("NewTree: %v", err)
+	}
+	if err := p.Publish(); err == nil {
+		t.Fatal("Publish succeeded, want error")
+	}
+	tp.mu.Lock()
+	tp.err = nil
+	tp.mu.Unlock()
+	// The tree which failed to be published is still outstanding.
+	if err := p.Publish(); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if got, _ := tp.published(); fmt.Sprint(got) != "[4]" {
+		t.Errorf("Got published sizes %v, want [4]", got)
+	}
+}
+
+func TestPublisherSteadyLoad(t *testing.T) {
+	const (
+		interval = 50 * time.Millisecond
+		duration = 500 * time.Millisecond
+	)
+	tp := &testPublished{}
+	p := NewPublisher(func() (uint64, []byte, error) { return 0, nil, nil }, tp.newTree, interval)
+
+	// Integrate a new tree every millisecond.
+	start := time.Now()
+	var size uint64
+	for time.Since(start) < duration {
+		size++
+		if err := p.NewTree(size, testRoot(size)); err != nil {
+			t.Fatalf("NewTree: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Publish(); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	sizes, times := tp.published()
+	if len(sizes) < 2 || len(sizes) > int(duration/interval)+2 {
+		t.Fatalf("Got %d publishes over %v, want about one every %v", len(sizes), duration, interval)
+	}
+	if sizes[len(sizes)-1] != size {
+		t.Errorf("Final publish has size %d, want latest integrated size %d", sizes[len(sizes)-1], size)
+	}
+	for i := 1; i < len(sizes); i++ {
+		// Each publish reflects the trees integrated over the preceding interval, rather than every tree.
+		if sizes[i] <= sizes[i-1] {
+			t.Errorf("Publish %d has size %d, want > %d", i, sizes[i], sizes[i-1])
+		}
+		// The final, explicit, Publish may come sooner.
+		if gap := times[i].Sub(times[i-1]); i < len(sizes)-1 && gap < interval {
+			t.Errorf("Publish %d came %v after the previous one, want >= %v", i, gap, interval)
+		}
+	}
+	t.Logf("Published sizes %v", sizes)
+}
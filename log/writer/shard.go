@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// WithShards causes the Pool to spread the entries added to it over n shards, each of which batches the entries
+// added to it independently, so that concurrent callers don't all contend for the same batch.
+//
+// The batches flushed by the shards are sequenced together: whichever batches are waiting when the previous call
+// to the SequenceFunc returns are concatenated, in shard order, and sequenced with a single call. The entries of
+// each shard's batch are therefore still assigned a contiguous run of indices, and the log remains a single tree.
+// An n of 1 or less disables sharding.
+func WithShards(n int) PoolOption {
+	return func(p *Pool) {
+		p.numShards = n
+	}
+}
+
+// shard returns the shard of the Pool to which the next entries should be added, or nil if the Pool isn't sharded.
+func (p *Pool) shard() *Pool {
+	if len(p.shards) == 0 {
+		return nil
+	}
+	return p.shards[p.nextShard.Add(1)%uint64(len(p.shards))]
+}
+
+// merger combines the batches flushed by the shards of a Pool, so that they're sequenced together.
+type merger struct {
+	seq SequenceFunc
+
+	mu sync.Mutex
+	// pending holds the batches flushed by the shards which are waiting to be sequenced.
+	pending []*shardBatch
+	// busy is set while a goroutine is sequencing the pending batches.
+	busy bool
+}
+
+// shardBatch is a batch flushed by a shard, waiting to be sequenced.
+type shardBatch struct {
+	ctx     context.Context
+	shard   int
+	entries [][]byte
+	// first and err are the result of sequencing the batch, which are set before done is closed.
+	first uint64
+	err   error
+	done  chan struct{}
+}
+
+// sequenceFunc returns the SequenceFunc for the given shard, which queues its batches to be sequenced along with
+// those of the other shards.
+func (m *merger) sequenceFunc(shard int) SequenceFunc {
+	return func(ctx context.Context, b Batch) (uint64, error) {
+		sb := &shardBatch{ctx: ctx, shard: shard, entries: b.Entries, done: make(chan struct{})}
+		m.mu.Lock()
+		m.pending = append(m.pending, sb)
+		if !m.busy {
+			m.busy = true
+			go m.run()
+		}
+		m.mu.Unlock()
+		<-sb.done
+		return sb.first, sb.err
+	}
+}
+
+// run sequences the pending batches until there are none left.
+func (m *merger) run() {
+	for {
+		m.mu.Lock()
+		ready := m.pending
+		m.pending = nil
+		if len(ready) == 0 {
+			m.busy = false
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+
+		// The batches are interleaved in shard order, so that the order doesn't depend on which shard happened to
+		// flush first.
+		sort.SliceStable(ready, func(i, j int) bool { return ready[i].shard < ready[j].shard })
+		var es [][]byte
+		for _, sb := range ready {
+			es = append(es, sb.entries...)
+		}
+		// The sequencing is traced as part of the first batch's span.
+		first, err := m.seq(ready[0].ctx, Batch{Entries: es})
+		for _, sb := range ready {
+			sb.first, sb.err = first, err
+			first += uint64(len(sb.entries))
+			close(sb.done)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedPoolIndices(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		shards     int
+		bufferSize int
+		writers    int
+		// perWriter entries are added by each writer, in batches of batch entries if batch is set.
+		perWriter int
+		batch     int
+	}{
+		{name: "unsharded", shards: 1, bufferSize: 8, writers: 16, perWriter: 50},
+		{name: "two shards", shards: 2, bufferSize: 8, writers: 16, perWriter: 50},
+		{name: "many shards", shards: 8, bufferSize: 8, writers: 32, perWriter: 50},
+		{name: "more shards than writers", shards: 16, bufferSize: 4, writers: 4, perWriter: 50},
+		{name: "single entry batches", shards: 4, bufferSize: 1, writers: 8, perWriter: 50},
+		{name: "batches", shards: 4, bufferSize: 8, writers: 16, perWriter: 60, batch: 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testSequencer{}
+			p := NewPool(test.bufferSize, time.Millisecond, s.sequence, WithShards(test.shards))
+			var (
+				mu  sync.Mutex
+				got = make(map[uint64][]byte)
+				wg  sync.WaitGroup
+			)
+			record := func(idx uint64, e []byte) {
+				mu.Lock()
+				defer mu.Unlock()
+				if prev, ok := got[idx]; ok {
+					t.Errorf("Index %d was assigned to both %q and %q", idx, prev, e)
+				}
+				got[idx] = e
+			}
+			for w := range test.writers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					es := testLeaves(w*test.perWriter, test.perWriter)
+					if test.batch == 0 {
+						for _, e := range es {
+							idx, err := p.Add(context.Background(), e)
+							if err != nil {
+								t.Errorf("Add: %v", err)
+								return
+							}
+							record(idx, e)
+						}
+						return
+					}
+					for len(es) > 0 {
+						b := es[:min(test.batch, len(es))]
+						es = es[len(b):]
+						idx, err := p.AddBatch(context.Background(), b)
+						if err != nil {
+							t.Errorf("AddBatch: %v", err)
+							return
+						}
+						// The entries of a batch are assigned a contiguous run of indices, whichever shard they
+						// were added to.
+						for i := range idx {
+							if idx[i] != idx[0]+uint64(i) {
+								t.Errorf("AddBatch assigned non-contiguous indices %v", idx)
+							}
+							record(idx[i], b[i])
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			// Every index of the tree was assigned to exactly one entry, which is the one sequenced at that index.
+			n := test.writers * test.perWriter
+			if len(got) != n {
+				t.Fatalf("Got %d indices, want %d", len(got), n)
+			}
+			var seqd [][]byte
+			for _, b := range s.batches {
+				seqd = append(seqd, b...)
+			}
+			if len(seqd) != n {
+				t.Fatalf("Sequenced %d entries, want %d", len(seqd), n)
+			}
+			for i := range uint64(n) {
+				if e, ok := got[i]; !ok {
+					t.Errorf("No entry was assigned index %d", i)
+				} else if string(e) != string(seqd[i]) {
+					t.Errorf("Index %d was assigned to %q, but %q was sequenced there", i, e, seqd[i])
+				}
+			}
+		})
+	}
+}
+
+// blockingSequencer records the batches it's asked to sequence, blocking the first call until it's released.
+type blockingSequencer struct {
+	testSequencer
+	entered chan struct{}
+	release chan struct{}
+	err     error
+	calls   int
+}
+
+func (s *blockingSequencer) sequence(ctx context.Context, b Batch) (uint64, error) {
+	s.calls++
+	if s.calls == 1 {
+		close(s.entered)
+		<-s.release
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.testSequencer.sequence(ctx, b)
+}
+
+func TestMerger(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// While the first batch, from shard first, is being sequenced, batches from each of the shards in queued
+		// are queued to be sequenced together.
+		first  int
+		queued []int
+		err    error
+	}{
+		{name: "in order", first: 0, queued: []int{1, 2, 3}},
+		{name: "out of order", first: 1, queued: []int{3, 0, 2}},
+		{name: "one queued", first: 2, queued: []int{0}},
+		{name: "error", first: 0, queued: []int{2, 1}, err: errors.New("failed")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &blockingSequencer{entered: make(chan struct{}), release: make(chan struct{})}
+			m := &merger{seq: s.sequence}
+			// Each shard's batch contains as many entries as the number of the shard, plus one.
+			entries := func(shard int) [][]byte {
+				r := make([][]byte, shard+1)
+				for i := range r {
+					r[i] = []byte(fmt.Sprintf("shard %d entry %d", shard, i))
+				}
+				return r
+			}
+			type result struct {
+				first uint64
+				err   error
+			}
+			results := make(map[int]chan result)
+			add := func(shard int) {
+				c := make(chan result, 1)
+				results[shard] = c
+				go func() {
+					first, err := m.sequenceFunc(shard)(context.Background(), Batch{Entries: entries(shard)})
+					c <- result{first, err}
+				}()
+			}
+			add(test.first)
+			<-s.entered
+			for _, sh := range test.queued {
+				add(sh)
+			}
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+				m.mu.Lock()
+				n := len(m.pending)
+				m.mu.Unlock()
+				if n == len(test.queued) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Only %d batches were queued, want %d", n, len(test.queued))
+				}
+			}
+			if test.err != nil {
+				s.err = test.err
+			}
+			close(s.release)
+
+			if r := <-results[test.first]; r.err != test.err || (r.err == nil && r.first != 0) {
+				t.Errorf("Shard %d batch got (%d, %v), want (0, %v)", test.first, r.first, r.err, test.err)
+			}
+			// The queued batches are sequenced together, in shard order, following the first batch.
+			sorted := slices.Clone(test.queued)
+			slices.Sort(sorted)
+			next := uint64(test.first + 1)
+			var want [][]byte
+			for _, sh := range sorted {
+				if r := <-results[sh]; r.err != test.err || (r.err == nil && r.first != next) {
+					t.Errorf("Shard %d batch got (%d, %v), want (%d, %v)", sh, r.first, r.err, next, test.err)
+				}
+				next += uint64(sh + 1)
+				want = append(want, entries(sh)...)
+			}
+			if s.calls != 2 {
+				t.Errorf("Sequenced %d times, want 2", s.calls)
+			}
+			if test.err == nil {
+				if got := s.batches[1]; !slices.EqualFunc(got, want, slices.Equal) {
+					t.Errorf("Sequenced queued batches as %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkShardedPool(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("%d shards", shards), func(b *testing.B) {
+			s := &testSequencer{}
+			p := NewPool(256, time.Millisecond, s.sequence, WithShards(shards))
+			e := []byte("leaf")
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := p.Add(context.Background(), e); err != nil {
+						b.Errorf("Add: %v", err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "entries/s")
+		})
+	}
+}
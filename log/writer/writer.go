@@ -2,8 +2,16 @@ package writer
 
 import (
 	"context"
+	"math"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
 )
 
 type Batch struct {
@@ -15,15 +23,74 @@ type Batch struct {
 // Must not return successfully until the assigned sequence numbers are durably stored.
 type SequenceFunc func(context.Context, Batch) (uint64, error)
 
-func NewPool(bufferSize int, maxAge time.Duration, s SequenceFunc) *Pool {
-	return &Pool{
+// NewTreeFunc is the signature of a function which receives information about newly integrated trees.
+type NewTreeFunc func(size uint64, root []byte) error
+
+// CurrentTreeFunc is the signature of a function which retrieves the current integrated tree size and root hash.
+type CurrentTreeFunc func() (uint64, []byte, error)
+
+// PoolOption configures optional behaviour of a Pool.
+type PoolOption func(*Pool)
+
+// WithAdaptiveBatching causes the Pool to flush batches once they hold roughly as many entries as are
+// expected to arrive within target, based on the recent arrival rate, rather than waiting for them to
+// fill to bufferSize.
+// Under low load this flushes small batches promptly, while under high load the batches grow up to bufferSize.
+func WithAdaptiveBatching(target time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.target = target
+		p.effectiveSize = 1
+	}
+}
+
+// WithMaxBytes causes the Pool to flush batches once the total size of their entries reaches maxBytes, as well as
+// when they reach bufferSize entries.
+// A maxBytes of zero means that there is no limit.
+func WithMaxBytes(maxBytes int) PoolOption {
+	return func(p *Pool) {
+		p.maxBytes = maxBytes
+	}
+}
+
+// WithName labels the metrics exported by the Pool with the name of its log, see log.Params.Name.
+func WithName(name string) PoolOption {
+	return func(p *Pool) {
+		p.name = name
+	}
+}
+
+// WithClock causes the Pool to use c, rather than RealClock, to time the age of batches.
+func WithClock(c Clock) PoolOption {
+	return func(p *Pool) {
+		p.clock = c
+	}
+}
+
+func NewPool(bufferSize int, maxAge time.Duration, s SequenceFunc, opts ...PoolOption) *Pool {
+	p := &Pool{
 		current: &batch{
 			Done: make(chan struct{}),
 		},
-		bufferSize: bufferSize,
-		seq:        s,
-		maxAge:     maxAge,
+		bufferSize:    bufferSize,
+		effectiveSize: bufferSize,
+		seq:           s,
+		maxAge:        maxAge,
+		clock:         RealClock,
+	}
+	for _, o := range opts {
+		o(p)
 	}
+	if p.numShards > 1 {
+		m := &merger{seq: s}
+		// The shards are configured like the Pool itself, other than being unsharded.
+		shardOpts := append(slices.Clip(opts), WithShards(1))
+		for i := range p.numShards {
+			p.shards = append(p.shards, NewPool(bufferSize, maxAge, m.sequenceFunc(i), shardOpts...))
+		}
+	}
+	p.metrics = metricsFor(p.name)
+	p.metrics.batchEffectiveSize.Set(float64(p.effectiveSize))
+	return p
 }
 
 // Pool is a helper for adding entries to a log.
@@ -32,35 +99,197 @@ type Pool struct {
 	current    *batch
 	bufferSize int
 	maxAge     time.Duration
-	flushTimer *time.Timer
+	flushTimer Timer
+	clock      Clock
+
+	// name is the name of the log, which labels the metrics exported by the Pool.
+	name    string
+	metrics *metrics
+
+	// maxBytes, if non-zero, is the total size of entries at which a batch is flushed.
+	maxBytes int
+
+	// effectiveSize is the number of entries at which a batch is flushed, this is always bufferSize
+	// unless adaptive batching is enabled.
+	effectiveSize int
+	// target is the time within which adaptive batching aims to flush entries, or zero if disabled.
+	target time.Duration
+	// rate is the recent arrival rate of entries, in entries per second.
+	rate float64
+	// lastArrival is the time at which entries were most recently added.
+	lastArrival time.Time
+	// sequencing is the number of flushed batches which are being sequenced, when adaptive batching is enabled.
+	sequencing int
+
+	// inFlight tracks batches which have been flushed but not yet sequenced.
+	inFlight sync.WaitGroup
+
+	// stats summarises the batches flushed since FlushStats was last called.
+	stats FlushStats
+	// highWater is the size of the smallest tree containing every batch sequenced so far.
+	highWater uint64
+
+	// numShards is the number of shards configured by WithShards.
+	numShards int
+	// shards, if set, are the Pools to which entries are added in place of this one, in turn.
+	shards []*Pool
+	// nextShard counts the calls to add entries, choosing the shard to which they're added.
+	nextShard atomic.Uint64
 
 	seq SequenceFunc
 }
 
 // Add adds an entry to the tree.
 // Returns the assigned sequence number, or an error.
-func (p *Pool) Add(e []byte) (uint64, error) {
+//
+// If ctx is done before the entry's batch has been flushed, the entry is withdrawn and ctx's error is returned.
+func (p *Pool) Add(ctx context.Context, e []byte) (uint64, error) {
+	if sh := p.shard(); sh != nil {
+		return sh.Add(ctx, e)
+	}
 	p.Lock()
 	b := p.current
+	b.addSpan(ctx)
 	// If this is the first entry in a batch, set a flush timer so we attempt to sequence it within maxAge.
 	if len(b.Entries) == 0 {
-		p.flushTimer = time.AfterFunc(p.maxAge, func() {
+		b.start = p.clock.Now()
+		p.flushTimer = p.clock.AfterFunc(p.maxAge, func() {
 			p.Lock()
 			defer p.Unlock()
-			p.flushWithLock()
+			p.flushWithLock(FlushAge)
 		})
 	}
-	n := b.Add(e)
+	i := b.Add(e)
+	p.arrived(1)
 	// If the batch is full, then attempt to sequence it immediately.
-	if n >= p.bufferSize {
-		p.flushWithLock()
+	if r := p.full(b.live); r != "" {
+		p.flushWithLock(r)
+	}
+	p.Unlock()
+	if err := p.wait(ctx, b, i, 1); err != nil {
+		return 0, err
+	}
+	return b.index(i), b.Err
+}
+
+// AddBatch adds all of the provided entries to the tree.
+// The entries are guaranteed to be assigned a contiguous run of sequence numbers, in the order given.
+// Returns the assigned sequence numbers, or an error.
+//
+// If ctx is done before the entries' batch has been flushed, all of the entries are withdrawn and ctx's error
+// is returned.
+func (p *Pool) AddBatch(ctx context.Context, es [][]byte) ([]uint64, error) {
+	if len(es) == 0 {
+		return nil, nil
+	}
+	if sh := p.shard(); sh != nil {
+		return sh.AddBatch(ctx, es)
+	}
+	p.Lock()
+	b := p.current
+	b.addSpan(ctx)
+	// If this is the first entry in a batch, set a flush timer so we attempt to sequence it within maxAge.
+	if len(b.Entries) == 0 {
+		b.start = p.clock.Now()
+		p.flushTimer = p.clock.AfterFunc(p.maxAge, func() {
+			p.Lock()
+			defer p.Unlock()
+			p.flushWithLock(FlushAge)
+		})
+	}
+	first := len(b.Entries)
+	for _, e := range es {
+		b.Add(e)
+	}
+	p.arrived(len(es))
+	// If the batch is full, then attempt to sequence it immediately.
+	if r := p.full(b.live); r != "" {
+		p.flushWithLock(r)
 	}
 	p.Unlock()
-	<-b.Done
-	return b.FirstSeq + uint64(n), b.Err
+	if err := p.wait(ctx, b, first, len(es)); err != nil {
+		return nil, err
+	}
+	if b.Err != nil {
+		return nil, b.Err
+	}
+	r := make([]uint64, len(es))
+	for i := range r {
+		r[i] = b.index(first + i)
+	}
+	return r, nil
+}
+
+// wait blocks until the batch b has been sequenced, or ctx is done.
+// If ctx is done before b has been flushed, the n entries starting at index i are withdrawn from b so that they
+// will never be sequenced, and ctx's error is returned.
+// Once b has been flushed its entries can no longer be withdrawn, so wait continues to block until b has been
+// sequenced, ensuring that an entry is never committed without its caller learning its sequence number.
+func (p *Pool) wait(ctx context.Context, b *batch, i, n int) error {
+	select {
+	case <-b.Done:
+		return nil
+	case <-ctx.Done():
+	}
+	p.Lock()
+	if b != p.current {
+		p.Unlock()
+		<-b.Done
+		return nil
+	}
+	b.withdraw(i, n)
+	p.metrics.entriesWithdrawn.Add(float64(n))
+	// If nothing is left in the batch there's no point in flushing it, so start afresh.
+	if b.live == 0 {
+		p.flushTimer.Stop()
+		p.flushTimer = nil
+		p.current = &batch{
+			Done: make(chan struct{}),
+		}
+	}
+	p.Unlock()
+	return ctx.Err()
+}
+
+// rateWindow is the time constant over which the arrival rate is averaged for adaptive batching.
+const rateWindow = time.Second
+
+// arrived updates the arrival rate estimate, and the effective batch size derived from it, when adaptive
+// batching is enabled.
+// Must be called with the lock held.
+func (p *Pool) arrived(n int) {
+	if p.target == 0 {
+		return
+	}
+	now := p.clock.Now()
+	// Exponentially decay the previous estimate according to the time since the last arrival.
+	p.rate = p.rate*math.Exp(-now.Sub(p.lastArrival).Seconds()/rateWindow.Seconds()) + float64(n)/rateWindow.Seconds()
+	p.lastArrival = now
+	p.effectiveSize = min(max(int(p.rate*p.target.Seconds()), 1), p.bufferSize)
+	p.metrics.batchEffectiveSize.Set(float64(p.effectiveSize))
+}
+
+// full returns the reason for which the current batch, containing n entries, should be flushed now, or
+// the empty string if it should not.
+// Must be called with the lock held.
+func (p *Pool) full(n int) FlushReason {
+	if n >= p.bufferSize {
+		return FlushSize
+	}
+	if p.maxBytes > 0 && p.current.bytes >= p.maxBytes {
+		return FlushBytes
+	}
+	// With adaptive batching, entries continue to accumulate while a previous batch is being sequenced,
+	// since flushing more small batches would just queue them up behind it.
+	if n >= p.effectiveSize && p.sequencing == 0 {
+		return FlushSize
+	}
+	return ""
 }
 
-func (p *Pool) flushWithLock() {
+// flushWithLock flushes the current batch for the given reason.
+// Must be called with the lock held.
+func (p *Pool) flushWithLock(reason FlushReason) {
 	// timer can be nil if a batch was flushed because it because full at about the same time as it hit maxAge.
 	// In this case we can just return.
 	if p.flushTimer == nil {
@@ -72,20 +301,223 @@ func (p *Pool) flushWithLock() {
 	p.current = &batch{
 		Done: make(chan struct{}),
 	}
+	b.compact()
+	age := p.clock.Now().Sub(b.start)
+	p.metrics.batchFlushes.WithLabelValues(string(reason)).Inc()
+	p.metrics.batchAge.Observe(age.Seconds())
+	if p.stats.Flushes == nil {
+		p.stats.Flushes = make(map[FlushReason]int)
+	}
+	p.stats.Flushes[reason]++
+	p.stats.MaxAge = max(p.stats.MaxAge, age)
+	klog.V(1).Infof("Flushing batch of %d entries, oldest %v ago, due to %s", len(b.Entries), age, reason)
+	p.metrics.batchFillRatio.Observe(float64(len(b.Entries)) / float64(p.bufferSize))
+	p.inFlight.Add(1)
+	if p.target > 0 {
+		p.sequencing++
+	}
 	go func() {
-		b.FirstSeq, b.Err = p.seq(context.TODO(), Batch{Entries: b.Entries})
+		defer p.inFlight.Done()
+		if p.target > 0 {
+			defer p.sequenced()
+		}
+		ctx, span := b.startSpan()
+		b.FirstSeq, b.Err = p.seq(ctx, Batch{Entries: b.Entries})
+		if b.Err == nil {
+			p.metrics.entriesSequenced.Add(float64(len(b.Entries)))
+			p.Lock()
+			p.highWater = max(p.highWater, b.FirstSeq+uint64(len(b.Entries)))
+			p.Unlock()
+			span.SetAttributes(attribute.Int64("betty.first_index", int64(b.FirstSeq)))
+		} else {
+			p.metrics.batchFailures.Inc()
+			klog.Errorf("Failed to sequence batch of %d entries: %v", len(b.Entries), b.Err)
+			span.RecordError(b.Err)
+			span.SetStatus(codes.Error, b.Err.Error())
+		}
+		span.End()
 		close(b.Done)
 	}()
 }
 
+// sequenced is called when adaptive batching is enabled, once a flushed batch has been sequenced, to flush
+// any entries which have accumulated in the meantime.
+func (p *Pool) sequenced() {
+	p.Lock()
+	defer p.Unlock()
+	p.sequencing--
+	if p.sequencing == 0 && p.current.live > 0 {
+		if r := p.full(p.current.live); r != "" {
+			p.flushWithLock(r)
+		}
+	}
+}
+
+// Flush immediately sequences any pending entries, and waits until all flushed batches
+// have been sequenced or the context is done.
+func (p *Pool) Flush(ctx context.Context) error {
+	for _, sh := range p.shards {
+		if err := sh.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	p.Lock()
+	p.flushWithLock(FlushRequested)
+	p.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// FlushReason describes why a batch was flushed for sequencing.
+type FlushReason string
+
+const (
+	// FlushSize means the batch held as many entries as it's allowed to.
+	FlushSize FlushReason = "size"
+	// FlushBytes means the total size of the batch's entries reached the limit set by WithMaxBytes.
+	FlushBytes FlushReason = "bytes"
+	// FlushAge means the batch's oldest entry had been waiting for maxAge.
+	FlushAge FlushReason = "age"
+	// FlushRequested means the batch was flushed by a call to Flush.
+	FlushRequested FlushReason = "requested"
+)
+
+// FlushStats summarises the batches flushed by a Pool over an interval.
+type FlushStats struct {
+	// Flushes counts the batches flushed for each reason.
+	Flushes map[FlushReason]int
+	// MaxAge is the greatest age of the oldest entry in a batch when it was flushed.
+	MaxAge time.Duration
+}
+
+// FlushStats returns a summary of the batches flushed since the previous call, and resets it.
+func (p *Pool) FlushStats() FlushStats {
+	p.Lock()
+	r := p.stats
+	p.stats = FlushStats{}
+	p.Unlock()
+	for _, sh := range p.shards {
+		s := sh.FlushStats()
+		for k, v := range s.Flushes {
+			if r.Flushes == nil {
+				r.Flushes = make(map[FlushReason]int)
+			}
+			r.Flushes[k] += v
+		}
+		r.MaxAge = max(r.MaxAge, s.MaxAge)
+	}
+	return r
+}
+
+// SequencedSize returns the size of the smallest tree containing every entry sequenced by this Pool so far, or zero
+// if none has been sequenced yet.
+// The gap between this and the size of the published checkpoint shows how far integration is lagging sequencing.
+func (p *Pool) SequencedSize() uint64 {
+	p.Lock()
+	r := p.highWater
+	p.Unlock()
+	for _, sh := range p.shards {
+		r = max(r, sh.SequencedSize())
+	}
+	return r
+}
+
 type batch struct {
 	Entries  [][]byte
 	Done     chan struct{}
 	FirstSeq uint64
 	Err      error
+
+	// bytes is the total size of the entries in the batch.
+	bytes int
+	// start is the time at which the first entry was added to the batch.
+	start time.Time
+	// live is the number of entries in the batch which have not been withdrawn.
+	live int
+	// withdrawn flags the entries which have been withdrawn by their callers, or is nil if there are none.
+	withdrawn []bool
+	// pos maps the index at which an entry was added to its position in the compacted batch, or is nil if no
+	// entries were withdrawn.
+	pos []int
+
+	// spans holds the span contexts of the callers which added entries to this batch.
+	spans []trace.SpanContext
 }
 
+// addSpan records the span, if any, of a caller adding entries to the batch.
+func (b *batch) addSpan(ctx context.Context) {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		b.spans = append(b.spans, sc)
+	}
+}
+
+// startSpan starts a span covering the sequencing of the batch.
+// Since a batch is shared between callers, the span is parented by the first caller's span and is
+// linked to those of all the other callers.
+func (b *batch) startSpan() (context.Context, trace.Span) {
+	ctx := context.Background()
+	opts := []trace.SpanStartOption{trace.WithAttributes(attribute.Int("betty.batch_size", len(b.Entries)))}
+	if len(b.spans) > 0 {
+		ctx = trace.ContextWithSpanContext(ctx, b.spans[0])
+		for _, sc := range b.spans[1:] {
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+		}
+	}
+	return tracer.Start(ctx, "writer.SequenceBatch", opts...)
+}
+
+// Add adds an entry to the batch, and returns its index.
 func (b *batch) Add(e []byte) int {
 	b.Entries = append(b.Entries, e)
-	return len(b.Entries)
+	b.bytes += len(e)
+	b.live++
+	return len(b.Entries) - 1
+}
+
+// withdraw marks the n entries starting at index i as withdrawn, so that they are dropped when the batch is flushed.
+func (b *batch) withdraw(i, n int) {
+	if len(b.withdrawn) < len(b.Entries) {
+		b.withdrawn = append(b.withdrawn, make([]bool, len(b.Entries)-len(b.withdrawn))...)
+	}
+	for j := i; j < i+n; j++ {
+		b.withdrawn[j] = true
+		b.bytes -= len(b.Entries[j])
+	}
+	b.live -= n
+}
+
+// compact removes any withdrawn entries from the batch, recording where the remaining entries end up.
+// Must be called before the batch is sequenced.
+func (b *batch) compact() {
+	if b.withdrawn == nil {
+		return
+	}
+	b.pos = make([]int, len(b.Entries))
+	es := make([][]byte, 0, b.live)
+	for i, e := range b.Entries {
+		if i < len(b.withdrawn) && b.withdrawn[i] {
+			continue
+		}
+		b.pos[i] = len(es)
+		es = append(es, e)
+	}
+	b.Entries = es
+}
+
+// index returns the sequence number assigned to the entry which was added at index i.
+func (b *batch) index(i int) uint64 {
+	if b.pos != nil {
+		return b.FirstSeq + uint64(b.pos[i])
+	}
+	return b.FirstSeq + uint64(i)
 }
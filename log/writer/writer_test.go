@@ -0,0 +1,486 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testSequencer records the batches it's asked to sequence, assigning them consecutive indices.
+type testSequencer struct {
+	mu      sync.Mutex
+	size    uint64
+	batches [][][]byte
+	// flushed counts the entries in the batches received so far.
+	flushed int
+}
+
+func (s *testSequencer) sequence(_ context.Context, b Batch) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.size
+	s.size += uint64(len(b.Entries))
+	s.batches = append(s.batches, b.Entries)
+	s.flushed += len(b.Entries)
+	return seq, nil
+}
+
+// batchSizes returns the number of entries in each of the batches sequenced so far.
+func (s *testSequencer) batchSizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r []int
+	for _, b := range s.batches {
+		r = append(r, len(b))
+	}
+	return r
+}
+
+// added returns the number of entries which have been added to p, whether they're still in its current batch or have
+// been sequenced by s.
+func (s *testSequencer) added(p *Pool) int {
+	p.Lock()
+	n := len(p.current.Entries)
+	p.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return n + s.flushed
+}
+
+// addInTurn adds each of the entries to p in its own goroutine, waiting for each to reach p before adding the next so
+// that they're batched in order, and returns a func which waits for them all to be sequenced.
+func addInTurn(t *testing.T, p *Pool, s *testSequencer, entries [][]byte) func() {
+	t.Helper()
+	var wg sync.WaitGroup
+	start := s.added(p)
+	for i, e := range entries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Add(context.Background(), e); err != nil {
+				t.Errorf("Add: %v", err)
+			}
+		}()
+		for deadline := time.Now().Add(5 * time.Second); s.added(p) < start+i+1; {
+			if time.Now().After(deadline) {
+				t.Fatalf("Entry %d wasn't added", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return wg.Wait
+}
+
+// flushCount returns the number of batches flushed so far for the given reason, according to the metrics.
+func flushCount(t *testing.T, r FlushReason) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metricsFor("").batchFlushes.WithLabelValues(string(r)).Write(&m); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestPoolFlushReason(t *testing.T) {
+	reasons := []FlushReason{FlushSize, FlushBytes, FlushAge, FlushRequested}
+	for _, test := range []struct {
+		name     string
+		maxBytes int
+		// before entries are added, then the clock is advanced, then after entries are added, and finally the
+		// pool is flushed if flush is set.
+		before, after int
+		advance       time.Duration
+		flush         bool
+		want          map[FlushReason]int
+		wantMaxAge    time.Duration
+	}{
+		{name: "size", before: 3, advance: 300 * time.Millisecond, after: 1, want: map[FlushReason]int{FlushSize: 1}, wantMaxAge: 300 * time.Millisecond},
+		{name: "bytes", maxBytes: 20, before: 1, advance: 200 * time.Millisecond, after: 1, want: map[FlushReason]int{FlushBytes: 1}, wantMaxAge: 200 * time.Millisecond},
+		{name: "age", before: 2, advance: time.Second, want: map[FlushReason]int{FlushAge: 1}, wantMaxAge: time.Second},
+		{name: "requested", before: 2, advance: 500 * time.Millisecond, flush: true, want: map[FlushReason]int{FlushRequested: 1}, wantMaxAge: 500 * time.Millisecond},
+		{name: "size then age", before: 5, advance: time.Second, want: map[FlushReason]int{FlushSize: 1, FlushAge: 1}, wantMaxAge: time.Second},
+		{name: "nothing flushed", before: 2, advance: 500 * time.Millisecond},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testSequencer{}
+			c := NewFakeClock(time.Now())
+			p := NewPool(4, time.Second, s.sequence, WithMaxBytes(test.maxBytes), WithClock(c))
+			before := make(map[FlushReason]float64)
+			for _, r := range reasons {
+				before[r] = flushCount(t, r)
+			}
+			entries := make([][]byte, test.before+test.after)
+			for i := range entries {
+				entries[i] = bytes.Repeat([]byte{byte(i)}, 10)
+			}
+			wait := addInTurn(t, p, s, entries[:test.before])
+			c.Advance(test.advance)
+			waitAfter := addInTurn(t, p, s, entries[test.before:])
+			if test.flush {
+				if err := p.Flush(context.Background()); err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+			}
+			if len(test.want) > 0 {
+				wait()
+				waitAfter()
+			}
+
+			got := p.FlushStats()
+			for _, r := range reasons {
+				if got.Flushes[r] != test.want[r] {
+					t.Errorf("Got %d flushes due to %s, want %d", got.Flushes[r], r, test.want[r])
+				}
+				if d := flushCount(t, r) - before[r]; d != float64(test.want[r]) {
+					t.Errorf("Flushes due to %s metric increased by %v, want %d", r, d, test.want[r])
+				}
+			}
+			if got.MaxAge != test.wantMaxAge {
+				t.Errorf("Got max age %v, want %v", got.MaxAge, test.wantMaxAge)
+			}
+			// The stats are reset once they've been read.
+			if got := p.FlushStats(); len(got.Flushes) != 0 || got.MaxAge != 0 {
+				t.Errorf("Got %+v once the stats were reset, want none", got)
+			}
+			if len(test.want) == 0 {
+				// Release the entries which are still waiting.
+				if err := p.Flush(context.Background()); err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+				wait()
+			}
+		})
+	}
+}
+
+func TestPoolFlushPending(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		pending int
+		want    []int
+	}{
+		{name: "nothing pending", pending: 0, want: nil},
+		{name: "one entry", pending: 1, want: []int{1}},
+		{name: "just under the buffer size", pending: 3, want: []int{3}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testSequencer{}
+			// Batches are never flushed by age, since the clock isn't advanced.
+			p := NewPool(4, time.Second, s.sequence, WithClock(NewFakeClock(time.Now())))
+			entries := make([][]byte, test.pending)
+			for i := range entries {
+				entries[i] = []byte{byte(i)}
+			}
+			wait := addInTurn(t, p, s, entries)
+			if err := p.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			// The entries have been sequenced by the time Flush returns.
+			if got := s.batchSizes(); !slices.Equal(got, test.want) {
+				t.Errorf("Got batches of %v entries, want %v", got, test.want)
+			}
+			wait()
+		})
+	}
+}
+
+func TestPoolFlushCancelled(t *testing.T) {
+	started, block := make(chan struct{}), make(chan struct{})
+	defer close(block)
+	p := NewPool(1, time.Hour, func(context.Context, Batch) (uint64, error) {
+		close(started)
+		<-block
+		return 0, nil
+	})
+	// The entry fills the batch, so is flushed as soon as it's added, and stays in flight until the test ends.
+	go func() { _, _ = p.Add(context.Background(), []byte("stuck")) }()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Flush with a batch in flight: got %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestPoolAdaptiveBatching(t *testing.T) {
+	type phase struct {
+		// n entries are added, with interval between each of them.
+		n        int
+		interval time.Duration
+		// wantSize is the effective batch size once the entries have been added.
+		wantSize int
+	}
+	for _, test := range []struct {
+		name   string
+		phases []phase
+	}{
+		{name: "quiet", phases: []phase{{n: 5, interval: 100 * time.Millisecond, wantSize: 1}}},
+		{name: "burst", phases: []phase{{n: 500, wantSize: 32}}},
+		{name: "quiet then burst", phases: []phase{{n: 5, interval: 100 * time.Millisecond, wantSize: 1}, {n: 500, wantSize: 32}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testSequencer{}
+			// Batches aim to be flushed within 100ms, so hold as many entries as arrive in that time.
+			p := NewPool(32, time.Minute, s.sequence, WithAdaptiveBatching(100*time.Millisecond))
+			total := 0
+			for _, ph := range test.phases {
+				flushed := len(s.batchSizes())
+				entries := make([][]byte, ph.n)
+				for i := range entries {
+					entries[i] = []byte{byte(i)}
+				}
+				total += ph.n
+				if ph.interval == 0 {
+					wait := addInTurn(t, p, s, entries)
+					if err := p.Flush(context.Background()); err != nil {
+						t.Fatalf("Flush: %v", err)
+					}
+					wait()
+					// The batches grew as the entries arrived.
+					if got := slices.Max(s.batchSizes()[flushed:]); got < ph.wantSize {
+						t.Errorf("Got largest batch of %d entries, want at least %d", got, ph.wantSize)
+					}
+				} else {
+					for _, e := range entries {
+						time.Sleep(ph.interval)
+						// Each entry is flushed without waiting for the batch to age, or for more entries to arrive.
+						if _, err := p.Add(context.Background(), e); err != nil {
+							t.Fatalf("Add: %v", err)
+						}
+					}
+				}
+				p.Lock()
+				got := p.effectiveSize
+				p.Unlock()
+				if got != ph.wantSize {
+					t.Errorf("Got effective batch size %d, want %d", got, ph.wantSize)
+				}
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.flushed != total {
+				t.Errorf("Sequenced %d entries, want %d", s.flushed, total)
+			}
+		})
+	}
+}
+
+func TestPoolMaxBytes(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		maxBytes  int
+		entrySize int
+		want      []int
+	}{
+		{name: "no limit", maxBytes: 0, entrySize: 60, want: []int{4, 4}},
+		{name: "small entries", maxBytes: 100, entrySize: 10, want: []int{4, 4}},
+		{name: "reaching limit", maxBytes: 100, entrySize: 50, want: []int{2, 2, 2, 2}},
+		{name: "beyond limit", maxBytes: 100, entrySize: 60, want: []int{2, 2, 2, 2}},
+		{name: "large entries", maxBytes: 100, entrySize: 200, want: []int{1, 1, 1, 1, 1, 1, 1, 1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testSequencer{}
+			// Batches are never flushed by age, since the clock isn't advanced.
+			p := NewPool(4, time.Second, s.sequence, WithMaxBytes(test.maxBytes), WithClock(NewFakeClock(time.Now())))
+			entries := make([][]byte, 8)
+			for i := range entries {
+				entries[i] = bytes.Repeat([]byte{byte(i)}, test.entrySize)
+			}
+			wait := addInTurn(t, p, s, entries)
+			if err := p.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			wait()
+			if got := s.batchSizes(); !slices.Equal(got, test.want) {
+				t.Errorf("Got batches of %v entries, want %v", got, test.want)
+			}
+			if got := p.FlushStats().Flushes[FlushRequested]; got != 0 {
+				t.Errorf("Got %d requested flushes, want none", got)
+			}
+		})
+	}
+}
+
+func TestPoolSequencedSize(t *testing.T) {
+	type step struct {
+		// n entries are added in a single batch, whose sequencing fails if fail is set.
+		n    int
+		fail bool
+	}
+	for _, test := range []struct {
+		name   string
+		shards int
+		steps  []step
+		want   uint64
+	}{
+		{name: "nothing sequenced", want: 0},
+		{name: "one batch", steps: []step{{n: 4}}, want: 4},
+		{name: "several batches", steps: []step{{n: 4}, {n: 6}, {n: 4}}, want: 14},
+		{name: "failed batch", steps: []step{{n: 4, fail: true}}, want: 0},
+		{name: "failure after success", steps: []step{{n: 4}, {n: 5, fail: true}}, want: 4},
+		{name: "success after failure", steps: []step{{n: 4}, {n: 5, fail: true}, {n: 4}}, want: 8},
+		{name: "sharded", shards: 3, steps: []step{{n: 4}, {n: 4}, {n: 4}, {n: 4}}, want: 16},
+		{name: "sharded with failure", shards: 2, steps: []step{{n: 4}, {n: 4, fail: true}, {n: 4}}, want: 8},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testSequencer{}
+			var mu sync.Mutex
+			fail := false
+			seq := func(ctx context.Context, b Batch) (uint64, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if fail {
+					return 0, errors.New("failed")
+				}
+				return s.sequence(ctx, b)
+			}
+			p := NewPool(4, time.Second, seq, WithShards(test.shards), WithClock(NewFakeClock(time.Now())))
+			for i, st := range test.steps {
+				mu.Lock()
+				fail = st.fail
+				mu.Unlock()
+				// The batches are large enough to be flushed as soon as they're added.
+				_, err := p.AddBatch(context.Background(), testLeaves(0, st.n))
+				if (err != nil) != st.fail {
+					t.Fatalf("AddBatch %d = %v, want error: %t", i, err, st.fail)
+				}
+			}
+			if got := p.SequencedSize(); got != test.want {
+				t.Errorf("SequencedSize() = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPoolAddCancelled(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// entries are added in turn, and those at the indices in cancel have their contexts cancelled before the
+		// batch is flushed.
+		entries []string
+		cancel  []int
+		want    []string
+	}{
+		{name: "only entry", entries: []string{"a"}, cancel: []int{0}, want: nil},
+		{name: "first entry", entries: []string{"a", "b", "c"}, cancel: []int{0}, want: []string{"b", "c"}},
+		{name: "middle entry", entries: []string{"a", "b", "c"}, cancel: []int{1}, want: []string{"a", "c"}},
+		{name: "all entries", entries: []string{"a", "b", "c"}, cancel: []int{0, 1, 2}, want: nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testSequencer{}
+			// Batches are never flushed by age, since the clock isn't advanced.
+			p := NewPool(4, time.Second, s.sequence, WithClock(NewFakeClock(time.Now())))
+			type result struct {
+				idx uint64
+				err error
+			}
+			results := make([]chan result, len(test.entries))
+			cancels := make([]context.CancelFunc, len(test.entries))
+			for i, e := range test.entries {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				results[i], cancels[i] = make(chan result, 1), cancel
+				go func() {
+					idx, err := p.Add(ctx, []byte(e))
+					results[i] <- result{idx, err}
+				}()
+				for deadline := time.Now().Add(5 * time.Second); s.added(p) < i+1; time.Sleep(time.Millisecond) {
+					if time.Now().After(deadline) {
+						t.Fatalf("Entry %d wasn't added", i)
+					}
+				}
+			}
+			// Cancelled callers return without waiting for the batch to be flushed.
+			for _, i := range test.cancel {
+				cancels[i]()
+				select {
+				case r := <-results[i]:
+					if !errors.Is(r.err, context.Canceled) {
+						t.Errorf("Cancelled Add(%q) = (%d, %v), want context.Canceled", test.entries[i], r.idx, r.err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Cancelled Add(%q) didn't return", test.entries[i])
+				}
+			}
+			if err := p.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			// Only the entries which weren't withdrawn are sequenced, at consecutive indices.
+			var got []string
+			for _, b := range s.batches {
+				for _, e := range b {
+					got = append(got, string(e))
+				}
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("Sequenced %q, want %q", got, test.want)
+			}
+			next := uint64(0)
+			for i, e := range test.entries {
+				if slices.Contains(test.cancel, i) {
+					continue
+				}
+				if r := <-results[i]; r.err != nil || r.idx != next {
+					t.Errorf("Add(%q) = (%d, %v), want (%d, nil)", e, r.idx, r.err, next)
+				}
+				next++
+			}
+		})
+	}
+}
+
+func TestPoolAddDeadline(t *testing.T) {
+	s := &testSequencer{}
+	// The batch is never flushed by age, since the clock isn't advanced, so the caller's deadline passes first.
+	p := NewPool(4, time.Second, s.sequence, WithClock(NewFakeClock(time.Now())))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.AddBatch(ctx, [][]byte{[]byte("a"), []byte("b")}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("AddBatch = %v, want context.DeadlineExceeded", err)
+	}
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got := s.batchSizes(); len(got) != 0 {
+		t.Errorf("Sequenced batches of %v entries after the deadline passed, want none", got)
+	}
+}
+
+func TestPoolAddCancelledAfterFlush(t *testing.T) {
+	// The sequencer doesn't return until released, so the batch is flushed but not yet sequenced.
+	entered, release := make(chan struct{}), make(chan struct{})
+	s := &testSequencer{}
+	p := NewPool(1, time.Second, func(ctx context.Context, b Batch) (uint64, error) {
+		close(entered)
+		<-release
+		return s.sequence(ctx, b)
+	}, WithClock(NewFakeClock(time.Now())))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.Add(ctx, []byte("a"))
+		done <- err
+	}()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Entry wasn't flushed")
+	}
+	// Once flushed, the entry can't be withdrawn, so the caller must wait to learn its index.
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("Add returned %v before its flushed entry was sequenced", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Add = %v, want nil once sequenced", err)
+	}
+}
@@ -0,0 +1,534 @@
+// Package azblob provides a log storage implementation on Azure Blob Storage.
+package azblob
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/AlCutter/betty/storage/retry"
+	"github.com/AlCutter/betty/storage/tilecompress"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/transparency-dev/serverless-log/api"
+	"github.com/transparency-dev/serverless-log/api/layout"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/klog/v2"
+)
+
+var tracer = otel.Tracer("github.com/AlCutter/betty/storage/azblob")
+
+const (
+	// lockTTL is the age after which a lock blob is considered to have been abandoned by its owner.
+	lockTTL = time.Minute
+	// lockRetryInterval is the period between attempts to acquire a held lock.
+	lockRetryInterval = 10 * time.Millisecond
+)
+
+// Storage implements storage functions on top of an Azure Blob Storage container.
+// Blobs are stored using the same layout as the POSIX storage uses on disk, rooted at the
+// configured prefix.
+type Storage struct {
+	sync.Mutex
+	params log.Params
+	client *container.Client
+	prefix string
+	pool   *writer.Pool
+
+	curTree writer.CurrentTreeFunc
+	newTree writer.NewTreeFunc
+
+	curSize uint64
+
+	// tileCache, if set, caches tiles read from storage.
+	tileCache *reader.TileCache
+	// compressTiles is set if tiles should be compressed as they're written.
+	compressTiles bool
+	// writes bounds the number of blobs written concurrently while integrating a batch, each write holding a
+	// slot in the channel's buffer.
+	writes chan struct{}
+	// writeRetry is the policy with which writes which fail transiently are retried.
+	writeRetry retry.Policy
+
+	// readOnly is set if the log may only be read.
+	readOnly bool
+
+	// lease, if set, fences the log so that only this writer may add entries.
+	lease *writer.Lease
+	// leaseDone is closed to stop the lease from being renewed.
+	leaseDone chan struct{}
+}
+
+// Option configures optional behaviour of the storage.
+type Option func(*Storage)
+
+// WithTileCache causes up to size of the most recently used tiles to be cached in memory.
+func WithTileCache(size int) Option {
+	return func(s *Storage) {
+		s.tileCache = reader.NewTileCache(s.params, size)
+	}
+}
+
+// WithTileCompression causes tiles to be compressed with zstd as they're written.
+// Compressed and uncompressed tiles are both readable regardless of this option, so it may be
+// enabled or disabled for an existing log.
+func WithTileCompression() Option {
+	return func(s *Storage) {
+		s.compressTiles = true
+	}
+}
+
+// WithWriteConcurrency causes up to n of the entry bundle and tile blobs written while integrating a batch to be
+// written concurrently, rather than runtime.GOMAXPROCS(0). n must be positive.
+// Since each write is a round trip to Azure Blob Storage, integrating large batches is largely bound by this limit,
+// which should be raised as far as the service's rate limits allow.
+func WithWriteConcurrency(n int) Option {
+	return func(s *Storage) {
+		s.writes = make(chan struct{}, n)
+	}
+}
+
+// WithWriteRetries causes writes which fail transiently, e.g. because Azure Blob Storage throttled them, to be retried
+// according to p rather than retry.DefaultPolicy.
+func WithWriteRetries(p retry.Policy) Option {
+	return func(s *Storage) {
+		s.writeRetry = p
+	}
+}
+
+// WithReadOnly opens the log for reading only, so that additional instances can serve reads from a log
+// written by another: no writer lease is taken, nothing is written to storage, and attempts to sequence
+// entries fail with writer.ErrReadOnly.
+func WithReadOnly() Option {
+	return func(s *Storage) {
+		s.readOnly = true
+	}
+}
+
+// New creates a new Azure Blob Storage storage, storing the log in the container accessed via client.
+func New(ctx context.Context, client *container.Client, prefix string, params log.Params, batchMaxAge time.Duration, curTree writer.CurrentTreeFunc, newTree writer.NewTreeFunc, opts ...Option) (*Storage, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	curSize, _, err := curTree()
+	if err != nil {
+		return nil, err
+	}
+	r := &Storage{
+		client:     client,
+		prefix:     prefix,
+		params:     params,
+		curSize:    curSize,
+		writes:     make(chan struct{}, runtime.GOMAXPROCS(0)),
+		writeRetry: retry.DefaultPolicy,
+		curTree:    curTree,
+		newTree:    newTree,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	if err := r.checkMetadata(ctx); err != nil {
+		return nil, err
+	}
+	if r.readOnly {
+		return r, nil
+	}
+	if err := r.acquireLease(ctx); err != nil {
+		return nil, err
+	}
+	r.pool = writer.NewPool(params.EntryBundleSize, batchMaxAge, r.sequenceBatch, writer.WithMaxBytes(params.BundleMaxBytes), writer.WithName(params.Name))
+
+	return r, nil
+}
+
+// checkMetadata ensures that the log's persisted metadata is compatible with the configured params,
+// persisting it if this is a new log.
+func (s *Storage) checkMetadata(ctx context.Context) error {
+	p := path.Join(s.prefix, log.MetadataPath)
+	m, err := readBlob(ctx, s.client, p)
+	if errors.Is(err, os.ErrNotExist) {
+		if s.readOnly {
+			// Nothing to check against, and we mustn't write to the log.
+			return nil
+		}
+		m, err := s.params.MarshalMetadata()
+		if err != nil {
+			return fmt.Errorf("failed to marshal log metadata: %v", err)
+		}
+		return writeBlob(ctx, s.client, p, m)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read log metadata: %w", err)
+	}
+	return s.params.CheckMetadata(m)
+}
+
+// ReadMetadata returns the log's persisted metadata, see log.Metadata.
+// If the log has none, the returned error will satisfy errors.Is(err, os.ErrNotExist).
+func (s *Storage) ReadMetadata(ctx context.Context) ([]byte, error) {
+	return readBlob(ctx, s.client, path.Join(s.prefix, log.MetadataPath))
+}
+
+// lockCP acquires the lock blob for the checkpoint.
+//
+// The lock is taken by creating the `checkpoint.lock` blob with a conditional PUT (If-None-Match: *),
+// so only one writer can hold it at a time. Lock blobs which have been held for longer than lockTTL
+// are assumed to have been abandoned, and are removed.
+func (s *Storage) lockCP(ctx context.Context) error {
+	name := path.Join(s.prefix, layout.CheckpointPath+".lock")
+	for {
+		_, err := s.client.NewBlockBlobClient(name).UploadBuffer(ctx, nil, &blockblob.UploadBufferOptions{
+			AccessConditions: &blob.AccessConditions{
+				ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: to.Ptr(azcore.ETagAny)},
+			},
+		})
+		if err == nil {
+			return nil
+		}
+		if !isPreconditionFailed(err) {
+			return fmt.Errorf("failed to create lock blob: %w", err)
+		}
+		if p, err := s.client.NewBlobClient(name).GetProperties(ctx, nil); err == nil && p.LastModified != nil && time.Since(*p.LastModified) > lockTTL {
+			klog.Warningf("Breaking stale lock last modified at %v", *p.LastModified)
+			if err := s.unlockCP(ctx); err != nil {
+				klog.Warningf("Failed to remove stale lock: %v", err)
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// unlockCP releases the lock blob.
+func (s *Storage) unlockCP(ctx context.Context) error {
+	_, err := s.client.NewBlobClient(path.Join(s.prefix, layout.CheckpointPath+".lock")).Delete(ctx, nil)
+	return err
+}
+
+// Sequence commits to sequence numbers for an entry
+// Returns the sequence number assigned to the first entry in the batch, or an error.
+func (s *Storage) Sequence(ctx context.Context, b []byte) (uint64, error) {
+	ctx, span := tracer.Start(ctx, "azblob.Sequence")
+	defer span.End()
+	if s.readOnly {
+		return 0, writer.ErrReadOnly
+	}
+	seq, err := s.pool.Add(ctx, b)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	span.SetAttributes(attribute.Int64("betty.index", int64(seq)))
+	return seq, nil
+}
+
+// SequenceBatch commits to a contiguous run of sequence numbers for the provided entries.
+// Returns the sequence numbers assigned to the entries, in the same order, or an error.
+func (s *Storage) SequenceBatch(ctx context.Context, b [][]byte) ([]uint64, error) {
+	ctx, span := tracer.Start(ctx, "azblob.SequenceBatch", trace.WithAttributes(attribute.Int("betty.batch_size", len(b))))
+	defer span.End()
+	if s.readOnly {
+		return nil, writer.ErrReadOnly
+	}
+	seqs, err := s.pool.AddBatch(ctx, b)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		span.SetAttributes(
+			attribute.Int64("betty.first_index", int64(seqs[0])),
+			attribute.Int64("betty.last_index", int64(seqs[len(seqs)-1])))
+	}
+	return seqs, nil
+}
+
+// Close sequences and integrates any pending entries, returning once they're committed.
+func (s *Storage) Close(ctx context.Context) error {
+	if s.readOnly {
+		return nil
+	}
+	if err := s.pool.Flush(ctx); err != nil {
+		return err
+	}
+	return s.releaseLease(ctx)
+}
+
+// FlushStats returns a summary of the batches flushed for sequencing since the previous call.
+func (s *Storage) FlushStats() writer.FlushStats {
+	if s.readOnly {
+		return writer.FlushStats{}
+	}
+	return s.pool.FlushStats()
+}
+
+// SequencedSize returns the size of the smallest tree containing every entry sequenced so far, or zero if none has
+// been sequenced by this process.
+func (s *Storage) SequencedSize() uint64 {
+	if s.readOnly {
+		return 0
+	}
+	return s.pool.SequencedSize()
+}
+
+// GetEntryBundle retrieves the Nth entries bundle.
+// If size is != the max size of the bundle, a partial bundle is returned.
+func (s *Storage) GetEntryBundle(ctx context.Context, index, size uint64) ([]byte, error) {
+	bd, bf := layout.SeqPath(s.prefix, index)
+	if size < uint64(s.params.EntryBundleSize) {
+		bf = fmt.Sprintf("%s.%d", bf, size)
+	}
+	return readBlob(ctx, s.client, path.Join(bd, bf))
+}
+
+// sequenceBatch writes the entries from the provided batch into the entry bundle blobs of the log.
+//
+// This func starts filling entries bundles at the next available slot in the log, ensuring that the
+// sequenced entries are contiguous from the zeroth entry (i.e left-hand dense).
+func (s *Storage) sequenceBatch(ctx context.Context, batch writer.Batch) (uint64, error) {
+	// Double locking:
+	// - The mutex `Lock()` ensures that multiple concurrent calls to this function within a task are serialised.
+	// - The lock blob ensures that distinct tasks are serialised.
+	s.Lock()
+	defer s.Unlock()
+	if err := s.lockCP(ctx); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := s.unlockCP(ctx); err != nil {
+			klog.Errorf("Failed to release lock: %v", err)
+		}
+	}()
+
+	if s.lease != nil {
+		if err := s.lease.Check(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	size, _, err := s.curTree()
+	if err != nil {
+		return 0, err
+	}
+	s.curSize = size
+
+	if len(batch.Entries) == 0 {
+		return 0, nil
+	}
+	seq := s.curSize
+	bundleIndex, entriesInBundle := seq/uint64(s.params.EntryBundleSize), seq%uint64(s.params.EntryBundleSize)
+	bundle := &bytes.Buffer{}
+	if entriesInBundle > 0 {
+		// If the latest bundle is partial, we need to read the data it contains in for our newer, larger, bundle.
+		part, err := s.GetEntryBundle(ctx, bundleIndex, entriesInBundle)
+		if err != nil {
+			return 0, err
+		}
+		bundle.Write(part)
+	}
+	// The entry bundles are written concurrently with integrating the entries, and are waited for before the
+	// checkpoint is updated.
+	var bundles errgroup.Group
+	// Add new entries to the bundle
+	for _, e := range batch.Entries {
+		bundle.WriteString(base64.StdEncoding.EncodeToString(e))
+		bundle.WriteString("\n")
+		entriesInBundle++
+		if entriesInBundle == uint64(s.params.EntryBundleSize) {
+			//  This bundle is full, so we need to write it out...
+			bd, bf := layout.SeqPath(s.prefix, bundleIndex)
+			bundles.Go(s.writeFunc(ctx, path.Join(bd, bf), bundle.Bytes()))
+			// ... and prepare the next entry bundle for any remaining entries in the batch
+			bundleIndex++
+			entriesInBundle = 0
+			bundle = &bytes.Buffer{}
+		}
+	}
+	// If we have a partial bundle remaining once we've added all the entries from the batch,
+	// this needs writing out too.
+	if entriesInBundle > 0 {
+		bd, bf := layout.SeqPath(s.prefix, bundleIndex)
+		bf = fmt.Sprintf("%s.%d", bf, entriesInBundle)
+		bundles.Go(s.writeFunc(ctx, path.Join(bd, bf), bundle.Bytes()))
+	}
+
+	return seq, s.doIntegrate(ctx, seq, batch.Entries, &bundles)
+}
+
+// doIntegrate handles integrating new entries into the log, and updating the checkpoint once the entry bundles
+// being written by bundles have also been stored.
+func (s *Storage) doIntegrate(ctx context.Context, from uint64, batch [][]byte, bundles *errgroup.Group) error {
+	newSize, newRoot, err := writer.Integrate(ctx, s.params, from, batch, s, s.params.Hasher(), writer.WithStoreConcurrency(cap(s.writes)))
+	// Even if integration failed, the bundle writes must finish before the lock is released.
+	if bErr := bundles.Wait(); err == nil {
+		err = bErr
+	}
+	if err != nil {
+		klog.Errorf("Failed to integrate: %v", err)
+		return err
+	}
+	if err := s.newTree(newSize, newRoot); err != nil {
+		return fmt.Errorf("newTree: %v", err)
+	}
+	return nil
+}
+
+// GetTile returns the tile at the given tile-level and tile-index.
+// If no complete tile exists at that location, it will attempt to find a
+// partial tile for the given tree size at that location.
+func (s *Storage) GetTile(ctx context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	return s.tileCache.GetTile(ctx, level, index, logSize, s.readTile)
+}
+
+// readTile reads the tile at the given tile-level and tile-index from storage, bypassing the cache.
+func (s *Storage) readTile(ctx context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	tileSize := s.params.PartialTileSize(level, index, logSize)
+	p := path.Join(layout.TilePath(s.prefix, level, index, tileSize))
+	t, err := readBlob(ctx, s.client, p)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err = tilecompress.Decompress(t)
+	if err != nil {
+		return nil, err
+	}
+
+	var tile api.Tile
+	if err := tile.UnmarshalText(t); err != nil {
+		return nil, fmt.Errorf("failed to parse tile: %w", err)
+	}
+	return &tile, nil
+}
+
+// StoreTile writes a tile out to the container.
+// Fully populated tiles are stored at the path corresponding to the level &
+// index parameters, partially populated (i.e. right-hand edge) tiles are
+// stored with a .xx suffix where xx is the number of "tile leaves" in hex.
+func (s *Storage) StoreTile(ctx context.Context, level, index uint64, tile *api.Tile) error {
+	tileSize := uint64(tile.NumLeaves)
+	klog.V(2).Infof("StoreTile: level %d index %x ts: %x", level, index, tileSize)
+	if tileSize == 0 || tileSize > s.params.TileWidth() {
+		return fmt.Errorf("tileSize %d must be > 0 and <= %d", tileSize, s.params.TileWidth())
+	}
+	t, err := tile.MarshalText()
+	if err != nil {
+		return fmt.Errorf("failed to marshal tile: %w", err)
+	}
+	if s.compressTiles {
+		t = tilecompress.Compress(t)
+	}
+
+	tDir, tFile := layout.TilePath(s.prefix, level, index, tileSize%s.params.TileWidth())
+	if err := s.writeFunc(ctx, path.Join(tDir, tFile), t)(); err != nil {
+		return err
+	}
+	s.tileCache.Invalidate(level, index)
+	return nil
+}
+
+// writeFunc returns a func which stores d in the named blob once one of the concurrent write slots is free,
+// retrying if the write fails transiently.
+func (s *Storage) writeFunc(ctx context.Context, name string, d []byte) func() error {
+	return func() error {
+		select {
+		case s.writes <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-s.writes }()
+		return retry.Do(ctx, s.writeRetry, isTransient, func(ctx context.Context) error {
+			return writeBlob(ctx, s.client, name, d)
+		})
+	}
+}
+
+// ReadCheckpoint returns the latest stored checkpoint for this log.
+func (s *Storage) ReadCheckpoint(ctx context.Context) ([]byte, error) {
+	return ReadCheckpoint(ctx, s.client, s.prefix)
+}
+
+// WriteCheckpoint stores a raw log checkpoint in the container.
+// The write is retried if it fails transiently.
+// Of the opts, only WithWriteRetries applies.
+func WriteCheckpoint(ctx context.Context, client *container.Client, prefix string, newCPRaw []byte, opts ...Option) error {
+	if err := retry.Do(ctx, writeRetries(opts), isTransient, func(ctx context.Context) error {
+		return writeBlob(ctx, client, path.Join(prefix, layout.CheckpointPath), newCPRaw)
+	}); err != nil {
+		return fmt.Errorf("failed to write checkpoint blob: %w", err)
+	}
+	return nil
+}
+
+// ReadCheckpoint returns the latest stored checkpoint.
+func ReadCheckpoint(ctx context.Context, client *container.Client, prefix string) ([]byte, error) {
+	return readBlob(ctx, client, path.Join(prefix, layout.CheckpointPath))
+}
+
+// readBlob returns the contents of the blob with the given name.
+// If the blob does not exist, the returned error will satisfy errors.Is(err, os.ErrNotExist).
+func readBlob(ctx context.Context, client *container.Client, name string) ([]byte, error) {
+	r, err := client.NewBlobClient(name).DownloadStream(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, fmt.Errorf("%q: %w", name, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to read blob %q: %w", name, err)
+	}
+	defer r.Body.Close()
+	return io.ReadAll(r.Body)
+}
+
+// writeBlob stores d in the blob with the given name, overwriting any existing contents.
+func writeBlob(ctx context.Context, client *container.Client, name string, d []byte) error {
+	if _, err := client.NewBlockBlobClient(name).UploadBuffer(ctx, d, nil); err != nil {
+		return fmt.Errorf("failed to write blob %q: %w", name, err)
+	}
+	return nil
+}
+
+// isPreconditionFailed returns true if err indicates that the precondition on a blob operation was not met.
+// Azure reports a failed If-None-Match: * precondition on upload as a conflict with an existing blob.
+func isPreconditionFailed(err error) bool {
+	return bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet)
+}
+
+// isTransient returns true if err indicates that the operation may succeed if retried.
+func isTransient(err error) bool {
+	var re *azcore.ResponseError
+	return errors.As(err, &re) && retry.IsTransientStatus(re.StatusCode)
+}
+
+// writeRetries returns the write retry policy configured by opts.
+func writeRetries(opts []Option) retry.Policy {
+	s := &Storage{writeRetry: retry.DefaultPolicy}
+	for _, o := range opts {
+		o(s)
+	}
+	return s.writeRetry
+}
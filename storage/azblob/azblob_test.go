@@ -0,0 +1,126 @@
+package azblob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/AlCutter/betty/storage/storagetest"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// testRun distinguishes the blobs written by this run of the tests from those of earlier runs.
+var testRun = time.Now().UnixNano()
+
+// testContainer returns the container named by BETTY_TEST_AZBLOB_CONTAINER in the account given by
+// BETTY_TEST_AZBLOB_CONNECTION_STRING, which may be an emulator such as Azurite, skipping the test if they
+// aren't set.
+func testContainer(t *testing.T) *container.Client {
+	t.Helper()
+	cs, name := os.Getenv("BETTY_TEST_AZBLOB_CONNECTION_STRING"), os.Getenv("BETTY_TEST_AZBLOB_CONTAINER")
+	if cs == "" || name == "" {
+		t.Skip("BETTY_TEST_AZBLOB_CONNECTION_STRING and BETTY_TEST_AZBLOB_CONTAINER aren't set")
+	}
+	c, err := container.NewClientFromConnectionString(cs, name, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConnectionString: %v", err)
+	}
+	return c
+}
+
+// testPrefix returns a prefix under which the test can create a log of its own.
+func testPrefix(t *testing.T) string {
+	return fmt.Sprintf("betty-test-%d/%s", testRun, t.Name())
+}
+
+func TestConformance(t *testing.T) {
+	ctx := context.Background()
+	c := testContainer(t)
+	storagetest.RunConformance(t, func(t *testing.T) storagetest.OpenFunc {
+		prefix := testPrefix(t)
+		return func(t *testing.T, params log.Params, ct writer.CurrentTreeFunc, nt writer.NewTreeFunc) storagetest.Storage {
+			s, err := New(ctx, c, prefix, params, 10*time.Millisecond, ct, nt)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			return s
+		}
+	})
+}
+
+func TestCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	c := testContainer(t)
+	prefix := testPrefix(t)
+	if _, err := ReadCheckpoint(ctx, c, prefix); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ReadCheckpoint of a new log: got %v, want ErrNotExist", err)
+	}
+	for _, cp := range []string{"first\n", "second\n"} {
+		if err := WriteCheckpoint(ctx, c, prefix, []byte(cp)); err != nil {
+			t.Fatalf("WriteCheckpoint: %v", err)
+		}
+		got, err := ReadCheckpoint(ctx, c, prefix)
+		if err != nil {
+			t.Fatalf("ReadCheckpoint: %v", err)
+		}
+		if string(got) != cp {
+			t.Errorf("ReadCheckpoint = %q, want %q", got, cp)
+		}
+	}
+}
+
+func TestCheckpointLock(t *testing.T) {
+	ctx := context.Background()
+	s := &Storage{client: testContainer(t), prefix: testPrefix(t)}
+	if err := s.lockCP(ctx); err != nil {
+		t.Fatalf("lockCP: %v", err)
+	}
+	// The lock can't be taken again until it's released.
+	tctx, cancel := context.WithTimeout(ctx, 3*lockRetryInterval)
+	defer cancel()
+	if err := s.lockCP(tctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lockCP while locked: got %v, want DeadlineExceeded", err)
+	}
+	if err := s.unlockCP(ctx); err != nil {
+		t.Fatalf("unlockCP: %v", err)
+	}
+	if err := s.lockCP(ctx); err != nil {
+		t.Fatalf("lockCP after unlockCP: %v", err)
+	}
+	if err := s.unlockCP(ctx); err != nil {
+		t.Fatalf("unlockCP: %v", err)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	for _, test := range []struct {
+		name                      string
+		err                       error
+		wantTransient, wantPrecon bool
+	}{
+		{name: "throttled", err: &azcore.ResponseError{StatusCode: http.StatusTooManyRequests}, wantTransient: true},
+		{name: "unavailable", err: fmt.Errorf("wrapped: %w", &azcore.ResponseError{StatusCode: http.StatusServiceUnavailable, ErrorCode: string(bloberror.ServerBusy)}), wantTransient: true},
+		{name: "blob exists", err: &azcore.ResponseError{StatusCode: http.StatusConflict, ErrorCode: string(bloberror.BlobAlreadyExists)}, wantPrecon: true},
+		{name: "condition not met", err: &azcore.ResponseError{StatusCode: http.StatusPreconditionFailed, ErrorCode: string(bloberror.ConditionNotMet)}, wantPrecon: true},
+		{name: "not found", err: &azcore.ResponseError{StatusCode: http.StatusNotFound, ErrorCode: string(bloberror.BlobNotFound)}},
+		{name: "forbidden", err: &azcore.ResponseError{StatusCode: http.StatusForbidden, ErrorCode: string(bloberror.AuthorizationFailure)}},
+		{name: "not an API error", err: errors.New("boom")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isTransient(test.err); got != test.wantTransient {
+				t.Errorf("isTransient(%v) = %t, want %t", test.err, got, test.wantTransient)
+			}
+			if got := isPreconditionFailed(test.err); got != test.wantPrecon {
+				t.Errorf("isPreconditionFailed(%v) = %t, want %t", test.err, got, test.wantPrecon)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/AlCutter/betty/storage/storagetest"
+	"google.golang.org/api/googleapi"
+)
+
+// testRun distinguishes the objects written by this run of the tests from those of earlier runs.
+var testRun = time.Now().UnixNano()
+
+// testBucket returns the bucket named by BETTY_TEST_GCS_BUCKET, which may be served by an emulator such as
+// fake-gcs-server by also setting STORAGE_EMULATOR_HOST, skipping the test if it isn't set.
+func testBucket(t *testing.T) *storage.BucketHandle {
+	t.Helper()
+	bucket := os.Getenv("BETTY_TEST_GCS_BUCKET")
+	if bucket == "" {
+		t.Skip("BETTY_TEST_GCS_BUCKET isn't set")
+	}
+	c, err := storage.NewClient(context.Background())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c.Bucket(bucket)
+}
+
+// testPrefix returns a prefix under which the test can create a log of its own.
+func testPrefix(t *testing.T) string {
+	return fmt.Sprintf("betty-test-%d/%s", testRun, t.Name())
+}
+
+func TestConformance(t *testing.T) {
+	ctx := context.Background()
+	b := testBucket(t)
+	storagetest.RunConformance(t, func(t *testing.T) storagetest.OpenFunc {
+		prefix := testPrefix(t)
+		return func(t *testing.T, params log.Params, ct writer.CurrentTreeFunc, nt writer.NewTreeFunc) storagetest.Storage {
+			s, err := New(ctx, b, prefix, params, 10*time.Millisecond, ct, nt)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			return s
+		}
+	})
+}
+
+func TestCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	b := testBucket(t)
+	prefix := testPrefix(t)
+	if _, err := ReadCheckpoint(ctx, b, prefix); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ReadCheckpoint of a new log: got %v, want ErrNotExist", err)
+	}
+	for _, cp := range []string{"first\n", "second\n"} {
+		if err := WriteCheckpoint(ctx, b, prefix, []byte(cp)); err != nil {
+			t.Fatalf("WriteCheckpoint: %v", err)
+		}
+		got, err := ReadCheckpoint(ctx, b, prefix)
+		if err != nil {
+			t.Fatalf("ReadCheckpoint: %v", err)
+		}
+		if string(got) != cp {
+			t.Errorf("ReadCheckpoint = %q, want %q", got, cp)
+		}
+	}
+}
+
+func TestCheckpointLock(t *testing.T) {
+	ctx := context.Background()
+	s := &Storage{bucket: testBucket(t), prefix: testPrefix(t)}
+	gen, err := s.lockCP(ctx)
+	if err != nil {
+		t.Fatalf("lockCP: %v", err)
+	}
+	// The lock can't be taken again until it's released.
+	tctx, cancel := context.WithTimeout(ctx, 3*lockRetryInterval)
+	defer cancel()
+	if _, err := s.lockCP(tctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lockCP while locked: got %v, want DeadlineExceeded", err)
+	}
+	if err := s.unlockCP(ctx, gen); err != nil {
+		t.Fatalf("unlockCP: %v", err)
+	}
+	gen, err = s.lockCP(ctx)
+	if err != nil {
+		t.Fatalf("lockCP after unlockCP: %v", err)
+	}
+	if err := s.unlockCP(ctx, gen); err != nil {
+		t.Fatalf("unlockCP: %v", err)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	for _, test := range []struct {
+		name                      string
+		err                       error
+		wantTransient, wantPrecon bool
+	}{
+		{name: "throttled", err: &googleapi.Error{Code: http.StatusTooManyRequests}, wantTransient: true},
+		{name: "unavailable", err: fmt.Errorf("wrapped: %w", &googleapi.Error{Code: http.StatusServiceUnavailable}), wantTransient: true},
+		{name: "precondition failed", err: &googleapi.Error{Code: http.StatusPreconditionFailed}, wantPrecon: true},
+		{name: "wrapped precondition failed", err: fmt.Errorf("wrapped: %w", &googleapi.Error{Code: http.StatusPreconditionFailed}), wantPrecon: true},
+		{name: "forbidden", err: &googleapi.Error{Code: http.StatusForbidden}},
+		{name: "not an API error", err: errors.New("boom")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isTransient(test.err); got != test.wantTransient {
+				t.Errorf("isTransient(%v) = %t, want %t", test.err, got, test.wantTransient)
+			}
+			if got := isPreconditionFailed(test.err); got != test.wantPrecon {
+				t.Errorf("isPreconditionFailed(%v) = %t, want %t", test.err, got, test.wantPrecon)
+			}
+		})
+	}
+}
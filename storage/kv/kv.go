@@ -0,0 +1,370 @@
+// Package kv provides a log storage implementation on top of an embedded Pebble key-value store.
+//
+// Entry bundles and tiles are stored as values keyed by the path they'd have in the POSIX storage,
+// and the checkpoint is stored under a reserved key. All of the bundles and tiles written while
+// sequencing a batch are committed together in a single KV batch, so a crash can never leave a
+// partially written flush behind.
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/cockroachdb/pebble"
+	"github.com/transparency-dev/serverless-log/api"
+	"github.com/transparency-dev/serverless-log/api/layout"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+var tracer = otel.Tracer("github.com/AlCutter/betty/storage/kv")
+
+// Storage implements storage functions on top of a Pebble database.
+type Storage struct {
+	sync.Mutex
+	params log.Params
+	db     *pebble.DB
+	pool   *writer.Pool
+
+	curTree writer.CurrentTreeFunc
+	newTree writer.NewTreeFunc
+
+	curSize uint64
+
+	// tileCache, if set, caches tiles read from storage.
+	tileCache *reader.TileCache
+}
+
+// Option configures optional behaviour of the storage.
+type Option func(*Storage)
+
+// WithTileCache causes up to size of the most recently used tiles to be cached in memory.
+func WithTileCache(size int) Option {
+	return func(s *Storage) {
+		s.tileCache = reader.NewTileCache(s.params, size)
+	}
+}
+
+// New creates a new KV storage, storing the log in the provided database.
+// The caller remains responsible for closing db once the storage has been closed.
+func New(db *pebble.DB, params log.Params, batchMaxAge time.Duration, curTree writer.CurrentTreeFunc, newTree writer.NewTreeFunc, opts ...Option) (*Storage, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	curSize, _, err := curTree()
+	if err != nil {
+		return nil, err
+	}
+	r := &Storage{
+		db:      db,
+		params:  params,
+		curSize: curSize,
+		curTree: curTree,
+		newTree: newTree,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	if err := r.checkMetadata(); err != nil {
+		return nil, err
+	}
+	r.pool = writer.NewPool(params.EntryBundleSize, batchMaxAge, r.sequenceBatch, writer.WithMaxBytes(params.BundleMaxBytes), writer.WithName(params.Name))
+
+	return r, nil
+}
+
+// checkMetadata ensures that the log's persisted metadata is compatible with the configured params,
+// persisting it if this is a new log.
+func (s *Storage) checkMetadata() error {
+	m, err := get(s.db, log.MetadataPath)
+	if errors.Is(err, os.ErrNotExist) {
+		m, err := s.params.MarshalMetadata()
+		if err != nil {
+			return fmt.Errorf("failed to marshal log metadata: %v", err)
+		}
+		return s.db.Set([]byte(log.MetadataPath), m, pebble.Sync)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read log metadata: %w", err)
+	}
+	return s.params.CheckMetadata(m)
+}
+
+// Sequence commits to sequence numbers for an entry
+// Returns the sequence number assigned to the first entry in the batch, or an error.
+func (s *Storage) Sequence(ctx context.Context, b []byte) (uint64, error) {
+	ctx, span := tracer.Start(ctx, "kv.Sequence")
+	defer span.End()
+	seq, err := s.pool.Add(ctx, b)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	span.SetAttributes(attribute.Int64("betty.index", int64(seq)))
+	return seq, nil
+}
+
+// SequenceBatch commits to a contiguous run of sequence numbers for the provided entries.
+// Returns the sequence numbers assigned to the entries, in the same order, or an error.
+func (s *Storage) SequenceBatch(ctx context.Context, b [][]byte) ([]uint64, error) {
+	ctx, span := tracer.Start(ctx, "kv.SequenceBatch", trace.WithAttributes(attribute.Int("betty.batch_size", len(b))))
+	defer span.End()
+	seqs, err := s.pool.AddBatch(ctx, b)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		span.SetAttributes(
+			attribute.Int64("betty.first_index", int64(seqs[0])),
+			attribute.Int64("betty.last_index", int64(seqs[len(seqs)-1])))
+	}
+	return seqs, nil
+}
+
+// Close sequences and integrates any pending entries, returning once they're committed.
+func (s *Storage) Close(ctx context.Context) error {
+	return s.pool.Flush(ctx)
+}
+
+// FlushStats returns a summary of the batches flushed for sequencing since the previous call.
+func (s *Storage) FlushStats() writer.FlushStats {
+	return s.pool.FlushStats()
+}
+
+// SequencedSize returns the size of the smallest tree containing every entry sequenced so far, or zero if none has
+// been sequenced by this process.
+func (s *Storage) SequencedSize() uint64 {
+	return s.pool.SequencedSize()
+}
+
+// GetEntryBundle retrieves the Nth entries bundle.
+// If size is != the max size of the bundle, a partial bundle is returned.
+func (s *Storage) GetEntryBundle(_ context.Context, index, size uint64) ([]byte, error) {
+	return get(s.db, s.bundleKey(index, size))
+}
+
+// bundleKey returns the key under which the Nth entries bundle of the given size is stored.
+func (s *Storage) bundleKey(index, size uint64) string {
+	bd, bf := layout.SeqPath("", index)
+	if size < uint64(s.params.EntryBundleSize) {
+		bf = fmt.Sprintf("%s.%d", bf, size)
+	}
+	return path.Join(bd, bf)
+}
+
+// sequenceBatch writes the entries from the provided batch into the entry bundles of the log.
+//
+// This func starts filling entries bundles at the next available slot in the log, ensuring that the
+// sequenced entries are contiguous from the zeroth entry (i.e left-hand dense).
+//
+// The entry bundles, along with the tiles created by integrating them, are committed to the database in a
+// single KV batch before the new checkpoint is published.
+func (s *Storage) sequenceBatch(ctx context.Context, batch writer.Batch) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	size, _, err := s.curTree()
+	if err != nil {
+		return 0, err
+	}
+	s.curSize = size
+
+	if len(batch.Entries) == 0 {
+		return 0, nil
+	}
+	b := s.db.NewIndexedBatch()
+	defer b.Close()
+
+	seq := s.curSize
+	bundleIndex, entriesInBundle := seq/uint64(s.params.EntryBundleSize), seq%uint64(s.params.EntryBundleSize)
+	bundle := &bytes.Buffer{}
+	if entriesInBundle > 0 {
+		// If the latest bundle is partial, we need to read the data it contains in for our newer, larger, bundle.
+		part, err := s.GetEntryBundle(ctx, bundleIndex, entriesInBundle)
+		if err != nil {
+			return 0, err
+		}
+		bundle.Write(part)
+	}
+	// Add new entries to the bundle
+	for _, e := range batch.Entries {
+		bundle.WriteString(base64.StdEncoding.EncodeToString(e))
+		bundle.WriteString("\n")
+		entriesInBundle++
+		if entriesInBundle == uint64(s.params.EntryBundleSize) {
+			//  This bundle is full, so we need to add it to the batch...
+			if err := b.Set([]byte(s.bundleKey(bundleIndex, entriesInBundle)), bundle.Bytes(), nil); err != nil {
+				return 0, err
+			}
+			// ... and prepare the next entry bundle for any remaining entries in the batch
+			bundleIndex++
+			entriesInBundle = 0
+			bundle = &bytes.Buffer{}
+		}
+	}
+	// If we have a partial bundle remaining once we've added all the entries from the batch,
+	// this needs adding too.
+	if entriesInBundle > 0 {
+		if err := b.Set([]byte(s.bundleKey(bundleIndex, entriesInBundle)), bundle.Bytes(), nil); err != nil {
+			return 0, err
+		}
+	}
+
+	return seq, s.doIntegrate(ctx, b, seq, batch.Entries)
+}
+
+// doIntegrate handles integrating new entries into the log, committing the KV batch b, and updating the checkpoint.
+func (s *Storage) doIntegrate(ctx context.Context, b *pebble.Batch, from uint64, batch [][]byte) error {
+	bs := &batchStorage{s: s, b: b}
+	newSize, newRoot, err := writer.Integrate(ctx, s.params, from, batch, bs, s.params.Hasher())
+	if err != nil {
+		klog.Errorf("Failed to integrate: %v", err)
+		return err
+	}
+	if err := b.Commit(pebble.Sync); err != nil {
+		return fmt.Errorf("failed to commit batch: %v", err)
+	}
+	for _, t := range bs.tiles {
+		s.tileCache.Invalidate(t[0], t[1])
+	}
+	if err := s.newTree(newSize, newRoot); err != nil {
+		return fmt.Errorf("newTree: %v", err)
+	}
+	return nil
+}
+
+// GetTile returns the tile at the given tile-level and tile-index.
+// If no complete tile exists at that location, it will attempt to find a
+// partial tile for the given tree size at that location.
+func (s *Storage) GetTile(ctx context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	return s.tileCache.GetTile(ctx, level, index, logSize, s.readTile)
+}
+
+// readTile reads the tile at the given tile-level and tile-index from the database, bypassing the cache.
+func (s *Storage) readTile(_ context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	return readTile(s.db, s.params, level, index, logSize)
+}
+
+// StoreTile writes a tile directly to the database.
+// Fully populated tiles are stored at the key corresponding to the level &
+// index parameters, partially populated (i.e. right-hand edge) tiles are
+// stored with a .xx suffix where xx is the number of "tile leaves" in hex.
+func (s *Storage) StoreTile(_ context.Context, level, index uint64, tile *api.Tile) error {
+	k, t, err := s.marshalTile(level, index, tile)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Set(k, t, pebble.Sync); err != nil {
+		return err
+	}
+	s.tileCache.Invalidate(level, index)
+	return nil
+}
+
+// marshalTile returns the key and serialised value for the given tile.
+func (s *Storage) marshalTile(level, index uint64, tile *api.Tile) ([]byte, []byte, error) {
+	tileSize := uint64(tile.NumLeaves)
+	klog.V(2).Infof("StoreTile: level %d index %x ts: %x", level, index, tileSize)
+	if tileSize == 0 || tileSize > s.params.TileWidth() {
+		return nil, nil, fmt.Errorf("tileSize %d must be > 0 and <= %d", tileSize, s.params.TileWidth())
+	}
+	t, err := tile.MarshalText()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal tile: %w", err)
+	}
+	tDir, tFile := layout.TilePath("", level, index, tileSize%s.params.TileWidth())
+	return []byte(path.Join(tDir, tFile)), t, nil
+}
+
+// ReadCheckpoint returns the latest stored checkpoint for this log.
+func (s *Storage) ReadCheckpoint(_ context.Context) ([]byte, error) {
+	return ReadCheckpoint(s.db)
+}
+
+// batchStorage implements writer.IntegrateStorage on top of an uncommitted KV batch, so that integration
+// sees the tiles it has already written and the tiles it writes are committed along with the entry bundles.
+type batchStorage struct {
+	s *Storage
+	b *pebble.Batch
+	// tiles holds the level and index of each tile stored in b.
+	tiles [][2]uint64
+}
+
+func (b *batchStorage) GetTile(_ context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	return readTile(b.b, b.s.params, level, index, logSize)
+}
+
+func (b *batchStorage) StoreTile(_ context.Context, level, index uint64, tile *api.Tile) error {
+	k, t, err := b.s.marshalTile(level, index, tile)
+	if err != nil {
+		return err
+	}
+	if err := b.b.Set(k, t, nil); err != nil {
+		return err
+	}
+	b.tiles = append(b.tiles, [2]uint64{level, index})
+	return nil
+}
+
+func (b *batchStorage) GetEntryBundle(_ context.Context, index, size uint64) ([]byte, error) {
+	return get(b.b, b.s.bundleKey(index, size))
+}
+
+// readTile reads the tile at the given tile-level and tile-index from r.
+func readTile(r pebble.Reader, params log.Params, level, index, logSize uint64) (*api.Tile, error) {
+	tileSize := params.PartialTileSize(level, index, logSize)
+	tDir, tFile := layout.TilePath("", level, index, tileSize)
+	t, err := get(r, path.Join(tDir, tFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var tile api.Tile
+	if err := tile.UnmarshalText(t); err != nil {
+		return nil, fmt.Errorf("failed to parse tile: %w", err)
+	}
+	return &tile, nil
+}
+
+// WriteCheckpoint stores a raw log checkpoint in the database.
+func WriteCheckpoint(db *pebble.DB, newCPRaw []byte) error {
+	if err := db.Set([]byte(layout.CheckpointPath), newCPRaw, pebble.Sync); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// ReadCheckpoint returns the latest stored checkpoint.
+func ReadCheckpoint(db *pebble.DB) ([]byte, error) {
+	return get(db, layout.CheckpointPath)
+}
+
+// get returns a copy of the value stored under the given key.
+// If the key does not exist, the returned error will satisfy errors.Is(err, os.ErrNotExist).
+func get(r pebble.Reader, key string) ([]byte, error) {
+	v, c, err := r.Get([]byte(key))
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			return nil, fmt.Errorf("%q: %w", key, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to read %q: %w", key, err)
+	}
+	defer c.Close()
+	return bytes.Clone(v), nil
+}
@@ -0,0 +1,52 @@
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/AlCutter/betty/storage/storagetest"
+	"github.com/cockroachdb/pebble"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storagetest.OpenFunc {
+		// The database stays open across restarts of the storage, as its caller is responsible for closing it.
+		db, err := pebble.Open(t.TempDir(), &pebble.Options{})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		t.Cleanup(func() {
+			if err := db.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		})
+		return func(t *testing.T, params log.Params, ct writer.CurrentTreeFunc, nt writer.NewTreeFunc) storagetest.Storage {
+			s, err := New(db, params, 10*time.Millisecond, ct, nt)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			return s
+		}
+	})
+}
+
+func BenchmarkAdd(b *testing.B) {
+	storagetest.RunAddBenchmark(b, func(b *testing.B, params log.Params, ct writer.CurrentTreeFunc, nt writer.NewTreeFunc) storagetest.Storage {
+		db, err := pebble.Open(b.TempDir(), &pebble.Options{})
+		if err != nil {
+			b.Fatalf("Open: %v", err)
+		}
+		b.Cleanup(func() {
+			if err := db.Close(); err != nil {
+				b.Errorf("Close: %v", err)
+			}
+		})
+		s, err := New(db, params, 10*time.Millisecond, ct, nt)
+		if err != nil {
+			b.Fatalf("New: %v", err)
+		}
+		return s
+	})
+}
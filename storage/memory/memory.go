@@ -0,0 +1,285 @@
+// Package memory provides an ephemeral in-memory log storage implementation, useful for tests.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/transparency-dev/serverless-log/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+var tracer = otel.Tracer("github.com/AlCutter/betty/storage/memory")
+
+// Checkpoint holds a raw log checkpoint in memory.
+type Checkpoint struct {
+	sync.Mutex
+	raw []byte
+}
+
+// Read returns the stored checkpoint.
+// If no checkpoint has been written, the returned error will satisfy errors.Is(err, os.ErrNotExist).
+func (c *Checkpoint) Read() ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.raw == nil {
+		return nil, fmt.Errorf("checkpoint: %w", os.ErrNotExist)
+	}
+	return c.raw, nil
+}
+
+// Write stores the provided raw checkpoint.
+func (c *Checkpoint) Write(raw []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	c.raw = raw
+	return nil
+}
+
+// bundleKey identifies an entry bundle, size is zero for full bundles.
+type bundleKey struct {
+	index uint64
+	size  uint64
+}
+
+// tileKey identifies a tile, size is zero for full tiles.
+type tileKey struct {
+	level uint64
+	index uint64
+	size  uint64
+}
+
+// Storage implements storage functions entirely in memory.
+type Storage struct {
+	sync.Mutex
+	params log.Params
+	cp     *Checkpoint
+	pool   *writer.Pool
+
+	curTree writer.CurrentTreeFunc
+	newTree writer.NewTreeFunc
+
+	curSize uint64
+
+	// mu guards the maps below, which may be read concurrently with sequencing.
+	mu      sync.RWMutex
+	bundles map[bundleKey][]byte
+	tiles   map[tileKey][]byte
+}
+
+// New creates a new in-memory storage.
+func New(cp *Checkpoint, params log.Params, batchMaxAge time.Duration, curTree writer.CurrentTreeFunc, newTree writer.NewTreeFunc) (*Storage, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	curSize, _, err := curTree()
+	if err != nil {
+		return nil, err
+	}
+	r := &Storage{
+		cp:      cp,
+		params:  params,
+		curSize: curSize,
+		curTree: curTree,
+		newTree: newTree,
+		bundles: make(map[bundleKey][]byte),
+		tiles:   make(map[tileKey][]byte),
+	}
+	r.pool = writer.NewPool(params.EntryBundleSize, batchMaxAge, r.sequenceBatch, writer.WithMaxBytes(params.BundleMaxBytes), writer.WithName(params.Name))
+
+	return r, nil
+}
+
+// Sequence commits to sequence numbers for an entry
+// Returns the sequence number assigned to the first entry in the batch, or an error.
+func (s *Storage) Sequence(ctx context.Context, b []byte) (uint64, error) {
+	ctx, span := tracer.Start(ctx, "memory.Sequence")
+	defer span.End()
+	seq, err := s.pool.Add(ctx, b)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	span.SetAttributes(attribute.Int64("betty.index", int64(seq)))
+	return seq, nil
+}
+
+// SequenceBatch commits to a contiguous run of sequence numbers for the provided entries.
+// Returns the sequence numbers assigned to the entries, in the same order, or an error.
+func (s *Storage) SequenceBatch(ctx context.Context, b [][]byte) ([]uint64, error) {
+	ctx, span := tracer.Start(ctx, "memory.SequenceBatch", trace.WithAttributes(attribute.Int("betty.batch_size", len(b))))
+	defer span.End()
+	seqs, err := s.pool.AddBatch(ctx, b)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		span.SetAttributes(
+			attribute.Int64("betty.first_index", int64(seqs[0])),
+			attribute.Int64("betty.last_index", int64(seqs[len(seqs)-1])))
+	}
+	return seqs, nil
+}
+
+// Close sequences and integrates any pending entries, returning once they're committed.
+func (s *Storage) Close(ctx context.Context) error {
+	return s.pool.Flush(ctx)
+}
+
+// FlushStats returns a summary of the batches flushed for sequencing since the previous call.
+func (s *Storage) FlushStats() writer.FlushStats {
+	return s.pool.FlushStats()
+}
+
+// SequencedSize returns the size of the smallest tree containing every entry sequenced so far, or zero if none has
+// been sequenced by this process.
+func (s *Storage) SequencedSize() uint64 {
+	return s.pool.SequencedSize()
+}
+
+// GetEntryBundle retrieves the Nth entries bundle.
+// If size is != the max size of the bundle, a partial bundle is returned.
+func (s *Storage) GetEntryBundle(ctx context.Context, index, size uint64) ([]byte, error) {
+	k := bundleKey{index: index}
+	if size < uint64(s.params.EntryBundleSize) {
+		k.size = size
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.bundles[k]
+	if !ok {
+		return nil, fmt.Errorf("bundle %d.%d: %w", index, size, os.ErrNotExist)
+	}
+	return b, nil
+}
+
+// setEntryBundle stores the Nth entries bundle.
+func (s *Storage) setEntryBundle(index, size uint64, b []byte) {
+	k := bundleKey{index: index}
+	if size < uint64(s.params.EntryBundleSize) {
+		k.size = size
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bundles[k] = b
+}
+
+// sequenceBatch writes the entries from the provided batch into the entry bundles of the log.
+//
+// This func starts filling entries bundles at the next available slot in the log, ensuring that the
+// sequenced entries are contiguous from the zeroth entry (i.e left-hand dense).
+func (s *Storage) sequenceBatch(ctx context.Context, batch writer.Batch) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	size, _, err := s.curTree()
+	if err != nil {
+		return 0, err
+	}
+	s.curSize = size
+
+	if len(batch.Entries) == 0 {
+		return 0, nil
+	}
+	seq := s.curSize
+	bundleIndex, entriesInBundle := seq/uint64(s.params.EntryBundleSize), seq%uint64(s.params.EntryBundleSize)
+	bundle := &bytes.Buffer{}
+	if entriesInBundle > 0 {
+		// If the latest bundle is partial, we need to read the data it contains in for our newer, larger, bundle.
+		part, err := s.GetEntryBundle(ctx, bundleIndex, entriesInBundle)
+		if err != nil {
+			return 0, err
+		}
+		bundle.Write(part)
+	}
+	// Add new entries to the bundle
+	for _, e := range batch.Entries {
+		bundle.WriteString(base64.StdEncoding.EncodeToString(e))
+		bundle.WriteString("\n")
+		entriesInBundle++
+		if entriesInBundle == uint64(s.params.EntryBundleSize) {
+			//  This bundle is full, so we need to store it...
+			s.setEntryBundle(bundleIndex, entriesInBundle, bundle.Bytes())
+			// ... and prepare the next entry bundle for any remaining entries in the batch
+			bundleIndex++
+			entriesInBundle = 0
+			bundle = &bytes.Buffer{}
+		}
+	}
+	// If we have a partial bundle remaining once we've added all the entries from the batch,
+	// this needs storing too.
+	if entriesInBundle > 0 {
+		s.setEntryBundle(bundleIndex, entriesInBundle, bundle.Bytes())
+	}
+
+	return seq, s.doIntegrate(ctx, seq, batch.Entries)
+}
+
+// doIntegrate handles integrating new entries into the log, and updating the checkpoint.
+func (s *Storage) doIntegrate(ctx context.Context, from uint64, batch [][]byte) error {
+	newSize, newRoot, err := writer.Integrate(ctx, s.params, from, batch, s, s.params.Hasher())
+	if err != nil {
+		klog.Errorf("Failed to integrate: %v", err)
+		return err
+	}
+	if err := s.newTree(newSize, newRoot); err != nil {
+		return fmt.Errorf("newTree: %v", err)
+	}
+	return nil
+}
+
+// GetTile returns the tile at the given tile-level and tile-index.
+// If no complete tile exists at that location, it will attempt to find a
+// partial tile for the given tree size at that location.
+func (s *Storage) GetTile(_ context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	tileSize := s.params.PartialTileSize(level, index, logSize)
+	s.mu.RLock()
+	t, ok := s.tiles[tileKey{level: level, index: index, size: tileSize}]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("tile %d/%d.%d: %w", level, index, tileSize, os.ErrNotExist)
+	}
+
+	var tile api.Tile
+	if err := tile.UnmarshalText(t); err != nil {
+		return nil, fmt.Errorf("failed to parse tile: %w", err)
+	}
+	return &tile, nil
+}
+
+// StoreTile stores a tile.
+// Tiles are stored in their serialised form so that callers cannot mutate the stored state.
+func (s *Storage) StoreTile(_ context.Context, level, index uint64, tile *api.Tile) error {
+	tileSize := uint64(tile.NumLeaves)
+	klog.V(2).Infof("StoreTile: level %d index %x ts: %x", level, index, tileSize)
+	if tileSize == 0 || tileSize > s.params.TileWidth() {
+		return fmt.Errorf("tileSize %d must be > 0 and <= %d", tileSize, s.params.TileWidth())
+	}
+	t, err := tile.MarshalText()
+	if err != nil {
+		return fmt.Errorf("failed to marshal tile: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tiles[tileKey{level: level, index: index, size: tileSize % s.params.TileWidth()}] = t
+	return nil
+}
+
+// ReadCheckpoint returns the latest stored checkpoint for this log.
+func (s *Storage) ReadCheckpoint(_ context.Context) ([]byte, error) {
+	return s.cp.Read()
+}
@@ -0,0 +1,103 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/AlCutter/betty/storage/storagetest"
+	"github.com/transparency-dev/serverless-log/api"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storagetest.OpenFunc {
+		opened := false
+		return func(t *testing.T, params log.Params, ct writer.CurrentTreeFunc, nt writer.NewTreeFunc) storagetest.Storage {
+			if opened {
+				t.Skip("Memory storage doesn't survive a restart")
+			}
+			opened = true
+			s, err := New(&Checkpoint{}, params, 10*time.Millisecond, ct, nt)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			return s
+		}
+	})
+}
+
+func TestCheckpoint(t *testing.T) {
+	c := &Checkpoint{}
+	if _, err := c.Read(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Read of an empty checkpoint: got %v, want ErrNotExist", err)
+	}
+	for _, cp := range []string{"first\n", "second\n"} {
+		if err := c.Write([]byte(cp)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		got, err := c.Read()
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if string(got) != cp {
+			t.Errorf("Read = %q, want %q", got, cp)
+		}
+	}
+}
+
+func TestStoreTile(t *testing.T) {
+	ctx := context.Background()
+	empty := func() (uint64, []byte, error) { return 0, nil, nil }
+	s, err := New(&Checkpoint{}, log.Params{EntryBundleSize: 4, TileHeight: 2}, time.Second, empty, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, test := range []struct {
+		name      string
+		numLeaves uint
+		// logSize is the size of a tree containing the tile.
+		logSize uint64
+		wantErr bool
+	}{
+		{name: "partial", numLeaves: 3, logSize: 7},
+		{name: "full", numLeaves: 4, logSize: 9},
+		{name: "empty", numLeaves: 0, wantErr: true},
+		{name: "too wide", numLeaves: 5, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tile := &api.Tile{NumLeaves: test.numLeaves, Nodes: make([][]byte, api.TileNodeKey(0, uint64(test.numLeaves))+1)}
+			for i := range tile.Nodes {
+				tile.Nodes[i] = []byte{byte(i)}
+			}
+			err := s.StoreTile(ctx, 0, 1, tile)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("StoreTile: got %v, want error %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// The stored tile is unaffected by changes to the caller's copy.
+			tile.Nodes[0][0] = 0xff
+			got, err := s.GetTile(ctx, 0, 1, test.logSize)
+			if err != nil {
+				t.Fatalf("GetTile: %v", err)
+			}
+			if got.NumLeaves != test.numLeaves || got.Nodes[0][0] != 0 {
+				t.Errorf("GetTile returned %d leaves with first node %x, want %d leaves with first node 00", got.NumLeaves, got.Nodes[0], test.numLeaves)
+			}
+		})
+	}
+}
+
+func TestNewInvalidEntryBundleSize(t *testing.T) {
+	empty := func() (uint64, []byte, error) { return 0, nil, nil }
+	for _, size := range []int{0, -1} {
+		if _, err := New(&Checkpoint{}, log.Params{EntryBundleSize: size}, time.Second, empty, nil); err == nil {
+			t.Errorf("New succeeded with entry bundle size %d", size)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package posix
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// dedupFilterFPRate is the false positive rate the dedup filter is sized for.
+const dedupFilterFPRate = 0.01
+
+// bloomFilter is a Bloom filter over leaf hashes, used to skip the leaf index lookup for leaves which definitely
+// haven't been seen before.
+//
+// Since the keys are already uniformly distributed hashes, the k bit positions are derived from the first 16 bytes
+// of the key by double hashing, rather than hashing the key again.
+type bloomFilter struct {
+	mu   sync.RWMutex
+	bits []uint64
+	k    uint64
+}
+
+// newBloomFilter creates a filter sized to hold n keys with a false positive rate of around p.
+// The rate degrades gracefully if more keys are added.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(max(n, 1)) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(max(1, math.Round(float64(m)/float64(max(n, 1))*math.Ln2)))
+	f := &bloomFilter{bits: make([]uint64, (m+63)/64), k: k}
+	dedupFilterBytes.Add(float64(len(f.bits) * 8))
+	return f
+}
+
+// positions returns the bit positions for key h, which must be at least 16 bytes long.
+func (f *bloomFilter) positions(h []byte) []uint64 {
+	h1, h2 := binary.BigEndian.Uint64(h), binary.BigEndian.Uint64(h[8:])
+	m := uint64(len(f.bits)) * 64
+	r := make([]uint64, f.k)
+	for i := range r {
+		r[i] = (h1 + uint64(i)*h2) % m
+	}
+	return r
+}
+
+// Add records that the key h has been seen.
+func (f *bloomFilter) Add(h []byte) {
+	p := f.positions(h)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, b := range p {
+		f.bits[b/64] |= 1 << (b % 64)
+	}
+	dedupFilterEntries.Inc()
+}
+
+// MayContain returns false if the key h has definitely not been added, and true if it may have been.
+func (f *bloomFilter) MayContain(h []byte) bool {
+	p := f.positions(h)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, b := range p {
+		if f.bits[b/64]&(1<<(b%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// loadDedupFilter populates the dedup filter with the hashes of every leaf recorded in the leaf index.
+func (s *Storage) loadDedupFilter() error {
+	root := filepath.Join(s.path, "leaves")
+	n := 0
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// Leaf index files are stored at leaves/<hex byte>/<hex byte>/<hex byte>/<remaining hex bytes>.
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		h, err := hex.DecodeString(strings.ReplaceAll(filepath.ToSlash(rel), "/", ""))
+		if err != nil || len(h) < 16 {
+			klog.Warningf("Ignoring unexpected file in leaf index: %s", p)
+			return nil
+		}
+		s.dedupFilter.Add(h)
+		n++
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	klog.Infof("Loaded %d leaf hashes into dedup filter", n)
+	return nil
+}
@@ -0,0 +1,141 @@
+package posix
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue returns the current value of the counter.
+func counterValue(tb testing.TB, c prometheus.Counter) float64 {
+	tb.Helper()
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		tb.Fatalf("Write: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// testKey returns a distinct leaf hash for i.
+func testKey(i int) []byte {
+	h := sha256.Sum256([]byte(fmt.Sprintf("key %d", i)))
+	return h[:]
+}
+
+func TestBloomFilter(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// size is the number of keys the filter is sized for, and added the number actually added.
+		size, added int
+		// maxFPRate is the highest acceptable rate of false positives.
+		maxFPRate float64
+	}{
+		{name: "empty", size: 1000, added: 0, maxFPRate: 0},
+		{name: "sized", size: 10000, added: 10000, maxFPRate: 2 * dedupFilterFPRate},
+		{name: "under filled", size: 10000, added: 1000, maxFPRate: dedupFilterFPRate},
+		{name: "over filled", size: 1000, added: 5000, maxFPRate: 1},
+		{name: "zero size", size: 0, added: 10, maxFPRate: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f := newBloomFilter(test.size, dedupFilterFPRate)
+			for i := range test.added {
+				f.Add(testKey(i))
+			}
+			// There must never be false negatives, however full the filter is.
+			for i := range test.added {
+				if !f.MayContain(testKey(i)) {
+					t.Fatalf("MayContain(key %d) = false for an added key", i)
+				}
+			}
+			const probes = 10000
+			fps := 0
+			for i := range probes {
+				if f.MayContain(testKey(test.added + i)) {
+					fps++
+				}
+			}
+			if rate := float64(fps) / probes; rate > test.maxFPRate {
+				t.Errorf("False positive rate %.4f, want <= %.4f", rate, test.maxFPRate)
+			}
+		})
+	}
+}
+
+func TestDedupFilter(t *testing.T) {
+	ctx := context.Background()
+	params := testParams(4)
+	dir := t.TempDir()
+	tree := &testTree{}
+	ls := leaves(50)
+	s := newTestStorage(t, dir, params, tree, WithDedup(), WithDedupFilter(100))
+	skips := counterValue(t, dedupFilterSkips)
+	sequenceInBatch(t, s, 0, ls[:10])
+	sequenceAll(t, s, 10, ls[10:20])
+	// Most new leaves skip the leaf index, but false positives may be looked up.
+	if got := counterValue(t, dedupFilterSkips) - skips; got < 8 {
+		t.Errorf("%v of 10 new leaves skipped the leaf index lookup, want most of them", got)
+	}
+	closeStorage(t, s)
+
+	// The filter is rebuilt from the leaf index on restart, so every leaf already in the log is still found.
+	s = newTestStorage(t, dir, params, tree, WithDedup(), WithDedupFilter(100))
+	defer closeStorage(t, s)
+	for i, l := range ls[:20] {
+		idx, err := s.Sequence(ctx, l)
+		if !errors.Is(err, writer.ErrDupeLeaf) || idx != uint64(i) {
+			t.Errorf("Sequence(%q) after restart: got (%d, %v), want (%d, ErrDupeLeaf)", l, idx, err, i)
+		}
+	}
+	sequenceAll(t, s, 20, ls[20:])
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	checkTree(t, tree, params, ls)
+}
+
+func BenchmarkDedupNewLeaves(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "index", opts: []Option{WithDedup()}},
+		{name: "filter", opts: []Option{WithDedup(), WithDedupFilter(1 << 20)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctx := context.Background()
+			tree := &testTree{}
+			s, err := New(b.TempDir(), testParams(256), 10*time.Millisecond, tree.current, tree.newTree, bc.opts...)
+			if err != nil {
+				b.Fatalf("New: %v", err)
+			}
+			var next atomic.Int64
+			skips := counterValue(b, dedupFilterSkips)
+			b.ResetTimer()
+			// Enough concurrent callers to fill batches, as a busy log would.
+			b.SetParallelism(64)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := s.Sequence(ctx, []byte(fmt.Sprintf("leaf %d", next.Add(1)))); err != nil {
+						b.Errorf("Sequence: %v", err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			// Every new leaf which isn't skipped by the filter is looked up in the leaf index.
+			reads := float64(b.N) - (counterValue(b, dedupFilterSkips) - skips)
+			b.ReportMetric(reads/float64(b.N), "index-reads/op")
+			if err := s.Close(ctx); err != nil {
+				b.Fatalf("Close: %v", err)
+			}
+		})
+	}
+}
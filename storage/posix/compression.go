@@ -0,0 +1,151 @@
+package posix
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression identifies the codec used to compress entry bundles on disk.
+type Compression string
+
+const (
+	// CompressionNone stores entry bundles uncompressed.
+	CompressionNone Compression = "none"
+	// CompressionGzip stores entry bundles gzip compressed, with a .gz extension.
+	CompressionGzip Compression = "gzip"
+	// CompressionZstd stores entry bundles zstd compressed, with a .zst extension.
+	CompressionZstd Compression = "zstd"
+)
+
+// compressions lists all of the supported codecs.
+var compressions = []Compression{CompressionNone, CompressionGzip, CompressionZstd}
+
+// ParseCompression returns the Compression with the given name.
+func ParseCompression(s string) (Compression, error) {
+	for _, c := range compressions {
+		if s == string(c) {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("unknown compression %q, must be one of %v", s, compressions)
+}
+
+// WithBundleCompression causes entry bundles to be compressed with the given codec as they're written.
+//
+// Entry bundles are always transparently decompressed when read, regardless of which codec was used to
+// write them, so the codec may be changed over the life of a log.
+func WithBundleCompression(c Compression) Option {
+	return func(s *Storage) {
+		s.compression = c
+	}
+}
+
+// ext returns the filename extension used for entry bundles compressed with c.
+func (c Compression) ext() string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		// This can only fail when given invalid options.
+		e, _ := zstd.NewWriter(nil)
+		return e
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		d, _ := zstd.NewReader(nil)
+		return d
+	})
+)
+
+// compress returns d compressed with c.
+func (c Compression) compress(d []byte) ([]byte, error) {
+	switch c {
+	case CompressionGzip:
+		b := &bytes.Buffer{}
+		w := gzip.NewWriter(b)
+		if _, err := w.Write(d); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case CompressionZstd:
+		return zstdEncoder().EncodeAll(d, nil), nil
+	default:
+		return d, nil
+	}
+}
+
+// decompress returns the original data from d, which was compressed with c.
+func (c Compression) decompress(d []byte) ([]byte, error) {
+	switch c {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(d))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case CompressionZstd:
+		return zstdDecoder().DecodeAll(d, nil)
+	default:
+		return d, nil
+	}
+}
+
+// writeBundle compresses the entry bundle d with the configured codec, and writes it to the file at f with
+// the codec's extension appended.
+func (s *Storage) writeBundle(f string, d []byte) error {
+	c, err := s.compression.compress(d)
+	if err != nil {
+		return fmt.Errorf("failed to compress entry bundle: %v", err)
+	}
+	return s.writeFile(f+s.compression.ext(), c)
+}
+
+// readBundle reads and decompresses the entry bundle stored at the file f, with whichever codec's extension
+// it was written with.
+func (s *Storage) readBundle(f string) ([]byte, error) {
+	// Most bundles will have been written with the configured codec, so try that first.
+	for _, c := range append([]Compression{s.compression}, compressions...) {
+		d, err := os.ReadFile(f + c.ext())
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r, err := c.decompress(d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress entry bundle %q: %v", f+c.ext(), err)
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("entry bundle %q: %w", f, os.ErrNotExist)
+}
+
+// trimCompressionExt removes any codec extension from the end of the filename f.
+func trimCompressionExt(f string) string {
+	for _, c := range compressions {
+		if e := c.ext(); e != "" {
+			f = strings.TrimSuffix(f, e)
+		}
+	}
+	return f
+}
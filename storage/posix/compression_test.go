@@ -0,0 +1,183 @@
+package posix
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/serverless-log/api/layout"
+)
+
+func TestParseCompression(t *testing.T) {
+	for _, test := range []struct {
+		s       string
+		want    Compression
+		wantErr bool
+	}{
+		{s: "none", want: CompressionNone},
+		{s: "gzip", want: CompressionGzip},
+		{s: "zstd", want: CompressionZstd},
+		{s: "", wantErr: true},
+		{s: "gz", wantErr: true},
+		{s: "ZSTD", wantErr: true},
+	} {
+		t.Run(test.s, func(t *testing.T) {
+			got, err := ParseCompression(test.s)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("ParseCompression(%q): got err %v, want err %t", test.s, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("ParseCompression(%q) = %q, want %q", test.s, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, c := range compressions {
+		for _, d := range [][]byte{
+			nil,
+			[]byte("bGVhZiAw\n"),
+			bytes.Repeat([]byte("bGVhZiAw\n"), 1000),
+		} {
+			t.Run(string(c), func(t *testing.T) {
+				z, err := c.compress(d)
+				if err != nil {
+					t.Fatalf("compress: %v", err)
+				}
+				if c != CompressionNone && len(d) > 1000 && len(z) >= len(d) {
+					t.Errorf("Compressed %d bytes to %d", len(d), len(z))
+				}
+				got, err := c.decompress(z)
+				if err != nil {
+					t.Fatalf("decompress: %v", err)
+				}
+				if !bytes.Equal(got, d) {
+					t.Errorf("Round trip of %d bytes gave %d bytes", len(d), len(got))
+				}
+			})
+		}
+	}
+}
+
+func TestBundleCompression(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// codecs are used in turn to add to the log, reopening it each time.
+		codecs []Compression
+	}{
+		{name: "none", codecs: []Compression{CompressionNone}},
+		{name: "gzip", codecs: []Compression{CompressionGzip}},
+		{name: "zstd", codecs: []Compression{CompressionZstd}},
+		{name: "changed", codecs: []Compression{CompressionNone, CompressionGzip, CompressionZstd, CompressionNone}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			params := testParams(4)
+			tree := &testTree{}
+			var added [][]byte
+			for _, c := range test.codecs {
+				s := newTestStorage(t, dir, params, tree, WithBundleCompression(c))
+				ls := leaves(len(added) + 6)[len(added):]
+				sequenceAll(t, s, uint64(len(added)), ls)
+				added = append(added, ls...)
+				closeStorage(t, s)
+
+				// The last bundle was written with this codec, and is stored with its extension.
+				n := len(added)
+				bd, bf := layout.SeqPath(dir, uint64(n-1)/4)
+				if n%4 != 0 {
+					bf = fmt.Sprintf("%s.%d", bf, n%4)
+				}
+				z, err := os.ReadFile(filepath.Join(bd, bf+c.ext()))
+				if err != nil {
+					t.Fatalf("Failed to read last bundle written with %s: %v", c, err)
+				}
+				if _, err := c.decompress(z); err != nil {
+					t.Errorf("Last bundle isn't %s compressed: %v", c, err)
+				}
+			}
+
+			// Bundles are read regardless of the codecs they were written with.
+			s := newTestStorage(t, dir, params, tree)
+			defer closeStorage(t, s)
+			if got := readEntries(t, s, params, len(added)); !slices.EqualFunc(got, added, bytes.Equal) {
+				t.Errorf("Got entries %q, want %q", got, added)
+			}
+			checkTree(t, tree, params, added)
+		})
+	}
+}
+
+func TestTileCompression(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// compress says whether tiles are compressed while each run of entries is added, reopening the log each time.
+		compress []bool
+	}{
+		{name: "uncompressed", compress: []bool{false}},
+		{name: "compressed", compress: []bool{true}},
+		{name: "enabled", compress: []bool{false, true}},
+		{name: "disabled", compress: []bool{true, false}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			params := log.Params{EntryBundleSize: 4, TileHeight: 2}
+			h := params.Hasher()
+			tree := &testTree{}
+			var added [][]byte
+			for _, compress := range test.compress {
+				var opts []Option
+				if compress {
+					opts = append(opts, WithTileCompression())
+				}
+				s := newTestStorage(t, dir, params, tree, opts...)
+				ls := leaves(len(added) + 23)[len(added):]
+				sequenceInBatch(t, s, uint64(len(added)), ls)
+				added = append(added, ls...)
+				closeStorage(t, s)
+
+				// The tiles written for the latest tree are stored as configured.
+				size := uint64(len(added))
+				tDir, tFile := layout.TilePath(dir, 0, size/params.TileWidth(), size%params.TileWidth())
+				raw, err := os.ReadFile(filepath.Join(tDir, tFile))
+				if err != nil {
+					t.Fatalf("Failed to read tile: %v", err)
+				}
+				if got := bytes.HasPrefix(raw, []byte{0x28, 0xb5, 0x2f, 0xfd}); got != compress {
+					t.Errorf("Got compressed tile %t, want %t", got, compress)
+				}
+			}
+
+			// Proofs can be built from a mix of compressed and uncompressed tiles.
+			s := newTestStorage(t, dir, params, tree)
+			defer closeStorage(t, s)
+			size := uint64(len(added))
+			root := refRoot(h, added)
+			pb, err := reader.NewProofBuilder(ctx, params, size, h.HashChildren, s)
+			if err != nil {
+				t.Fatalf("NewProofBuilder: %v", err)
+			}
+			if !bytes.Equal(pb.Root(), root) {
+				t.Fatalf("Got root %x from tiles, want %x", pb.Root(), root)
+			}
+			for i, l := range added {
+				p, err := pb.InclusionProof(ctx, uint64(i))
+				if err != nil {
+					t.Fatalf("InclusionProof(%d): %v", i, err)
+				}
+				if err := proof.VerifyInclusion(h, uint64(i), size, h.HashLeaf(l), p, root); err != nil {
+					t.Errorf("VerifyInclusion(%d): %v", i, err)
+				}
+			}
+		})
+	}
+}
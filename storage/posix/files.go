@@ -9,18 +9,29 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
 	"github.com/AlCutter/betty/log/writer"
-	"github.com/transparency-dev/merkle/rfc6962"
+	"github.com/AlCutter/betty/storage/tilecompress"
+	"github.com/transparency-dev/merkle"
 	"github.com/transparency-dev/serverless-log/api"
 	"github.com/transparency-dev/serverless-log/api/layout"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 	"k8s.io/klog/v2"
 )
 
+var tracer = otel.Tracer("github.com/AlCutter/betty/storage/posix")
+
+// The default modes of the directories and files created by the storage.
 const (
 	dirPerm  = 0o755
 	filePerm = 0o644
@@ -34,36 +45,329 @@ type Storage struct {
 	path   string
 	pool   *writer.Pool
 
+	// hasher is the log's hasher, as given by params, with which leaves are hashed for the leaf index as well
+	// as for the tree.
+	hasher merkle.LogHasher
+
 	cpFile *os.File
 
-	curTree CurrentTreeFunc
-	newTree NewTreeFunc
+	curTree writer.CurrentTreeFunc
+	newTree writer.NewTreeFunc
 
 	curSize uint64
+
+	// compression is the codec used to compress entry bundles as they're written.
+	compression Compression
+
+	// batchTarget, if set, enables adaptive batching with this target flush latency.
+	batchTarget time.Duration
+	// shards is the number of shards over which entries are batched, see writer.WithShards.
+	shards int
+	// clock, if set, replaces the system clock for timing the age of batches.
+	clock writer.Clock
+
+	// cpInterval, if set, is the min interval between publishing checkpoints.
+	cpInterval time.Duration
+	// publisher, if set, publishes checkpoints for integrated trees at most once per cpInterval.
+	publisher *writer.Publisher
+
+	// integrateInterval, if set, is the interval at which sequenced entries are integrated, see WithIntegrateInterval.
+	integrateInterval time.Duration
+	// pending holds the entries which have been sequenced, but not yet integrated, following the integrated tree.
+	pending [][]byte
+	// integrateDone is closed to stop sequenced entries from being integrated periodically.
+	integrateDone chan struct{}
+
+	// durable is set if writes must be flushed to stable storage before being relied upon.
+	durable bool
+	// reserveBlock, if set, is the number of indices reserved at a time, see WithIndexReservation.
+	reserveBlock uint64
+	// reserved is the persisted high-water mark of the reserved indices, below which indices may have been assigned.
+	reserved uint64
+	// dirMode and fileMode are the permissions of the directories and files created by the storage.
+	dirMode, fileMode os.FileMode
+
+	// tileCache, if set, caches tiles read from storage.
+	tileCache *reader.TileCache
+	// compressTiles is set if tiles should be compressed as they're written.
+	compressTiles bool
+
+	// readOnly is set if the log may only be read.
+	readOnly bool
+
+	// lease, if set, fences the log so that only this writer may add entries.
+	lease *writer.Lease
+	// leaseDone is closed to stop the lease from being renewed.
+	leaseDone chan struct{}
+
+	// dedup is set if identical leaves should be assigned only a single index.
+	dedup bool
+	// dedupGroup ensures that concurrent requests to sequence identical leaves are handled once.
+	dedupGroup singleflight.Group
+	// dedupMu guards dedupAdds.
+	dedupMu sync.Mutex
+	// dedupAdds tracks the callers waiting for each leaf being added by dedupGroup, keyed by its leaf hash.
+	dedupAdds map[string]*dedupAdd
+	// dedupFilter, if set, holds the hashes of the leaves in the leaf index, so that looking up leaves which
+	// definitely aren't in the index can be skipped.
+	dedupFilter *bloomFilter
+}
+
+// Option configures optional behaviour of the storage.
+type Option func(*Storage)
+
+// WithDedup causes Sequence to return the previously assigned index, along with writer.ErrDupeLeaf,
+// for leaves which are identical to one already in the log.
+//
+// The leaf hash to index mapping is persisted under the log root so that it survives restarts.
+func WithDedup() Option {
+	return func(s *Storage) {
+		s.dedup = true
+	}
+}
+
+// WithDedupFilter keeps an in-memory Bloom filter of the hashes of the leaves in the log, sized for around n leaves,
+// in front of the leaf index used by WithDedup. Leaves which definitely haven't been seen before then skip reading
+// the index, while possible duplicates are still checked against it.
+//
+// The filter is rebuilt from the leaf index at startup. Leaves added by other writers to the same log are not
+// added to the filter, so this should only be used when a single writer is guaranteed, e.g. with WithWriterLease.
+func WithDedupFilter(n int) Option {
+	return func(s *Storage) {
+		s.dedupFilter = newBloomFilter(n, dedupFilterFPRate)
+	}
+}
+
+// WithDurable causes entry bundles and tiles to be fsync'd as they're written, so that entries survive
+// a power loss once Sequence has returned, at the cost of throughput.
+func WithDurable() Option {
+	return func(s *Storage) {
+		s.durable = true
+	}
+}
+
+// WithIndexReservation persists the sequence counter by reserving blocks of n indices at a time, rather than relying
+// on the entry bundles stored by each flush.
+// The end of the reserved block is fsync'd before any index in it is assigned, so without WithDurable a crash may lose
+// the bundles of entries which were acknowledged, but their indices are never reused: on restart, the indices between
+// the recovered tree and the high-water mark are skipped by filling them with empty entries. This bounds the number
+// of indices skipped beyond the last one assigned to n, while only fsyncing once per n indices. Close releases the
+// unused indices of the block, so they're only skipped after a crash.
+//
+// Since the high-water mark is only read at startup, this should only be used when a single writer is guaranteed,
+// e.g. with WithWriterLease.
+func WithIndexReservation(n uint64) Option {
+	return func(s *Storage) {
+		s.reserveBlock = n
+	}
+}
+
+// WithDirMode sets the permissions with which the storage creates directories, less the process's umask,
+// which otherwise default to 0755.
+func WithDirMode(m os.FileMode) Option {
+	return func(s *Storage) {
+		s.dirMode = m
+	}
+}
+
+// WithFileMode sets the permissions of the files written by the storage, which otherwise default to 0644.
+// Unlike directories, files are given exactly these permissions, regardless of the process's umask.
+func WithFileMode(m os.FileMode) Option {
+	return func(s *Storage) {
+		s.fileMode = m
+	}
+}
+
+// modes returns the directory and file modes set by opts, among which any other options are ignored.
+// This allows the package level functions which write to a log to honour the same options as its Storage.
+func modes(opts []Option) (os.FileMode, os.FileMode) {
+	s := &Storage{dirMode: dirPerm, fileMode: filePerm}
+	for _, o := range opts {
+		o(s)
+	}
+	return s.dirMode, s.fileMode
+}
+
+// WithAdaptiveBatching causes the size of the batches of entries sequenced together to vary with load, aiming to
+// flush entries within target of their arrival, rather than always waiting for batches to fill.
+// Batches never grow larger than the entry bundle size.
+func WithAdaptiveBatching(target time.Duration) Option {
+	return func(s *Storage) {
+		s.batchTarget = target
+	}
+}
+
+// WithSequencerShards causes the entries added to the storage to be batched by n shards, which are sequenced
+// together, reducing contention between concurrent callers at very high write rates.
+func WithSequencerShards(n int) Option {
+	return func(s *Storage) {
+		s.shards = n
+	}
 }
 
-// NewTreeFunc is the signature of a function which receives information about newly integrated trees.
-type NewTreeFunc func(size uint64, root []byte) error
+// WithCheckpointInterval causes a new checkpoint to be published at most once per interval, rather than
+// after every batch is integrated, reducing the overhead of signing and witnessing checkpoints under load.
+// Integration continues in the meantime, and each checkpoint reflects the latest integrated tree when it's published,
+// so entries may not be covered by a checkpoint until up to interval after Sequence returns.
+func WithCheckpointInterval(interval time.Duration) Option {
+	return func(s *Storage) {
+		s.cpInterval = interval
+	}
+}
 
-// CurrentTree is the signature of a function which retrieves the current integrated tree size and root hash.
-type CurrentTreeFunc func() (uint64, []byte, error)
+// WithIntegrateInterval causes sequenced entries to be integrated into the tree at most once per interval, rather
+// than after every batch, so that several batches are integrated together, reducing the rewriting of the tiles at
+// the upper levels of the tree under bursty load.
+// Sequence still returns once an entry's bundle has been durably stored, but the entry isn't covered by a checkpoint
+// until the next integration, which is also done by Flush. Entries sequenced but not yet integrated are recovered
+// from their entry bundles if the process crashes.
+//
+// Since the entries awaiting integration are only known to this process, this should only be used when a single
+// writer is guaranteed, e.g. with WithWriterLease.
+func WithIntegrateInterval(interval time.Duration) Option {
+	return func(s *Storage) {
+		s.integrateInterval = interval
+	}
+}
+
+// WithTileCache causes up to size of the most recently used tiles to be cached in memory.
+func WithTileCache(size int) Option {
+	return func(s *Storage) {
+		s.tileCache = reader.NewTileCache(s.params, size)
+	}
+}
+
+// WithTileCompression causes tiles to be compressed with zstd as they're written.
+// Compressed and uncompressed tiles are both readable regardless of this option, so it may be
+// enabled or disabled for an existing log.
+func WithTileCompression() Option {
+	return func(s *Storage) {
+		s.compressTiles = true
+	}
+}
+
+// WithClock causes the age of batches to be timed with c rather than the system clock, allowing tests to
+// trigger age-based flushes deterministically.
+func WithClock(c writer.Clock) Option {
+	return func(s *Storage) {
+		s.clock = c
+	}
+}
+
+// WithReadOnly opens the log for reading only, so that additional instances can serve reads from a log
+// written by another: no writer lease is taken, nothing is written to storage, and attempts to sequence
+// entries fail with writer.ErrReadOnly.
+func WithReadOnly() Option {
+	return func(s *Storage) {
+		s.readOnly = true
+	}
+}
 
 // New creates a new POSIX storage.
-func New(path string, params log.Params, batchMaxAge time.Duration, curTree CurrentTreeFunc, newTree NewTreeFunc) *Storage {
+func New(path string, params log.Params, batchMaxAge time.Duration, curTree writer.CurrentTreeFunc, newTree writer.NewTreeFunc, opts ...Option) (*Storage, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
 	curSize, _, err := curTree()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	r := &Storage{
 		path:    path,
 		params:  params,
+		hasher:  params.Hasher(),
 		curSize: curSize,
 		curTree: curTree,
 		newTree: newTree,
+
+		compression: CompressionNone,
+		dirMode:     dirPerm,
+		fileMode:    filePerm,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	if err := r.checkMetadata(); err != nil {
+		return nil, err
+	}
+	if r.readOnly {
+		return r, nil
+	}
+	if r.cpInterval > 0 {
+		r.publisher = writer.NewPublisher(curTree, r.lockedNewTree(newTree), r.cpInterval)
+		r.curTree, r.newTree = r.publisher.CurrentTree, r.publisher.NewTree
+	}
+	if err := r.acquireLease(context.Background()); err != nil {
+		return nil, err
+	}
+	if r.dedup && r.dedupFilter != nil {
+		if err := r.loadDedupFilter(); err != nil {
+			return nil, fmt.Errorf("failed to load dedup filter: %v", err)
+		}
+	}
+	if err := r.recover(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to recover entries beyond checkpoint: %v", err)
+	}
+	if r.reserveBlock > 0 {
+		if err := r.skipReserved(context.Background()); err != nil {
+			return nil, fmt.Errorf("failed to skip reserved indices: %v", err)
+		}
+	}
+	next, _, err := r.curTree()
+	if err != nil {
+		return nil, err
+	}
+	if r.reserveBlock > 0 {
+		klog.Infof("Sequencing entries from index %d, reserving blocks of %d indices", next, r.reserveBlock)
+	} else {
+		// The next index is always the size of the integrated tree, derived from the stored entry bundles.
+		klog.Infof("Sequencing entries from index %d, persisted by the entry bundles of each flush", next)
+	}
+	poolOpts := []writer.PoolOption{writer.WithMaxBytes(params.BundleMaxBytes), writer.WithName(params.Name)}
+	if r.batchTarget > 0 {
+		poolOpts = append(poolOpts, writer.WithAdaptiveBatching(r.batchTarget))
+	}
+	if r.clock != nil {
+		poolOpts = append(poolOpts, writer.WithClock(r.clock))
+	}
+	if r.shards > 1 {
+		poolOpts = append(poolOpts, writer.WithShards(r.shards))
+	}
+	r.pool = writer.NewPool(params.EntryBundleSize, batchMaxAge, r.sequenceBatch, poolOpts...)
+	if r.integrateInterval > 0 {
+		r.integrateDone = make(chan struct{})
+		go r.integrateEvery(r.integrateInterval, r.integrateDone)
 	}
-	r.pool = writer.NewPool(params.EntryBundleSize, batchMaxAge, r.sequenceBatch)
 
-	return r
+	return r, nil
+}
+
+// checkMetadata ensures that the log's persisted metadata is compatible with the configured params,
+// persisting it if this is a new log.
+func (s *Storage) checkMetadata() error {
+	p := filepath.Join(s.path, log.MetadataPath)
+	m, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		if s.readOnly {
+			// Nothing to check against, and we mustn't write to the log.
+			return nil
+		}
+		m, err := s.params.MarshalMetadata()
+		if err != nil {
+			return fmt.Errorf("failed to marshal log metadata: %v", err)
+		}
+		return createExclusive(p, m, s.fileMode)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read log metadata: %w", err)
+	}
+	return s.params.CheckMetadata(m)
+}
+
+// ReadMetadata returns the log's persisted metadata, see log.Metadata.
+// If the log has none, the returned error will satisfy errors.Is(err, os.ErrNotExist).
+func (s *Storage) ReadMetadata(_ context.Context) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.path, log.MetadataPath))
 }
 
 // lockCP places a POSIX advisory lock for the checkpoint.
@@ -76,7 +380,7 @@ func (s *Storage) lockCP() error {
 	if s.cpFile != nil {
 		panic("not unlocked")
 	}
-	s.cpFile, err = os.OpenFile(filepath.Join(s.path, layout.CheckpointPath+".lock"), syscall.O_CREAT|syscall.O_RDWR|syscall.O_CLOEXEC, filePerm)
+	s.cpFile, err = os.OpenFile(filepath.Join(s.path, layout.CheckpointPath+".lock"), syscall.O_CREAT|syscall.O_RDWR|syscall.O_CLOEXEC, s.fileMode)
 	if err != nil {
 		return err
 	}
@@ -106,10 +410,310 @@ func (s *Storage) unlockCP() error {
 	return nil
 }
 
+// withLock calls f while holding both the mutex and the `checkpoint.lock` file.
+func (s *Storage) withLock(f func() error) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.lockCP(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.unlockCP(); err != nil {
+			panic(err)
+		}
+	}()
+	return f()
+}
+
 // Sequence commits to sequence numbers for an entry
 // Returns the sequence number assigned to the first entry in the batch, or an error.
 func (s *Storage) Sequence(ctx context.Context, b []byte) (uint64, error) {
-	return s.pool.Add(b)
+	ctx, span := tracer.Start(ctx, "posix.Sequence")
+	defer span.End()
+	if s.readOnly {
+		return 0, writer.ErrReadOnly
+	}
+	if err := s.checkEntrySize(b); err != nil {
+		return 0, err
+	}
+	var seq uint64
+	var err error
+	if s.dedup {
+		seq, err = s.sequenceDedup(ctx, b)
+	} else {
+		seq, err = s.pool.Add(ctx, b)
+	}
+	if errors.Is(err, writer.ErrDupeLeaf) {
+		span.SetAttributes(attribute.Int64("betty.index", int64(seq)), attribute.Bool("betty.dupe", true))
+		return seq, err
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	span.SetAttributes(attribute.Int64("betty.index", int64(seq)))
+	return seq, nil
+}
+
+// SequenceBatch commits to a contiguous run of sequence numbers for the provided entries.
+// Returns the sequence numbers assigned to the entries, in the same order, or an error.
+//
+// Since the assigned sequence numbers must be contiguous, entries are not deduplicated, but if
+// deduplication is enabled the indices are recorded so that subsequent calls to Sequence with
+// identical leaves will not be sequenced again.
+func (s *Storage) SequenceBatch(ctx context.Context, b [][]byte) ([]uint64, error) {
+	ctx, span := tracer.Start(ctx, "posix.SequenceBatch", trace.WithAttributes(attribute.Int("betty.batch_size", len(b))))
+	defer span.End()
+	if s.readOnly {
+		return nil, writer.ErrReadOnly
+	}
+	for _, e := range b {
+		if err := s.checkEntrySize(e); err != nil {
+			return nil, err
+		}
+	}
+	seqs, err := s.pool.AddBatch(ctx, b)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	if len(seqs) > 0 {
+		span.SetAttributes(
+			attribute.Int64("betty.first_index", int64(seqs[0])),
+			attribute.Int64("betty.last_index", int64(seqs[len(seqs)-1])))
+	}
+	return seqs, nil
+}
+
+// checkEntrySize returns writer.ErrEntryTooLarge if the entry is larger than the log's params allow, which ensures
+// that no entry bundle exceeds BundleMaxBytes however it's filled.
+func (s *Storage) checkEntrySize(e []byte) error {
+	if max := s.params.MaxEntryBytes(); max > 0 && len(e) > max {
+		return fmt.Errorf("entry of %d bytes exceeds max of %d bytes: %w", len(e), max, writer.ErrEntryTooLarge)
+	}
+	return nil
+}
+
+// sequenceDedup sequences the provided entry unless an identical entry has already been sequenced,
+// in which case the previously assigned index is returned along with writer.ErrDupeLeaf.
+//
+// The leaf index is updated by sequenceBatch as the entry is sequenced.
+func (s *Storage) sequenceDedup(ctx context.Context, b []byte) (uint64, error) {
+	h := s.hasher.HashLeaf(b)
+	for {
+		seq, added, err := s.addDedup(ctx, h, b)
+		if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+			// This caller joined an add which was cancelled as the last of its other callers gave up.
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !added {
+			dedupLookups.WithLabelValues("hit").Inc()
+			return seq, writer.ErrDupeLeaf
+		}
+		dedupLookups.WithLabelValues("miss").Inc()
+		return seq, nil
+	}
+}
+
+// dedupAdd counts the callers waiting for a leaf to be added, which is added with ctx.
+type dedupAdd struct {
+	waiters int
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// addDedup adds the entry b, whose leaf hash is h, unless it's already in the leaf index, returning its index and
+// whether this caller added it.
+// Only one of the concurrent callers with identical entries actually adds it, on behalf of them all, so the add
+// is only cancelled once every one of them has given up, the last of which waits to learn whether it was withdrawn.
+func (s *Storage) addDedup(ctx context.Context, h, b []byte) (uint64, bool, error) {
+	key := string(h)
+	s.dedupMu.Lock()
+	a, ok := s.dedupAdds[key]
+	if !ok {
+		a = &dedupAdd{}
+		a.ctx, a.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		if s.dedupAdds == nil {
+			s.dedupAdds = make(map[string]*dedupAdd)
+		}
+		s.dedupAdds[key] = a
+	}
+	a.waiters++
+	s.dedupMu.Unlock()
+	defer func() {
+		s.dedupMu.Lock()
+		defer s.dedupMu.Unlock()
+		if a.waiters--; a.waiters == 0 {
+			a.cancel()
+			delete(s.dedupAdds, key)
+		}
+	}()
+
+	added := false
+	ch := s.dedupGroup.DoChan(key, func() (interface{}, error) {
+		if s.dedupFilter == nil || s.dedupFilter.MayContain(h) {
+			seq, err := s.readLeafIndex(h)
+			if err == nil {
+				return seq, nil
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				return uint64(0), err
+			}
+		} else {
+			dedupFilterSkips.Inc()
+		}
+		added = true
+		return s.pool.Add(a.ctx, b)
+	})
+	var r singleflight.Result
+	select {
+	case r = <-ch:
+	case <-ctx.Done():
+		s.dedupMu.Lock()
+		last := a.waiters == 1
+		if last {
+			a.cancel()
+		}
+		s.dedupMu.Unlock()
+		if !last {
+			return 0, false, ctx.Err()
+		}
+		// As with writer.Pool, the entry can't be withdrawn once it's been flushed, in which case its index is
+		// returned, so that it's never committed without this caller learning it.
+		if r = <-ch; errors.Is(r.Err, context.Canceled) {
+			return 0, false, ctx.Err()
+		}
+	}
+	if r.Err != nil {
+		return 0, false, r.Err
+	}
+	return r.Val.(uint64), added, nil
+}
+
+// LeafIndex returns the index assigned to the leaf with the given leaf hash, as computed by the log's hasher.
+// Leaves are only indexed by hash when WithDedup is used, if the leaf is not known the returned error
+// will satisfy errors.Is(err, os.ErrNotExist).
+func (s *Storage) LeafIndex(_ context.Context, h []byte) (uint64, error) {
+	if !s.dedup {
+		return 0, fmt.Errorf("leaves are not indexed by hash: %w", os.ErrNotExist)
+	}
+	return s.readLeafIndex(h)
+}
+
+// readLeafIndex returns the index previously assigned to the leaf with the given hash.
+// If the leaf is not known, the returned error will satisfy errors.Is(err, os.ErrNotExist).
+func (s *Storage) readLeafIndex(h []byte) (uint64, error) {
+	d, f := layout.LeafPath(s.path, h)
+	raw, err := os.ReadFile(filepath.Join(d, f))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(raw), 10, 64)
+}
+
+// writeLeafIndex records the index assigned to the leaf with the given hash, returning the path of the record.
+// If an index is already recorded for the leaf, it is left unchanged and the returned path is empty.
+func (s *Storage) writeLeafIndex(h []byte, seq uint64) (string, error) {
+	if s.dedupFilter != nil {
+		// The filter must never miss a leaf which may be in the index, so add it before the index is written.
+		s.dedupFilter.Add(h)
+	}
+	d, f := layout.LeafPath(s.path, h)
+	if err := os.MkdirAll(d, s.dirMode); err != nil {
+		return "", fmt.Errorf("failed to make leaf index directory structure: %w", err)
+	}
+	p := filepath.Join(d, f)
+	if _, err := os.Stat(p); err == nil {
+		return "", nil
+	}
+	return p, s.writeFile(p, []byte(strconv.FormatUint(seq, 10)))
+}
+
+// writeLeafIndexes records the indices of the entries starting at index from in the leaf index, returning the
+// paths of the records which were created.
+func (s *Storage) writeLeafIndexes(from uint64, entries [][]byte) ([]string, error) {
+	var created []string
+	for i, e := range entries {
+		p, err := s.writeLeafIndex(s.hasher.HashLeaf(e), from+uint64(i))
+		if p != "" {
+			created = append(created, p)
+		}
+		if err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// discardLeafIndexes removes the leaf index records created for a batch which failed to be sequenced, so that its
+// leaves, whose callers have been returned an error, aren't mistaken for duplicates.
+func discardLeafIndexes(indexed []string) {
+	for _, p := range indexed {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			klog.Errorf("Failed to discard leaf index record %q: %v", p, err)
+		}
+	}
+}
+
+// Close sequences and integrates any pending entries, returning once they're committed.
+func (s *Storage) Close(ctx context.Context) error {
+	if s.readOnly {
+		return nil
+	}
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	if s.reserveBlock > 0 {
+		if err := s.releaseReservation(); err != nil {
+			return err
+		}
+	}
+	if s.integrateDone != nil {
+		close(s.integrateDone)
+	}
+	return s.releaseLease(ctx)
+}
+
+// Flush immediately sequences and integrates any pending entries, rather than waiting for their batch to fill
+// or age, and publishes a checkpoint covering them, returning once it's been written.
+func (s *Storage) Flush(ctx context.Context) error {
+	if s.readOnly {
+		return writer.ErrReadOnly
+	}
+	if err := s.pool.Flush(ctx); err != nil {
+		return err
+	}
+	if err := s.integratePending(ctx); err != nil {
+		return err
+	}
+	if s.publisher != nil {
+		if err := s.publisher.Publish(); err != nil {
+			return fmt.Errorf("failed to publish checkpoint: %v", err)
+		}
+	}
+	return nil
+}
+
+// FlushStats returns a summary of the batches flushed for sequencing since the previous call.
+func (s *Storage) FlushStats() writer.FlushStats {
+	if s.readOnly {
+		return writer.FlushStats{}
+	}
+	return s.pool.FlushStats()
+}
+
+// SequencedSize returns the size of the smallest tree containing every entry sequenced so far, or zero if none has
+// been sequenced by this process.
+func (s *Storage) SequencedSize() uint64 {
+	if s.readOnly {
+		return 0
+	}
+	return s.pool.SequencedSize()
 }
 
 // GetEntryBundle retrieves the Nth entries bundle.
@@ -119,7 +723,7 @@ func (s *Storage) GetEntryBundle(ctx context.Context, index, size uint64) ([]byt
 	if size < uint64(s.params.EntryBundleSize) {
 		bf = fmt.Sprintf("%s.%d", bf, size)
 	}
-	return os.ReadFile(filepath.Join(bd, bf))
+	return s.readBundle(filepath.Join(bd, bf))
 }
 
 // sequenceBatch writes the entries from the provided batch into the entry bundle files of the log.
@@ -143,18 +747,39 @@ func (s *Storage) sequenceBatch(ctx context.Context, batch writer.Batch) (uint64
 		s.Unlock()
 	}()
 
+	if s.lease != nil {
+		if err := s.lease.Check(ctx); err != nil {
+			return 0, err
+		}
+	}
+
 	size, _, err := s.curTree()
 	if err != nil {
 		return 0, err
 	}
-	s.curSize = size
+	// Any entries awaiting integration follow the integrated tree.
+	s.curSize = size + uint64(len(s.pending))
 
 	if len(batch.Entries) == 0 {
 		return 0, nil
 	}
+	// Entries are normally rejected as they're added, but since bundles fill over several batches they're checked
+	// again here before anything's written, so that no bundle can exceed BundleMaxBytes.
+	for _, e := range batch.Entries {
+		if err := s.checkEntrySize(e); err != nil {
+			return 0, err
+		}
+	}
 	seq := s.curSize
+	if s.reserveBlock > 0 {
+		if err := s.reserveIndices(seq + uint64(len(batch.Entries))); err != nil {
+			return 0, err
+		}
+	}
 	bundleIndex, entriesInBundle := seq/uint64(s.params.EntryBundleSize), seq%uint64(s.params.EntryBundleSize)
 	bundle := &bytes.Buffer{}
+	// written records the bundles written for this batch, which must be discarded if it fails to integrate.
+	var written []string
 	if entriesInBundle > 0 {
 		// If the latest bundle is partial, we need to read the data it contains in for our newer, larger, bundle.
 		part, err := s.GetEntryBundle(ctx, bundleIndex, entriesInBundle)
@@ -171,13 +796,16 @@ func (s *Storage) sequenceBatch(ctx context.Context, batch writer.Batch) (uint64
 		if entriesInBundle == uint64(s.params.EntryBundleSize) {
 			//  This bundle is full, so we need to write it out...
 			bd, bf := layout.SeqPath(s.path, bundleIndex)
-			if err := os.MkdirAll(bd, dirPerm); err != nil {
+			if err := os.MkdirAll(bd, s.dirMode); err != nil {
 				return 0, fmt.Errorf("failed to make seq directory structure: %w", err)
 			}
-			if err := createExclusive(filepath.Join(bd, bf), bundle.Bytes()); err != nil {
+			if err := s.writeBundle(filepath.Join(bd, bf), bundle.Bytes()); err != nil {
 				if !errors.Is(os.ErrExist, err) {
+					s.discardBundles(seq, written)
 					return 0, err
 				}
+			} else {
+				written = append(written, filepath.Join(bd, bf))
 			}
 			// ... and prepare the next entry bundle for any remaining entries in the batch
 			bundleIndex++
@@ -190,23 +818,64 @@ func (s *Storage) sequenceBatch(ctx context.Context, batch writer.Batch) (uint64
 	if entriesInBundle > 0 {
 		bd, bf := layout.SeqPath(s.path, bundleIndex)
 		bf = fmt.Sprintf("%s.%d", bf, entriesInBundle)
-		if err := os.MkdirAll(bd, dirPerm); err != nil {
+		if err := os.MkdirAll(bd, s.dirMode); err != nil {
 			return 0, fmt.Errorf("failed to make seq directory structure: %w", err)
 		}
-		if err := createExclusive(filepath.Join(bd, bf), bundle.Bytes()); err != nil {
+		if err := s.writeBundle(filepath.Join(bd, bf), bundle.Bytes()); err != nil {
 			if !errors.Is(os.ErrExist, err) {
+				s.discardBundles(seq, written)
 				return 0, err
 			}
+		} else {
+			written = append(written, filepath.Join(bd, bf))
 		}
 	}
 
+	var indexed []string
+	if s.dedup {
+		// The entries are recorded in the leaf index before they're integrated or acknowledged, so that identical
+		// leaves submitted later are always recognised as duplicates.
+		var err error
+		if indexed, err = s.writeLeafIndexes(seq, batch.Entries); err != nil {
+			discardLeafIndexes(indexed)
+			s.discardBundles(seq, written)
+			return 0, err
+		}
+	}
+	if s.integrateInterval > 0 {
+		// The entries are durably stored in their bundles, so they'll be integrated by the next integrateEvery,
+		// Flush, or recovery after a crash.
+		s.pending = append(s.pending, batch.Entries...)
+		return seq, nil
+	}
 	// For simplicitly, well in-line the integration of these new entries into the Merkle structure too.
-	return seq, s.doIntegrate(ctx, seq, batch.Entries)
+	if err := s.doIntegrate(ctx, seq, batch.Entries); err != nil {
+		discardLeafIndexes(indexed)
+		s.discardBundles(seq, written)
+		return 0, err
+	}
+	return seq, nil
+}
+
+// discardBundles removes the entry bundles written for a batch starting at index from which failed to be
+// integrated, so that its entries, whose callers have been returned an error, aren't later integrated by
+// recovery.
+// The bundles are kept if the checkpoint, and any entries awaiting integration, show the batch was integrated after all.
+func (s *Storage) discardBundles(from uint64, bundles []string) {
+	if size, _, err := s.curTree(); err != nil || size+uint64(len(s.pending)) != from {
+		klog.Warningf("Not discarding bundles for failed batch at %d, checkpoint size %d: %v", from, size, err)
+		return
+	}
+	for _, b := range bundles {
+		if err := os.Remove(b + s.compression.ext()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			klog.Errorf("Failed to discard bundle %q for failed batch at %d: %v", b, from, err)
+		}
+	}
 }
 
 // doIntegrate handles integrating new entries into the log, and updating the checkpoint.
 func (s *Storage) doIntegrate(ctx context.Context, from uint64, batch [][]byte) error {
-	newSize, newRoot, err := writer.Integrate(ctx, from, batch, s, rfc6962.DefaultHasher)
+	newSize, newRoot, err := writer.Integrate(ctx, s.params, from, batch, s, s.hasher)
 	if err != nil {
 		klog.Errorf("Failed to integrate: %v", err)
 		return err
@@ -217,11 +886,73 @@ func (s *Storage) doIntegrate(ctx context.Context, from uint64, batch [][]byte)
 	return nil
 }
 
+// integrateEvery integrates any sequenced entries awaiting integration once per interval, until done is closed.
+func (s *Storage) integrateEvery(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if err := s.integratePending(context.Background()); err != nil {
+				klog.Errorf("Failed to integrate sequenced entries: %v", err)
+			}
+		}
+	}
+}
+
+// integratePending integrates the entries which have been sequenced, but not yet integrated, in a single pass.
+// If integration fails the entries remain pending, so that it's retried by the next call.
+func (s *Storage) integratePending(ctx context.Context) error {
+	return s.withLock(func() error {
+		if len(s.pending) == 0 {
+			return nil
+		}
+		if s.lease != nil {
+			if err := s.lease.Check(ctx); err != nil {
+				return err
+			}
+		}
+		size, _, err := s.curTree()
+		if err != nil {
+			return err
+		}
+		if err := s.doIntegrate(ctx, size, s.pending); err != nil {
+			return err
+		}
+		s.pending = nil
+		return nil
+	})
+}
+
+// lockedNewTree returns a NewTreeFunc which calls newTree with the checkpoint lock held, for publishing
+// checkpoints separately from integration.
+func (s *Storage) lockedNewTree(newTree writer.NewTreeFunc) writer.NewTreeFunc {
+	return func(size uint64, root []byte) error {
+		// Check the lease with the lock held, so that a checkpoint can't be published once another writer
+		// has taken over the log.
+		return s.withLock(func() error {
+			if s.lease != nil {
+				if err := s.lease.Check(context.Background()); err != nil {
+					return err
+				}
+			}
+			return newTree(size, root)
+		})
+	}
+}
+
 // GetTile returns the tile at the given tile-level and tile-index.
 // If no complete tile exists at that location, it will attempt to find a
 // partial tile for the given tree size at that location.
-func (s *Storage) GetTile(_ context.Context, level, index, logSize uint64) (*api.Tile, error) {
-	tileSize := layout.PartialTileSize(level, index, logSize)
+func (s *Storage) GetTile(ctx context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	return s.tileCache.GetTile(ctx, level, index, logSize, s.readTile)
+}
+
+// readTile reads the tile at the given tile-level and tile-index from storage, bypassing the cache.
+func (s *Storage) readTile(_ context.Context, level, index, logSize uint64) (*api.Tile, error) {
+	tileSize := s.params.PartialTileSize(level, index, logSize)
 	p := filepath.Join(layout.TilePath(s.path, level, index, tileSize))
 	t, err := os.ReadFile(p)
 	if err != nil {
@@ -231,6 +962,11 @@ func (s *Storage) GetTile(_ context.Context, level, index, logSize uint64) (*api
 		return nil, err
 	}
 
+	t, err = tilecompress.Decompress(t)
+	if err != nil {
+		return nil, err
+	}
+
 	var tile api.Tile
 	if err := tile.UnmarshalText(t); err != nil {
 		return nil, fmt.Errorf("failed to parse tile: %w", err)
@@ -245,34 +981,30 @@ func (s *Storage) GetTile(_ context.Context, level, index, logSize uint64) (*api
 func (s *Storage) StoreTile(_ context.Context, level, index uint64, tile *api.Tile) error {
 	tileSize := uint64(tile.NumLeaves)
 	klog.V(2).Infof("StoreTile: level %d index %x ts: %x", level, index, tileSize)
-	if tileSize == 0 || tileSize > 256 {
-		return fmt.Errorf("tileSize %d must be > 0 and <= 256", tileSize)
+	if tileSize == 0 || tileSize > s.params.TileWidth() {
+		return fmt.Errorf("tileSize %d must be > 0 and <= %d", tileSize, s.params.TileWidth())
 	}
 	t, err := tile.MarshalText()
 	if err != nil {
 		return fmt.Errorf("failed to marshal tile: %w", err)
 	}
+	if s.compressTiles {
+		t = tilecompress.Compress(t)
+	}
 
-	tDir, tFile := layout.TilePath(s.path, level, index, tileSize%256)
+	tDir, tFile := layout.TilePath(s.path, level, index, tileSize%s.params.TileWidth())
 	tPath := filepath.Join(tDir, tFile)
 
-	if err := os.MkdirAll(tDir, dirPerm); err != nil {
+	if err := os.MkdirAll(tDir, s.dirMode); err != nil {
 		return fmt.Errorf("failed to create directory %q: %w", tDir, err)
 	}
 
-	// TODO(al): use unlinked temp file
-	temp := fmt.Sprintf("%s.temp", tPath)
-	if err := os.WriteFile(temp, t, filePerm); err != nil {
-		return fmt.Errorf("failed to write temporary tile file: %w", err)
-	}
-	if err := os.Rename(temp, tPath); err != nil {
-		if !errors.Is(os.ErrExist, err) {
-			return fmt.Errorf("failed to rename temporary tile file: %w", err)
-		}
-		os.Remove(temp)
+	if err := s.writeFile(tPath, t); err != nil {
+		return fmt.Errorf("failed to write tile file: %w", err)
 	}
+	s.tileCache.Invalidate(level, index)
 
-	if tileSize == 256 {
+	if tileSize == s.params.TileWidth() {
 		partials, err := filepath.Glob(fmt.Sprintf("%s.*", tPath))
 		if err != nil {
 			return fmt.Errorf("failed to list partial tiles for clean up; %w", err)
@@ -298,9 +1030,76 @@ func (s *Storage) StoreTile(_ context.Context, level, index uint64, tile *api.Ti
 }
 
 // WriteCheckpoint stores a raw log checkpoint on disk.
-func WriteCheckpoint(path string, newCPRaw []byte) error {
-	if err := createExclusive(filepath.Join(path, layout.CheckpointPath), newCPRaw); err != nil {
-		return fmt.Errorf("failed to create checkpoint file: %w", err)
+//
+// The checkpoint is written to a temporary file which is fsync'd and then renamed over the existing
+// checkpoint, so readers see either the old or the new checkpoint but never a partially written one,
+// even if the process crashes.
+//
+// Since the log is append-only, a checkpoint for a smaller tree than the existing checkpoint is refused
+// with writer.ErrCheckpointRollback, leaving the existing checkpoint in place.
+// Of the opts, only WithFileMode applies.
+func WriteCheckpoint(path string, newCPRaw []byte, opts ...Option) error {
+	_, fileMode := modes(opts)
+	newSize, err := checkpointSize(newCPRaw)
+	if err != nil {
+		return err
+	}
+	if oldCPRaw, err := ReadCheckpoint(path); err == nil {
+		oldSize, err := checkpointSize(oldCPRaw)
+		if err != nil {
+			return fmt.Errorf("existing checkpoint: %v", err)
+		}
+		if newSize < oldSize {
+			return fmt.Errorf("%w: size %d < %d", writer.ErrCheckpointRollback, newSize, oldSize)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read existing checkpoint: %w", err)
+	}
+	if err := writeDurable(filepath.Join(path, layout.CheckpointPath), newCPRaw, fileMode); err != nil {
+		return fmt.Errorf("failed to write checkpoint file: %w", err)
+	}
+	return nil
+}
+
+// writeDurable atomically replaces the contents of the file at f with d, ensuring that the new contents
+// have been flushed to stable storage before returning.
+// Any temporary files left behind by a crash are ignored by readers of f.
+func writeDurable(f string, d []byte, mode os.FileMode) (err error) {
+	dir := filepath.Dir(f)
+	tmpFile, err := os.CreateTemp(dir, "."+filepath.Base(f)+"-*")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file: %w", err)
+	}
+	tmpName := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	if err := tmpFile.Chmod(mode); err != nil {
+		return fmt.Errorf("unable to set mode of temporary file: %w", err)
+	}
+	if _, err := tmpFile.Write(d); err != nil {
+		return fmt.Errorf("unable to write to temporary file: %w", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("unable to sync temporary file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, f); err != nil {
+		return err
+	}
+	// The rename is only durable once the directory entry has been sync'd too.
+	dh, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open directory: %w", err)
+	}
+	defer dh.Close()
+	if err := dh.Sync(); err != nil {
+		return fmt.Errorf("unable to sync directory: %w", err)
 	}
 	return nil
 }
@@ -310,15 +1109,32 @@ func ReadCheckpoint(path string) ([]byte, error) {
 	return os.ReadFile(filepath.Join(path, layout.CheckpointPath))
 }
 
+// ReadCheckpoint returns the latest stored checkpoint for this log.
+func (s *Storage) ReadCheckpoint(_ context.Context) ([]byte, error) {
+	return ReadCheckpoint(s.path)
+}
+
+// writeFile atomically writes d to the file at f, flushing it to stable storage first if the
+// storage is durable.
+func (s *Storage) writeFile(f string, d []byte) error {
+	if s.durable {
+		return writeDurable(f, d, s.fileMode)
+	}
+	return createExclusive(f, d, s.fileMode)
+}
+
 // createExclusive creates a file at the given path and name before writing the data in d to it.
 // It will error if the file already exists, or it's unable to fully write the
 // data & close the file.
-func createExclusive(f string, d []byte) error {
+func createExclusive(f string, d []byte, mode os.FileMode) error {
 	tmpFile, err := os.CreateTemp(filepath.Dir(f), "")
 	if err != nil {
 		return fmt.Errorf("unable to create temporary file: %w", err)
 	}
 	tmpName := tmpFile.Name()
+	if err := tmpFile.Chmod(mode); err != nil {
+		return fmt.Errorf("unable to set mode of temporary file: %w", err)
+	}
 	n, err := tmpFile.Write(d)
 	if err != nil {
 		return fmt.Errorf("unable to write leafdata to temporary file: %w", err)
@@ -0,0 +1,1075 @@
+package posix
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
+	"github.com/AlCutter/betty/log/writer"
+	f_log "github.com/transparency-dev/formats/log"
+	"github.com/transparency-dev/merkle"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/serverless-log/api/layout"
+)
+
+// testTree holds the latest tree integrated by a Storage, standing in for its checkpoint, so that it survives the
+// Storage being reopened.
+type testTree struct {
+	mu   sync.Mutex
+	size uint64
+	root []byte
+	// updates counts the trees published with newTree.
+	updates int
+}
+
+func (t *testTree) current() (uint64, []byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.size, t.root, nil
+}
+
+func (t *testTree) newTree(size uint64, root []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.size, t.root = size, root
+	t.updates++
+	return nil
+}
+
+// testParams returns valid params with the given entry bundle size.
+func testParams(bundleSize int) log.Params {
+	return log.Params{EntryBundleSize: bundleSize}
+}
+
+// newTestStorage creates a Storage for the log at dir, whose tree is held by tree.
+func newTestStorage(t *testing.T, dir string, params log.Params, tree *testTree, opts ...Option) *Storage {
+	t.Helper()
+	s, err := New(dir, params, 10*time.Millisecond, tree.current, tree.newTree, opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+// closeStorage closes s, failing the test if that fails.
+func closeStorage(t *testing.T, s *Storage) {
+	t.Helper()
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// leaves returns n distinct leaves.
+func leaves(n int) [][]byte {
+	r := make([][]byte, n)
+	for i := range r {
+		r[i] = []byte(fmt.Sprintf("leaf %d", i))
+	}
+	return r
+}
+
+// refRoot returns the root hash of the tree containing the leaves, as per RFC6962.
+func refRoot(h merkle.LogHasher, leaves [][]byte) []byte {
+	switch n := len(leaves); n {
+	case 0:
+		return h.EmptyRoot()
+	case 1:
+		return h.HashLeaf(leaves[0])
+	default:
+		k := 1
+		for k*2 < n {
+			k *= 2
+		}
+		return h.HashChildren(refRoot(h, leaves[:k]), refRoot(h, leaves[k:]))
+	}
+}
+
+// sequenceInBatch sequences the leaves as a single batch, checking that they're assigned consecutive indices from
+// first.
+func sequenceInBatch(t *testing.T, s *Storage, first uint64, leaves [][]byte) {
+	t.Helper()
+	seqs, err := s.SequenceBatch(context.Background(), leaves)
+	if err != nil {
+		t.Fatalf("SequenceBatch: %v", err)
+	}
+	for i, idx := range seqs {
+		if want := first + uint64(i); idx != want {
+			t.Fatalf("SequenceBatch: got index %d for leaf %d, want %d", idx, i, want)
+		}
+	}
+}
+
+// checkTree checks that tree holds the root of the tree containing the leaves.
+func checkTree(t *testing.T, tree *testTree, params log.Params, leaves [][]byte) {
+	t.Helper()
+	size, root, _ := tree.current()
+	if size != uint64(len(leaves)) {
+		t.Fatalf("Got tree size %d, want %d", size, len(leaves))
+	}
+	if want := refRoot(params.Hasher(), leaves); !bytes.Equal(root, want) {
+		t.Fatalf("Got root %x, want %x", root, want)
+	}
+}
+
+func TestNewInvalidEntryBundleSize(t *testing.T) {
+	for _, size := range []int{0, -1, -256} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			dir := t.TempDir()
+			tree := &testTree{}
+			if s, err := New(dir, testParams(size), time.Second, tree.current, tree.newTree); err == nil {
+				closeStorage(t, s)
+				t.Fatalf("New succeeded with entry bundle size %d", size)
+			}
+			// Nothing is written for a log which can't be created.
+			if es, err := os.ReadDir(dir); err != nil || len(es) != 0 {
+				t.Errorf("Log directory has %d entries (%v), want none", len(es), err)
+			}
+		})
+	}
+}
+
+func TestEntryBundleSizeChange(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{name: "unchanged", size: 4},
+		{name: "larger", size: 8, wantErr: true},
+		{name: "smaller", size: 2, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tree := &testTree{}
+			s := newTestStorage(t, dir, testParams(4), tree)
+			ls := leaves(6)
+			sequenceInBatch(t, s, 0, ls)
+			closeStorage(t, s)
+
+			s, err := New(dir, testParams(test.size), time.Second, tree.current, tree.newTree)
+			if !test.wantErr {
+				if err != nil {
+					t.Fatalf("New: %v", err)
+				}
+				defer closeStorage(t, s)
+				sequenceAll(t, s, 6, leaves(1))
+				return
+			}
+			if err == nil {
+				closeStorage(t, s)
+				t.Fatalf("New succeeded with entry bundle size %d for a log created with 4", test.size)
+			}
+			if want := fmt.Sprintf("entry bundle size 4, but %d is configured", test.size); !strings.Contains(err.Error(), want) {
+				t.Errorf("New = %v, want error containing %q", err, want)
+			}
+		})
+	}
+}
+
+func TestTileHeight(t *testing.T) {
+	for _, test := range []struct {
+		height int
+		leaves int
+	}{
+		{height: 2, leaves: 37},
+		{height: 4, leaves: 300},
+		{height: 8, leaves: 300},
+		{height: 8, leaves: 70000},
+	} {
+		t.Run(fmt.Sprintf("height %d with %d leaves", test.height, test.leaves), func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			params := log.Params{EntryBundleSize: 256, TileHeight: test.height}
+			tree := &testTree{}
+			s := newTestStorage(t, dir, params, tree)
+			ls := leaves(test.leaves)
+			sequenceInBatch(t, s, 0, ls)
+			checkTree(t, tree, params, ls)
+
+			h := params.Hasher()
+			size, root, _ := tree.current()
+			pb, err := reader.NewProofBuilder(ctx, params, size, h.HashChildren, s)
+			if err != nil {
+				t.Fatalf("NewProofBuilder: %v", err)
+			}
+			for _, idx := range []uint64{0, 1, size / 2, size - 1} {
+				p, err := pb.InclusionProof(ctx, idx)
+				if err != nil {
+					t.Fatalf("InclusionProof(%d): %v", idx, err)
+				}
+				if err := proof.VerifyInclusion(h, idx, size, h.HashLeaf(ls[idx]), p, root); err != nil {
+					t.Errorf("VerifyInclusion(%d, %d): %v", idx, size, err)
+				}
+			}
+			// The first tile is full, so holds one node for each of the tile width's worth of leaves.
+			tile, err := s.GetTile(ctx, 0, 0, size)
+			if err != nil {
+				t.Fatalf("GetTile: %v", err)
+			}
+			if got, want := uint64(tile.NumLeaves), min(params.TileWidth(), size); got != want {
+				t.Errorf("Got tile of width %d, want %d", got, want)
+			}
+
+			// The tile height can't change over the life of the log.
+			params.TileHeight = log.MaxTileHeight
+			if test.height == log.MaxTileHeight {
+				params.TileHeight = 1
+			}
+			if _, err := New(dir, params, time.Second, tree.current, tree.newTree); err == nil {
+				t.Errorf("New succeeded with tile height %d for a log created with height %d", params.TileHeight, test.height)
+			}
+		})
+	}
+}
+
+// sequenceAll sequences each of the leaves in turn, checking that they're assigned consecutive indices from first.
+func sequenceAll(t *testing.T, s *Storage, first uint64, leaves [][]byte) {
+	t.Helper()
+	for i, l := range leaves {
+		idx, err := s.Sequence(context.Background(), l)
+		if err != nil {
+			t.Fatalf("Sequence(%q): %v", l, err)
+		}
+		if want := first + uint64(i); idx != want {
+			t.Fatalf("Sequence(%q): got index %d, want %d", l, idx, want)
+		}
+	}
+}
+
+// notifyClock is a FakeClock which signals timers whenever a timer is set, which a Pool does as the first entry of
+// each batch arrives, so that tests can tell when entries are pending.
+type notifyClock struct {
+	*writer.FakeClock
+	timers chan struct{}
+}
+
+func newNotifyClock() *notifyClock {
+	return &notifyClock{FakeClock: writer.NewFakeClock(time.Now()), timers: make(chan struct{}, 100)}
+}
+
+func (c *notifyClock) AfterFunc(d time.Duration, f func()) writer.Timer {
+	t := c.FakeClock.AfterFunc(d, f)
+	c.timers <- struct{}{}
+	return t
+}
+
+func TestFlushByAge(t *testing.T) {
+	ctx := context.Background()
+	params := testParams(8)
+	tree := &testTree{}
+	clock := newNotifyClock()
+	s := newTestStorage(t, t.TempDir(), params, tree, WithClock(clock))
+	defer closeStorage(t, s)
+	ls := leaves(3)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.SequenceBatch(ctx, ls)
+		errc <- err
+	}()
+	<-clock.timers
+	// Too few entries to fill a batch are flushed once the fake clock reaches the max age of 10ms given by
+	// newTestStorage, without sleeping.
+	clock.Advance(9 * time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("SequenceBatch returned %v before the batch reached its max age", err)
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if err := <-errc; err != nil {
+		t.Fatalf("SequenceBatch: %v", err)
+	}
+	checkTree(t, tree, params, ls)
+}
+
+func TestIntegrationFailure(t *testing.T) {
+	tilePath := func(dir string, size uint64) string {
+		d, f := layout.TilePath(dir, 0, 0, size)
+		return filepath.Join(d, f)
+	}
+	bundlePath := func(dir string, index uint64, suffix string) string {
+		d, f := layout.SeqPath(dir, index)
+		return filepath.Join(d, f+suffix)
+	}
+	for _, test := range []struct {
+		name string
+		// n leaves are added to a log of 3 leaves, with entry bundles of 8.
+		n int
+		// blocked returns the path of the file, written for the batch, which is made impossible to write by
+		// occupying it with a directory.
+		blocked func(dir string) string
+		// discarded returns the paths of files written for the batch before the failure, which must be removed.
+		discarded func(dir string) []string
+	}{
+		{
+			name:      "tile write",
+			n:         2,
+			blocked:   func(dir string) string { return tilePath(dir, 5) },
+			discarded: func(dir string) []string { return []string{bundlePath(dir, 0, ".5")} },
+		}, {
+			name:      "entry bundle write",
+			n:         6,
+			blocked:   func(dir string) string { return bundlePath(dir, 1, ".1") },
+			discarded: func(dir string) []string { return []string{bundlePath(dir, 0, "")} },
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			params := testParams(8)
+			tree := &testTree{}
+			s := newTestStorage(t, dir, params, tree)
+			defer closeStorage(t, s)
+			ls := leaves(3 + test.n)
+			sequenceInBatch(t, s, 0, ls[:3])
+			updates := tree.updates
+
+			blocked := test.blocked(dir)
+			if err := os.MkdirAll(filepath.Join(blocked, "blocker"), 0o755); err != nil {
+				t.Fatalf("MkdirAll: %v", err)
+			}
+			// The callers of a batch which fails to integrate get an error, rather than indices which aren't in
+			// the tree...
+			if seqs, err := s.SequenceBatch(context.Background(), ls[3:]); err == nil {
+				t.Fatalf("SequenceBatch succeeded with indices %v, despite a write failing", seqs)
+			}
+			// ... the checkpoint isn't advanced...
+			checkTree(t, tree, params, ls[:3])
+			if tree.updates != updates {
+				t.Errorf("Tree was published %d times after the failure", tree.updates-updates)
+			}
+			// ... and whatever was written for the batch is discarded, so that it isn't integrated on recovery.
+			for _, p := range test.discarded(dir) {
+				if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("Stat(%q) for the failed batch: got %v, want ErrNotExist", p, err)
+				}
+			}
+
+			// Once the failure is resolved, the same entries are sequenced at the same indices.
+			if err := os.RemoveAll(blocked); err != nil {
+				t.Fatalf("RemoveAll: %v", err)
+			}
+			sequenceInBatch(t, s, 3, ls[3:])
+			checkTree(t, tree, params, ls)
+		})
+	}
+}
+
+func TestCloseIntegratesPending(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		pending int
+	}{
+		{name: "one entry", pending: 1},
+		{name: "just under the bundle size", pending: 7},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			params := log.Params{EntryBundleSize: 8}
+			tree := &testTree{}
+			// The batch is never flushed by age during the test, only by Close.
+			s, err := New(dir, params, time.Hour, tree.current, tree.newTree)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			ls := leaves(test.pending)
+			errc := make(chan error, 1)
+			go func() {
+				_, err := s.SequenceBatch(ctx, ls)
+				errc <- err
+			}()
+			// Close may be called before the entries reach the pool, in which case it has nothing to flush.
+			for done := false; !done; {
+				if err := s.Close(ctx); err != nil {
+					t.Fatalf("Close: %v", err)
+				}
+				select {
+				case err := <-errc:
+					if err != nil {
+						t.Fatalf("SequenceBatch: %v", err)
+					}
+					done = true
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			checkTree(t, tree, params, ls)
+
+			// The entries were persisted, so are recovered when the log is reopened.
+			s = newTestStorage(t, dir, params, tree)
+			sequenceAll(t, s, uint64(test.pending), leaves(1))
+		})
+	}
+}
+
+func TestDedupConcurrent(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		callers int
+		opts    []Option
+	}{
+		{name: "one caller", callers: 1, opts: []Option{WithDedup()}},
+		{name: "many callers", callers: 50, opts: []Option{WithDedup()}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			params := log.Params{EntryBundleSize: 8}
+			tree := &testTree{}
+			s := newTestStorage(t, t.TempDir(), params, tree, test.opts...)
+			defer closeStorage(t, s)
+
+			var wg sync.WaitGroup
+			idx := make([]uint64, test.callers)
+			errs := make([]error, test.callers)
+			for i := range test.callers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					idx[i], errs[i] = s.Sequence(ctx, []byte("same"))
+				}()
+			}
+			wg.Wait()
+			added := 0
+			for i := range test.callers {
+				switch {
+				case errs[i] == nil:
+					added++
+				case !errors.Is(errs[i], writer.ErrDupeLeaf):
+					t.Fatalf("Sequence: %v", errs[i])
+				}
+				if idx[i] != 0 {
+					t.Errorf("Caller %d got index %d, want 0", i, idx[i])
+				}
+			}
+			if added != 1 {
+				t.Errorf("Leaf was added by %d callers, want 1", added)
+			}
+			// Identical leaves submitted later are still duplicates, and new leaves aren't.
+			if idx, err := s.Sequence(ctx, []byte("same")); !errors.Is(err, writer.ErrDupeLeaf) || idx != 0 {
+				t.Errorf("Sequence(same): got (%d, %v), want (0, ErrDupeLeaf)", idx, err)
+			}
+			if idx, err := s.Sequence(ctx, []byte("different")); err != nil || idx != 1 {
+				t.Errorf("Sequence(different): got (%d, %v), want (1, nil)", idx, err)
+			}
+		})
+	}
+}
+
+func TestDedupCallerCancelled(t *testing.T) {
+	tree := &testTree{}
+	// Batches are only flushed when full or by Close, so the first caller is still waiting when it's cancelled.
+	s, err := New(t.TempDir(), testParams(8), time.Hour, tree.current, tree.newTree, WithDedup())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	cctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := s.Sequence(cctx, []byte("leaf"))
+		first <- err
+	}()
+	// Give the first caller time to start adding the leaf, so that the second joins it.
+	time.Sleep(50 * time.Millisecond)
+	type result struct {
+		idx uint64
+		err error
+	}
+	second := make(chan result)
+	go func() {
+		idx, err := s.Sequence(context.Background(), []byte("leaf"))
+		second <- result{idx, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("Cancelled caller got %v, want context.Canceled", err)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// The leaf is still added on behalf of the caller which wasn't cancelled.
+	if r := <-second; r.err != nil && !errors.Is(r.err, writer.ErrDupeLeaf) || r.idx != 0 {
+		t.Errorf("Second caller got (%d, %v), want index 0", r.idx, r.err)
+	}
+	checkTree(t, tree, testParams(8), [][]byte{[]byte("leaf")})
+}
+
+func TestDedupSubmitterCancelled(t *testing.T) {
+	for _, callers := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d callers", callers), func(t *testing.T) {
+			dir := t.TempDir()
+			tree := &testTree{}
+			// Batches are only flushed when full or by Close, so the callers are still waiting when they're cancelled.
+			s, err := New(dir, testParams(8), time.Hour, tree.current, tree.newTree, WithDedup())
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			var cancels []context.CancelFunc
+			var done []chan error
+			for range callers {
+				cctx, cancel := context.WithCancel(context.Background())
+				d := make(chan error)
+				go func() {
+					_, err := s.Sequence(cctx, []byte("leaf"))
+					d <- err
+				}()
+				cancels, done = append(cancels, cancel), append(done, d)
+			}
+			time.Sleep(50 * time.Millisecond)
+			// The callers give up in turn, the last of which withdraws the leaf.
+			for i, cancel := range cancels {
+				cancel()
+				if err := <-done[i]; !errors.Is(err, context.Canceled) {
+					t.Errorf("Cancelled caller %d got %v, want context.Canceled", i, err)
+				}
+			}
+			if err := s.Close(context.Background()); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			// With no callers left waiting for it, the leaf is neither committed nor indexed, so resubmitting it
+			// adds it afresh.
+			if size, _, _ := tree.current(); size != 0 {
+				t.Errorf("Got tree size %d, want 0", size)
+			}
+			s = newTestStorage(t, dir, testParams(8), tree, WithDedup())
+			defer closeStorage(t, s)
+			if idx, err := s.Sequence(context.Background(), []byte("leaf")); err != nil || idx != 0 {
+				t.Errorf("Resubmitted leaf got (%d, %v), want index 0", idx, err)
+			}
+		})
+	}
+}
+
+func TestDedupBatch(t *testing.T) {
+	ctx := context.Background()
+	params := testParams(4)
+	tree := &testTree{}
+	s := newTestStorage(t, t.TempDir(), params, tree, WithDedup())
+	defer closeStorage(t, s)
+
+	// Entries sequenced in a batch aren't deduplicated, but are recorded so that later identical leaves are.
+	ls := leaves(3)
+	sequenceInBatch(t, s, 0, append(ls, ls[0]))
+	for i, l := range ls {
+		if idx, err := s.Sequence(ctx, l); !errors.Is(err, writer.ErrDupeLeaf) || idx != uint64(i) {
+			t.Errorf("Sequence(%q): got (%d, %v), want (%d, ErrDupeLeaf)", l, idx, err, i)
+		}
+	}
+	checkTree(t, tree, params, append(ls, ls[0]))
+}
+
+// checkpointTree stores the trees integrated by a Storage as unsigned checkpoints in the log's directory, as
+// bettyfe does with signed ones.
+type checkpointTree struct {
+	dir string
+}
+
+func (c checkpointTree) current() (uint64, []byte, error) {
+	raw, err := ReadCheckpoint(c.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	cp := &f_log.Checkpoint{}
+	if _, err := cp.Unmarshal(raw); err != nil {
+		return 0, nil, err
+	}
+	return cp.Size, cp.Hash, nil
+}
+
+func (c checkpointTree) newTree(size uint64, root []byte) error {
+	return WriteCheckpoint(c.dir, f_log.Checkpoint{Origin: "example.com/log", Size: size, Hash: root}.Marshal())
+}
+
+func TestCheckpointCrash(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// tmp is the contents of the temporary file left behind by a crash while writing a checkpoint.
+		tmp []byte
+	}{
+		{name: "empty", tmp: nil},
+		{name: "partially written", tmp: []byte("example.com/log\n9\n")},
+		{name: "not renamed", tmp: f_log.Checkpoint{Origin: "example.com/log", Size: 9, Hash: []byte("not the root")}.Marshal()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			params := log.Params{EntryBundleSize: 4}
+			tree := checkpointTree{dir: dir}
+			s, err := New(dir, params, 10*time.Millisecond, tree.current, tree.newTree)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			ls := leaves(5)
+			for _, l := range ls {
+				if _, err := s.Sequence(ctx, l); err != nil {
+					t.Fatalf("Sequence: %v", err)
+				}
+			}
+			closeStorage(t, s)
+			good, err := ReadCheckpoint(dir)
+			if err != nil {
+				t.Fatalf("ReadCheckpoint: %v", err)
+			}
+
+			// The crash happened before the temporary file was renamed over the checkpoint.
+			tmp, err := os.CreateTemp(dir, "."+filepath.Base(layout.CheckpointPath)+"-*")
+			if err != nil {
+				t.Fatalf("CreateTemp: %v", err)
+			}
+			if _, err := tmp.Write(test.tmp); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			tmp.Close()
+			if got, err := ReadCheckpoint(dir); err != nil || !bytes.Equal(got, good) {
+				t.Fatalf("ReadCheckpoint = (%q, %v), want %q", got, err, good)
+			}
+
+			// The log recovers from the last good checkpoint.
+			s, err = New(dir, params, 10*time.Millisecond, tree.current, tree.newTree)
+			if err != nil {
+				t.Fatalf("New after crash: %v", err)
+			}
+			defer closeStorage(t, s)
+			if idx, err := s.Sequence(ctx, []byte("after crash")); err != nil || idx != 5 {
+				t.Fatalf("Sequence after crash: got (%d, %v), want (5, nil)", idx, err)
+			}
+			size, root, err := tree.current()
+			if err != nil {
+				t.Fatalf("Failed to read checkpoint: %v", err)
+			}
+			if want := refRoot(params.Hasher(), append(ls, []byte("after crash"))); size != 6 || !bytes.Equal(root, want) {
+				t.Errorf("Got checkpoint of size %d with root %x, want size 6 with root %x", size, root, want)
+			}
+		})
+	}
+}
+
+// readEntries returns the first n entries of the log, read from its entry bundles.
+func readEntries(t *testing.T, s *Storage, params log.Params, n int) [][]byte {
+	t.Helper()
+	var r [][]byte
+	for i := 0; i < n; i += params.EntryBundleSize {
+		size := min(params.EntryBundleSize, n-i)
+		raw, err := s.GetEntryBundle(context.Background(), uint64(i/params.EntryBundleSize), uint64(size))
+		if err != nil {
+			t.Fatalf("GetEntryBundle(%d, %d): %v", i/params.EntryBundleSize, size, err)
+		}
+		for _, l := range bytes.Split(bytes.TrimSuffix(raw, []byte("\n")), []byte("\n")) {
+			e, err := base64.StdEncoding.DecodeString(string(l))
+			if err != nil {
+				t.Fatalf("Invalid bundle entry %q: %v", l, err)
+			}
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+func TestDurableReopen(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		opts  []Option
+		n     int
+		batch bool
+	}{
+		{name: "partial bundle", opts: []Option{WithDurable()}, n: 3},
+		{name: "several bundles", opts: []Option{WithDurable()}, n: 10},
+		{name: "batch", opts: []Option{WithDurable()}, n: 10, batch: true},
+		{name: "not durable", n: 10},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			params := log.Params{EntryBundleSize: 4}
+			tree := &testTree{}
+			ls := leaves(test.n)
+			s := newTestStorage(t, dir, params, tree, test.opts...)
+			if test.batch {
+				sequenceInBatch(t, s, 0, ls)
+			} else {
+				sequenceAll(t, s, 0, ls)
+			}
+			closeStorage(t, s)
+
+			s = newTestStorage(t, dir, params, tree, test.opts...)
+			defer closeStorage(t, s)
+			if got := readEntries(t, s, params, test.n); !slices.EqualFunc(got, ls, bytes.Equal) {
+				t.Errorf("Got entries %q after reopening, want %q", got, ls)
+			}
+			checkTree(t, tree, params, ls)
+			// The reopened log carries on from where it left off.
+			sequenceAll(t, s, uint64(test.n), [][]byte{[]byte("after reopening")})
+		})
+	}
+}
+
+func TestRecoverFromStaleCheckpoint(t *testing.T) {
+	const n = 10
+	for _, test := range []struct {
+		name string
+		// size is that of the checkpoint left behind, or -1 if there's none.
+		size int
+	}{
+		{name: "missing", size: -1},
+		{name: "empty", size: 0},
+		{name: "within first bundle", size: 2},
+		{name: "bundle boundary", size: 4},
+		{name: "within last bundle", size: 9},
+		{name: "up to date", size: n},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			params := testParams(4)
+			tree := checkpointTree{dir: dir}
+			ls := leaves(n)
+			s, err := New(dir, params, 10*time.Millisecond, tree.current, tree.newTree)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			sequenceAll(t, s, 0, ls)
+			closeStorage(t, s)
+
+			// Truncate the log's checkpoint, as if the writer had crashed before updating it.
+			cpPath := filepath.Join(dir, layout.CheckpointPath)
+			if err := os.Remove(cpPath); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+			if test.size >= 0 {
+				if err := tree.newTree(uint64(test.size), refRoot(params.Hasher(), ls[:test.size])); err != nil {
+					t.Fatalf("Failed to write checkpoint: %v", err)
+				}
+			}
+
+			// Recovery is idempotent, so reopening the log repeatedly makes no difference.
+			for range 2 {
+				s, err := New(dir, params, 10*time.Millisecond, tree.current, tree.newTree)
+				if err != nil {
+					t.Fatalf("New after truncating checkpoint: %v", err)
+				}
+				closeStorage(t, s)
+				size, root, err := tree.current()
+				if err != nil {
+					t.Fatalf("Failed to read checkpoint: %v", err)
+				}
+				if want := refRoot(params.Hasher(), ls); size != n || !bytes.Equal(root, want) {
+					t.Fatalf("Got recovered checkpoint of size %d with root %x, want size %d with root %x", size, root, n, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRecoveryRebuildsLeafIndex(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	params := testParams(4)
+	tree := &testTree{}
+	s := newTestStorage(t, dir, params, tree, WithDedup())
+	ls := leaves(6)
+	sequenceAll(t, s, 0, ls)
+	closeStorage(t, s)
+
+	// Simulate a crash after the entry bundles were written, but before either the leaf index or the checkpoint.
+	if err := os.RemoveAll(filepath.Join(dir, "leaves")); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	tree = &testTree{}
+	s = newTestStorage(t, dir, params, tree, WithDedup())
+	defer closeStorage(t, s)
+	if size, _, _ := tree.current(); size != uint64(len(ls)) {
+		t.Fatalf("Got recovered tree of size %d, want %d", size, len(ls))
+	}
+	for i, l := range ls {
+		if idx, err := s.Sequence(ctx, l); !errors.Is(err, writer.ErrDupeLeaf) || idx != uint64(i) {
+			t.Errorf("Sequence(%q): got (%d, %v), want (%d, ErrDupeLeaf)", l, idx, err, i)
+		}
+	}
+}
+
+func TestBundleMaxBytes(t *testing.T) {
+	// Entries of up to 10 bytes are accepted, so that a complete bundle of 4 holds no more than 40.
+	params := log.Params{EntryBundleSize: 4, BundleMaxBytes: 40}
+	for _, test := range []struct {
+		name string
+		// batches holds the sizes of the entries sequenced together, and those containing an entry of over 10 bytes
+		// must be rejected.
+		batches [][]int
+	}{
+		{name: "small entries", batches: [][]int{{1, 2, 3}, {4, 5}, {6}}},
+		{name: "largest entries", batches: [][]int{{10}, {10, 10, 10}, {10, 10}}},
+		{name: "bundles filled over several batches", batches: [][]int{{10}, {10}, {10}, {10}, {10}}},
+		{name: "too large", batches: [][]int{{3}, {11}, {4}}},
+		{name: "too large within a batch", batches: [][]int{{1}, {1, 11, 1}, {2, 2}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			tree := &testTree{}
+			s := newTestStorage(t, t.TempDir(), params, tree)
+
+			var added [][]byte
+			for _, sizes := range test.batches {
+				var b [][]byte
+				for _, n := range sizes {
+					b = append(b, bytes.Repeat([]byte{byte(len(added) + len(b))}, n))
+				}
+				var err error
+				if len(b) == 1 {
+					_, err = s.Sequence(ctx, b[0])
+				} else {
+					_, err = s.SequenceBatch(ctx, b)
+				}
+				if slices.Max(sizes) > 10 {
+					if !errors.Is(err, writer.ErrEntryTooLarge) {
+						t.Fatalf("Got %v, want ErrEntryTooLarge", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Sequence: %v", err)
+				}
+				added = append(added, b...)
+			}
+			closeStorage(t, s)
+			// Rejected entries mustn't have been sequenced alongside any others.
+			checkTree(t, tree, params, added)
+			for i := 0; i < len(added); i += params.EntryBundleSize {
+				n := min(params.EntryBundleSize, len(added)-i)
+				raw, err := s.GetEntryBundle(ctx, uint64(i/params.EntryBundleSize), uint64(n))
+				if err != nil {
+					t.Fatalf("GetEntryBundle: %v", err)
+				}
+				size := 0
+				for _, l := range bytes.Split(bytes.TrimSuffix(raw, []byte("\n")), []byte("\n")) {
+					e, err := base64.StdEncoding.DecodeString(string(l))
+					if err != nil {
+						t.Fatalf("Invalid bundle entry %q: %v", l, err)
+					}
+					size += len(e)
+				}
+				if size > params.BundleMaxBytes {
+					t.Errorf("Bundle %d holds %d bytes of entries, want at most %d", i/params.EntryBundleSize, size, params.BundleMaxBytes)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteCheckpointRollback(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		cp   []byte
+		// wantRollback is set if the checkpoint should be refused as a rollback, and wantErr if it should be refused
+		// for any other reason.
+		wantRollback, wantErr bool
+	}{
+		{name: "larger", cp: testCheckpoint(6)},
+		{name: "same size", cp: testCheckpoint(5)},
+		{name: "smaller", cp: testCheckpoint(4), wantRollback: true},
+		{name: "empty tree", cp: testCheckpoint(0), wantRollback: true},
+		{name: "invalid", cp: []byte("not a checkpoint\n"), wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := WriteCheckpoint(dir, testCheckpoint(5)); err != nil {
+				t.Fatalf("WriteCheckpoint(5): %v", err)
+			}
+			err := WriteCheckpoint(dir, test.cp)
+			if got := errors.Is(err, writer.ErrCheckpointRollback); got != test.wantRollback {
+				t.Fatalf("WriteCheckpoint: got err %v, want rollback %t", err, test.wantRollback)
+			}
+			if gotErr := err != nil; gotErr != (test.wantRollback || test.wantErr) {
+				t.Fatalf("WriteCheckpoint: got err %v, want err %t", err, test.wantRollback || test.wantErr)
+			}
+			want := test.cp
+			if err != nil {
+				// A refused checkpoint leaves the existing one in place.
+				want = testCheckpoint(5)
+			}
+			got, err := ReadCheckpoint(dir)
+			if err != nil {
+				t.Fatalf("ReadCheckpoint: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Checkpoint on disk is %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestModes(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		opts              []Option
+		dirMode, fileMode os.FileMode
+	}{
+		{name: "defaults", dirMode: dirPerm, fileMode: filePerm},
+		{name: "owner only", opts: []Option{WithDirMode(0o700), WithFileMode(0o600)}, dirMode: 0o700, fileMode: 0o600},
+		{name: "group readable", opts: []Option{WithDirMode(0o750), WithFileMode(0o640)}, dirMode: 0o750, fileMode: 0o640},
+		{name: "durable", opts: []Option{WithDirMode(0o700), WithFileMode(0o600), WithDurable()}, dirMode: 0o700, fileMode: 0o600},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tree := checkpointTree{dir: dir}
+			// The leaf index and checkpoint are written too.
+			opts := append([]Option{WithDedup()}, test.opts...)
+			s, err := New(dir, testParams(4), 10*time.Millisecond, tree.current, func(size uint64, root []byte) error {
+				return WriteCheckpoint(dir, f_log.Checkpoint{Origin: "example.com/log", Size: size, Hash: root}.Marshal(), test.opts...)
+			}, opts...)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			sequenceInBatch(t, s, 0, leaves(6))
+			closeStorage(t, s)
+
+			var files int
+			if err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+				if err != nil || p == dir {
+					return err
+				}
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					// Directories are created with the mode less the umask, but never more.
+					if perm := fi.Mode().Perm(); perm&^test.dirMode != 0 || perm&0o700 != test.dirMode&0o700 {
+						t.Errorf("Directory %s has mode %v, want %v less the umask", p, perm, test.dirMode)
+					}
+					return nil
+				}
+				files++
+				if perm := fi.Mode().Perm(); perm != test.fileMode {
+					t.Errorf("File %s has mode %v, want %v", p, perm, test.fileMode)
+				}
+				return nil
+			}); err != nil {
+				t.Fatalf("WalkDir: %v", err)
+			}
+			if files == 0 {
+				t.Fatal("No files were written")
+			}
+		})
+	}
+}
+
+func TestDedupWithConfiguredHash(t *testing.T) {
+	for _, h := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		t.Run(h.String(), func(t *testing.T) {
+			ctx := context.Background()
+			params := testParams(4)
+			params.Hash = h
+			tree := &testTree{}
+			s := newTestStorage(t, t.TempDir(), params, tree, WithDedup())
+			defer closeStorage(t, s)
+
+			ls := leaves(3)
+			sequenceAll(t, s, 0, ls)
+			idx, err := s.Sequence(ctx, ls[1])
+			if !errors.Is(err, writer.ErrDupeLeaf) || idx != 1 {
+				t.Errorf("Sequence(duplicate): got (%d, %v), want (1, ErrDupeLeaf)", idx, err)
+			}
+			// The leaf index is keyed by the log's leaf hashes.
+			if idx, err := s.LeafIndex(ctx, params.Hasher().HashLeaf(ls[2])); err != nil || idx != 2 {
+				t.Errorf("LeafIndex: got (%d, %v), want (2, nil)", idx, err)
+			}
+			if err := s.Flush(ctx); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			checkTree(t, tree, params, ls)
+		})
+	}
+}
+
+func TestIntegrateInterval(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		batches    int
+		batchSize  int
+		interval   time.Duration
+		flush      bool
+		wantPasses int
+	}{
+		// The interval is long enough that the entries are only integrated by Flush.
+		{name: "one batch", batches: 1, batchSize: 4, interval: time.Hour, flush: true, wantPasses: 1},
+		{name: "full batches", batches: 5, batchSize: 4, interval: time.Hour, flush: true, wantPasses: 1},
+		{name: "partial batches", batches: 7, batchSize: 3, interval: time.Hour, flush: true, wantPasses: 1},
+		// The batches are sequenced well within the interval, so are integrated together by the next tick, or at
+		// worst split across two.
+		{name: "ticker", batches: 10, batchSize: 4, interval: 500 * time.Millisecond, wantPasses: 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			params := testParams(4)
+			tree := &testTree{}
+			s := newTestStorage(t, dir, params, tree, WithIntegrateInterval(test.interval))
+			defer closeStorage(t, s)
+			ls := leaves(test.batches * test.batchSize)
+			for i := range test.batches {
+				first := i * test.batchSize
+				sequenceInBatch(t, s, uint64(first), ls[first:first+test.batchSize])
+			}
+			if test.flush {
+				// Sequencing returns before the entries are integrated.
+				if size, _, _ := tree.current(); size != 0 {
+					t.Fatalf("Got tree of size %d before integration, want 0", size)
+				}
+				if err := s.Flush(context.Background()); err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+			} else {
+				for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+					if size, _, _ := tree.current(); size == uint64(len(ls)) {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatal("Sequenced entries weren't integrated by the ticker")
+					}
+				}
+			}
+			checkTree(t, tree, params, ls)
+			tree.mu.Lock()
+			passes := tree.updates
+			tree.mu.Unlock()
+			if passes < 1 || passes > test.wantPasses {
+				t.Errorf("%d batches were integrated in %d passes, want at most %d", test.batches, passes, test.wantPasses)
+			}
+		})
+	}
+}
+
+func TestIntegrateIntervalRecovery(t *testing.T) {
+	dir := t.TempDir()
+	params := testParams(4)
+	tree := &testTree{}
+	s := newTestStorage(t, dir, params, tree, WithIntegrateInterval(time.Hour))
+	ls := leaves(10)
+	sequenceInBatch(t, s, 0, ls[:4])
+	sequenceInBatch(t, s, 4, ls[4:])
+	// Simulate a crash before the sequenced entries are integrated, by abandoning the storage without closing it.
+	close(s.integrateDone)
+	if size, _, _ := tree.current(); size != 0 {
+		t.Fatalf("Got tree of size %d before integration, want 0", size)
+	}
+
+	// The entries were durably stored in their bundles, so are integrated when the log is reopened.
+	s = newTestStorage(t, dir, params, tree)
+	defer closeStorage(t, s)
+	checkTree(t, tree, params, ls)
+	sequenceAll(t, s, uint64(len(ls)), leaves(1))
+}
@@ -0,0 +1,89 @@
+package posix
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	f_log "github.com/transparency-dev/formats/log"
+)
+
+// HistoryDir is the directory, relative to the log root, under which historic checkpoints are archived,
+// in files named by the decimal tree size.
+const HistoryDir = "checkpoint.history"
+
+// ArchiveCheckpoint stores a copy of the raw checkpoint under the history directory, so that it can be
+// retrieved with ReadCheckpointAt once the log has grown.
+// If keep is greater than zero, only the keep checkpoints for the largest trees are retained.
+// Of the opts, only WithDirMode and WithFileMode apply.
+func ArchiveCheckpoint(path string, cpRaw []byte, keep int, opts ...Option) error {
+	size, err := checkpointSize(cpRaw)
+	if err != nil {
+		return err
+	}
+	dirMode, fileMode := modes(opts)
+	dir := filepath.Join(path, HistoryDir)
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return fmt.Errorf("failed to create history directory: %v", err)
+	}
+	if err := writeDurable(filepath.Join(dir, strconv.FormatUint(size, 10)), cpRaw, fileMode); err != nil {
+		return fmt.Errorf("failed to archive checkpoint: %v", err)
+	}
+	if keep > 0 {
+		return pruneHistory(dir, keep)
+	}
+	return nil
+}
+
+// pruneHistory removes all but the keep checkpoints for the largest trees from dir.
+func pruneHistory(dir string, keep int) error {
+	es, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list history directory: %v", err)
+	}
+	var sizes []uint64
+	for _, e := range es {
+		s, err := strconv.ParseUint(e.Name(), 10, 64)
+		if err != nil {
+			// Not an archived checkpoint, e.g. a temporary file.
+			continue
+		}
+		sizes = append(sizes, s)
+	}
+	if len(sizes) <= keep {
+		return nil
+	}
+	slices.Sort(sizes)
+	for _, s := range sizes[:len(sizes)-keep] {
+		if err := os.Remove(filepath.Join(dir, strconv.FormatUint(s, 10))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to prune archived checkpoint: %v", err)
+		}
+	}
+	return nil
+}
+
+// ReadCheckpointAt returns the archived checkpoint for the tree of the given size.
+func ReadCheckpointAt(path string, size uint64) ([]byte, error) {
+	return os.ReadFile(filepath.Join(path, HistoryDir, strconv.FormatUint(size, 10)))
+}
+
+// ReadCheckpointAt returns the archived checkpoint for the tree of the given size.
+func (s *Storage) ReadCheckpointAt(_ context.Context, size uint64) ([]byte, error) {
+	return ReadCheckpointAt(s.path, size)
+}
+
+// checkpointSize returns the tree size committed to by the raw checkpoint, without verifying its signatures.
+func checkpointSize(cpRaw []byte) (uint64, error) {
+	// The note text ends with a blank line, before the signatures.
+	text, _, _ := bytes.Cut(cpRaw, []byte("\n\n"))
+	cp := &f_log.Checkpoint{}
+	if _, err := cp.Unmarshal(append(text, '\n')); err != nil {
+		return 0, fmt.Errorf("failed to parse checkpoint: %v", err)
+	}
+	return cp.Size, nil
+}
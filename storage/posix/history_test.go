@@ -0,0 +1,80 @@
+package posix
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	f_log "github.com/transparency-dev/formats/log"
+)
+
+// testCheckpoint returns an unsigned checkpoint for a tree of the given size.
+func testCheckpoint(size uint64) []byte {
+	return f_log.Checkpoint{Origin: "example.com/log", Size: size, Hash: []byte{byte(size)}}.Marshal()
+}
+
+func TestArchiveCheckpoint(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		sizes []uint64
+		keep  int
+		// want are the sizes of the archived checkpoints which should be retrievable, and gone those which shouldn't.
+		want, gone []uint64
+	}{
+		{name: "all retained", sizes: []uint64{0, 1, 5, 10}, want: []uint64{0, 1, 5, 10}},
+		{name: "pruned", sizes: []uint64{0, 1, 5, 10}, keep: 2, want: []uint64{5, 10}, gone: []uint64{0, 1}},
+		{name: "out of order", sizes: []uint64{10, 1, 5, 0}, keep: 2, want: []uint64{5, 10}, gone: []uint64{0, 1}},
+		{name: "fewer than kept", sizes: []uint64{3, 7}, keep: 5, want: []uint64{3, 7}},
+		{name: "rewritten", sizes: []uint64{3, 3, 7}, keep: 2, want: []uint64{3, 7}},
+		{name: "never written", sizes: []uint64{3}, want: []uint64{3}, gone: []uint64{2, 4}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, size := range test.sizes {
+				if err := ArchiveCheckpoint(dir, testCheckpoint(size), test.keep); err != nil {
+					t.Fatalf("ArchiveCheckpoint(%d): %v", size, err)
+				}
+			}
+			for _, size := range test.want {
+				got, err := ReadCheckpointAt(dir, size)
+				if err != nil {
+					t.Fatalf("ReadCheckpointAt(%d): %v", size, err)
+				}
+				if want := testCheckpoint(size); !bytes.Equal(got, want) {
+					t.Errorf("ReadCheckpointAt(%d) = %q, want %q", size, got, want)
+				}
+			}
+			for _, size := range test.gone {
+				if _, err := ReadCheckpointAt(dir, size); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("ReadCheckpointAt(%d): got %v, want ErrNotExist", size, err)
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveCheckpointIgnoresOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := ArchiveCheckpoint(dir, testCheckpoint(1), 1); err != nil {
+		t.Fatalf("ArchiveCheckpoint: %v", err)
+	}
+	// A temporary file left behind by a crash isn't an archived checkpoint, so isn't pruned.
+	tmp := filepath.Join(dir, HistoryDir, ".2-123")
+	if err := os.WriteFile(tmp, nil, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := ArchiveCheckpoint(dir, testCheckpoint(2), 1); err != nil {
+		t.Fatalf("ArchiveCheckpoint: %v", err)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("Stat(%q): %v", tmp, err)
+	}
+	if _, err := ReadCheckpointAt(dir, 2); err != nil {
+		t.Errorf("ReadCheckpointAt(2): %v", err)
+	}
+	if err := ArchiveCheckpoint(dir, []byte("not a checkpoint"), 1); err == nil {
+		t.Error("ArchiveCheckpoint succeeded with an invalid checkpoint")
+	}
+}
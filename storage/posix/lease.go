@@ -0,0 +1,81 @@
+package posix
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AlCutter/betty/log/writer"
+	"k8s.io/klog/v2"
+)
+
+// WithWriterLease fences the log so that only a single writer at a time may add entries to it.
+//
+// The lease is renewed in the background, and is considered stale if it isn't renewed within ttl.
+// If takeover is true, a stale lease held by another writer will be taken over, otherwise New will fail.
+func WithWriterLease(ttl time.Duration, takeover bool) Option {
+	return func(s *Storage) {
+		s.lease = writer.NewLease(leaseFile{path: filepath.Join(s.path, writer.LeasePath), s: s}, ttl, takeover)
+	}
+}
+
+// leaseFile implements writer.LeaseStorage using a file at the given path, written with the storage's file mode.
+type leaseFile struct {
+	path string
+	s    *Storage
+}
+
+func (f leaseFile) ReadLease(_ context.Context) ([]byte, error) {
+	return os.ReadFile(f.path)
+}
+
+func (f leaseFile) WriteLease(_ context.Context, l []byte) error {
+	return writeDurable(f.path, l, f.s.fileMode)
+}
+
+func (f leaseFile) DeleteLease(_ context.Context) error {
+	return os.Remove(f.path)
+}
+
+// acquireLease takes the writer lease, if one is configured, and starts renewing it in the background.
+func (s *Storage) acquireLease(ctx context.Context) error {
+	if s.lease == nil {
+		return nil
+	}
+	if err := s.withLock(func() error { return s.lease.Acquire(ctx) }); err != nil {
+		return err
+	}
+	s.leaseDone = make(chan struct{})
+	go s.renewLease(s.leaseDone)
+	return nil
+}
+
+// renewLease periodically renews the writer lease until done is closed, or the lease is lost.
+func (s *Storage) renewLease(done <-chan struct{}) {
+	t := time.NewTicker(s.lease.TTL() / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if err := s.withLock(func() error { return s.lease.Renew(context.Background()) }); err != nil {
+				klog.Errorf("Failed to renew writer lease: %v", err)
+				if errors.Is(err, writer.ErrLeaseLost) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// releaseLease stops renewing the writer lease, if one is configured, and gives it up.
+func (s *Storage) releaseLease(ctx context.Context) error {
+	if s.lease == nil {
+		return nil
+	}
+	close(s.leaseDone)
+	return s.withLock(func() error { return s.lease.Release(ctx) })
+}
@@ -0,0 +1,94 @@
+package posix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log/writer"
+)
+
+func TestWriterLease(t *testing.T) {
+	const ttl = time.Minute
+	for _, test := range []struct {
+		name string
+		// staleFor is how long before the second writer starts that the first last renewed its lease, or zero if
+		// the first writer is still running.
+		staleFor time.Duration
+		takeover bool
+		wantErr  error
+	}{
+		{name: "held", wantErr: writer.ErrLeaseHeld},
+		{name: "held with takeover", takeover: true, wantErr: writer.ErrLeaseHeld},
+		{name: "not yet stale", staleFor: ttl / 2, takeover: true, wantErr: writer.ErrLeaseHeld},
+		{name: "stale", staleFor: 2 * ttl, wantErr: writer.ErrLeaseHeld},
+		{name: "stale with takeover", staleFor: 2 * ttl, takeover: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			params := testParams(4)
+			tree := &testTree{}
+			first := newTestStorage(t, dir, params, tree, WithWriterLease(ttl, false))
+			sequenceAll(t, first, 0, leaves(3))
+			if test.staleFor > 0 {
+				// The first writer crashed, leaving its lease behind.
+				p := filepath.Join(dir, writer.LeasePath)
+				var r map[string]any
+				raw, err := os.ReadFile(p)
+				if err != nil {
+					t.Fatalf("ReadFile: %v", err)
+				}
+				if err := json.Unmarshal(raw, &r); err != nil {
+					t.Fatalf("Invalid lease: %v", err)
+				}
+				r["renewed"] = time.Now().Add(-test.staleFor)
+				if raw, err = json.Marshal(r); err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+				if err := os.WriteFile(p, raw, 0o644); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+			}
+
+			second, err := New(dir, params, 10*time.Millisecond, tree.current, tree.newTree, WithWriterLease(ttl, test.takeover))
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Starting second writer: got %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				// The first writer carries on regardless.
+				sequenceAll(t, first, 3, [][]byte{[]byte("first")})
+				closeStorage(t, first)
+				return
+			}
+			defer closeStorage(t, second)
+			// The log can't be forked by a writer which has lost its lease.
+			if _, err := first.Sequence(ctx, []byte("first")); !errors.Is(err, writer.ErrLeaseLost) {
+				t.Errorf("Sequence on first writer: got %v, want ErrLeaseLost", err)
+			}
+			if err := first.Close(ctx); !errors.Is(err, writer.ErrLeaseLost) {
+				t.Errorf("Close on first writer: got %v, want ErrLeaseLost", err)
+			}
+			sequenceAll(t, second, 3, [][]byte{[]byte("second")})
+			checkTree(t, tree, params, append(leaves(3), []byte("second")))
+		})
+	}
+}
+
+func TestWriterLeaseReleased(t *testing.T) {
+	dir := t.TempDir()
+	params := testParams(4)
+	tree := &testTree{}
+	s := newTestStorage(t, dir, params, tree, WithWriterLease(time.Minute, false))
+	sequenceAll(t, s, 0, leaves(3))
+	closeStorage(t, s)
+
+	// A clean shutdown gives up the lease, so the log may be reopened straight away.
+	s = newTestStorage(t, dir, params, tree, WithWriterLease(time.Minute, false))
+	defer closeStorage(t, s)
+	sequenceAll(t, s, 3, leaves(1))
+}
@@ -0,0 +1,46 @@
+package posix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/AlCutter/betty/log/writer"
+)
+
+// EntryMetaDir is the directory, relative to the log root, under which the metadata stored alongside entries is
+// kept, in files named by the entry's index.
+// The metadata isn't committed to by the tree, so its integrity relies on the storage alone.
+const EntryMetaDir = "entry.meta"
+
+// WriteEntryMeta stores metadata alongside the entry at the given index, e.g. the time it was submitted and by
+// whom, replacing any previously stored.
+func (s *Storage) WriteEntryMeta(_ context.Context, index uint64, meta []byte) error {
+	if s.readOnly {
+		return writer.ErrReadOnly
+	}
+	d, f := entryMetaPath(s.path, index)
+	if err := os.MkdirAll(d, s.dirMode); err != nil {
+		return fmt.Errorf("failed to make entry metadata directory structure: %w", err)
+	}
+	return writeDurable(filepath.Join(d, f), meta, s.fileMode)
+}
+
+// ReadEntryMeta returns the metadata stored alongside the entry at the given index.
+// If none was stored, the returned error will satisfy errors.Is(err, os.ErrNotExist).
+func (s *Storage) ReadEntryMeta(_ context.Context, index uint64) ([]byte, error) {
+	d, f := entryMetaPath(s.path, index)
+	return os.ReadFile(filepath.Join(d, f))
+}
+
+// entryMetaPath returns the directory and file name in which the metadata of the entry at the given index is stored,
+// which are fanned out in the same way as entry bundles, so that no directory holds more than 256 files.
+func entryMetaPath(root string, index uint64) (string, string) {
+	d := filepath.Join(root, EntryMetaDir,
+		fmt.Sprintf("%02x", index>>32),
+		fmt.Sprintf("%02x", (index>>24)&0xff),
+		fmt.Sprintf("%02x", (index>>16)&0xff),
+		fmt.Sprintf("%02x", (index>>8)&0xff))
+	return d, fmt.Sprintf("%02x", index&0xff)
+}
@@ -0,0 +1,92 @@
+package posix
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AlCutter/betty/log/writer"
+)
+
+func TestEntryMeta(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	tree := &testTree{}
+	s := newTestStorage(t, dir, testParams(4), tree)
+	defer closeStorage(t, s)
+	for _, test := range []struct {
+		name  string
+		index uint64
+		metas []string
+	}{
+		{name: "first", index: 0, metas: []string{"ts=1 by=alice"}},
+		{name: "end of directory", index: 255, metas: []string{"ts=2"}},
+		{name: "next directory", index: 256, metas: []string{"ts=3"}},
+		{name: "beyond 32 bits", index: 1<<32 + 5, metas: []string{"ts=4"}},
+		{name: "empty", index: 7, metas: []string{""}},
+		{name: "replaced", index: 9, metas: []string{"ts=5", "ts=6"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, m := range test.metas {
+				if err := s.WriteEntryMeta(ctx, test.index, []byte(m)); err != nil {
+					t.Fatalf("WriteEntryMeta: %v", err)
+				}
+			}
+			got, err := s.ReadEntryMeta(ctx, test.index)
+			if err != nil {
+				t.Fatalf("ReadEntryMeta: %v", err)
+			}
+			if want := test.metas[len(test.metas)-1]; string(got) != want {
+				t.Errorf("ReadEntryMeta(%d) = %q, want %q", test.index, got, want)
+			}
+		})
+	}
+	if _, err := s.ReadEntryMeta(ctx, 1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadEntryMeta of an index without metadata = %v, want an error satisfying os.ErrNotExist", err)
+	}
+	// The metadata is stored apart from the entries, so doesn't affect the tree.
+	if size, _, _ := tree.current(); size != 0 {
+		t.Errorf("Got tree of size %d after storing metadata, want 0", size)
+	}
+}
+
+func TestEntryMetaReadOnly(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	tree := &testTree{}
+	s := newTestStorage(t, dir, testParams(4), tree)
+	sequenceAll(t, s, 0, leaves(1))
+	if err := s.WriteEntryMeta(ctx, 0, []byte("meta")); err != nil {
+		t.Fatalf("WriteEntryMeta: %v", err)
+	}
+	closeStorage(t, s)
+
+	s = newTestStorage(t, dir, testParams(4), tree, WithReadOnly())
+	defer closeStorage(t, s)
+	if err := s.WriteEntryMeta(ctx, 0, []byte("other")); !errors.Is(err, writer.ErrReadOnly) {
+		t.Errorf("WriteEntryMeta on read-only storage = %v, want %v", err, writer.ErrReadOnly)
+	}
+	if got, err := s.ReadEntryMeta(ctx, 0); err != nil || string(got) != "meta" {
+		t.Errorf("ReadEntryMeta on read-only storage = (%q, %v), want %q", got, err, "meta")
+	}
+}
+
+func TestEntryMetaPath(t *testing.T) {
+	for _, test := range []struct {
+		index uint64
+		want  string
+	}{
+		{index: 0, want: "entry.meta/00/00/00/00/00"},
+		{index: 0xff, want: "entry.meta/00/00/00/00/ff"},
+		{index: 0x1234, want: "entry.meta/00/00/00/12/34"},
+		{index: 0x12345678, want: "entry.meta/00/12/34/56/78"},
+		{index: 0x1234567890, want: "entry.meta/12/34/56/78/90"},
+	} {
+		d, f := entryMetaPath("", test.index)
+		if got := filepath.ToSlash(filepath.Join(d, f)); got != test.want {
+			t.Errorf("entryMetaPath(%#x) = %q, want %q", test.index, got, test.want)
+		}
+	}
+}
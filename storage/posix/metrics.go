@@ -0,0 +1,25 @@
+package posix
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dedupLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "betty_dedup_lookups_total",
+		Help: "Total number of leaves checked for duplicates, by result: hit if the leaf was already in the log, miss otherwise.",
+	}, []string{"result"})
+	dedupFilterSkips = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "betty_dedup_filter_skips_total",
+		Help: "Total number of new leaves for which the dedup filter saved a leaf index lookup.",
+	})
+	dedupFilterEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "betty_dedup_filter_entries",
+		Help: "Number of leaf hashes added to the in-memory dedup filter. Entries are never evicted, the false positive rate rises once this exceeds the filter's configured size.",
+	})
+	dedupFilterBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "betty_dedup_filter_bytes",
+		Help: "Memory used by the in-memory dedup filter.",
+	})
+)
@@ -0,0 +1,117 @@
+package posix
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gaugeValue returns the current value of the gauge.
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestDedupMetrics(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// filterSize, if non-zero, enables the dedup filter.
+		filterSize int
+		// adds are the leaves sequenced, in turn, by their index in leaves.
+		adds                 []int
+		wantHits, wantMisses float64
+		wantFilterEntries    float64
+	}{
+		{name: "new leaves", adds: []int{0, 1, 2}, wantMisses: 3},
+		{name: "duplicates", adds: []int{0, 1, 0, 1, 0}, wantHits: 3, wantMisses: 2},
+		{name: "filter", filterSize: 100, adds: []int{0, 1, 0, 2}, wantHits: 1, wantMisses: 3, wantFilterEntries: 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			hits, misses := counterValue(t, dedupLookups.WithLabelValues("hit")), counterValue(t, dedupLookups.WithLabelValues("miss"))
+			entries, bytes := gaugeValue(t, dedupFilterEntries), gaugeValue(t, dedupFilterBytes)
+			opts := []Option{WithDedup()}
+			if test.filterSize > 0 {
+				opts = append(opts, WithDedupFilter(test.filterSize))
+			}
+			s := newTestStorage(t, t.TempDir(), testParams(4), &testTree{}, opts...)
+			defer closeStorage(t, s)
+			ls := leaves(len(test.adds))
+			for _, i := range test.adds {
+				if _, err := s.Sequence(ctx, ls[i]); err != nil && !errors.Is(err, writer.ErrDupeLeaf) {
+					t.Fatalf("Sequence(%q): %v", ls[i], err)
+				}
+			}
+			if got := counterValue(t, dedupLookups.WithLabelValues("hit")) - hits; got != test.wantHits {
+				t.Errorf("Hits increased by %v, want %v", got, test.wantHits)
+			}
+			if got := counterValue(t, dedupLookups.WithLabelValues("miss")) - misses; got != test.wantMisses {
+				t.Errorf("Misses increased by %v, want %v", got, test.wantMisses)
+			}
+			if got := gaugeValue(t, dedupFilterEntries) - entries; got != test.wantFilterEntries {
+				t.Errorf("Filter entries increased by %v, want %v", got, test.wantFilterEntries)
+			}
+			// The filter's memory is accounted for when it's created.
+			if got := gaugeValue(t, dedupFilterBytes) - bytes; (got > 0) != (test.filterSize > 0) {
+				t.Errorf("Filter bytes increased by %v with a filter of size %d", got, test.filterSize)
+			}
+		})
+	}
+}
+
+// histogramSample returns the sample count and sum of the registered histogram with the given name.
+func histogramSample(t *testing.T, name string) (uint64, float64) {
+	t.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			h := mf.GetMetric()[0].GetHistogram()
+			return h.GetSampleCount(), h.GetSampleSum()
+		}
+	}
+	t.Fatalf("No metric named %q", name)
+	return 0, 0
+}
+
+func TestIntegrationBatchEntriesMetric(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// Each of the batches is sequenced in turn, and is flushed either because it fills the bundle or by age.
+		batches []int
+	}{
+		{name: "full batches", batches: []int{8, 8}},
+		{name: "timed out batches", batches: []int{1, 3, 2}},
+		{name: "differing sizes", batches: []int{3, 8, 1, 5}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tree := &testTree{}
+			s := newTestStorage(t, t.TempDir(), testParams(8), tree)
+			defer closeStorage(t, s)
+			count, sum := histogramSample(t, "betty_integration_batch_entries")
+			next, wantSum := 0, 0
+			for _, n := range test.batches {
+				sequenceInBatch(t, s, uint64(next), leaves(next + n)[next:])
+				next += n
+				wantSum += n
+			}
+			gotCount, gotSum := histogramSample(t, "betty_integration_batch_entries")
+			if d := gotCount - count; d != uint64(len(test.batches)) {
+				t.Errorf("Got %d samples, want one for each of the %d batches", d, len(test.batches))
+			}
+			if d := gotSum - sum; d != float64(wantSum) {
+				t.Errorf("Got samples summing to %v, want %d", d, wantSum)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package posix
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/AlCutter/betty/storage/storagetest"
+)
+
+// TestConformance runs the storagetest suite against the options which don't change when entries are integrated, since
+// the suite expects them to be as soon as they're sequenced.
+func TestConformance(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "default"},
+		{name: "dedup", opts: []Option{WithDedup()}},
+		{name: "compressed", opts: []Option{WithBundleCompression(CompressionZstd), WithTileCompression()}},
+		{name: "sharded", opts: []Option{WithSequencerShards(4)}},
+		{name: "index reservation", opts: []Option{WithIndexReservation(16)}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			storagetest.RunConformance(t, func(t *testing.T) storagetest.OpenFunc {
+				dir := t.TempDir()
+				return func(t *testing.T, params log.Params, ct writer.CurrentTreeFunc, nt writer.NewTreeFunc) storagetest.Storage {
+					s, err := New(dir, params, 10*time.Millisecond, ct, nt, test.opts...)
+					if err != nil {
+						t.Fatalf("New: %v", err)
+					}
+					return s
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	storagetest.RunAddBenchmark(b, func(b *testing.B, params log.Params, ct writer.CurrentTreeFunc, nt writer.NewTreeFunc) storagetest.Storage {
+		s, err := New(b.TempDir(), params, 10*time.Millisecond, ct, nt)
+		if err != nil {
+			b.Fatalf("New: %v", err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,154 @@
+package posix
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/transparency-dev/serverless-log/api/layout"
+	"k8s.io/klog/v2"
+)
+
+// recover integrates any entries found in entry bundles beyond the current checkpoint, which can happen
+// if a writer crashed after storing the bundles but before updating the checkpoint.
+//
+// Since re-integrating entries overwrites any tiles with identical contents, this is safe to call repeatedly.
+func (s *Storage) recover(ctx context.Context) error {
+	return s.withLock(func() error { return s.recoverLocked(ctx) })
+}
+
+// recoverLocked does the work of recover, and must be called with the checkpoint lock held.
+func (s *Storage) recoverLocked(ctx context.Context) error {
+	size, _, err := s.curTree()
+	if err != nil {
+		return err
+	}
+	s.curSize = size
+
+	if ahead, err := s.tilesAhead(size); err != nil {
+		return err
+	} else if ahead {
+		klog.Warningf("Found tiles beyond checkpoint size %d", size)
+	}
+
+	entries, err := s.entriesAfter(size)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	klog.Infof("Recovering %d entries beyond checkpoint size %d", len(entries), size)
+	if s.dedup {
+		// The writer may have crashed before recording the entries in the leaf index.
+		if _, err := s.writeLeafIndexes(size, entries); err != nil {
+			return fmt.Errorf("failed to index recovered entries: %v", err)
+		}
+	}
+	return s.doIntegrate(ctx, size, entries)
+}
+
+// entriesAfter returns the contents of any entry bundles for indices at or beyond size.
+func (s *Storage) entriesAfter(size uint64) ([][]byte, error) {
+	bundleSize := uint64(s.params.EntryBundleSize)
+	var r [][]byte
+	for i := size / bundleSize; ; i++ {
+		b, n, err := s.latestBundle(i)
+		if errors.Is(err, os.ErrNotExist) {
+			return r, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first := i * bundleSize; first < size {
+			// This bundle also contains already integrated entries, so check that it extends the integrated
+			// bundle, rather than being left over from an earlier failed write.
+			integrated, err := s.GetEntryBundle(context.Background(), i, size-first)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read integrated entry bundle %d: %v", i, err)
+			}
+			if !bytes.HasPrefix(b, integrated) {
+				klog.Warningf("Ignoring entry bundle %d.%d which is inconsistent with the checkpoint", i, n)
+				return r, nil
+			}
+		}
+		lines := bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n"))
+		if uint64(len(lines)) != n {
+			return nil, fmt.Errorf("entry bundle %d.%d contains %d entries", i, n, len(lines))
+		}
+		for j, l := range lines {
+			if i*bundleSize+uint64(j) < size {
+				continue
+			}
+			e, err := base64.StdEncoding.DecodeString(string(l))
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry %d in bundle %d: %v", j, i, err)
+			}
+			r = append(r, e)
+		}
+		if n < bundleSize {
+			// Only the last bundle may be partial.
+			return r, nil
+		}
+	}
+}
+
+// latestBundle returns the largest stored version of the entry bundle at the given index, along
+// with the number of entries it contains.
+func (s *Storage) latestBundle(index uint64) ([]byte, uint64, error) {
+	bundleSize := uint64(s.params.EntryBundleSize)
+	if b, err := s.GetEntryBundle(context.Background(), index, bundleSize); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return b, bundleSize, err
+	}
+	bd, bf := layout.SeqPath(s.path, index)
+	n, err := largestSuffix(filepath.Join(bd, bf), 10)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n == 0 {
+		return nil, 0, fmt.Errorf("entry bundle %d: %w", index, os.ErrNotExist)
+	}
+	b, err := s.GetEntryBundle(context.Background(), index, n)
+	return b, n, err
+}
+
+// tilesAhead returns true if there is a level zero tile stored for a tree larger than size.
+func (s *Storage) tilesAhead(size uint64) (bool, error) {
+	tw := s.params.TileWidth()
+	tDir, tFile := layout.TilePath(s.path, 0, size/tw, 0)
+	p := filepath.Join(tDir, tFile)
+	if _, err := os.Stat(p); err == nil {
+		return true, nil
+	}
+	// Partial tile sizes are hex encoded in the filename.
+	n, err := largestSuffix(p, 16)
+	if err != nil {
+		return false, err
+	}
+	return n > size%tw, nil
+}
+
+// largestSuffix returns the largest N, encoded in the given base, for which a file named "<p>.N" exists,
+// optionally followed by a compression extension, or zero if there are none.
+func largestSuffix(p string, base int) (uint64, error) {
+	fs, err := filepath.Glob(p + ".*")
+	if err != nil {
+		return 0, err
+	}
+	var r uint64
+	for _, f := range fs {
+		n, err := strconv.ParseUint(trimCompressionExt(strings.TrimPrefix(f, p+".")), base, 64)
+		if err != nil {
+			// Not a partial, e.g. a temporary file.
+			continue
+		}
+		r = max(r, n)
+	}
+	return r, nil
+}
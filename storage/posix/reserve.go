@@ -0,0 +1,87 @@
+package posix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/AlCutter/betty/log/writer"
+	"k8s.io/klog/v2"
+)
+
+// reservationPath is the path, relative to the log root, of the high-water mark of the indices reserved with
+// WithIndexReservation.
+const reservationPath = "seq.reserved"
+
+// readReservation returns the persisted high-water mark of the reserved indices, or zero if none have been reserved.
+func (s *Storage) readReservation() (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(s.path, reservationPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	r, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", reservationPath, err)
+	}
+	return r, nil
+}
+
+// reserveIndices ensures that the indices below end have been reserved, durably persisting a new high-water mark a
+// block beyond end if not.
+// Must be called with the lock held.
+func (s *Storage) reserveIndices(end uint64) error {
+	if end <= s.reserved {
+		return nil
+	}
+	r := end + s.reserveBlock
+	if err := writeDurable(filepath.Join(s.path, reservationPath), []byte(strconv.FormatUint(r, 10)), s.fileMode); err != nil {
+		return fmt.Errorf("failed to reserve indices up to %d: %v", r, err)
+	}
+	klog.V(1).Infof("Reserved indices up to %d", r)
+	s.reserved = r
+	return nil
+}
+
+// releaseReservation lowers the high-water mark to the size of the tree, once every sequenced entry has been
+// integrated, so that the unused indices of the reserved block aren't skipped after a clean shutdown.
+func (s *Storage) releaseReservation() error {
+	return s.withLock(func() error {
+		size, _, err := s.curTree()
+		if err != nil {
+			return err
+		}
+		if err := writeDurable(filepath.Join(s.path, reservationPath), []byte(strconv.FormatUint(size, 10)), s.fileMode); err != nil {
+			return fmt.Errorf("failed to release reserved indices: %v", err)
+		}
+		s.reserved = size
+		return nil
+	})
+}
+
+// skipReserved fills any indices between the recovered tree and the reserved high-water mark with empty entries,
+// since they may have been assigned to entries which were lost in a crash, so must never be reused.
+func (s *Storage) skipReserved(ctx context.Context) error {
+	reserved, err := s.readReservation()
+	if err != nil {
+		return err
+	}
+	size, _, err := s.curTree()
+	if err != nil {
+		return err
+	}
+	if reserved <= size {
+		s.reserved = reserved
+		return nil
+	}
+	klog.Warningf("Skipping indices [%d, %d) reserved before a crash, which are filled with empty entries", size, reserved)
+	s.reserved = reserved
+	_, err = s.sequenceBatch(ctx, writer.Batch{Entries: make([][]byte, reserved-size)})
+	return err
+}
@@ -0,0 +1,87 @@
+package posix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestIndexReservationCrash(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		block uint64
+		added int
+		// crash is set if the storage isn't closed cleanly.
+		crash bool
+		// lose is set if the crash loses everything but the reservation, as a power loss could without WithDurable.
+		lose bool
+	}{
+		{name: "clean restart", block: 8, added: 5},
+		{name: "crash", block: 8, added: 5, crash: true},
+		{name: "lost entries", block: 8, added: 5, crash: true, lose: true},
+		{name: "lost entries over several blocks", block: 3, added: 10, crash: true, lose: true},
+		{name: "lost entries filling block", block: 4, added: 4, crash: true, lose: true},
+		{name: "large block", block: 100, added: 7, crash: true, lose: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			params := testParams(4)
+			tree := &testTree{}
+			s := newTestStorage(t, dir, params, tree, WithIndexReservation(test.block))
+			ls := leaves(test.added)
+			sequenceAll(t, s, 0, ls)
+			// The reservation is released by a clean shutdown, but not by a crash.
+			reserved, err := os.ReadFile(filepath.Join(dir, reservationPath))
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			closeStorage(t, s)
+
+			want := ls
+			if test.crash {
+				if err := os.WriteFile(filepath.Join(dir, reservationPath), reserved, filePerm); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+			}
+			if test.lose {
+				for _, d := range []string{"seq", "tile"} {
+					if err := os.RemoveAll(filepath.Join(dir, d)); err != nil {
+						t.Fatalf("RemoveAll: %v", err)
+					}
+				}
+				tree = &testTree{}
+				want = nil
+			}
+			s = newTestStorage(t, dir, params, tree, WithIndexReservation(test.block))
+			defer closeStorage(t, s)
+			idx, err := s.Sequence(ctx, []byte("after crash"))
+			if err != nil {
+				t.Fatalf("Sequence: %v", err)
+			}
+			if idx < uint64(test.added) {
+				t.Fatalf("Index %d assigned before the crash was reused", idx)
+			}
+			if limit := uint64(test.added) + test.block; idx > limit {
+				t.Errorf("Got index %d, want at most %d indices skipped", idx, test.block)
+			}
+			if !test.crash && idx != uint64(test.added) {
+				t.Errorf("Got index %d after a clean restart, want %d", idx, test.added)
+			}
+			// The skipped indices are filled with empty entries.
+			for uint64(len(want)) < idx {
+				want = append(want, []byte{})
+			}
+			checkTree(t, tree, params, append(slices.Clip(want), []byte("after crash")))
+			es, err := s.entriesAfter(0)
+			if err != nil {
+				t.Fatalf("entriesAfter: %v", err)
+			}
+			if got := uint64(len(es)); got != idx+1 {
+				t.Errorf("Got %d stored entries, want %d", got, idx+1)
+			}
+		})
+	}
+}
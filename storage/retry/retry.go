@@ -0,0 +1,94 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retry retries storage operations which fail transiently, e.g. because an object storage service
+// responded with a 5xx error or throttled the request, with exponential backoff and jitter.
+package retry
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/klog/v2"
+)
+
+var retries = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "betty_storage_write_retries_total",
+	Help: "Total number of storage writes retried after failing transiently.",
+})
+
+// Policy configures how many times, and for how long, an operation is retried.
+type Policy struct {
+	// MaxAttempts is the max number of times the operation is attempted, including the first.
+	// Values less than 1 are treated as 1, i.e. the operation isn't retried.
+	MaxAttempts int
+	// InitialBackoff is the max delay before the first retry, which doubles for each subsequent retry up to
+	// MaxBackoff, if set. The actual delay is chosen at random up to this max, so that the retries of concurrent
+	// operations which failed together are spread out.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Deadline, if non-zero, is the max time from the first attempt after which no further attempts are made.
+	Deadline time.Duration
+}
+
+// DefaultPolicy is the Policy used by the object storage backends unless configured otherwise.
+var DefaultPolicy = Policy{
+	MaxAttempts:    5,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Deadline:       30 * time.Second,
+}
+
+// Do calls f until it succeeds, returns an error for which retryable returns false, or the policy's attempts or
+// deadline are exhausted, returning the last error in the latter cases.
+// The context bounds the whole operation: Do gives up as soon as it's done rather than waiting to retry.
+func Do(ctx context.Context, p Policy, retryable func(error) bool, f func(context.Context) error) error {
+	start := time.Now()
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := f(ctx)
+		if err == nil || !retryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+		d := time.Duration(0)
+		if backoff > 0 {
+			d = rand.N(backoff)
+		}
+		if p.Deadline > 0 && time.Since(start)+d > p.Deadline {
+			return fmt.Errorf("%w (gave up retrying after %d attempts)", err, attempt)
+		}
+		klog.V(1).Infof("Retrying in %v after attempt %d failed: %v", d, attempt, err)
+		retries.Inc()
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+		backoff *= 2
+		if p.MaxBackoff > 0 {
+			backoff = min(backoff, p.MaxBackoff)
+		}
+	}
+}
+
+// IsTransientStatus returns true if the HTTP status returned by a storage service indicates that the request
+// may succeed if retried, i.e. that it was throttled or the service had an internal error.
+func IsTransientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
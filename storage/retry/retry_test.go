@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var (
+	errTransient = errors.New("transient")
+	errPermanent = errors.New("permanent")
+)
+
+func isTransient(err error) bool { return errors.Is(err, errTransient) }
+
+// fakeWriter fails with the given errors, in turn, before succeeding.
+type fakeWriter struct {
+	errs     []error
+	attempts int
+}
+
+func (w *fakeWriter) write(context.Context) error {
+	w.attempts++
+	if w.attempts <= len(w.errs) {
+		return w.errs[w.attempts-1]
+	}
+	return nil
+}
+
+func TestDo(t *testing.T) {
+	fast := Policy{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	for _, test := range []struct {
+		name         string
+		p            Policy
+		errs         []error
+		wantErr      error
+		wantAttempts int
+	}{
+		{name: "success", p: fast, wantAttempts: 1},
+		{name: "fails twice then succeeds", p: fast, errs: []error{errTransient, errTransient}, wantAttempts: 3},
+		{name: "no backoff", p: Policy{MaxAttempts: 3}, errs: []error{errTransient, errTransient}, wantAttempts: 3},
+		{name: "permanent error", p: fast, errs: []error{errTransient, errPermanent}, wantErr: errPermanent, wantAttempts: 2},
+		{name: "attempts exhausted", p: Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, errs: []error{errTransient, errTransient, errTransient, errTransient}, wantErr: errTransient, wantAttempts: 3},
+		{name: "no retries", p: Policy{}, errs: []error{errTransient}, wantErr: errTransient, wantAttempts: 1},
+		{name: "deadline", p: Policy{MaxAttempts: 5, InitialBackoff: time.Hour, Deadline: time.Millisecond}, errs: []error{errTransient, errTransient}, wantErr: errTransient, wantAttempts: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := &fakeWriter{errs: test.errs}
+			err := Do(context.Background(), test.p, isTransient, w.write)
+			if !errors.Is(err, test.wantErr) || (err == nil) != (test.wantErr == nil) {
+				t.Errorf("Do = %v, want %v", err, test.wantErr)
+			}
+			if w.attempts != test.wantAttempts {
+				t.Errorf("Got %d attempts, want %d", w.attempts, test.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestDoContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &fakeWriter{errs: []error{errTransient, errTransient}}
+	start := time.Now()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	// The backoff is long enough that the test times out if Do waits for it.
+	err := Do(ctx, Policy{MaxAttempts: 3, InitialBackoff: time.Hour}, isTransient, w.write)
+	if !errors.Is(err, errTransient) {
+		t.Errorf("Do = %v, want %v", err, errTransient)
+	}
+	if w.attempts != 1 {
+		t.Errorf("Got %d attempts, want 1", w.attempts)
+	}
+	if d := time.Since(start); d > time.Minute {
+		t.Errorf("Do took %v to return after the context was cancelled", d)
+	}
+}
+
+func TestIsTransientStatus(t *testing.T) {
+	for _, test := range []struct {
+		code int
+		want bool
+	}{
+		{code: http.StatusTooManyRequests, want: true},
+		{code: http.StatusInternalServerError, want: true},
+		{code: http.StatusServiceUnavailable, want: true},
+		{code: http.StatusBadRequest},
+		{code: http.StatusNotFound},
+		{code: http.StatusPreconditionFailed},
+		{code: http.StatusOK},
+	} {
+		if got := IsTransientStatus(test.code); got != test.want {
+			t.Errorf("IsTransientStatus(%d) = %t, want %t", test.code, got, test.want)
+		}
+	}
+}
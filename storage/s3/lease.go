@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"k8s.io/klog/v2"
+)
+
+// Option configures optional behaviour of the storage.
+type Option func(*Storage)
+
+// WithWriterLease fences the log so that only a single writer at a time may add entries to it.
+//
+// The lease is renewed in the background, and is considered stale if it isn't renewed within ttl.
+// If takeover is true, a stale lease held by another writer will be taken over, otherwise New will fail.
+func WithWriterLease(ttl time.Duration, takeover bool) Option {
+	return func(s *Storage) {
+		s.lease = writer.NewLease(&leaseObject{client: s.client, bucket: s.bucket, key: path.Join(s.prefix, writer.LeasePath)}, ttl, takeover)
+	}
+}
+
+// leaseObject implements writer.LeaseStorage using an S3 object.
+type leaseObject struct {
+	client *s3.Client
+	bucket string
+	key    string
+}
+
+func (o *leaseObject) ReadLease(ctx context.Context) ([]byte, error) {
+	return readObject(ctx, o.client, o.bucket, o.key)
+}
+
+func (o *leaseObject) WriteLease(ctx context.Context, l []byte) error {
+	return writeObject(ctx, o.client, o.bucket, o.key, l)
+}
+
+func (o *leaseObject) DeleteLease(ctx context.Context) error {
+	_, err := o.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(o.bucket),
+		Key:    aws.String(o.key),
+	})
+	return err
+}
+
+// withLock calls f while holding both the mutex and the checkpoint lock object.
+func (s *Storage) withLock(ctx context.Context, f func() error) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.lockCP(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.unlockCP(ctx); err != nil {
+			klog.Errorf("Failed to release lock: %v", err)
+		}
+	}()
+	return f()
+}
+
+// acquireLease takes the writer lease, if one is configured, and starts renewing it in the background.
+func (s *Storage) acquireLease(ctx context.Context) error {
+	if s.lease == nil {
+		return nil
+	}
+	if err := s.withLock(ctx, func() error { return s.lease.Acquire(ctx) }); err != nil {
+		return err
+	}
+	s.leaseDone = make(chan struct{})
+	go s.renewLease(s.leaseDone)
+	return nil
+}
+
+// renewLease periodically renews the writer lease until done is closed, or the lease is lost.
+func (s *Storage) renewLease(done <-chan struct{}) {
+	t := time.NewTicker(s.lease.TTL() / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			ctx := context.Background()
+			if err := s.withLock(ctx, func() error { return s.lease.Renew(ctx) }); err != nil {
+				klog.Errorf("Failed to renew writer lease: %v", err)
+				if errors.Is(err, writer.ErrLeaseLost) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// releaseLease stops renewing the writer lease, if one is configured, and gives it up.
+func (s *Storage) releaseLease(ctx context.Context) error {
+	if s.lease == nil {
+		return nil
+	}
+	close(s.leaseDone)
+	return s.withLock(ctx, func() error { return s.lease.Release(ctx) })
+}
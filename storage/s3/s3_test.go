@@ -0,0 +1,146 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/AlCutter/betty/storage/storagetest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// testRun distinguishes the objects written by this run of the tests from those of earlier runs.
+var testRun = time.Now().UnixNano()
+
+// testClient returns a client for the bucket named by BETTY_TEST_S3_BUCKET, using credentials from the environment,
+// skipping the test if it isn't set. Setting BETTY_TEST_S3_ENDPOINT runs the test against another implementation,
+// such as MinIO, with path style addressing.
+func testClient(t *testing.T) (*s3.Client, string) {
+	t.Helper()
+	bucket := os.Getenv("BETTY_TEST_S3_BUCKET")
+	if bucket == "" {
+		t.Skip("BETTY_TEST_S3_BUCKET isn't set")
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		t.Fatalf("LoadDefaultConfig: %v", err)
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if ep := os.Getenv("BETTY_TEST_S3_ENDPOINT"); ep != "" {
+			o.BaseEndpoint = &ep
+			o.UsePathStyle = true
+		}
+	}), bucket
+}
+
+// testPrefix returns a prefix under which the test can create a log of its own.
+func testPrefix(t *testing.T) string {
+	return fmt.Sprintf("betty-test-%d/%s", testRun, t.Name())
+}
+
+func TestConformance(t *testing.T) {
+	ctx := context.Background()
+	c, bucket := testClient(t)
+	storagetest.RunConformance(t, func(t *testing.T) storagetest.OpenFunc {
+		prefix := testPrefix(t)
+		return func(t *testing.T, params log.Params, ct writer.CurrentTreeFunc, nt writer.NewTreeFunc) storagetest.Storage {
+			s, err := New(ctx, c, bucket, prefix, params, 10*time.Millisecond, ct, nt)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			return s
+		}
+	})
+}
+
+func TestCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	c, bucket := testClient(t)
+	prefix := testPrefix(t)
+	if _, err := ReadCheckpoint(ctx, c, bucket, prefix); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ReadCheckpoint of a new log: got %v, want ErrNotExist", err)
+	}
+	for _, cp := range []string{"first\n", "second\n"} {
+		if err := WriteCheckpoint(ctx, c, bucket, prefix, []byte(cp)); err != nil {
+			t.Fatalf("WriteCheckpoint: %v", err)
+		}
+		got, err := ReadCheckpoint(ctx, c, bucket, prefix)
+		if err != nil {
+			t.Fatalf("ReadCheckpoint: %v", err)
+		}
+		if string(got) != cp {
+			t.Errorf("ReadCheckpoint = %q, want %q", got, cp)
+		}
+	}
+}
+
+func TestCheckpointLock(t *testing.T) {
+	ctx := context.Background()
+	c, bucket := testClient(t)
+	s := &Storage{client: c, bucket: bucket, prefix: testPrefix(t)}
+	if err := s.lockCP(ctx); err != nil {
+		t.Fatalf("lockCP: %v", err)
+	}
+	// The lock can't be taken again until it's released.
+	tctx, cancel := context.WithTimeout(ctx, 3*lockRetryInterval)
+	defer cancel()
+	if err := s.lockCP(tctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lockCP while locked: got %v, want DeadlineExceeded", err)
+	}
+	if err := s.unlockCP(ctx); err != nil {
+		t.Fatalf("unlockCP: %v", err)
+	}
+	if err := s.lockCP(ctx); err != nil {
+		t.Fatalf("lockCP after unlockCP: %v", err)
+	}
+	if err := s.unlockCP(ctx); err != nil {
+		t.Fatalf("unlockCP: %v", err)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	for _, test := range []struct {
+		status                    int
+		wantTransient, wantPrecon bool
+	}{
+		{status: http.StatusServiceUnavailable, wantTransient: true},
+		{status: http.StatusInternalServerError, wantTransient: true},
+		{status: http.StatusTooManyRequests, wantTransient: true},
+		{status: http.StatusPreconditionFailed, wantPrecon: true},
+		{status: http.StatusForbidden},
+	} {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			// The errors are those returned by the client for responses with the status, without retrying them.
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			defer ts.Close()
+			c := s3.New(s3.Options{
+				BaseEndpoint: aws.String(ts.URL),
+				UsePathStyle: true,
+				Region:       "us-east-1",
+				Credentials:  aws.AnonymousCredentials{},
+				Retryer:      aws.NopRetryer{},
+			})
+			err := writeObject(context.Background(), c, "bucket", "key", []byte("data"))
+			if err == nil {
+				t.Fatalf("writeObject succeeded with status %d", test.status)
+			}
+			if got := isTransient(err); got != test.wantTransient {
+				t.Errorf("isTransient(%v) = %t, want %t", err, got, test.wantTransient)
+			}
+			if got := isPreconditionFailed(err); got != test.wantPrecon {
+				t.Errorf("isPreconditionFailed(%v) = %t, want %t", err, got, test.wantPrecon)
+			}
+		})
+	}
+}
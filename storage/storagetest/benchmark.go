@@ -0,0 +1,80 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/writer"
+)
+
+// BenchOpenFunc opens the storage for a new log with the given params, whose current tree is returned by curTree
+// and which publishes new trees with newTree.
+type BenchOpenFunc func(b *testing.B, params log.Params, curTree writer.CurrentTreeFunc, newTree writer.NewTreeFunc) Storage
+
+// benchParams is the shape of the logs created by RunAddBenchmark, which uses the default bundles and tiles so that
+// backends are compared under a realistic layout.
+var benchParams = log.Params{EntryBundleSize: 256}
+
+// benchLeafSize is the size of the leaves added by RunAddBenchmark.
+const benchLeafSize = 128
+
+// RunAddBenchmark measures the rate at which the storage opened by open sequences and integrates new leaves, both
+// when they're added one at a time by many concurrent callers, and in batches.
+// Running it against several backends gives a like-for-like comparison, e.g.
+//
+//	go test -run=NONE -bench=Add ./storage/posix ./storage/kv
+func RunAddBenchmark(b *testing.B, open BenchOpenFunc) {
+	for _, bc := range []struct {
+		name string
+		// batch is the number of leaves passed to each call to SequenceBatch, or 0 to call Sequence concurrently.
+		batch int
+	}{
+		{name: "Sequence"},
+		{name: "SequenceBatch", batch: benchParams.EntryBundleSize},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctx := context.Background()
+			l := &testLog{root: benchParams.Hasher().EmptyRoot()}
+			s := open(b, benchParams, l.curTree, l.newTree)
+			var next atomic.Int64
+			b.SetBytes(benchLeafSize)
+			b.ResetTimer()
+			if bc.batch == 0 {
+				// Enough concurrent callers to fill batches, as a busy log would.
+				b.SetParallelism(64)
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if _, err := s.Sequence(ctx, benchLeaf(int(next.Add(1)))); err != nil {
+							b.Errorf("Sequence: %v", err)
+							return
+						}
+					}
+				})
+			} else {
+				for i := 0; i < b.N; i += bc.batch {
+					es := make([][]byte, min(bc.batch, b.N-i))
+					for j := range es {
+						es[j] = benchLeaf(i + j)
+					}
+					if _, err := s.SequenceBatch(ctx, es); err != nil {
+						b.Fatalf("SequenceBatch: %v", err)
+					}
+				}
+			}
+			if err := s.Close(ctx); err != nil {
+				b.Fatalf("Close: %v", err)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "entries/s")
+		})
+	}
+}
+
+// benchLeaf returns a distinct leaf of benchLeafSize bytes for the given index.
+func benchLeaf(i int) []byte {
+	l := leaf(i)
+	return append(l, bytes.Repeat([]byte{'.'}, benchLeafSize-len(l))...)
+}
@@ -0,0 +1,347 @@
+// Package storagetest provides a conformance test suite for log storage implementations, so that every
+// backend can be checked to behave identically.
+//
+// A backend plugs into the suite from its own tests by providing a Factory, e.g.
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.RunConformance(t, func(t *testing.T) storagetest.OpenFunc {
+//			dir := t.TempDir()
+//			return func(t *testing.T, params log.Params, ct writer.CurrentTreeFunc, nt writer.NewTreeFunc) storagetest.Storage {
+//				s, err := posix.New(dir, params, 10*time.Millisecond, ct, nt)
+//				if err != nil {
+//					t.Fatalf("New: %v", err)
+//				}
+//				return s
+//			}
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/AlCutter/betty/log"
+	"github.com/AlCutter/betty/log/reader"
+	"github.com/AlCutter/betty/log/writer"
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/proof"
+)
+
+// Storage is the set of functions of a storage implementation exercised by the suite.
+type Storage interface {
+	writer.IntegrateStorage
+
+	// Sequence assigns the provided leaf data to an index in the log, returning that index once it's been
+	// integrated.
+	Sequence(context.Context, []byte) (uint64, error)
+	// SequenceBatch assigns a contiguous run of indices to the provided leaves, returning them once they've
+	// been integrated.
+	SequenceBatch(context.Context, [][]byte) ([]uint64, error)
+	// Close sequences and integrates any pending entries, and releases the storage.
+	Close(context.Context) error
+}
+
+// OpenFunc opens the storage for a log with the given params, whose current tree is returned by curTree and
+// which publishes new trees with newTree.
+// It may be called again once the storage it previously returned has been closed, and must then return storage
+// for the same log, as if the process had been restarted.
+// The storage should flush batches of entries promptly, e.g. within 10ms, to keep the suite fast.
+type OpenFunc func(t *testing.T, params log.Params, curTree writer.CurrentTreeFunc, newTree writer.NewTreeFunc) Storage
+
+// Factory creates a new location for an empty log, returning the func which opens its storage.
+// It's called once for each of the suite's tests.
+type Factory func(t *testing.T) OpenFunc
+
+// params is the shape of the logs created by the suite, which has small bundles and tiles so that modest numbers
+// of entries exercise their boundaries.
+var params = log.Params{EntryBundleSize: 4, TileHeight: 2}
+
+// RunConformance runs the conformance suite against the storage implementation created by f.
+func RunConformance(t *testing.T, f Factory) {
+	t.Helper()
+	for _, tc := range []struct {
+		name string
+		fn   func(t *testing.T, l *testLog)
+	}{
+		{name: "SequentialAdds", fn: testSequentialAdds},
+		{name: "ConcurrentAdds", fn: testConcurrentAdds},
+		{name: "BatchBoundaries", fn: testBatchBoundaries},
+		{name: "Restart", fn: testRestart},
+		{name: "Proofs", fn: testProofs},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &testLog{open: f(t)}
+			l.root = params.Hasher().EmptyRoot()
+			l.reopen(t)
+			defer l.close(t)
+			tc.fn(t, l)
+		})
+	}
+}
+
+// testLog is a log whose storage is under test, along with the leaves expected to be in it and its current tree,
+// which the suite holds in place of a checkpoint.
+type testLog struct {
+	open OpenFunc
+	s    Storage
+
+	mu     sync.Mutex
+	size   uint64
+	root   []byte
+	leaves [][]byte
+	// roots holds the root hash of each tree published.
+	roots map[uint64][]byte
+}
+
+func (l *testLog) curTree() (uint64, []byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size, l.root, nil
+}
+
+func (l *testLog) newTree(size uint64, root []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if size < l.size {
+		return writer.ErrCheckpointRollback
+	}
+	l.size, l.root = size, root
+	if l.roots == nil {
+		l.roots = make(map[uint64][]byte)
+	}
+	l.roots[size] = root
+	return nil
+}
+
+// reopen opens the log's storage, closing it first if it's already open.
+func (l *testLog) reopen(t *testing.T) {
+	t.Helper()
+	l.close(t)
+	l.s = l.open(t, params, l.curTree, l.newTree)
+}
+
+func (l *testLog) close(t *testing.T) {
+	t.Helper()
+	if l.s == nil {
+		return
+	}
+	if err := l.s.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	l.s = nil
+}
+
+// leaf returns a distinct leaf for the given index, so that storage which deduplicates leaves doesn't treat any
+// of them as duplicates.
+func leaf(i int) []byte {
+	return []byte(fmt.Sprintf("conformance leaf %d", i))
+}
+
+// add sequences n new leaves one at a time, checking that they're assigned consecutive indices.
+func (l *testLog) add(t *testing.T, n int) {
+	t.Helper()
+	for range n {
+		want := uint64(len(l.leaves))
+		e := leaf(len(l.leaves))
+		got, err := l.s.Sequence(context.Background(), e)
+		if err != nil {
+			t.Fatalf("Sequence(%q): %v", e, err)
+		}
+		if got != want {
+			t.Fatalf("Sequence(%q) = %d, want %d", e, got, want)
+		}
+		l.leaves = append(l.leaves, e)
+	}
+}
+
+// addBatch sequences n new leaves with a single call to SequenceBatch, checking that they're assigned
+// consecutive indices.
+func (l *testLog) addBatch(t *testing.T, n int) {
+	t.Helper()
+	first := len(l.leaves)
+	es := make([][]byte, n)
+	for i := range es {
+		es[i] = leaf(first + i)
+	}
+	got, err := l.s.SequenceBatch(context.Background(), es)
+	if err != nil {
+		t.Fatalf("SequenceBatch(%d leaves): %v", n, err)
+	}
+	if len(got) != n {
+		t.Fatalf("SequenceBatch(%d leaves) returned %d indices", n, len(got))
+	}
+	for i, idx := range got {
+		if want := uint64(first + i); idx != want {
+			t.Fatalf("SequenceBatch(%d leaves) assigned %d to leaf %d, want %d", n, idx, i, want)
+		}
+	}
+	l.leaves = append(l.leaves, es...)
+}
+
+// check verifies that the log's current tree contains exactly the expected leaves, and that its stored tiles and
+// entry bundles are consistent with its root hash.
+func (l *testLog) check(t *testing.T) {
+	t.Helper()
+	ctx := context.Background()
+	size, root, _ := l.curTree()
+	if want := uint64(len(l.leaves)); size != want {
+		t.Fatalf("Tree size is %d, want %d", size, want)
+	}
+	if want := expectedRoot(t, l.leaves); !bytes.Equal(root, want) {
+		t.Fatalf("Root hash of tree of size %d is %x, want %x", size, root, want)
+	}
+	if err := reader.VerifyTree(ctx, params, size, root, l.s, l.s, size); err != nil {
+		t.Fatalf("VerifyTree(%d): %v", size, err)
+	}
+	if size == 0 {
+		return
+	}
+	got, err := reader.GetVerifiedEntries(ctx, params, size, 0, size, l.s, l.s)
+	if err != nil {
+		t.Fatalf("GetVerifiedEntries(0, %d): %v", size, err)
+	}
+	for i, e := range got {
+		if !bytes.Equal(e, l.leaves[i]) {
+			t.Fatalf("Entry %d is %q, want %q", i, e, l.leaves[i])
+		}
+	}
+}
+
+// expectedRoot returns the root hash of a tree containing the given leaves.
+func expectedRoot(t *testing.T, leaves [][]byte) []byte {
+	t.Helper()
+	h := params.Hasher()
+	rf := compact.RangeFactory{Hash: h.HashChildren}
+	r := rf.NewEmptyRange(0)
+	for _, e := range leaves {
+		if err := r.Append(h.HashLeaf(e), nil); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if len(leaves) == 0 {
+		return h.EmptyRoot()
+	}
+	root, err := r.GetRootHash(nil)
+	if err != nil {
+		t.Fatalf("GetRootHash: %v", err)
+	}
+	return root
+}
+
+func testSequentialAdds(t *testing.T, l *testLog) {
+	l.check(t)
+	for range 3 {
+		l.add(t, 7)
+		l.check(t)
+	}
+}
+
+func testConcurrentAdds(t *testing.T, l *testLog) {
+	const writers, perWriter = 16, 8
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		byIndex = make(map[uint64][]byte)
+		errs    []error
+	)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				e := leaf(w*perWriter + i)
+				idx, err := l.s.Sequence(context.Background(), e)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("Sequence(%q): %v", e, err))
+				} else if prev, ok := byIndex[idx]; ok {
+					errs = append(errs, fmt.Errorf("index %d assigned to both %q and %q", idx, prev, e))
+				} else {
+					byIndex[idx] = e
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+	for i := range uint64(writers * perWriter) {
+		e, ok := byIndex[i]
+		if !ok {
+			t.Fatalf("No leaf was assigned index %d", i)
+		}
+		l.leaves = append(l.leaves, e)
+	}
+	l.check(t)
+}
+
+func testBatchBoundaries(t *testing.T, l *testLog) {
+	// These batch sizes fill partial bundles and tiles, exactly complete them, and span several of them.
+	for _, n := range []int{1, 3, 4, 2, 6, 9, 16, 1, 31} {
+		l.addBatch(t, n)
+		l.check(t)
+	}
+	// Single adds following batches must continue from the end of the last batch.
+	l.add(t, 5)
+	l.check(t)
+}
+
+func testRestart(t *testing.T, l *testLog) {
+	l.add(t, 6)
+	l.reopen(t)
+	l.check(t)
+	// Sequencing must continue where it left off, filling in the partial bundle and tiles left before the restart.
+	l.addBatch(t, 7)
+	l.add(t, 3)
+	l.reopen(t)
+	l.check(t)
+	l.add(t, 1)
+	l.check(t)
+}
+
+func testProofs(t *testing.T, l *testLog) {
+	ctx := context.Background()
+	for _, n := range []int{5, 11, 16, 27} {
+		l.addBatch(t, n)
+	}
+	l.check(t)
+	size, root, _ := l.curTree()
+	h := params.Hasher()
+	pb, err := reader.NewProofBuilder(ctx, params, size, h.HashChildren, l.s)
+	if err != nil {
+		t.Fatalf("NewProofBuilder(%d): %v", size, err)
+	}
+	for i, e := range l.leaves {
+		p, err := pb.InclusionProof(ctx, uint64(i))
+		if err != nil {
+			t.Fatalf("InclusionProof(%d): %v", i, err)
+		}
+		if err := proof.VerifyInclusion(h, uint64(i), size, h.HashLeaf(e), p, root); err != nil {
+			t.Errorf("Inclusion proof for leaf %d in tree of size %d failed to verify: %v", i, size, err)
+		}
+	}
+	l.mu.Lock()
+	roots := l.roots
+	l.mu.Unlock()
+	for smaller, smallerRoot := range roots {
+		if smaller == 0 || smaller > size {
+			continue
+		}
+		p, err := pb.ConsistencyProof(ctx, smaller)
+		if err != nil {
+			t.Fatalf("ConsistencyProof(%d, %d): %v", smaller, size, err)
+		}
+		if err := proof.VerifyConsistency(h, smaller, size, p, smallerRoot, root); err != nil {
+			t.Errorf("Consistency proof between trees of size %d and %d failed to verify: %v", smaller, size, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tilecompress provides zstd compression of stored tiles.
+//
+// Compressed tiles are identified by the zstd frame magic number, which can never begin an uncompressed
+// serialised tile, so storage may contain a mix of compressed and uncompressed tiles.
+package tilecompress
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// magic is the zstd frame magic number, in the little-endian order it appears in a frame.
+var magic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var (
+	encoder = sync.OnceValue(func() *zstd.Encoder {
+		// This can only fail when given invalid options.
+		e, _ := zstd.NewWriter(nil)
+		return e
+	})
+	decoder = sync.OnceValue(func() *zstd.Decoder {
+		d, _ := zstd.NewReader(nil)
+		return d
+	})
+)
+
+// Compress returns the serialised tile t compressed with zstd.
+func Compress(t []byte) []byte {
+	return encoder().EncodeAll(t, nil)
+}
+
+// Decompress returns the serialised tile from t, decompressing it if it was compressed by Compress, or
+// returning it unchanged otherwise.
+func Decompress(t []byte) ([]byte, error) {
+	if !bytes.HasPrefix(t, magic) {
+		return t, nil
+	}
+	r, err := decoder().DecodeAll(t, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress tile: %v", err)
+	}
+	return r, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tilecompress
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/transparency-dev/serverless-log/api"
+)
+
+// testTile returns a serialised tile with n leaves.
+func testTile(t *testing.T, n int) []byte {
+	t.Helper()
+	tile := &api.Tile{NumLeaves: uint(n)}
+	for i := range n {
+		h := sha256.Sum256([]byte(fmt.Sprintf("leaf %d", i)))
+		tile.Nodes = append(tile.Nodes, h[:])
+	}
+	raw, err := tile.MarshalText()
+	if err != nil {
+		t.Fatalf("MarshalText: %v", err)
+	}
+	return raw
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, n := range []int{1, 2, 17, 256} {
+		t.Run(fmt.Sprintf("%d leaves", n), func(t *testing.T) {
+			raw := testTile(t, n)
+			if bytes.HasPrefix(raw, magic) {
+				t.Fatal("Uncompressed tile begins with the zstd magic number")
+			}
+			c := Compress(raw)
+			if !bytes.HasPrefix(c, magic) {
+				t.Errorf("Compressed tile doesn't begin with the zstd magic number")
+			}
+			got, err := Decompress(c)
+			if err != nil {
+				t.Fatalf("Decompress: %v", err)
+			}
+			if !bytes.Equal(got, raw) {
+				t.Errorf("Round trip gave %q, want %q", got, raw)
+			}
+			var tile api.Tile
+			if err := tile.UnmarshalText(got); err != nil {
+				t.Errorf("UnmarshalText: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	raw := testTile(t, 3)
+	for _, test := range []struct {
+		name    string
+		in      []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "uncompressed", in: raw, want: raw},
+		{name: "compressed", in: Compress(raw), want: raw},
+		{name: "empty", in: []byte{}, want: []byte{}},
+		{name: "truncated", in: Compress(raw)[:8], wantErr: true},
+		{name: "corrupt", in: append(bytes.Clone(magic), []byte("not zstd")...), wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Decompress(test.in)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Decompress: got err %v, want err %t", err, test.wantErr)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("Decompress = %q, want %q", got, test.want)
+			}
+		})
+	}
+}